@@ -0,0 +1,365 @@
+// Package admin provides an HTTP API to manage a gitkit deployment: its SSH
+// keys, repositories and active sessions. The API is protected by admin
+// tokens and meant to be served on an internal port, separate from the git
+// servers.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/fluxcd/gitkit/keystore"
+)
+
+// Handler serves the admin API:
+//
+//	GET    /keys?owner={owner}  lists the keys of an owner
+//	POST   /keys                {"owner", "name", "key"} adds a key
+//	GET    /keys/{id}           returns a key
+//	PATCH  /keys/{id}           {"owner", "name"} changes a key
+//	DELETE /keys/{id}           deletes a key
+//	GET    /repos               lists the repositories
+//	POST   /repos               {"name"} creates a repository
+//	PATCH  /repos/{name}        {"name"} renames a repository
+//	DELETE /repos/{name}        deletes a repository
+//	GET    /sessions            lists the git commands being served
+//	GET    /config              returns the configuration of the servers
+//
+// Requests must carry one of the tokens as a bearer token. Parts of the API
+// whose backend is not set answer 501.
+type Handler struct {
+	// Tokens are the admin tokens accepted.
+	Tokens []string
+	// Keys stores the keys of the SSH server, e.g. through
+	// keystore.LookupKeyFunc.
+	Keys keystore.Store
+	// HTTP manages the repositories and is asked for its sessions.
+	HTTP *gitkit.Server
+	// SSH is asked for its sessions. Deleted keys are revoked on it, which
+	// closes the connections made with them.
+	SSH *gitkit.SSH
+}
+
+// NewHandler returns a handler accepting tokens.
+func NewHandler(tokens ...string) *Handler {
+	return &Handler{Tokens: tokens}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gitkit admin"`)
+		writeError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+
+	resource, arg := strings.Trim(r.URL.Path, "/"), ""
+	if i := strings.Index(resource, "/"); i >= 0 {
+		resource, arg = resource[:i], resource[i+1:]
+	}
+	switch resource {
+	case "keys":
+		h.serveKeys(w, r, arg)
+	case "repos":
+		h.serveRepos(w, r, arg)
+	case "sessions":
+		h.serveSessions(w, r, arg)
+	case "config":
+		h.serveConfig(w, r, arg)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// authorized reports whether r carries an admin token.
+func (h *Handler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimSpace(auth[7:]))
+	ok := false
+	for _, t := range h.Tokens {
+		if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// key is the JSON representation of a stored key.
+type key struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"`
+	Key         string    `json:"key"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newKey(k *keystore.Key) key {
+	return key{ID: k.ID, Owner: k.Owner, Name: k.Name, Fingerprint: k.Fingerprint, Key: k.Content, CreatedAt: k.CreatedAt}
+}
+
+type keyRequest struct {
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+}
+
+func (h *Handler) serveKeys(w http.ResponseWriter, r *http.Request, id string) {
+	if h.Keys == nil {
+		writeError(w, http.StatusNotImplemented, "no key store configured")
+		return
+	}
+	ctx := r.Context()
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		owner := r.URL.Query().Get("owner")
+		if owner == "" {
+			writeError(w, http.StatusBadRequest, "owner is required")
+			return
+		}
+		keys, err := h.Keys.List(ctx, owner)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		list := []key{}
+		for _, k := range keys {
+			list = append(list, newKey(k))
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case id == "" && r.Method == http.MethodPost:
+		var body keyRequest
+		if !decode(w, r, &body) {
+			return
+		}
+		if body.Owner == "" {
+			writeError(w, http.StatusBadRequest, "owner is required")
+			return
+		}
+		k, err := keystore.Register(ctx, h.Keys, h.SSH, body.Owner, body.Name, body.Key)
+		if err != nil {
+			failKey(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newKey(k))
+
+	case id != "" && r.Method == http.MethodGet:
+		k, err := h.Keys.Get(ctx, id)
+		if err != nil {
+			failKey(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newKey(k))
+
+	case id != "" && r.Method == http.MethodPatch:
+		var body keyRequest
+		if !decode(w, r, &body) {
+			return
+		}
+		if body.Key != "" {
+			writeError(w, http.StatusBadRequest, "the key can't be changed, add a new one instead")
+			return
+		}
+		k, err := keystore.Update(ctx, h.Keys, id, body.Owner, body.Name)
+		if err != nil {
+			failKey(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newKey(k))
+
+	case id != "" && r.Method == http.MethodDelete:
+		if _, err := keystore.Unregister(ctx, h.Keys, h.SSH, id); err != nil {
+			failKey(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *Handler) serveRepos(w http.ResponseWriter, r *http.Request, name string) {
+	if h.HTTP == nil {
+		writeError(w, http.StatusNotImplemented, "no repository server configured")
+		return
+	}
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		repos, err := h.HTTP.Repos()
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		list := []gitkit.Repository{}
+		for _, repo := range repos {
+			list = append(list, gitkit.Repository{Name: repo})
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case name == "" && r.Method == http.MethodPost:
+		var body gitkit.Repository
+		if !decode(w, r, &body) {
+			return
+		}
+		if err := h.HTTP.CreateRepo(body.Name); err != nil {
+			failRepo(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, body)
+
+	case name != "" && r.Method == http.MethodPatch:
+		var body gitkit.Repository
+		if !decode(w, r, &body) {
+			return
+		}
+		if err := h.HTTP.RenameRepo(name, body.Name); err != nil {
+			failRepo(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, body)
+
+	case name != "" && r.Method == http.MethodDelete:
+		if err := h.HTTP.DeleteRepo(name); err != nil {
+			failRepo(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *Handler) serveSessions(w http.ResponseWriter, r *http.Request, arg string) {
+	if arg != "" || r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sessions := []gitkit.Session{}
+	if h.SSH != nil {
+		sessions = append(sessions, h.SSH.Sessions()...)
+	}
+	if h.HTTP != nil {
+		sessions = append(sessions, h.HTTP.Sessions()...)
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// serverConfig is the configuration of a server shown by /config. Hook
+// scripts are left out, only whether they are set is shown.
+type serverConfig struct {
+	Dir             string   `json:"dir"`
+	GitPath         string   `json:"git_path"`
+	GitUser         string   `json:"git_user,omitempty"`
+	KeyDir          string   `json:"key_dir,omitempty"`
+	KeyType         string   `json:"key_type,omitempty"`
+	AutoCreate      bool     `json:"auto_create"`
+	AutoHooks       bool     `json:"auto_hooks"`
+	Hooks           bool     `json:"hooks"`
+	Auth            bool     `json:"auth"`
+	ReadOnly        bool     `json:"read_only"`
+	Addresses       []string `json:"addresses,omitempty"`
+	ActiveProcesses int      `json:"active_processes"`
+	RevokedKeys     []string `json:"revoked_keys,omitempty"`
+}
+
+func newServerConfig(config gitkit.Config) *serverConfig {
+	return &serverConfig{
+		Dir:        config.Dir,
+		GitPath:    config.GitPath,
+		GitUser:    config.GitUser,
+		KeyDir:     config.KeyDir,
+		KeyType:    config.KeyType,
+		AutoCreate: config.AutoCreate,
+		AutoHooks:  config.AutoHooks,
+		Hooks:      config.Hooks != nil,
+		Auth:       config.Auth,
+		ReadOnly:   config.ReadOnly,
+	}
+}
+
+func (h *Handler) serveConfig(w http.ResponseWriter, r *http.Request, arg string) {
+	if arg != "" || r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var config struct {
+		HTTP *serverConfig `json:"http,omitempty"`
+		SSH  *serverConfig `json:"ssh,omitempty"`
+	}
+	if h.HTTP != nil {
+		config.HTTP = newServerConfig(h.HTTP.Config())
+		config.HTTP.ActiveProcesses = h.HTTP.ActiveProcesses()
+	}
+	if h.SSH != nil {
+		config.SSH = newServerConfig(h.SSH.Config())
+		config.SSH.Addresses = h.SSH.Addresses()
+		config.SSH.ActiveProcesses = h.SSH.ActiveProcesses()
+		config.SSH.RevokedKeys = h.SSH.RevokedKeys()
+	}
+	writeJSON(w, http.StatusOK, config)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func failKey(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, keystore.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, keystore.ErrInvalidKey):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, keystore.ErrKeyExists):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		fail(w, err)
+	}
+}
+
+func failRepo(w http.ResponseWriter, err error) {
+	switch err {
+	case gitkit.ErrInvalidRepoName:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case gitkit.ErrRepoNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case gitkit.ErrRepoExists:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		fail(w, err)
+	}
+}
+
+func fail(w http.ResponseWriter, err error) {
+	log.Printf("admin: %v", err)
+	writeError(w, http.StatusInternalServerError, "internal server error")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
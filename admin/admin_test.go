@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/fluxcd/gitkit/keystore"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// memStore is a keystore.Store in memory.
+type memStore struct {
+	mu   sync.Mutex
+	keys map[string]*keystore.Key
+}
+
+func (s *memStore) Add(_ context.Context, key *keystore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key.ID = fmt.Sprintf("key-%d", len(s.keys)+1)
+	key.CreatedAt = time.Now()
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memStore) Get(_ context.Context, id string) (*keystore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+	return nil, keystore.ErrNotFound
+}
+
+func (s *memStore) GetByFingerprint(_ context.Context, fingerprint string) (*keystore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		if key.Fingerprint == fingerprint {
+			return key, nil
+		}
+	}
+	return nil, keystore.ErrNotFound
+}
+
+func (s *memStore) List(_ context.Context, owner string) ([]*keystore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*keystore.Key
+	for _, key := range s.keys {
+		if key.Owner == owner {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memStore) Update(_ context.Context, key *keystore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.ID]; !ok {
+		return keystore.ErrNotFound
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	server := gitkit.New(gitkit.Config{Dir: dir})
+	h := NewHandler("admin-secret")
+	h.Keys = &memStore{keys: map[string]*keystore.Key{}}
+	h.HTTP = server
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	call := func(token, method, path string, body interface{}, out interface{}) int {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req, _ := http.NewRequest(method, srv.URL+path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		if out != nil {
+			json.NewDecoder(res.Body).Decode(out)
+		}
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call("wrong", "GET", "/repos", nil, nil))
+
+	// Repositories
+	assert.Equal(t, http.StatusCreated, call("admin-secret", "POST", "/repos", gitkit.Repository{Name: "org/app.git"}, nil))
+	assert.Equal(t, http.StatusConflict, call("admin-secret", "POST", "/repos", gitkit.Repository{Name: "org/app.git"}, nil))
+	assert.Equal(t, http.StatusBadRequest, call("admin-secret", "POST", "/repos", gitkit.Repository{Name: "../app.git"}, nil))
+	assert.Equal(t, http.StatusOK, call("admin-secret", "PATCH", "/repos/org/app.git", gitkit.Repository{Name: "org/new.git"}, nil))
+	var repos []gitkit.Repository
+	assert.Equal(t, http.StatusOK, call("admin-secret", "GET", "/repos", nil, &repos))
+	assert.Equal(t, []gitkit.Repository{{Name: "org/new.git"}}, repos)
+
+	// Keys
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(pub)
+	authorizedKey := gitkit.AuthorizedKeyString(sshPub) + " alice@laptop"
+	var k key
+	assert.Equal(t, http.StatusCreated, call("admin-secret", "POST", "/keys", keyRequest{Owner: "alice", Key: authorizedKey}, &k))
+	assert.Equal(t, "alice@laptop", k.Name)
+	assert.Equal(t, gitkit.KeyFingerprint(sshPub), k.Fingerprint)
+	assert.Equal(t, http.StatusConflict, call("admin-secret", "POST", "/keys", keyRequest{Owner: "bob", Key: authorizedKey}, nil))
+	assert.Equal(t, http.StatusBadRequest, call("admin-secret", "POST", "/keys", keyRequest{Owner: "bob", Key: "garbage"}, nil))
+	var keys []key
+	assert.Equal(t, http.StatusOK, call("admin-secret", "GET", "/keys?owner=alice", nil, &keys))
+	assert.Len(t, keys, 1)
+	var updated key
+	assert.Equal(t, http.StatusOK, call("admin-secret", "PATCH", "/keys/"+k.ID, keyRequest{Owner: "bob"}, &updated))
+	assert.Equal(t, "bob", updated.Owner)
+	assert.Equal(t, "alice@laptop", updated.Name)
+	assert.Equal(t, k.Fingerprint, updated.Fingerprint)
+	assert.Equal(t, http.StatusBadRequest, call("admin-secret", "PATCH", "/keys/"+k.ID, keyRequest{Key: authorizedKey}, nil))
+	assert.Equal(t, http.StatusNotFound, call("admin-secret", "PATCH", "/keys/missing", keyRequest{Name: "laptop"}, nil))
+	assert.Equal(t, http.StatusNoContent, call("admin-secret", "DELETE", "/keys/"+k.ID, nil, nil))
+	assert.Equal(t, http.StatusNotFound, call("admin-secret", "GET", "/keys/"+k.ID, nil, nil))
+
+	// Config
+	var config map[string]map[string]interface{}
+	assert.Equal(t, http.StatusOK, call("admin-secret", "GET", "/config", nil, &config))
+	assert.Equal(t, dir, config["http"]["dir"])
+	assert.NotContains(t, config, "ssh")
+
+	assert.Equal(t, http.StatusNoContent, call("admin-secret", "DELETE", "/repos/org/new.git", nil, nil))
+	assert.Equal(t, http.StatusNotFound, call("admin-secret", "DELETE", "/repos/org/new.git", nil, nil))
+}
+
+func TestHandlerSessions(t *testing.T) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+
+	// git blocks until released, so the request stays in flight.
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "repos", "app.git")).Run())
+	release := filepath.Join(dir, "release")
+	wrapper := filepath.Join(dir, "git")
+	script := fmt.Sprintf("#!/bin/sh\nwhile [ ! -f %s ]; do sleep 0.01; done\nexec %s \"$@\"\n", release, gitPath)
+	assert.NoError(t, os.WriteFile(wrapper, []byte(script), 0755))
+
+	server := gitkit.New(gitkit.Config{Dir: filepath.Join(dir, "repos"), GitPath: wrapper})
+	gitSrv := httptest.NewServer(server)
+	defer gitSrv.Close()
+	h := NewHandler("admin-secret")
+	h.HTTP = server
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("GET", gitSrv.URL+"/app.git/info/refs?service=git-upload-pack", nil)
+		req.SetBasicAuth("alice", "secret")
+		if res, err := http.DefaultClient.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	sessions := func() []gitkit.Session {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/sessions", nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		h.ServeHTTP(rec, req)
+		var sessions []gitkit.Session
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&sessions))
+		return sessions
+	}
+	assert.Eventually(t, func() bool { return len(sessions()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	session := sessions()[0]
+	assert.Equal(t, "http", session.Protocol)
+	assert.Equal(t, "app.git", session.Repo)
+	assert.Equal(t, "git-upload-pack", session.Command)
+	assert.Equal(t, "alice", session.User)
+
+	assert.NoError(t, os.WriteFile(release, nil, 0644))
+	<-done
+	assert.Empty(t, sessions())
+}
@@ -0,0 +1,39 @@
+package gitkit
+
+import "golang.org/x/crypto/ssh"
+
+// AnonymousKeyID is the key ID of clients connected through
+// SSH.AllowAnonymous.
+const AnonymousKeyID = "anonymous"
+
+// anonymousExtension marks the Permissions of anonymous clients, so a key
+// that happens to have AnonymousKeyID as ID is not mistaken for one.
+const anonymousExtension = "anonymous"
+
+var errAnonymousDenied = deniedBecause("anonymous access is limited to reading public repositories")
+
+// anonymousCallback accepts any client through keyboard-interactive
+// authentication without asking anything.
+func (s *SSH) anonymousCallback(conn ssh.ConnMetadata, _ ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	if s.isBanned(conn.RemoteAddr()) {
+		return nil, errBanned
+	}
+	if err := s.checkClientVersion(conn); err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{
+		"key-id":           AnonymousKeyID,
+		anonymousExtension: "true",
+	}}, nil
+}
+
+func isAnonymous(perms *ssh.Permissions) bool {
+	return perms != nil && perms.Extensions[anonymousExtension] == "true"
+}
+
+// isPublicRepo reports whether anonymous clients may read repo. Without a
+// PublicRepoFunc none may be read, so that AllowAnonymous alone doesn't
+// publish every repository.
+func (s *SSH) isPublicRepo(repo string) bool {
+	return s.PublicRepoFunc != nil && s.PublicRepoFunc(repo)
+}
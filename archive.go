@@ -0,0 +1,118 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// archivePattern matches archive downloads, /{repo}/archive/{ref}.{format}.
+var archivePattern = regexp.MustCompile(`^(.*)/archive/(.+)\.(tar\.gz|tgz|tar|zip)$`)
+
+// archiveFormats are the git archive formats and content types by file
+// extension.
+var archiveFormats = map[string]struct{ format, contentType string }{
+	"tar.gz": {"tar.gz", "application/gzip"},
+	"tgz":    {"tar.gz", "application/gzip"},
+	"tar":    {"tar", "application/x-tar"},
+	"zip":    {"zip", "application/zip"},
+}
+
+// findArchiveService returns the service serving an archive download and
+// the repository path, or nil if p is not one.
+func (s *Server) findArchiveService(p string) (*service, string) {
+	m := archivePattern.FindStringSubmatch(p)
+	if m == nil {
+		return nil, ""
+	}
+	ref, ext := m[2], m[3]
+	return &service{
+		method: "GET",
+		suffix: "/archive/" + ref + "." + ext,
+		handler: func(_ string, w http.ResponseWriter, r *Request) {
+			s.getArchive(ref, ext, w, r)
+		},
+		rpc: "git-upload-archive",
+	}, m[1]
+}
+
+// getArchive streams the tree of ref as an archive, with a top level
+// directory named after the repository and ref.
+func (s *Server) getArchive(ref, ext string, w http.ResponseWriter, r *Request) {
+	context := "get-archive"
+
+	if rejectNamespaced(w, r) {
+		return
+	}
+
+	// Refs starting with a dash would be taken for options.
+	if strings.HasPrefix(ref, "-") {
+		http.Error(w, "invalid ref", http.StatusBadRequest)
+		return
+	}
+	commit, err := s.resolveCommit(r, ref)
+	if err != nil {
+		logError(context, err)
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	name := strings.TrimSuffix(path.Base(r.RepoName), ".git") + "-" + strings.Replace(ref, "/", "-", -1)
+	format := archiveFormats[ext]
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, "--git-dir", r.RepoPath, "archive", "--format="+format.format, "--prefix="+name+"/", commit)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := s.procs.start(cmd); err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer s.procs.cleanUp(cmd)
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+ext))
+	if commit == ref {
+		// The archive of a commit never changes.
+		w.Header().Set("Cache-Control", s.immutableCacheControl(r))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, pipe); err != nil {
+		logError(context, err)
+		return
+	}
+	if err := s.procs.wait(cmd); err != nil {
+		logError(context, fmt.Errorf("%v: %s", err, stderr.Bytes()))
+	}
+}
+
+// resolveCommit returns the ID of the commit ref points to in the repository
+// of r.
+func (s *Server) resolveCommit(r *Request, ref string) (string, error) {
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, "--git-dir", r.RepoPath, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Stderr = nil
+	if err := s.procs.start(cmd); err != nil {
+		return "", err
+	}
+	out, _ := ioutil.ReadAll(pipe)
+	if err := s.procs.wait(cmd); err != nil {
+		return "", fmt.Errorf("unknown ref %q in %s", ref, r.RepoName)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// immutableCacheControl returns the Cache-Control header of a response that
+// never changes. Responses that needed authentication may only be kept by
+// the client, not by shared caches serving them to anyone.
+func (s *Server) immutableCacheControl(r *Request) string {
+	if s.config.Auth || r.Principal != nil {
+		return "private, max-age=31536000"
+	}
+	return "public, max-age=31536000"
+}
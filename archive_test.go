@@ -0,0 +1,131 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerArchives(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "org", "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	assert.NoError(t, os.WriteFile(filepath.Join(work, "README"), []byte("hello\n"), 0644))
+	git("-C", work, "add", "README")
+	git("-C", work, "commit", "-m", "initial")
+	git("-C", work, "tag", "release/1.0")
+	git("-C", work, "push", repo, "HEAD:refs/heads/master", "--tags")
+	commit := git("-C", work, "rev-parse", "HEAD")
+
+	off := httptest.NewServer(New(Config{Dir: repos}))
+	defer off.Close()
+	res, err := http.Get(off.URL + "/org/app.git/archive/master.tar.gz")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	var denied bool
+	server := New(Config{Dir: repos, Auth: true})
+	server.Archives = true
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		return &Principal{ID: username}, nil
+	}
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		assert.Equal(t, OperationRead, req.Operation)
+		assert.Equal(t, "git-upload-archive", req.Command)
+		if denied {
+			return ErrAccessDenied
+		}
+		return nil
+	})
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.SetBasicAuth("alice", "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, body
+	}
+
+	res, body := get("/org/app.git/archive/release/1.0.tar.gz")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/gzip", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="app-release-1.0.tar.gz"`, res.Header.Get("Content-Disposition"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, h.Name)
+	}
+	assert.Contains(t, names, "app-release-1.0/README")
+
+	res, body = get("/org/app.git/archive/" + commit + ".zip")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+	assert.Equal(t, "private, max-age=31536000", res.Header.Get("Cache-Control"), "authenticated")
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.NoError(t, err)
+	f, err := zr.Open("app-" + commit + "/README")
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(f)
+	assert.Equal(t, "hello\n", string(data))
+
+	res, _ = get("/org/app.git/archive/master.tar")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/x-tar", res.Header.Get("Content-Type"))
+
+	res, _ = get("/org/app.git/archive/missing.tar.gz")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = get("/org/app.git/archive/--output=x.tar.gz")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	denied = true
+	res, _ = get("/org/app.git/archive/master.tar.gz")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// Shared caches may keep archives anyone can download.
+	public := New(Config{Dir: repos})
+	public.Archives = true
+	publicSrv := httptest.NewServer(public)
+	defer publicSrv.Close()
+	res, err = http.Get(publicSrv.URL + "/org/app.git/archive/" + commit + ".zip")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "public, max-age=31536000", res.Header.Get("Cache-Control"))
+}
@@ -0,0 +1,68 @@
+package gitkit
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Types of an AuthEvent.
+const (
+	// AuthEventAuthentication is a rejected login: a key that was not
+	// accepted, or a username refused by UserResolver or UserCheckFunc.
+	AuthEventAuthentication = "authentication"
+	// AuthEventAuthorization is a git command or ref update that was
+	// denied to an authenticated client.
+	AuthEventAuthorization = "authorization"
+)
+
+// AuthEvent describes a failed authentication or authorization, see
+// SSH.OnAuthFailure.
+type AuthEvent struct {
+	Type string
+	Time time.Time
+	// RemoteAddr and User are the address and SSH username of the client.
+	RemoteAddr net.Addr
+	User       string
+	// Fingerprint is the SHA256 fingerprint of the key, if one was used.
+	Fingerprint string
+	// KeyID is the ID of the accepted key, empty if authentication failed.
+	KeyID string
+	// Repo and Operation are set for authorization failures.
+	Repo      string
+	Operation string
+	// Reason is the error the request was rejected with. It is meant for
+	// operators and may expose internals.
+	Reason string
+}
+
+// authFailure reports event to OnAuthFailure.
+func (s *SSH) authFailure(event AuthEvent) {
+	if s.OnAuthFailure == nil {
+		return
+	}
+	defer s.recoverPanic("ssh: auth failure callback")
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.OnAuthFailure(event)
+}
+
+// connFailure reports a failure of an authenticated connection.
+func (s *SSH) connFailure(sConn *ssh.ServerConn, principal *Principal, eventType, repo, operation string, err error) {
+	event := AuthEvent{
+		Type:       eventType,
+		RemoteAddr: sConn.RemoteAddr(),
+		User:       sConn.User(),
+		KeyID:      principal.ID,
+		Repo:       repo,
+		Operation:  operation,
+		Reason:     err.Error(),
+	}
+	if sConn.Permissions != nil {
+		event.Fingerprint = sConn.Permissions.Extensions[keyFingerprintExtension]
+	}
+	s.authFailure(event)
+}
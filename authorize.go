@@ -0,0 +1,219 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Operations of an AccessRequest.
+const (
+	// OperationRead covers fetches, clones and archives.
+	OperationRead = "read"
+	// OperationWrite covers pushes.
+	OperationWrite = "write"
+	// OperationCreate is checked before a repository is created because
+	// of Config.AutoCreate or through the repository API.
+	OperationCreate = "create"
+	// OperationDelete and OperationRename are checked by the repository
+	// API, see Server.RepoAPI. Renaming also needs OperationCreate on the
+	// new name.
+	OperationDelete = "delete"
+	OperationRename = "rename"
+	// OperationRun is checked before a command registered with
+	// SSH.HandleCommand runs, with Command set to its name and no Repo,
+	// so an ACL grants it through a pattern matching "", such as "*".
+	OperationRun = "run"
+)
+
+// ErrAccessDenied is returned by authorizers when a request is denied
+// without a more specific reason. Wrap it to give clients one.
+var ErrAccessDenied = errors.New("access denied")
+
+// deniedBecause returns ErrAccessDenied with reason attached, if any.
+func deniedBecause(reason string) error {
+	if reason == "" {
+		return ErrAccessDenied
+	}
+	return fmt.Errorf("%w: %s", ErrAccessDenied, reason)
+}
+
+// AccessRequest describes a git operation a client is about to perform.
+type AccessRequest struct {
+	// KeyID is the ID of the key the client authenticated with, empty if
+	// authentication is disabled.
+	KeyID string
+	// Principal is the identity behind KeyID. It is never nil.
+	Principal *Principal
+	// User is the SSH username of the client, or the basic auth username
+	// over HTTP.
+	User string
+	// Repo is the repository path relative to Config.Dir.
+	Repo string
+	// Operation is OperationRead, OperationWrite, OperationCreate,
+	// OperationDelete, OperationRename or OperationRun.
+	Operation string
+	// Command is the git command, e.g. "git-upload-pack".
+	Command string
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+	// GitNamespace may be set by the Authorizer to serve the git namespace
+	// of that name in the repository, see gitnamespaces(7), e.g. to keep
+	// forks or refs of pull requests in one repository. git-upload-pack
+	// and git-receive-pack then only see the refs in it.
+	GitNamespace string
+}
+
+// operationFor returns the operation performed by a git command.
+func operationFor(command string) string {
+	if strings.HasSuffix(command, "receive-pack") {
+		return OperationWrite
+	}
+	return OperationRead
+}
+
+// Authorizer decides whether a request is allowed. Returning an error denies
+// it.
+type Authorizer interface {
+	Authorize(req *AccessRequest) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface.
+type AuthorizerFunc func(req *AccessRequest) error
+
+// Authorize calls f(req).
+func (f AuthorizerFunc) Authorize(req *AccessRequest) error {
+	return f(req)
+}
+
+// AccessLevel is the access a key has to a repository. Each level includes
+// the ones below it.
+type AccessLevel int
+
+const (
+	AccessNone AccessLevel = iota
+	// AccessRead allows fetching.
+	AccessRead
+	// AccessWrite allows pushing.
+	AccessWrite
+	// AccessAdmin allows creating, deleting and renaming the repository.
+	AccessAdmin
+)
+
+// requiredLevel returns the access level an operation needs.
+func requiredLevel(operation string) AccessLevel {
+	switch operation {
+	case OperationRead, OperationRun:
+		return AccessRead
+	case OperationWrite:
+		return AccessWrite
+	}
+	return AccessAdmin
+}
+
+// ACL is an Authorizer granting keys access levels per repository.
+// Repositories are given as path.Match patterns, a key gets the highest
+// level of all patterns matching a repository.
+type ACL struct {
+	mu     sync.RWMutex
+	grants map[string]map[string]AccessLevel
+}
+
+// NewACL returns an empty ACL, denying everything.
+func NewACL() *ACL {
+	return &ACL{grants: make(map[string]map[string]AccessLevel)}
+}
+
+// Grant gives keyID the given level on repositories matching pattern,
+// replacing a previous grant for the same pattern.
+func (a *ACL) Grant(keyID, pattern string, level AccessLevel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.grants[keyID] == nil {
+		a.grants[keyID] = make(map[string]AccessLevel)
+	}
+	a.grants[keyID][pattern] = level
+}
+
+// Revoke removes the grant of keyID for pattern.
+func (a *ACL) Revoke(keyID, pattern string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.grants[keyID], pattern)
+	if len(a.grants[keyID]) == 0 {
+		delete(a.grants, keyID)
+	}
+}
+
+// Level returns the access keyID has to repo.
+func (a *ACL) Level(keyID, repo string) AccessLevel {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	level := AccessNone
+	for pattern, l := range a.grants[keyID] {
+		if ok, _ := path.Match(pattern, repo); ok && l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// Authorize implements Authorizer.
+func (a *ACL) Authorize(req *AccessRequest) error {
+	if a.Level(req.KeyID, req.Repo) < requiredLevel(req.Operation) {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// scopeLevels are the access levels of repository scopes by name.
+var scopeLevels = map[string]AccessLevel{
+	"read":  AccessRead,
+	"write": AccessWrite,
+	"admin": AccessAdmin,
+}
+
+// ScopeLevel returns the access the repository scopes of principal grant to
+// repo. Repository scopes have the form "repo:<pattern>:<level>", where
+// pattern is matched with path.Match and level is read, write or admin,
+// e.g. "repo:team/*:write". Other scopes are ignored.
+func ScopeLevel(principal *Principal, repo string) AccessLevel {
+	if principal == nil {
+		return AccessNone
+	}
+	level := AccessNone
+	for _, scope := range principal.Scopes {
+		if !strings.HasPrefix(scope, "repo:") {
+			continue
+		}
+		rest := strings.TrimPrefix(scope, "repo:")
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			continue
+		}
+		l := scopeLevels[rest[i+1:]]
+		if ok, _ := path.Match(rest[:i], repo); ok && l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// ScopeAuthorizer is an Authorizer granting principals the access their
+// repository scopes give them, see ScopeLevel. It is meant for tokens
+// carrying their own permissions, such as those of JWTAuthenticator.
+type ScopeAuthorizer struct{}
+
+// Authorize implements Authorizer.
+func (ScopeAuthorizer) Authorize(req *AccessRequest) error {
+	if ScopeLevel(req.Principal, req.Repo) < requiredLevel(req.Operation) {
+		return deniedBecause(fmt.Sprintf("no %s scope for %s", req.Operation, req.Repo))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	acl := NewACL()
+	acl.Grant("alice", "*", AccessRead)
+	acl.Grant("alice", "team/*", AccessWrite)
+	acl.Grant("bob", "team/app.git", AccessAdmin)
+
+	assert.Equal(t, AccessRead, acl.Level("alice", "other.git"))
+	assert.Equal(t, AccessWrite, acl.Level("alice", "team/app.git"))
+	assert.Equal(t, AccessNone, acl.Level("alice", "team/nested/app.git"))
+	assert.Equal(t, AccessNone, acl.Level("carol", "other.git"))
+
+	tests := []struct {
+		keyID     string
+		repo      string
+		operation string
+		allowed   bool
+	}{
+		{"alice", "other.git", OperationRead, true},
+		{"alice", "other.git", OperationWrite, false},
+		{"alice", "team/app.git", OperationWrite, true},
+		{"alice", "team/app.git", OperationCreate, false},
+		{"bob", "team/app.git", OperationCreate, true},
+		{"bob", "team/app.git", OperationRead, true},
+		{"bob", "team/web.git", OperationRead, false},
+		{"carol", "other.git", OperationRead, false},
+	}
+	for _, tt := range tests {
+		err := acl.Authorize(&AccessRequest{KeyID: tt.keyID, Repo: tt.repo, Operation: tt.operation})
+		assert.Equal(t, tt.allowed, err == nil, "%s %s %s", tt.keyID, tt.operation, tt.repo)
+	}
+
+	acl.Revoke("alice", "team/*")
+	assert.Equal(t, AccessNone, acl.Level("alice", "team/app.git"))
+}
+
+func TestScopeAuthorizer(t *testing.T) {
+	p := &Principal{ID: "pipeline-42", Scopes: []string{"openid", "repo:team/*:read", "repo:team/app.git:write", "repo:broken"}}
+
+	assert.Equal(t, AccessWrite, ScopeLevel(p, "team/app.git"))
+	assert.Equal(t, AccessRead, ScopeLevel(p, "team/web.git"))
+	assert.Equal(t, AccessNone, ScopeLevel(p, "other.git"))
+	assert.Equal(t, AccessNone, ScopeLevel(nil, "team/app.git"))
+
+	var authz ScopeAuthorizer
+	assert.NoError(t, authz.Authorize(&AccessRequest{Principal: p, Repo: "team/app.git", Operation: OperationWrite}))
+	assert.NoError(t, authz.Authorize(&AccessRequest{Principal: p, Repo: "team/web.git", Operation: OperationRead}))
+	err := authz.Authorize(&AccessRequest{Principal: p, Repo: "team/web.git", Operation: OperationWrite})
+	assert.ErrorIs(t, err, ErrAccessDenied)
+	assert.EqualError(t, err, "access denied: no write scope for team/web.git")
+	assert.Error(t, authz.Authorize(&AccessRequest{Principal: p, Repo: "team/app.git", Operation: OperationCreate}))
+}
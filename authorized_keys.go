@@ -0,0 +1,323 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeyIDVariable is the environment option that sets the key ID of
+// an authorized_keys entry, e.g. environment="GITKIT_KEY=alice". It matches
+// the variable git processes see the key ID in.
+const authorizedKeyIDVariable = "GITKIT_KEY"
+
+// AuthorizedKey is an entry of an authorized_keys file.
+type AuthorizedKey struct {
+	PublicKey
+	// Options are the raw options of the entry, e.g. `no-pty` or
+	// `from="10.0.0.0/8"`.
+	Options []string
+	// Environment holds the variables set with environment="NAME=value"
+	// options.
+	Environment map[string]string
+	// File and Line locate the entry.
+	File string
+	Line int
+
+	key ssh.PublicKey
+}
+
+// AuthorizedKeys looks up public keys in one or more authorized_keys files.
+// Its Lookup and LookupKey methods can be used as PublicKeyLookupFunc and
+// PublicKeyLookupKeyFunc respectively.
+//
+// The key ID of an entry is taken from its GITKIT_KEY environment option and
+// defaults to the key fingerprint. The comment of the entry becomes its Name.
+// If a key is listed more than once, the first entry wins.
+//
+// The from= and expiry-time= options are enforced by LookupKey. restrict and
+// the no-* options hold anyway, since the server offers no forwarding or
+// terminal. Entries with options it can't honor, such as command= or
+// cert-authority, are refused.
+type AuthorizedKeys struct {
+	paths []string
+
+	mu       sync.RWMutex
+	keys     map[string]*AuthorizedKey
+	modTimes map[string]time.Time
+}
+
+// NewAuthorizedKeys loads the given authorized_keys files.
+func NewAuthorizedKeys(paths ...string) (*AuthorizedKeys, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no authorized_keys file given")
+	}
+	a := &AuthorizedKeys{paths: paths}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads all files again. On error the previously loaded keys are
+// kept.
+func (a *AuthorizedKeys) Reload() error {
+	keys := make(map[string]*AuthorizedKey)
+	modTimes := make(map[string]time.Time, len(a.paths))
+	for _, path := range a.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := parseAuthorizedKeys(path, data, keys); err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.modTimes = modTimes
+	a.mu.Unlock()
+	return nil
+}
+
+// Watch polls the files for changes every interval and reloads them when
+// they are modified, until ctx is cancelled. Failed reloads are logged and
+// leave the previously loaded keys in place.
+func (a *AuthorizedKeys) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !a.changed() {
+				continue
+			}
+			if err := a.Reload(); err != nil {
+				log.Printf("authorized_keys: reload failed: %v", err)
+			}
+		}
+	}
+}
+
+// changed reports whether any of the files were modified, created or
+// removed since they were last loaded.
+func (a *AuthorizedKeys) changed() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, path := range a.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return true
+		}
+		if !info.ModTime().Equal(a.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the entry for key.
+func (a *AuthorizedKeys) Get(key ssh.PublicKey) (*AuthorizedKey, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	entry, ok := a.keys[KeyFingerprint(key)]
+	if !ok || !bytes.Equal(entry.key.Marshal(), key.Marshal()) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// Lookup resolves a key in authorized_keys format, see PublicKeyLookupFunc.
+// It doesn't know the client, so entries with a from= option aren't found.
+func (a *AuthorizedKeys) Lookup(content string) (*PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	return a.LookupKey(key, nil)
+}
+
+// LookupKey resolves a parsed key, see PublicKeyLookupKeyFunc. Entries with
+// a from= option are only found for clients connecting from the addresses
+// it allows, which conn must be given to check.
+func (a *AuthorizedKeys) LookupKey(key ssh.PublicKey, conn ssh.ConnMetadata) (*PublicKey, error) {
+	entry, ok := a.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("key not found")
+	}
+	if err := entry.checkOptions(conn, time.Now()); err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", entry.File, entry.Line, err)
+	}
+	pkey := entry.PublicKey
+	return &pkey, nil
+}
+
+// unsupportedOptions are the options of authorized_keys the server can't
+// honor. Entries with them are refused rather than accepted with fewer
+// restrictions than intended.
+var unsupportedOptions = map[string]bool{
+	"cert-authority":  true,
+	"command":         true,
+	"permitlisten":    true,
+	"permitopen":      true,
+	"principals":      true,
+	"tunnel":          true,
+	"verify-required": true,
+}
+
+// checkOptions returns an error if the options of the entry deny a client
+// connecting with conn at now.
+func (e *AuthorizedKey) checkOptions(conn ssh.ConnMetadata, now time.Time) error {
+	for _, opt := range e.Options {
+		name, value, _ := cut(opt, "=")
+		name = strings.ToLower(name)
+		value = strings.Trim(value, `"`)
+		switch {
+		case unsupportedOptions[name]:
+			return fmt.Errorf("unsupported option %s", name)
+		case name == "expiry-time":
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return err
+			}
+			if !now.Before(expiry) {
+				return fmt.Errorf("key expired at %s", expiry.Format(time.RFC3339))
+			}
+		case name == "from":
+			if conn == nil {
+				return fmt.Errorf("from= can't be checked without the connection")
+			}
+			host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			if err != nil {
+				host = conn.RemoteAddr().String()
+			}
+			if !matchFrom(value, net.ParseIP(host)) {
+				return fmt.Errorf("key not allowed from %s", host)
+			}
+		}
+	}
+	return nil
+}
+
+// parseExpiryTime parses the YYYYMMDD[HHMM[SS]] value of expiry-time=, in
+// local time unless it ends with Z, as sshd does.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
+
+// matchFrom reports whether ip matches the patterns of a from= option:
+// addresses with * and ? wildcards or CIDR ranges, separated by commas.
+// Patterns starting with ! deny the addresses they match. Host names never
+// match, since the server doesn't resolve the client's address.
+func matchFrom(patterns string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var ok bool
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			ok = network.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, ip.String())
+		}
+		switch {
+		case ok && negated:
+			return false
+		case ok:
+			matched = true
+		}
+	}
+	return matched
+}
+
+func parseAuthorizedKeys(path string, data []byte, keys map[string]*AuthorizedKey) error {
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+
+		fingerprint := KeyFingerprint(key)
+		if _, ok := keys[fingerprint]; ok {
+			continue
+		}
+
+		env := parseEnvironmentOptions(options)
+		id := env[authorizedKeyIDVariable]
+		if id == "" {
+			id = fingerprint
+		}
+		keys[fingerprint] = &AuthorizedKey{
+			PublicKey: PublicKey{
+				Id:          id,
+				Name:        comment,
+				Fingerprint: fingerprint,
+				Content:     AuthorizedKeyString(key),
+			},
+			Options:     options,
+			Environment: env,
+			File:        path,
+			Line:        i + 1,
+			key:         key,
+		}
+	}
+	return nil
+}
+
+// parseEnvironmentOptions collects environment="NAME=value" options.
+func parseEnvironmentOptions(options []string) map[string]string {
+	env := make(map[string]string)
+	for _, opt := range options {
+		name, value := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			name, value = opt[:i], opt[i+1:]
+		}
+		if !strings.EqualFold(name, "environment") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if i := strings.IndexByte(value, '='); i > 0 {
+			env[value[:i]] = value[i+1:]
+		}
+	}
+	return env
+}
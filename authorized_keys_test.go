@@ -0,0 +1,121 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizedKeys(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		assert.NoError(t, err)
+		return key
+	}
+	alice, bob, carol := newKey(), newKey(), newKey()
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "authorized_keys")
+	second := filepath.Join(dir, "deploy_keys")
+	assert.NoError(t, os.WriteFile(first, []byte(
+		"# team keys\n"+
+			`no-pty,environment="GITKIT_KEY=alice",environment="TEAM=dev" `+AuthorizedKeyString(alice)+" alice@laptop\n"+
+			"\n"+
+			AuthorizedKeyString(bob)+" bob@desktop\n"), 0600))
+	assert.NoError(t, os.WriteFile(second, []byte(AuthorizedKeyString(bob)+" duplicate\n"), 0600))
+
+	keys, err := NewAuthorizedKeys(first, second)
+	assert.NoError(t, err)
+
+	entry, ok := keys.Get(alice)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", entry.Id)
+	assert.Equal(t, "alice@laptop", entry.Name)
+	assert.Equal(t, KeyFingerprint(alice), entry.Fingerprint)
+	assert.Equal(t, []string{"no-pty", `environment="GITKIT_KEY=alice"`, `environment="TEAM=dev"`}, entry.Options)
+	assert.Equal(t, map[string]string{"GITKIT_KEY": "alice", "TEAM": "dev"}, entry.Environment)
+	assert.Equal(t, first, entry.File)
+	assert.Equal(t, 2, entry.Line)
+
+	pkey, err := keys.Lookup(AuthorizedKeyString(bob))
+	assert.NoError(t, err)
+	assert.Equal(t, KeyFingerprint(bob), pkey.Id)
+	assert.Equal(t, "bob@desktop", pkey.Name)
+
+	_, err = keys.LookupKey(carol, nil)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keys.Watch(ctx, 10*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(second, []byte(AuthorizedKeyString(carol)+"\n"), 0600))
+	future := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(second, future, future))
+	assert.Eventually(t, func() bool {
+		_, err := keys.LookupKey(carol, nil)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A broken file keeps the previous keys.
+	assert.NoError(t, os.WriteFile(first, []byte("not a key\n"), 0600))
+	assert.Error(t, keys.Reload())
+	_, ok = keys.Get(alice)
+	assert.True(t, ok)
+
+	_, err = NewAuthorizedKeys(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestAuthorizedKeysOptions(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		assert.NoError(t, err)
+		return key
+	}
+	office, expired, valid, forced := newKey(), newKey(), newKey(), newKey()
+
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	assert.NoError(t, os.WriteFile(file, []byte(
+		`restrict,from="10.0.0.0/8,192.168.1.*,!10.1.0.0/16" `+AuthorizedKeyString(office)+"\n"+
+			`expiry-time="20200101" `+AuthorizedKeyString(expired)+"\n"+
+			`expiry-time="99991231235959Z" `+AuthorizedKeyString(valid)+"\n"+
+			`command="gitolite-shell alice" `+AuthorizedKeyString(forced)+"\n"), 0600))
+	keys, err := NewAuthorizedKeys(file)
+	assert.NoError(t, err)
+
+	from := func(ip string) ssh.ConnMetadata {
+		return fakeConnMetadata{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 22}}
+	}
+	for ip, allowed := range map[string]bool{
+		"10.2.3.4":    true,
+		"192.168.1.7": true,
+		"10.1.2.3":    false,
+		"192.168.2.1": false,
+		"::1":         false,
+	} {
+		_, err := keys.LookupKey(office, from(ip))
+		assert.Equal(t, allowed, err == nil, ip)
+	}
+	_, err = keys.LookupKey(office, nil)
+	assert.Error(t, err, "from= needs the connection")
+
+	_, err = keys.LookupKey(expired, from("10.2.3.4"))
+	assert.Error(t, err)
+	_, err = keys.LookupKey(valid, from("10.2.3.4"))
+	assert.NoError(t, err)
+	_, err = keys.LookupKey(forced, from("10.2.3.4"))
+	assert.EqualError(t, err, file+":4: unsupported option command")
+}
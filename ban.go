@@ -0,0 +1,88 @@
+package gitkit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthFailureWindow = 10 * time.Minute
+	defaultBanDuration       = 15 * time.Minute
+)
+
+// banList counts failed attempts per client IP and bans clients that exceed
+// a threshold within a sliding window.
+type banList struct {
+	mu        sync.Mutex
+	entries   map[string]*banEntry
+	lastSweep time.Time
+}
+
+type banEntry struct {
+	failures    int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// banned reports whether host is currently banned.
+func (b *banList) banned(host string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[host]
+	return ok && now.Before(e.bannedUntil)
+}
+
+// fail records a failed attempt from host and reports whether it caused the
+// host to be banned.
+func (b *banList) fail(host string, now time.Time, threshold int, window, ban time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.entries == nil {
+		b.entries = make(map[string]*banEntry)
+	}
+	b.sweep(now, window)
+
+	e, ok := b.entries[host]
+	if !ok {
+		e = &banEntry{}
+		b.entries[host] = e
+	}
+	if now.Before(e.bannedUntil) {
+		return false
+	}
+	if now.Sub(e.windowStart) > window {
+		e.failures = 0
+		e.windowStart = now
+	}
+	e.failures++
+	if e.failures < threshold {
+		return false
+	}
+	e.failures = 0
+	e.bannedUntil = now.Add(ban)
+	return true
+}
+
+// reset forgets previous failures from host, e.g. after it authenticated
+// successfully.
+func (b *banList) reset(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries, host)
+}
+
+// sweep drops entries whose window and ban have both expired so addresses
+// that stopped connecting don't accumulate. It runs at most once per window.
+func (b *banList) sweep(now time.Time, window time.Duration) {
+	if now.Sub(b.lastSweep) < window {
+		return
+	}
+	b.lastSweep = now
+	for host, e := range b.entries {
+		if now.Sub(e.windowStart) > window && !now.Before(e.bannedUntil) {
+			delete(b.entries, host)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package gitkit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_banList(t *testing.T) {
+	var b banList
+	now := time.Now()
+	window, ban := time.Minute, 5*time.Minute
+
+	assert.False(t, b.fail("10.0.0.1", now, 3, window, ban))
+	assert.False(t, b.fail("10.0.0.1", now.Add(time.Second), 3, window, ban))
+	assert.False(t, b.banned("10.0.0.1", now))
+
+	// Failures outside the window start a new count.
+	assert.False(t, b.fail("10.0.0.1", now.Add(2*time.Minute), 3, window, ban))
+	assert.False(t, b.banned("10.0.0.1", now.Add(2*time.Minute)))
+
+	later := now.Add(2 * time.Minute)
+	assert.False(t, b.fail("10.0.0.1", later, 3, window, ban))
+	assert.True(t, b.fail("10.0.0.1", later, 3, window, ban))
+	assert.True(t, b.banned("10.0.0.1", later.Add(time.Minute)))
+	assert.False(t, b.banned("10.0.0.2", later))
+	assert.False(t, b.banned("10.0.0.1", later.Add(ban)))
+
+	assert.False(t, b.fail("10.0.0.3", now, 2, window, ban))
+	b.reset("10.0.0.3")
+	assert.False(t, b.fail("10.0.0.3", now, 2, window, ban))
+
+	// Expired entries are dropped.
+	b.fail("10.0.0.4", later.Add(time.Hour), 3, window, ban)
+	assert.Len(t, b.entries, 1)
+}
@@ -0,0 +1,42 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// bannerCallback shows clients rejected by ClientVersionFunc why, and
+// otherwise the banner of BannerFunc or Banner, falling back to the
+// BannerCallback of a config set with SetSSHConfig.
+func (s *SSH) bannerCallback(conn ssh.ConnMetadata) string {
+	if err := s.checkClientVersion(conn); err != nil {
+		return err.Error() + "\r\n"
+	}
+	switch {
+	case s.BannerFunc != nil:
+		return s.BannerFunc(conn)
+	case s.Banner != "":
+		return s.Banner
+	case s.userBanner != nil:
+		return s.userBanner(conn)
+	}
+	return ""
+}
+
+// writeMOTD writes the message of the day for principal, if any, to w, the
+// stderr of a session, with CRLF line endings.
+func (s *SSH) writeMOTD(w io.Writer, principal *Principal) {
+	motd := s.MOTD
+	if s.MOTDFunc != nil {
+		motd = s.MOTDFunc(principal)
+	}
+	motd = strings.TrimRight(motd, "\r\n")
+	if motd == "" {
+		return
+	}
+	motd = strings.ReplaceAll(strings.ReplaceAll(motd, "\r\n", "\n"), "\n", "\r\n")
+	fmt.Fprintf(w, "%s\r\n", motd)
+}
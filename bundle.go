@@ -0,0 +1,203 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errBundleTooLarge = errors.New("bundle too large")
+
+// findBundleService returns the service serving bundle downloads and the
+// repository path, or nil if p is not one.
+func (s *Server) findBundleService(p string) (*service, string) {
+	if !strings.HasSuffix(p, "/bundle") {
+		return nil, ""
+	}
+	return &service{
+		method:  "GET",
+		suffix:  "/bundle",
+		handler: func(_ string, w http.ResponseWriter, r *Request) { s.getBundle(w, r) },
+		rpc:     "git-upload-pack",
+	}, strings.TrimSuffix(p, "/bundle")
+}
+
+// getBundle serves a bundle of the refs given by the refs query parameter,
+// or of all refs. The bundle is generated into a file first, so its size
+// can be checked before anything is sent.
+func (s *Server) getBundle(w http.ResponseWriter, r *Request) {
+	context := "get-bundle"
+
+	if rejectNamespaced(w, r) {
+		return
+	}
+
+	refs := splitList(r.URL.Query()["refs"])
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \n\x00") {
+			http.Error(w, "invalid ref", http.StatusBadRequest)
+			return
+		}
+	}
+	key, err := s.bundleKey(r, refs)
+	if err != nil {
+		logError(context, err)
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	var file string
+	if s.BundleCacheDir != "" {
+		file = filepath.Join(s.BundleCacheDir, key+".bundle")
+	}
+	if file == "" || !fileExists(file) {
+		file, err = s.createBundle(r, refs, file)
+		if err == errBundleTooLarge {
+			logError(context, fmt.Errorf("bundle of %s exceeds %d bytes", r.RepoName, s.MaxBundleSize))
+			http.Error(w, fmt.Sprintf("bundle exceeds the limit of %d bytes, fetch the refs instead", s.MaxBundleSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			fail500(w, context, err)
+			return
+		}
+		if s.BundleCacheDir == "" {
+			defer os.Remove(file)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+
+	name := strings.TrimSuffix(path.Base(r.RepoName), ".git") + ".bundle"
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("ETag", `"`+key+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r.Request, "", info.ModTime(), f)
+}
+
+// bundleKey identifies the bundle of refs in the state the repository is in,
+// so cached bundles aren't served once the refs moved. Unknown refs return
+// an error.
+func (s *Server) bundleKey(r *Request, refs []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", r.RepoName)
+	if len(refs) == 0 {
+		cmd, pipe := gitCommand(r.Context(), s.config.GitPath, "--git-dir", r.RepoPath, "for-each-ref", "--format=%(objectname) %(refname)")
+		cmd.Stderr = nil
+		if err := s.procs.start(cmd); err != nil {
+			return "", err
+		}
+		out, _ := ioutil.ReadAll(pipe)
+		if err := s.procs.wait(cmd); err != nil {
+			return "", err
+		}
+		if len(out) == 0 {
+			return "", fmt.Errorf("%s has no refs", r.RepoName)
+		}
+		h.Write(out)
+	}
+	for _, ref := range refs {
+		commit, err := s.resolveCommit(r, ref)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", commit, ref)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// createBundle writes the bundle of refs to file, or a temporary file if
+// file is empty, and returns its name. It fails with errBundleTooLarge once
+// the bundle exceeds MaxBundleSize.
+func (s *Server) createBundle(r *Request, refs []string, file string) (_ string, err error) {
+	dir := s.BundleCacheDir
+	if dir != "" {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	tmp, err := ioutil.TempFile(dir, "gitkit-*.bundle")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	args := []string{"--git-dir", r.RepoPath, "bundle", "create", "-"}
+	if len(refs) == 0 {
+		args = append(args, "--all")
+	}
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, append(args, refs...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = s.procs.start(cmd); err != nil {
+		return "", err
+	}
+	defer s.procs.cleanUp(cmd)
+
+	out := io.Writer(tmp)
+	if s.MaxBundleSize > 0 {
+		out = &limitedWriter{w: tmp, n: s.MaxBundleSize}
+	}
+	if _, err = io.Copy(out, pipe); err != nil {
+		if err != errBundleTooLarge {
+			err = fmt.Errorf("bundle: %v", err)
+		}
+		return "", err
+	}
+	if err = s.procs.wait(cmd); err != nil {
+		return "", fmt.Errorf("bundle: %v: %s", err, stderr.Bytes())
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if file == "" {
+		return tmp.Name(), nil
+	}
+	// Concurrent requests for the same bundle each rename their own
+	// complete copy into place.
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// limitedWriter fails with errBundleTooLarge once more than n bytes are
+// written.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errBundleTooLarge
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
@@ -0,0 +1,101 @@
+package gitkit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerBundles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+	_, err = git("-C", work, "push", repo, "HEAD:refs/heads/master", "HEAD:refs/heads/other")
+	assert.NoError(t, err)
+
+	cache := filepath.Join(dir, "cache")
+	server := New(Config{Dir: repos})
+	server.Bundles = true
+	server.BundleCacheDir = cache
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	download := func(query string) (*http.Response, string) {
+		res, err := http.Get(srv.URL + "/app.git/bundle" + query)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		f, err := os.CreateTemp(dir, "*.bundle")
+		assert.NoError(t, err)
+		defer f.Close()
+		io.Copy(f, res.Body)
+		return res, f.Name()
+	}
+
+	res, bundle := download("?refs=master")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/x-git-bundle", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="app.bundle"`, res.Header.Get("Content-Disposition"))
+	out, err := git("bundle", "list-heads", bundle)
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "refs/heads/master")
+	assert.NotContains(t, out, "refs/heads/other")
+	out, err = git("clone", bundle, filepath.Join(dir, "clone"))
+	assert.NoError(t, err, out)
+
+	// The cached bundle is served until master moves.
+	etag := res.Header.Get("ETag")
+	cached, _ := filepath.Glob(filepath.Join(cache, "*.bundle"))
+	assert.Len(t, cached, 1)
+	res, _ = download("?refs=master")
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "second")
+	assert.NoError(t, err)
+	_, err = git("-C", work, "push", repo, "HEAD:refs/heads/master")
+	assert.NoError(t, err)
+	res, _ = download("?refs=master")
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+
+	res, bundle = download("")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	out, err = git("bundle", "list-heads", bundle)
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "refs/heads/other")
+
+	res, _ = download("?refs=missing")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = download("?refs=--all")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	limited := New(Config{Dir: repos})
+	limited.Bundles = true
+	limited.MaxBundleSize = 100
+	limitedSrv := httptest.NewServer(limited)
+	defer limitedSrv.Close()
+	res, err = http.Get(limitedSrv.URL + "/app.git/bundle")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
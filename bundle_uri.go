@@ -0,0 +1,38 @@
+package gitkit
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// bundleURIConfig returns the git configuration making upload-pack
+// advertise uris as a bundle list, as pairs of keys and values. Clients
+// download all the bundles before fetching the rest from the server.
+func bundleURIConfig(uris []string) []string {
+	if len(uris) == 0 {
+		return nil
+	}
+	config := []string{
+		"uploadpack.advertiseBundleURIs", "true",
+		"bundle.version", "1",
+		"bundle.mode", "all",
+	}
+	for i, uri := range uris {
+		config = append(config, fmt.Sprintf("bundle.b%d.uri", i), uri)
+	}
+	return config
+}
+
+// configEnviron returns the variables passing config, pairs of keys and
+// values, to a git process as if it was set with git -c.
+func configEnviron(config []string) []string {
+	if len(config) == 0 {
+		return nil
+	}
+	env := []string{"GIT_CONFIG_COUNT=" + strconv.Itoa(len(config)/2)}
+	for i := 0; i+1 < len(config); i += 2 {
+		n := strconv.Itoa(i / 2)
+		env = append(env, "GIT_CONFIG_KEY_"+n+"="+config[i], "GIT_CONFIG_VALUE_"+n+"="+config[i+1])
+	}
+	return env
+}
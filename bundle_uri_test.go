@@ -0,0 +1,65 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigEnviron(t *testing.T) {
+	assert.Nil(t, configEnviron(nil))
+	assert.Equal(t, []string{
+		"GIT_CONFIG_COUNT=4",
+		"GIT_CONFIG_KEY_0=uploadpack.advertiseBundleURIs", "GIT_CONFIG_VALUE_0=true",
+		"GIT_CONFIG_KEY_1=bundle.version", "GIT_CONFIG_VALUE_1=1",
+		"GIT_CONFIG_KEY_2=bundle.mode", "GIT_CONFIG_VALUE_2=all",
+		"GIT_CONFIG_KEY_3=bundle.b0.uri", "GIT_CONFIG_VALUE_3=https://cdn.example.com/app.bundle",
+	}, configEnviron(bundleURIConfig([]string{"https://cdn.example.com/app.bundle"})))
+}
+
+func TestServerBundleURIs(t *testing.T) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+
+	// The wrapper records the configuration git is run with.
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, "app.git")).Run())
+	envOut := filepath.Join(dir, "env.out")
+	wrapper := filepath.Join(dir, "git")
+	script := fmt.Sprintf("#!/bin/sh\nenv | grep ^GIT_CONFIG_ > %s\nexec %s \"$@\"\n", envOut, gitPath)
+	assert.NoError(t, os.WriteFile(wrapper, []byte(script), 0755))
+
+	server := New(Config{Dir: repos, GitPath: wrapper})
+	server.BundleURIs = func(repo string) []string {
+		return []string{"https://cdn.example.com/" + repo + ".bundle"}
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	config := func(service string) []string {
+		os.Remove(envOut)
+		req, _ := http.NewRequest("GET", srv.URL+"/app.git/info/refs?service="+service, nil)
+		req.Header.Set("Git-Protocol", "version=2")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		data, _ := os.ReadFile(envOut)
+		lines := strings.Fields(string(data))
+		sort.Strings(lines)
+		return lines
+	}
+	assert.Contains(t, config("git-upload-pack"), "GIT_CONFIG_VALUE_3=https://cdn.example.com/app.git.bundle")
+	assert.Empty(t, config("git-receive-pack"))
+}
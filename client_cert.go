@@ -0,0 +1,115 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// ClientCertAuthenticator authenticates HTTPS clients with TLS client
+// certificates. Its Authenticate method can be used as Server.AuthFunc, with
+// the server listening with the configuration from TLSConfig.
+type ClientCertAuthenticator struct {
+	// Roots are the CAs client certificates must be issued by, the system
+	// roots if nil.
+	Roots *x509.CertPool
+	// Intermediates are the intermediate CAs to build chains with, in
+	// addition to those sent by the client.
+	Intermediates []*x509.Certificate
+	// PrincipalFunc maps a verified certificate to a principal. If nil, the
+	// common name of the subject becomes the ID and the first email address
+	// the email, with the subject, serial number and fingerprint as
+	// attributes.
+	PrincipalFunc func(cert *x509.Certificate) (*Principal, error)
+}
+
+// NewClientCertAuthenticator returns an authenticator for client
+// certificates issued by roots.
+func NewClientCertAuthenticator(roots *x509.CertPool) *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{Roots: roots}
+}
+
+// TLSConfig returns a server configuration based on base, which may be nil,
+// that requires clients to present a certificate issued by Roots.
+func (a *ClientCertAuthenticator) TLSConfig(base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = a.Roots
+	return cfg
+}
+
+// Authenticate verifies the client certificate of req and sets its
+// principal. Requests without certificate are rejected.
+func (a *ClientCertAuthenticator) Authenticate(_ Credential, req *Request) (bool, error) {
+	if !hasClientCert(req.Request) {
+		return false, nil
+	}
+	certs := req.TLS.PeerCertificates
+
+	opts := x509.VerifyOptions{
+		Roots:         a.Roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range a.Intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	// The TLS configuration may accept certificates of other CAs, so the
+	// chain is always verified against Roots.
+	if _, err := certs[0].Verify(opts); err != nil {
+		return false, fmt.Errorf("invalid client certificate %q: %v", certs[0].Subject, err)
+	}
+
+	principal, err := a.principal(certs[0])
+	if err != nil {
+		return false, err
+	}
+	req.Principal = principal
+	return true, nil
+}
+
+func (a *ClientCertAuthenticator) principal(cert *x509.Certificate) (*Principal, error) {
+	if a.PrincipalFunc != nil {
+		principal, err := a.PrincipalFunc(cert)
+		if err == nil && principal == nil {
+			err = fmt.Errorf("no principal for certificate %q", cert.Subject)
+		}
+		return principal, err
+	}
+
+	if cert.Subject.CommonName == "" {
+		return nil, fmt.Errorf("client certificate %q has no common name", cert.Subject)
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	p := &Principal{
+		ID:          cert.Subject.CommonName,
+		Name:        cert.Subject.CommonName,
+		Certificate: true,
+		ValidBefore: cert.NotAfter,
+		Attributes: map[string]string{
+			"subject":     cert.Subject.String(),
+			"serial":      cert.SerialNumber.String(),
+			"fingerprint": hex.EncodeToString(fingerprint[:]),
+		},
+	}
+	if len(cert.EmailAddresses) > 0 {
+		p.Email = cert.EmailAddresses[0]
+	}
+	return p, nil
+}
+
+// hasClientCert reports whether the client sent a TLS client certificate.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
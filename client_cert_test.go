@@ -0,0 +1,107 @@
+package gitkit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCert returns a certificate for subject, signed by parent or self
+// signed if parent is nil.
+func newTestCert(t *testing.T, subject pkix.Name, parent *tls.Certificate, email ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        subject,
+		EmailAddresses: email,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	ca := newTestCert(t, pkix.Name{CommonName: "Test CA"}, nil)
+	otherCA := newTestCert(t, pkix.Name{CommonName: "Other CA"}, nil)
+	mirror := newTestCert(t, pkix.Name{CommonName: "mirror-1", Organization: []string{"Example"}}, &ca, "mirror@example.com")
+	rogue := newTestCert(t, pkix.Name{CommonName: "mirror-1"}, &otherCA)
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "repo.git")).Run())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	auth := NewClientCertAuthenticator(roots)
+
+	var principal *Principal
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		ok, err := auth.Authenticate(cred, req)
+		principal = req.Principal
+		return ok, err
+	}
+	srv := httptest.NewUnstartedServer(server)
+	// Ask for any certificate, so Authenticate has to reject the rogue one.
+	srv.TLS = auth.TLSConfig(nil)
+	srv.TLS.ClientAuth = tls.RequestClientCert
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cert *tls.Certificate) int {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		res, err := (&http.Client{Transport: transport}).Get(srv.URL + "/repo.git/info/refs?service=git-upload-pack")
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get(&mirror))
+	assert.Equal(t, "mirror-1", principal.ID)
+	assert.Equal(t, "mirror@example.com", principal.Email)
+	assert.Equal(t, "CN=mirror-1,O=Example", principal.Attributes["subject"])
+	assert.True(t, principal.Certificate)
+
+	assert.Equal(t, http.StatusUnauthorized, get(&rogue))
+	assert.Equal(t, http.StatusUnauthorized, get(nil))
+
+	auth.PrincipalFunc = func(cert *x509.Certificate) (*Principal, error) {
+		return &Principal{ID: "mtls:" + cert.Subject.CommonName}, nil
+	}
+	assert.Equal(t, http.StatusOK, get(&mirror))
+	assert.Equal(t, "mtls:mirror-1", principal.ID)
+}
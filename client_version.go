@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MinClientVersion returns a ClientVersionFunc that rejects clients
+// identifying as the given software, e.g. "OpenSSH", with a version lower
+// than min, e.g. "7.4". Clients running other software are accepted.
+func MinClientVersion(software, min string) func(version string) error {
+	return func(version string) error {
+		name, v := parseClientVersion(version)
+		if name != software {
+			return nil
+		}
+		if compareVersions(v, min) < 0 {
+			return fmt.Errorf("%s %s is not supported, please upgrade to %s or later", software, v, min)
+		}
+		return nil
+	}
+}
+
+// parseClientVersion splits an SSH identification string such as
+// "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3" into software name and version.
+func parseClientVersion(version string) (string, string) {
+	version = strings.TrimPrefix(version, "SSH-2.0-")
+	if i := strings.IndexByte(version, ' '); i >= 0 {
+		version = version[:i]
+	}
+	i := strings.IndexByte(version, '_')
+	if i < 0 {
+		return version, ""
+	}
+	return version[:i], version[i+1:]
+}
+
+// compareVersions compares dotted versions numerically, ignoring any
+// non-numeric suffix of a component such as the "p1" in "8.9p1".
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+// checkClientVersion applies ClientVersionFunc to the connecting client.
+func (s *SSH) checkClientVersion(conn ssh.ConnMetadata) error {
+	if s.ClientVersionFunc == nil {
+		return nil
+	}
+	return s.ClientVersionFunc(string(conn.ClientVersion()))
+}
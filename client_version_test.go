@@ -0,0 +1,29 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinClientVersion(t *testing.T) {
+	check := MinClientVersion("OpenSSH", "7.4")
+
+	tests := []struct {
+		version string
+		wantErr bool
+	}{
+		{"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3", false},
+		{"SSH-2.0-OpenSSH_7.4", false},
+		{"SSH-2.0-OpenSSH_7.4p1", false},
+		{"SSH-2.0-OpenSSH_7.3p1 Debian", true},
+		{"SSH-2.0-OpenSSH_5.3", true},
+		{"SSH-2.0-OpenSSH_10.0", false},
+		{"SSH-2.0-Go", false},
+		{"SSH-2.0-PuTTY_Release_0.70", false},
+	}
+	for _, tt := range tests {
+		err := check(tt.version)
+		assert.Equal(t, tt.wantErr, err != nil, tt.version)
+	}
+}
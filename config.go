@@ -8,14 +8,25 @@ import (
 
 type Config struct {
 	KeyDir     string       // Directory for server ssh keys. Only used in SSH strategy.
+	KeyType    string       // Type of generated ssh host key: "rsa" (default), "ed25519" or "ecdsa".
+	KeyBits    int          // Size of generated host keys: 2048 by default for RSA, 256 (P-256, default), 384 (P-384) or 521 (P-521) for ECDSA.
 	Dir        string       // Directory that contains repositories
 	GitPath    string       // Path to git binary
-	GitUser    string       // User for ssh connections
+	GitUser    string       // User for ssh connections, see SSH.UserCheckFunc for accepting several
 	AutoCreate bool         // Automatically create repostories
 	AutoHooks  bool         // Automatically setup git hooks
 	Hooks      *HookScripts // Scripts for hooks/* directory
 	Auth       bool         // Require authentication
 	ReadOnly   bool         // Simulates a user that has read-only access to the repository.
+
+	// ConfineSymlinks resolves symlinks in repository paths and refuses
+	// repositories that end up outside of Dir.
+	ConfineSymlinks bool
+	// CaseInsensitiveRepos looks up repositories ignoring case, so
+	// MyRepo.git serves myrepo.git if that is how it is stored, instead of
+	// AutoCreate creating another repository. Names are passed on to
+	// authorizers and hooks as they are stored.
+	CaseInsensitiveRepos bool
 }
 
 // HookScripts represents all repository server-size git hooks
@@ -62,8 +73,17 @@ func (c *HookScripts) setupInDir(path string) error {
 	return nil
 }
 
+// KeyPath returns the location of the ssh host key, e.g. gitkit.rsa,
+// gitkit.ed25519 or gitkit.ecdsa in KeyDir depending on KeyType.
 func (c *Config) KeyPath() string {
-	return filepath.Join(c.KeyDir, "gitkit.rsa")
+	return filepath.Join(c.KeyDir, "gitkit."+c.keyType())
+}
+
+func (c *Config) keyType() string {
+	if c.KeyType == "" {
+		return KeyTypeRSA
+	}
+	return c.KeyType
 }
 
 func (c *Config) Setup() error {
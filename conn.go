@@ -0,0 +1,46 @@
+package gitkit
+
+import (
+	"net"
+	"time"
+)
+
+// idleTimeoutConn closes the underlying connection once no data has been
+// read or written for the given timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration) *idleTimeoutConn {
+	return &idleTimeoutConn{
+		Conn:    conn,
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			logInfo("ssh", "closing idle connection from "+conn.RemoteAddr().String())
+			conn.Close()
+		}),
+	}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,106 @@
+package gitkit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of CORSConfig, covering what git clients in browsers send.
+var (
+	defaultCORSMethods = []string{"GET", "POST", "OPTIONS"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Content-Encoding", "Git-Protocol", "Accept"}
+)
+
+// CORSConfig lets browser based git clients, e.g. isomorphic-git, access
+// repositories from other origins.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to make requests, such as
+	// "https://ide.example.com". "*" allows every other origin, but
+	// without credentials.
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, POST and OPTIONS.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers browsers may send, defaulting
+	// to those used by git: Authorization, Content-Type, Content-Encoding,
+	// Git-Protocol and Accept.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read.
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and basic auth
+	// credentials they know for the server, from the origins listed by
+	// name.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight
+	// request.
+	MaxAge time.Duration
+}
+
+// handle adds the CORS headers for the request's origin. It answers
+// preflight requests, in which case it returns true.
+func (c *CORSConfig) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	listed := c.listed(origin)
+	if !listed && !c.anyOrigin() {
+		return false
+	}
+
+	// Any origin is answered with "*", which browsers refuse to send
+	// credentials to, so that no site can act as a logged in user.
+	if listed {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.AllowCredentials && listed {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	methods, headers := c.AllowedMethods, c.AllowedHeaders
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// listed reports whether origin is one of AllowedOrigins.
+func (c *CORSConfig) listed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOrigin reports whether AllowedOrigins allows every origin.
+func (c *CORSConfig) anyOrigin() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
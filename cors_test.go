@@ -0,0 +1,69 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	s := New(Config{Dir: t.TempDir()})
+	s.CORS = &CORSConfig{
+		AllowedOrigins:   []string{"https://ide.example.com"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
+
+	do := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/repo.git/info/refs?service=git-upload-pack", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		return rec
+	}
+
+	preflight := map[string]string{"Access-Control-Request-Method": "POST"}
+	rec := do("OPTIONS", "https://ide.example.com", preflight)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://ide.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST, OPTIONS", rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "Git-Protocol")
+	assert.Equal(t, "3600", rec.Header().Get("Access-Control-Max-Age"))
+
+	rec = do("OPTIONS", "https://evil.example.com", preflight)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", rec.Header().Get("Vary"))
+
+	// Actual requests are served with the headers added.
+	rec = do("GET", "https://ide.example.com", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "https://ide.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = do("GET", "", nil)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// Credentials are only allowed for the origins listed by name.
+	s.CORS = &CORSConfig{
+		AllowedOrigins:   []string{"https://ide.example.com", "*"},
+		AllowedHeaders:   []string{"Authorization"},
+		AllowCredentials: true,
+	}
+	rec = do("OPTIONS", "https://any.example.com", preflight)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Authorization", rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	rec = do("OPTIONS", "https://ide.example.com", preflight)
+	assert.Equal(t, "https://ide.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+}
@@ -0,0 +1,57 @@
+package gitkit
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Crypto profiles for SSH.CryptoProfile.
+const (
+	// CryptoProfileModern only offers AEAD or encrypt-then-MAC constructions
+	// over elliptic curve key exchanges, supported by OpenSSH 6.5 and later.
+	CryptoProfileModern = "modern"
+	// CryptoProfileCompat additionally offers MAC-then-encrypt, SHA-1 and
+	// CBC based algorithms for old clients that support nothing better.
+	CryptoProfileCompat = "compat"
+)
+
+var modernKeyExchanges = []string{
+	"curve25519-sha256",
+	"curve25519-sha256@libssh.org",
+	"ecdh-sha2-nistp521",
+	"ecdh-sha2-nistp384",
+	"ecdh-sha2-nistp256",
+}
+
+var modernCiphers = []string{
+	"chacha20-poly1305@openssh.com",
+	"aes128-gcm@openssh.com",
+	"aes256-ctr",
+	"aes192-ctr",
+	"aes128-ctr",
+}
+
+var modernMACs = []string{
+	"hmac-sha2-256-etm@openssh.com",
+}
+
+// applyCryptoProfile sets the key exchanges, ciphers and MACs of config for
+// the named profile. An empty profile leaves config untouched.
+func applyCryptoProfile(config *ssh.Config, profile string) error {
+	switch profile {
+	case "":
+	case CryptoProfileModern:
+		config.KeyExchanges = append([]string{}, modernKeyExchanges...)
+		config.Ciphers = append([]string{}, modernCiphers...)
+		config.MACs = append([]string{}, modernMACs...)
+	case CryptoProfileCompat:
+		config.KeyExchanges = append(append([]string{}, modernKeyExchanges...),
+			"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1")
+		config.Ciphers = append(append([]string{}, modernCiphers...), "aes128-cbc", "3des-cbc")
+		config.MACs = append(append([]string{}, modernMACs...), "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96")
+	default:
+		return fmt.Errorf("unsupported crypto profile %q", profile)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// denialMessage returns the message shown to a client whose request was
+// denied with err. Errors wrapping ErrAccessDenied carry a reason meant for
+// the client and are shown as is. Anything else may expose internals, such
+// as a failing backend, so the client is told fallback instead.
+func denialMessage(err error, fallback string) string {
+	if errors.Is(err, ErrAccessDenied) && err != ErrAccessDenied {
+		return err.Error()
+	}
+	return ErrAccessDenied.Error() + ": " + fallback
+}
+
+// permissionMessage explains what a client was missing to perform operation
+// on repo.
+func permissionMessage(operation, repo string) string {
+	if operation == OperationCreate {
+		return fmt.Sprintf("you may not create %s", repo)
+	}
+	return fmt.Sprintf("you need %s permission on %s", operation, repo)
+}
+
+// denyExec answers a denied exec request of command: msg is written to the
+// client's stderr, where git shows it, and the command exits with status 1.
+// git archive expects an answer to its request before it looks at anything
+// else, so git-upload-archive also sends msg as an ERR packet.
+func denyExec(req *ssh.Request, ch ssh.Channel, command, msg string) {
+	req.Reply(true, nil)
+	fmt.Fprintf(ch.Stderr(), "%s\r\n", msg)
+	if command == "git-upload-archive" {
+		WriteErrorPacket(ch, msg)
+	}
+	ch.SendRequest("exit-status", false, []byte{0, 0, 0, 1})
+}
+
+// rejectConn turns away a connection that authenticated but may not be
+// served. Its first session is refused with msg, which clients print, before
+// the connection is closed.
+func rejectConn(sConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, msg string) {
+	defer sConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if err := newChan.Reject(ssh.Prohibited, msg); err != nil {
+			log.Printf("ssh: rejecting channel: %v", err)
+		}
+		return
+	}
+}
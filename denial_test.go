@@ -0,0 +1,23 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenialMessage(t *testing.T) {
+	fallback := permissionMessage(OperationWrite, "repo.git")
+	assert.Equal(t, "you need write permission on repo.git", fallback)
+	assert.Equal(t, "you may not create new.git", permissionMessage(OperationCreate, "new.git"))
+
+	assert.Equal(t, "access denied: you need write permission on repo.git", denialMessage(ErrAccessDenied, fallback))
+	assert.Equal(t, "access denied: the repository is archived",
+		denialMessage(fmt.Errorf("%w: the repository is archived", ErrAccessDenied), fallback))
+	assert.Equal(t, "access denied: frozen", denialMessage(deniedBecause("frozen"), fallback))
+	// Unrelated errors may leak internals and are not shown.
+	assert.Equal(t, "access denied: you need write permission on repo.git",
+		denialMessage(errors.New("dial tcp 10.0.0.1:443: connection refused"), fallback))
+}
@@ -0,0 +1,95 @@
+package gitkit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// dumbFilePattern matches the files of a repository fetched by dumb HTTP
+// clients, other than info/refs.
+var dumbFilePattern = regexp.MustCompile(`^(.*)/(HEAD|objects/info/(?:packs|alternates|http-alternates)|objects/[0-9a-f]{2}/[0-9a-f]{38}(?:[0-9a-f]{24})?|objects/pack/pack-[0-9a-f]{40}(?:[0-9a-f]{24})?\.(?:pack|idx))$`)
+
+// dumbContentTypes are the content types of dumb HTTP files, as served by
+// git http-backend.
+var dumbContentTypes = map[string]string{
+	".pack": "application/x-git-packed-objects",
+	".idx":  "application/x-git-packed-objects-toc",
+}
+
+// findDumbService returns the service serving a file of the dumb protocol
+// and the repository path, or nil if p is not one.
+func (s *Server) findDumbService(p string) (*service, string) {
+	m := dumbFilePattern.FindStringSubmatch(p)
+	if m == nil {
+		return nil, ""
+	}
+	file := m[2]
+	return &service{
+		method: "GET",
+		suffix: "/" + file,
+		handler: func(_ string, w http.ResponseWriter, r *Request) {
+			s.getDumbFile(file, w, r)
+		},
+		rpc: "git-upload-pack",
+	}, m[1]
+}
+
+// getDumbFile serves a file of the repository to a dumb HTTP client. The
+// files listing refs and packs are generated first, since nothing keeps them
+// up to date otherwise.
+func (s *Server) getDumbFile(file string, w http.ResponseWriter, r *Request) {
+	context := "get-dumb-file"
+
+	if rejectNamespaced(w, r) {
+		return
+	}
+
+	if file == "info/refs" || file == "objects/info/packs" {
+		cmd, pipe := gitCommand(r.Context(), s.config.GitPath, "--git-dir", r.RepoPath, "update-server-info")
+		if err := s.procs.start(cmd); err != nil {
+			fail500(w, context, err)
+			return
+		}
+		out, _ := ioutil.ReadAll(pipe)
+		if err := s.procs.wait(cmd); err != nil {
+			// Losing the race for the lock against a concurrent update
+			// still leaves current files behind, so serve what is there.
+			logError(context, fmt.Errorf("update-server-info: %v: %s", err, out))
+		}
+	}
+
+	f, err := os.Open(filepath.Join(r.RepoPath, filepath.FromSlash(file)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r.Request)
+			return
+		}
+		fail500(w, context, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	switch ext := filepath.Ext(file); {
+	case dumbContentTypes[ext] != "":
+		w.Header().Set("Content-Type", dumbContentTypes[ext])
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	case filepath.Dir(file) != "objects/info" && file != "HEAD" && file != "info/refs":
+		w.Header().Set("Content-Type", "application/x-git-loose-object")
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	default:
+		// Refs and pack lists change with every push.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r.Request, "", info.ModTime(), f)
+}
@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumbHTTP(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "repo.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+
+	git := func(env []string, args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git(nil, "init", work)
+	assert.NoError(t, err)
+	_, err = git(nil, "-C", work, "commit", "--allow-empty", "-m", "packed")
+	assert.NoError(t, err)
+	_, err = git(nil, "-C", work, "push", repo, "HEAD:refs/heads/master")
+	assert.NoError(t, err)
+	_, err = git(nil, "-C", repo, "repack", "-a", "-d")
+	assert.NoError(t, err)
+	_, err = git(nil, "-C", work, "commit", "--allow-empty", "-m", "loose")
+	assert.NoError(t, err)
+	_, err = git(nil, "-C", work, "push", repo, "HEAD:refs/heads/master")
+	assert.NoError(t, err)
+
+	dumb := []string{"GIT_SMART_HTTP=0"}
+	smartOnly := httptest.NewServer(New(Config{Dir: repos}))
+	defer smartOnly.Close()
+	out, err := git(dumb, "clone", smartOnly.URL+"/repo.git", filepath.Join(dir, "disabled"))
+	assert.Error(t, err, out)
+
+	server := New(Config{Dir: repos})
+	server.DumbHTTP = true
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	clone := filepath.Join(dir, "clone")
+	out, err = git(dumb, "clone", srv.URL+"/repo.git", clone)
+	assert.NoError(t, err, out)
+	out, err = git(nil, "-C", clone, "log", "--format=%s")
+	assert.NoError(t, err)
+	assert.Equal(t, "loose\npacked\n", out)
+
+	// Smart clients are still served the smart protocol.
+	out, err = git(nil, "clone", srv.URL+"/repo.git", filepath.Join(dir, "smart"))
+	assert.NoError(t, err, out)
+
+	res, err := http.Get(srv.URL + "/repo.git/objects/info/packs")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+
+	for _, p := range []string{"/repo.git/config", "/repo.git/objects/00/" + strings.Repeat("0", 38), "/repo.git/hooks/pre-receive"} {
+		res, err := http.Get(srv.URL + p)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.NotEqual(t, http.StatusOK, res.StatusCode, p)
+	}
+}
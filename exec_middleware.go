@@ -0,0 +1,52 @@
+package gitkit
+
+import (
+	"context"
+	"net"
+)
+
+// Exec is a git command the SSH server runs for a client, once it has been
+// authorized.
+type Exec struct {
+	Principal *Principal
+	// User is the SSH username of the client.
+	User       string
+	RemoteAddr net.Addr
+	// Command is git-upload-pack, git-receive-pack or git-upload-archive.
+	Command string
+	Repo    string
+	// RepoPath is the absolute path of the repository on disk.
+	RepoPath string
+	// GitNamespace is the git namespace the command is served in, if any.
+	GitNamespace string
+	// Env is the environment git runs with. Middleware may change it,
+	// e.g. to set variables for hooks.
+	Env []string
+}
+
+// ExecFunc runs a git command for the SSH server, returning once it exited.
+// Its error is the one of exec.Cmd.Wait, reported to the client as the exit
+// status of the command.
+type ExecFunc func(ctx context.Context, e *Exec) error
+
+// ExecMiddleware wraps the git commands the SSH server runs, e.g. for
+// logging, timing or quota checks. Middleware may change the Env of e
+// before passing it on, and refuse to run the command by returning without
+// calling next. Errors wrapping ErrAccessDenied are then shown to the
+// client, as for the Authorizer.
+type ExecMiddleware func(next ExecFunc) ExecFunc
+
+// UseExec adds exec middleware, which runs in the order given, the first
+// one outermost. It must not be called while the server is serving.
+func (s *SSH) UseExec(middleware ...ExecMiddleware) {
+	s.execMiddleware = append(s.execMiddleware, middleware...)
+}
+
+// execHandler returns the exec middleware chain ending in run.
+func (s *SSH) execHandler(run ExecFunc) ExecFunc {
+	h := run
+	for i := len(s.execMiddleware) - 1; i >= 0; i-- {
+		h = s.execMiddleware[i](h)
+	}
+	return h
+}
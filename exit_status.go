@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// exitRequest returns the request telling a client how a command ended that
+// waiting for returned err: exit-status with its exit code, or exit-signal
+// if it was killed by a signal clients know. Other signals are reported as
+// an exit code of 128 and the signal number, the way shells do. Errors of
+// anything but the process, e.g. broken pipes, are reported as exit code 1.
+func exitRequest(err error) (string, []byte) {
+	if err == nil {
+		return "exit-status", ssh.Marshal(exitStatusMsg{0})
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "exit-status", ssh.Marshal(exitStatusMsg{1})
+	}
+	if name, payload, ok := signalRequest(exitErr); ok {
+		return name, payload
+	}
+	return "exit-status", ssh.Marshal(exitStatusMsg{uint32(exitErr.ExitCode())})
+}
+
+// sendExitStatus tells the client on ch how its command ended, see
+// exitRequest.
+func sendExitStatus(ch ssh.Channel, err error) {
+	name, payload := exitRequest(err)
+	if _, err := ch.SendRequest(name, false, payload); err != nil {
+		log.Printf("ssh: sending %s: %v", name, err)
+	}
+}
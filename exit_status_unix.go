@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package gitkit
+
+import (
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// signalNames are the names of the signals clients know from RFC 4254.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+// signalRequest returns the request reporting that the process of exitErr
+// was killed by a signal, if it was.
+func signalRequest(exitErr *exec.ExitError) (string, []byte, bool) {
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return "", nil, false
+	}
+	if name, ok := signalNames[ws.Signal()]; ok {
+		return "exit-signal", ssh.Marshal(exitSignalMsg{
+			Signal:     name,
+			CoreDumped: ws.CoreDump(),
+			Error:      ws.Signal().String(),
+		}), true
+	}
+	return "exit-status", ssh.Marshal(exitStatusMsg{128 + uint32(ws.Signal())}), true
+}
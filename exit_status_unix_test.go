@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package gitkit
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExitRequest(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not installed")
+	}
+
+	status := func(script string) (string, []byte) {
+		return exitRequest(exec.Command("sh", "-c", script).Run())
+	}
+
+	name, payload := status("exit 0")
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, []byte{0, 0, 0, 0}, payload)
+
+	name, payload = status("exit 3")
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, []byte{0, 0, 0, 3}, payload)
+
+	name, payload = status("kill -TERM $$")
+	assert.Equal(t, "exit-signal", name)
+	var msg exitSignalMsg
+	assert.NoError(t, ssh.Unmarshal(payload, &msg))
+	assert.Equal(t, "TERM", msg.Signal)
+	assert.False(t, msg.CoreDumped)
+
+	// Signals clients don't know are reported like shells do.
+	name, payload = status("kill -PROF $$")
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, ssh.Marshal(exitStatusMsg{128 + uint32(syscall.SIGPROF)}), payload)
+
+	name, payload = exitRequest(errors.New("broken pipe"))
+	assert.Equal(t, "exit-status", name)
+	assert.Equal(t, []byte{0, 0, 0, 1}, payload)
+}
@@ -0,0 +1,9 @@
+package gitkit
+
+import "os/exec"
+
+// signalRequest reports nothing, processes aren't killed by signals on
+// Windows and only their exit code is sent.
+func signalRequest(*exec.ExitError) (string, []byte, bool) {
+	return "", nil, false
+}
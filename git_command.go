@@ -2,29 +2,90 @@ package gitkit
 
 import (
 	"fmt"
-	"regexp"
 	"strings"
 )
 
-var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack) '(.*)'$`)
+// gitCommands are the only commands the SSH server runs.
+var gitCommands = map[string]bool{
+	"git-upload-pack":    true,
+	"git-receive-pack":   true,
+	"git-upload-archive": true,
+}
 
 type GitCommand struct {
+	// Command is git-upload-pack, git-receive-pack or git-upload-archive,
+	// also when the client asked for "git upload-pack".
 	Command  string
 	Repo     string
 	Original string
 }
 
+// ParseGitCommand parses the command of an exec request the way git-shell
+// does. It is one of gitCommands, also written as "git upload-pack", a
+// space and a single shell-quoted repository argument. Leading slashes of
+// the repository, as in ssh://host/repo.git, are removed.
 func ParseGitCommand(cmd string) (*GitCommand, error) {
-	matches := gitCommandRegex.FindAllStringSubmatch(cmd, 1)
-	if len(matches) == 0 {
+	prog := cmd
+	if len(prog) > 3 && strings.HasPrefix(prog, "git") && strings.IndexByte(" \t\n\r", prog[3]) >= 0 {
+		prog = "git-" + prog[4:]
+	}
+	name, arg, ok := cut(prog, " ")
+	if !ok || !gitCommands[name] {
 		return nil, fmt.Errorf("invalid git command")
 	}
+	repo, err := sqDequote(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git command: %w", err)
+	}
 
 	result := &GitCommand{
 		Original: cmd,
-		Command:  matches[0][1],
-		Repo:     strings.Replace(matches[0][2], "/", "", 1),
+		Command:  name,
+		Repo:     strings.TrimLeft(repo, "/"),
+	}
+	if err := result.validate(); err != nil {
+		return nil, err
 	}
 
 	return result, nil
 }
+
+// sqDequote undoes the quoting git applies to the argument of the command
+// it runs over SSH. s is a single-quoted word, in which a quote or an
+// exclamation mark closes the quotes, is escaped with a backslash and the
+// quotes are opened again. Anything else is refused, as git-shell does.
+func sqDequote(s string) (string, error) {
+	if !strings.HasPrefix(s, "'") {
+		return "", fmt.Errorf("argument is not quoted")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			b.WriteByte(s[i])
+			continue
+		}
+		rest := s[i+1:]
+		if rest == "" {
+			return b.String(), nil
+		}
+		if len(rest) >= 3 && rest[0] == '\\' && (rest[1] == '\'' || rest[1] == '!') && rest[2] == '\'' {
+			b.WriteByte(rest[1])
+			i += 3
+			continue
+		}
+		return "", fmt.Errorf("unexpected %q after quoted argument", rest)
+	}
+	return "", fmt.Errorf("unterminated quote")
+}
+
+// validate makes sure c only runs one of gitCommands on a repository, so
+// nothing else a client sends ends up on the command line.
+func (c *GitCommand) validate() error {
+	if !gitCommands[c.Command] {
+		return fmt.Errorf("command %q is not allowed", c.Command)
+	}
+	if c.Repo == "" || strings.HasPrefix(c.Repo, "-") || strings.ContainsAny(c.Repo, "\x00\r\n") {
+		return fmt.Errorf("invalid repository %q", c.Repo)
+	}
+	return nil
+}
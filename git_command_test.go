@@ -9,13 +9,20 @@ import (
 func TestParseGitCommand(t *testing.T) {
 	examples := map[string]GitCommand{
 		"git-upload-pack 'hello.git'":        GitCommand{"git-upload-pack", "hello.git", "git-upload-pack 'hello.git'"},
-		"git upload-pack 'hello.git'":        GitCommand{"git upload-pack", "hello.git", "git upload-pack 'hello.git'"},
+		"git upload-pack 'hello.git'":        GitCommand{"git-upload-pack", "hello.git", "git upload-pack 'hello.git'"},
 		"git-upload-pack '/hello.git'":       GitCommand{"git-upload-pack", "hello.git", "git-upload-pack 'hello.git'"},
 		"git-upload-pack '/hello/world.git'": GitCommand{"git-upload-pack", "hello/world.git", "git-upload-pack 'hello.git'"},
 		"git-receive-pack 'hello.git'":       GitCommand{"git-receive-pack", "hello.git", "git-receive-pack 'hello.git'"},
-		"git receive-pack 'hello.git'":       GitCommand{"git receive-pack", "hello.git", "git receive-pack 'hello.git'"},
+		"git receive-pack 'hello.git'":       GitCommand{"git-receive-pack", "hello.git", "git receive-pack 'hello.git'"},
 		"git-upload-archive 'hello.git'":     GitCommand{"git-upload-archive", "hello.git", "git-upload-archive 'hello.git'"},
-		"git upload-archive 'hello.git'":     GitCommand{"git upload-archive", "hello.git", "git upload-archive 'hello.git'"},
+		"git upload-archive 'hello.git'":     GitCommand{"git-upload-archive", "hello.git", "git upload-archive 'hello.git'"},
+		"git\tupload-pack 'hello.git'":       GitCommand{"git-upload-pack", "hello.git", "git\tupload-pack 'hello.git'"},
+		"git-upload-pack 'team/app.git'":     GitCommand{"git-upload-pack", "team/app.git", "git-upload-pack 'team/app.git'"},
+		"git-upload-pack '//app.git'":        GitCommand{"git-upload-pack", "app.git", "git-upload-pack '//app.git'"},
+		"git-upload-pack '/my repo.git'":     GitCommand{"git-upload-pack", "my repo.git", "git-upload-pack '/my repo.git'"},
+		`git-upload-pack 'it'\''s.git'`:      GitCommand{"git-upload-pack", "it's.git", `git-upload-pack 'it'\''s.git'`},
+		`git-upload-pack 'wow'\!'.git'`:      GitCommand{"git-upload-pack", "wow!.git", `git-upload-pack 'wow'\!'.git'`},
+		`git-upload-pack ''\'''`:             GitCommand{"git-upload-pack", "'", `git-upload-pack ''\'''`},
 	}
 
 	for s, expected := range examples {
@@ -26,7 +33,33 @@ func TestParseGitCommand(t *testing.T) {
 		assert.Equal(t, expected.Repo, cmd.Repo)
 	}
 
-	cmd, err := ParseGitCommand("git do-stuff")
-	assert.Error(t, err)
-	assert.Nil(t, cmd)
+	for _, s := range []string{
+		"git do-stuff",
+		"git do-stuff 'hello.git'",
+		"git|upload-pack 'hello.git'",
+		"sh -c 'git-upload-pack hello.git'",
+		"git-upload-pack ''",
+		"git-upload-pack '--help'",
+		"git-upload-pack '/--upload-pack=touch /tmp/pwned'",
+		"git-upload-pack 'hello.git\x00'",
+		"git-upload-pack",
+		"git-upload-pack hello.git",
+		"git-upload-pack  'hello.git'",
+		`git-upload-pack "hello.git"`,
+		"git-upload-pack 'hello.git",
+		"git-upload-pack 'hello.git' 'other.git'",
+		"git-upload-pack 'hello'.git",
+		"git-upload-pack --strict 'hello.git'",
+		`git-upload-pack 'it'\''`,
+		`git-upload-pack 'it'\x'.git'`,
+		`git-upload-pack '-'\''x'`,
+		"gitupload-pack 'hello.git'",
+		"git-upload-packs 'hello.git'",
+		"git-upload-pack\t'hello.git'",
+		" git-upload-pack 'hello.git'",
+	} {
+		cmd, err := ParseGitCommand(s)
+		assert.Error(t, err, s)
+		assert.Nil(t, cmd, s)
+	}
 }
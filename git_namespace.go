@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validGitNamespace reports whether ns can be used as a git namespace: one
+// or more names separated by slashes, each usable as part of a ref.
+func validGitNamespace(ns string) bool {
+	if ns == "" {
+		return false
+	}
+	for _, part := range strings.Split(ns, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") ||
+			strings.Contains(part, "..") || strings.Contains(part, "@{") {
+			return false
+		}
+		for _, c := range part {
+			if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkGitNamespace returns an error for a git namespace an authorizer set
+// that git can't use.
+func checkGitNamespace(ns string) error {
+	if ns != "" && !validGitNamespace(ns) {
+		return fmt.Errorf("invalid git namespace %q", ns)
+	}
+	return nil
+}
+
+// rejectNamespaced answers r with 404 if it is served from a git namespace.
+// Only upload-pack and receive-pack keep to the refs of a namespace, so
+// archives, raw files, bundles, dumb HTTP and the refs API can't be served
+// from one.
+func rejectNamespaced(w http.ResponseWriter, r *Request) bool {
+	if r.GitNamespace == "" {
+		return false
+	}
+	http.Error(w, "Not Found", http.StatusNotFound)
+	return true
+}
@@ -0,0 +1,96 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidGitNamespace(t *testing.T) {
+	for _, ns := range []string{"forks", "pr-42", "users/alice", "a.b"} {
+		assert.True(t, validGitNamespace(ns), ns)
+	}
+	for _, ns := range []string{"", "/", "users/", "/users", "a//b", ".hidden", "a..b", "a.lock", "a b", "a:b", "a~1", "a^", "a?", "a*", "a[", `a\b`, "a@{1}", "a\x00", "a\n"} {
+		assert.False(t, validGitNamespace(ns), ns)
+	}
+}
+
+func TestServerGitNamespace(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	// Every user gets their own refs in the repository.
+	for _, backend := range []bool{false, true} {
+		server := New(Config{Dir: repos, Auth: true})
+		server.HTTPBackend = backend
+		server.RawFiles = true
+		server.RepoAPI = true
+		server.AuthFunc = func(Credential, *Request) (bool, error) { return true, nil }
+		server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+			req.GitNamespace = "users/" + req.User
+			return nil
+		})
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+		remote := func(user string) string {
+			u, _ := url.Parse(srv.URL + "/app.git")
+			u.User = url.UserPassword(user, "secret")
+			return u.String()
+		}
+
+		for _, user := range []string{"alice", "bob"} {
+			work := filepath.Join(dir, "work-"+user)
+			os.RemoveAll(work)
+			_, err := git("init", work)
+			assert.NoError(t, err)
+			_, err = git("-C", work, "commit", "--allow-empty", "-m", user)
+			assert.NoError(t, err)
+			out, err := git("-C", work, "push", remote(user), "+HEAD:refs/heads/"+user)
+			assert.NoError(t, err, out)
+		}
+		for _, user := range []string{"alice", "bob"} {
+			out, err := git("ls-remote", remote(user))
+			assert.NoError(t, err, out)
+			assert.Contains(t, out, "refs/heads/"+user)
+			assert.NotContains(t, out, "refs/namespaces")
+			assert.Equal(t, 1, strings.Count(out, "refs/heads/"), out)
+		}
+		out, err := git("--git-dir", repo, "for-each-ref", "--format=%(refname)")
+		assert.NoError(t, err)
+		assert.Equal(t, "refs/namespaces/users/refs/namespaces/alice/refs/heads/alice\nrefs/namespaces/users/refs/namespaces/bob/refs/heads/bob", out)
+
+		// Raw files would look at the refs of the whole repository.
+		req, _ := http.NewRequest("GET", srv.URL+"/app.git/raw/alice/README", nil)
+		req.SetBasicAuth("bob", "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		// So would the refs API.
+		req, _ = http.NewRequest("GET", srv.URL+"/api/repos/app.git/refs", nil)
+		req.SetBasicAuth("bob", "secret")
+		res, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	}
+}
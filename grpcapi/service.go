@@ -0,0 +1,392 @@
+// Package grpcapi serves the management API of gitkit over gRPC, for
+// platforms whose control planes speak gRPC. It offers what the admin
+// package serves over HTTP, and streams the events of the git servers.
+//
+// The package is a module of its own, so applications not using gRPC don't
+// depend on it.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative management.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/fluxcd/gitkit/keystore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventBuffer is the number of events buffered per watcher. Events for
+// watchers that fall further behind are dropped, so slow clients don't hold
+// up git requests.
+const eventBuffer = 256
+
+// Service implements the Management service. Requests must carry one of
+// the tokens as a bearer token in the authorization metadata. Methods whose
+// backend is not set fail with codes.Unimplemented.
+type Service struct {
+	UnimplementedManagementServer
+
+	// Tokens are the tokens accepted.
+	Tokens []string
+	// Keys stores the keys of the SSH server.
+	Keys keystore.Store
+	// HTTP manages the repositories and is asked for its sessions.
+	HTTP *gitkit.Server
+	// SSH is asked for its sessions. Deleted keys are revoked on it.
+	SSH *gitkit.SSH
+
+	mu       sync.Mutex
+	watchers map[chan *Event]struct{}
+}
+
+// NewService returns a service accepting tokens.
+func NewService(tokens ...string) *Service {
+	return &Service{Tokens: tokens}
+}
+
+// Register registers the service with g and subscribes to the events of
+// the HTTP and SSH servers, keeping their OnRepoEvent and OnSession
+// callbacks. It must be called before the servers serve requests.
+func (s *Service) Register(g *grpc.Server) {
+	RegisterManagementServer(g, s)
+
+	if s.HTTP != nil {
+		onRepoEvent, onSession := s.HTTP.OnRepoEvent, s.HTTP.OnSession
+		s.HTTP.OnRepoEvent = func(event gitkit.RepoEvent) {
+			if onRepoEvent != nil {
+				onRepoEvent(event)
+			}
+			s.publish(repoEvent(event))
+		}
+		s.HTTP.OnSession = func(event gitkit.SessionEvent) {
+			if onSession != nil {
+				onSession(event)
+			}
+			s.publish(sessionEvent(event))
+		}
+	}
+	if s.SSH != nil {
+		onSession := s.SSH.OnSession
+		s.SSH.OnSession = func(event gitkit.SessionEvent) {
+			if onSession != nil {
+				onSession(event)
+			}
+			s.publish(sessionEvent(event))
+		}
+	}
+}
+
+// authorize checks the token of a request.
+func (s *Service) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			continue
+		}
+		token := []byte(strings.TrimSpace(auth[7:]))
+		for _, t := range s.Tokens {
+			if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				return nil
+			}
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+func (s *Service) repos(ctx context.Context) error {
+	if err := s.authorize(ctx); err != nil {
+		return err
+	}
+	if s.HTTP == nil {
+		return status.Error(codes.Unimplemented, "no repository server configured")
+	}
+	return nil
+}
+
+func (s *Service) keys(ctx context.Context) error {
+	if err := s.authorize(ctx); err != nil {
+		return err
+	}
+	if s.Keys == nil {
+		return status.Error(codes.Unimplemented, "no key store configured")
+	}
+	return nil
+}
+
+// ListRepositories implements ManagementServer.
+func (s *Service) ListRepositories(ctx context.Context, _ *ListRepositoriesRequest) (*ListRepositoriesResponse, error) {
+	if err := s.repos(ctx); err != nil {
+		return nil, err
+	}
+	repos, err := s.HTTP.Repos()
+	if err != nil {
+		return nil, internal(err)
+	}
+	res := &ListRepositoriesResponse{}
+	for _, repo := range repos {
+		res.Repositories = append(res.Repositories, &Repository{Name: repo})
+	}
+	return res, nil
+}
+
+// CreateRepository implements ManagementServer.
+func (s *Service) CreateRepository(ctx context.Context, req *CreateRepositoryRequest) (*Repository, error) {
+	if err := s.repos(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.HTTP.CreateRepo(req.Name); err != nil {
+		return nil, repoError(err)
+	}
+	return &Repository{Name: req.Name}, nil
+}
+
+// RenameRepository implements ManagementServer.
+func (s *Service) RenameRepository(ctx context.Context, req *RenameRepositoryRequest) (*Repository, error) {
+	if err := s.repos(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.HTTP.RenameRepo(req.Name, req.NewName); err != nil {
+		return nil, repoError(err)
+	}
+	return &Repository{Name: req.NewName}, nil
+}
+
+// DeleteRepository implements ManagementServer.
+func (s *Service) DeleteRepository(ctx context.Context, req *DeleteRepositoryRequest) (*DeleteRepositoryResponse, error) {
+	if err := s.repos(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.HTTP.DeleteRepo(req.Name); err != nil {
+		return nil, repoError(err)
+	}
+	return &DeleteRepositoryResponse{}, nil
+}
+
+// ListKeys implements ManagementServer.
+func (s *Service) ListKeys(ctx context.Context, req *ListKeysRequest) (*ListKeysResponse, error) {
+	if err := s.keys(ctx); err != nil {
+		return nil, err
+	}
+	if req.Owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "owner is required")
+	}
+	keys, err := s.Keys.List(ctx, req.Owner)
+	if err != nil {
+		return nil, internal(err)
+	}
+	res := &ListKeysResponse{}
+	for _, key := range keys {
+		res.Keys = append(res.Keys, newKey(key))
+	}
+	return res, nil
+}
+
+// GetKey implements ManagementServer.
+func (s *Service) GetKey(ctx context.Context, req *GetKeyRequest) (*Key, error) {
+	if err := s.keys(ctx); err != nil {
+		return nil, err
+	}
+	key, err := s.Keys.Get(ctx, req.Id)
+	if err != nil {
+		return nil, keyError(err)
+	}
+	return newKey(key), nil
+}
+
+// AddKey implements ManagementServer.
+func (s *Service) AddKey(ctx context.Context, req *AddKeyRequest) (*Key, error) {
+	if err := s.keys(ctx); err != nil {
+		return nil, err
+	}
+	if req.Owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "owner is required")
+	}
+	key, err := keystore.Register(ctx, s.Keys, s.SSH, req.Owner, req.Name, req.Key)
+	if err != nil {
+		return nil, keyError(err)
+	}
+	return newKey(key), nil
+}
+
+// UpdateKey implements ManagementServer.
+func (s *Service) UpdateKey(ctx context.Context, req *UpdateKeyRequest) (*Key, error) {
+	if err := s.keys(ctx); err != nil {
+		return nil, err
+	}
+	key, err := keystore.Update(ctx, s.Keys, req.Id, req.Owner, req.Name)
+	if err != nil {
+		return nil, keyError(err)
+	}
+	return newKey(key), nil
+}
+
+// DeleteKey implements ManagementServer.
+func (s *Service) DeleteKey(ctx context.Context, req *DeleteKeyRequest) (*DeleteKeyResponse, error) {
+	if err := s.keys(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := keystore.Unregister(ctx, s.Keys, s.SSH, req.Id); err != nil {
+		return nil, keyError(err)
+	}
+	return &DeleteKeyResponse{}, nil
+}
+
+// ListSessions implements ManagementServer.
+func (s *Service) ListSessions(ctx context.Context, _ *ListSessionsRequest) (*ListSessionsResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	var sessions []gitkit.Session
+	if s.SSH != nil {
+		sessions = append(sessions, s.SSH.Sessions()...)
+	}
+	if s.HTTP != nil {
+		sessions = append(sessions, s.HTTP.Sessions()...)
+	}
+	res := &ListSessionsResponse{}
+	for _, session := range sessions {
+		res.Sessions = append(res.Sessions, newSession(session))
+	}
+	return res, nil
+}
+
+// WatchEvents implements ManagementServer.
+func (s *Service) WatchEvents(_ *WatchEventsRequest, stream Management_WatchEventsServer) error {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+
+	events := make(chan *Event, eventBuffer)
+	s.mu.Lock()
+	if s.watchers == nil {
+		s.watchers = make(map[chan *Event]struct{})
+	}
+	s.watchers[events] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, events)
+		s.mu.Unlock()
+	}()
+
+	// Tell the client it is subscribed, so it knows it won't miss any
+	// events from now on.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publish sends event to all watchers.
+func (s *Service) publish(event *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for watcher := range s.watchers {
+		select {
+		case watcher <- event:
+		default:
+			log.Printf("grpcapi: dropping event for slow watcher")
+		}
+	}
+}
+
+var repoEventTypes = map[string]RepositoryEvent_Type{
+	gitkit.RepoCreated: RepositoryEvent_CREATED,
+	gitkit.RepoDeleted: RepositoryEvent_DELETED,
+	gitkit.RepoRenamed: RepositoryEvent_RENAMED,
+}
+
+func repoEvent(event gitkit.RepoEvent) *Event {
+	e := &RepositoryEvent{Type: repoEventTypes[event.Type], Repo: event.Repo, OldRepo: event.OldRepo}
+	if event.Principal != nil {
+		e.Principal = event.Principal.ID
+	}
+	return &Event{Time: timestamppb.New(event.Time), Event: &Event_Repository{Repository: e}}
+}
+
+var sessionEventTypes = map[string]SessionEvent_Type{
+	gitkit.SessionStarted: SessionEvent_STARTED,
+	gitkit.SessionEnded:   SessionEvent_ENDED,
+}
+
+func sessionEvent(event gitkit.SessionEvent) *Event {
+	return &Event{
+		Time: timestamppb.New(event.Time),
+		Event: &Event_Session{Session: &SessionEvent{
+			Type:    sessionEventTypes[event.Type],
+			Session: newSession(event.Session),
+		}},
+	}
+}
+
+func newSession(session gitkit.Session) *Session {
+	return &Session{
+		Id:         session.ID,
+		Protocol:   session.Protocol,
+		Principal:  session.Principal,
+		User:       session.User,
+		RemoteAddr: session.RemoteAddr,
+		Repo:       session.Repo,
+		Command:    session.Command,
+		Started:    timestamppb.New(session.Started),
+	}
+}
+
+func newKey(key *keystore.Key) *Key {
+	return &Key{
+		Id:          key.ID,
+		Owner:       key.Owner,
+		Name:        key.Name,
+		Fingerprint: key.Fingerprint,
+		Key:         key.Content,
+		CreatedAt:   timestamppb.New(key.CreatedAt),
+	}
+}
+
+func repoError(err error) error {
+	switch err {
+	case gitkit.ErrInvalidRepoName:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case gitkit.ErrRepoNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case gitkit.ErrRepoExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return internal(err)
+}
+
+func keyError(err error) error {
+	switch {
+	case errors.Is(err, keystore.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, keystore.ErrInvalidKey):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, keystore.ErrKeyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return internal(err)
+}
+
+func internal(err error) error {
+	log.Printf("grpcapi: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
@@ -0,0 +1,222 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/fluxcd/gitkit/keystore"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestService(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	server := gitkit.New(gitkit.Config{Dir: t.TempDir()})
+	svc := NewService("admin-secret")
+	svc.HTTP = server
+	g := grpc.NewServer()
+	svc.Register(g)
+	lis := bufconn.Listen(1 << 20)
+	go g.Serve(lis)
+	defer g.Stop()
+	gitSrv := httptest.NewServer(server)
+	defer gitSrv.Close()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := NewManagementClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = client.ListRepositories(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong"), &ListRepositoriesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListKeys(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin-secret"), &ListKeysRequest{Owner: "alice"})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin-secret")
+	events, err := client.WatchEvents(ctx, &WatchEventsRequest{})
+	assert.NoError(t, err)
+	_, err = events.Header()
+	assert.NoError(t, err)
+
+	// Repositories
+	_, err = client.CreateRepository(ctx, &CreateRepositoryRequest{Name: "org/app.git"})
+	assert.NoError(t, err)
+	_, err = client.CreateRepository(ctx, &CreateRepositoryRequest{Name: "org/app.git"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateRepository(ctx, &CreateRepositoryRequest{Name: "../app.git"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.RenameRepository(ctx, &RenameRepositoryRequest{Name: "org/app.git", NewName: "org/new.git"})
+	assert.NoError(t, err)
+	repos, err := client.ListRepositories(ctx, &ListRepositoriesRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, repos.Repositories, 1) {
+		assert.Equal(t, "org/new.git", repos.Repositories[0].Name)
+	}
+
+	// Sessions
+	res, err := http.Get(gitSrv.URL + "/org/new.git/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	_, err = client.DeleteRepository(ctx, &DeleteRepositoryRequest{Name: "org/new.git"})
+	assert.NoError(t, err)
+	_, err = client.DeleteRepository(ctx, &DeleteRepositoryRequest{Name: "org/new.git"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	var got []string
+	for len(got) < 5 {
+		event, err := events.Recv()
+		if !assert.NoError(t, err) {
+			break
+		}
+		switch e := event.Event.(type) {
+		case *Event_Repository:
+			got = append(got, e.Repository.Type.String()+" "+e.Repository.Repo)
+		case *Event_Session:
+			got = append(got, e.Session.Type.String()+" "+e.Session.Session.Command)
+		}
+	}
+	// The session may end after the response was read.
+	assert.ElementsMatch(t, []string{
+		"CREATED org/app.git",
+		"RENAMED org/new.git",
+		"STARTED git-upload-pack",
+		"ENDED git-upload-pack",
+		"DELETED org/new.git",
+	}, got)
+}
+
+// memStore is a keystore.Store in memory.
+type memStore struct {
+	mu   sync.Mutex
+	keys map[string]*keystore.Key
+}
+
+func (s *memStore) Add(_ context.Context, key *keystore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key.ID = fmt.Sprintf("key-%d", len(s.keys)+1)
+	key.CreatedAt = time.Now()
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memStore) Get(_ context.Context, id string) (*keystore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+	return nil, keystore.ErrNotFound
+}
+
+func (s *memStore) GetByFingerprint(_ context.Context, fingerprint string) (*keystore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		if key.Fingerprint == fingerprint {
+			return key, nil
+		}
+	}
+	return nil, keystore.ErrNotFound
+}
+
+func (s *memStore) List(_ context.Context, owner string) ([]*keystore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*keystore.Key
+	for _, key := range s.keys {
+		if key.Owner == owner {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memStore) Update(_ context.Context, key *keystore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.ID]; !ok {
+		return keystore.ErrNotFound
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+	return nil
+}
+
+func TestServiceKeys(t *testing.T) {
+	svc := NewService("admin-secret")
+	svc.Keys = &memStore{keys: map[string]*keystore.Key{}}
+	g := grpc.NewServer()
+	svc.Register(g)
+	lis := bufconn.Listen(1 << 20)
+	go g.Serve(lis)
+	defer g.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := NewManagementClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin-secret")
+
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(pub)
+	authorizedKey := gitkit.AuthorizedKeyString(sshPub) + " alice@laptop"
+	key, err := client.AddKey(ctx, &AddKeyRequest{Owner: "alice", Key: authorizedKey})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@laptop", key.Name)
+	_, err = client.AddKey(ctx, &AddKeyRequest{Owner: "bob", Key: authorizedKey})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.AddKey(ctx, &AddKeyRequest{Owner: "bob", Key: "garbage"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	updated, err := client.UpdateKey(ctx, &UpdateKeyRequest{Id: key.Id, Owner: "bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", updated.Owner)
+	assert.Equal(t, "alice@laptop", updated.Name)
+	assert.Equal(t, key.Fingerprint, updated.Fingerprint)
+	_, err = client.UpdateKey(ctx, &UpdateKeyRequest{Id: "missing", Name: "laptop"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	keys, err := client.ListKeys(ctx, &ListKeysRequest{Owner: "bob"})
+	assert.NoError(t, err)
+	assert.Len(t, keys.Keys, 1)
+
+	_, err = client.DeleteKey(ctx, &DeleteKeyRequest{Id: key.Id})
+	assert.NoError(t, err)
+	_, err = client.GetKey(ctx, &GetKeyRequest{Id: key.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
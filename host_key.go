@@ -0,0 +1,233 @@
+package gitkit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Host key types supported by Config.KeyType.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeECDSA   = "ecdsa"
+)
+
+// defaultRSAKeyBits is the size of generated RSA host keys unless
+// Config.KeyBits says otherwise.
+const defaultRSAKeyBits = 2048
+
+// generateHostKey creates a new private key of the given type and returns it
+// along with its PEM encoding.
+func generateHostKey(keyType string, bits int) (crypto.Signer, *pem.Block, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		if bits == 0 {
+			bits = defaultRSAKeyBits
+		}
+		if bits < defaultRSAKeyBits {
+			return nil, nil, fmt.Errorf("rsa key size must be at least %d bits, got %d", defaultRSAKeyBits, bits)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case KeyTypeECDSA:
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("ecdsa key size must be 256, 384 or 521 bits, got %d", bits)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported host key type %q", keyType)
+	}
+}
+
+func (c *Config) createServerKey() error {
+	if err := os.MkdirAll(c.KeyDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	privateKey, privateKeyPEM, err := generateHostKey(c.keyType(), c.KeyBits)
+	if err != nil {
+		return err
+	}
+
+	privateKeyFile, err := os.Create(c.KeyPath())
+	if err != nil {
+		return err
+	}
+	defer privateKeyFile.Close()
+
+	if err := os.Chmod(c.KeyPath(), 0600); err != nil {
+		return err
+	}
+	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
+		return err
+	}
+
+	pubKeyPath := c.KeyPath() + ".pub"
+	pub, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
+}
+
+// loadHostKeys parses every private key in dir, so that a server can
+// advertise several host key algorithms at once. Public keys (*.pub) are
+// skipped, as are files that do not contain a private key. If a host
+// certificate is found next to a key, following the OpenSSH naming of
+// <key>-cert.pub, it is advertised in addition to the plain key.
+func loadHostKeys(dir string) ([]ssh.Signer, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.Signer
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".pub") {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		privateBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ssh.ParsePrivateKey(privateBytes)
+		if err != nil {
+			logError("host-key", fmt.Errorf("skipping %s: %v", path, err))
+			continue
+		}
+		keys = append(keys, key)
+
+		certPath := path + "-cert.pub"
+		if !fileExists(certPath) {
+			continue
+		}
+		certSigner, err := loadHostCertificate(certPath, key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, certSigner)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys found in %s", dir)
+	}
+	return keys, nil
+}
+
+// loadHostCertificate parses the OpenSSH host certificate at path and
+// returns a signer presenting it for key.
+func loadHostCertificate(path string, key ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing host certificate %s: %v", path, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", path)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return signer, nil
+}
+
+// ReloadHostKeys re-reads the host keys from KeyDir and uses them for all new
+// connections, so keys can be rotated without restarting the server.
+// Established connections keep using the keys they were set up with. Host
+// keys added directly to a config passed to SetSSHConfig are not carried
+// over; use AddHostKey for keys that should survive a reload.
+func (s *SSH) ReloadHostKeys() error {
+	current := s.serverConfig()
+	if current == nil {
+		return fmt.Errorf("cannot reload host keys before Listen()")
+	}
+
+	hostKeys, err := loadHostKeys(s.config().KeyDir)
+	if err != nil {
+		return err
+	}
+
+	config := cloneServerConfig(current)
+	for _, key := range append(hostKeys, s.hostKeys...) {
+		config.AddHostKey(key)
+	}
+
+	s.mu.Lock()
+	s.sshConfig = config
+	s.mu.Unlock()
+	return nil
+}
+
+// cloneServerConfig returns a copy of c without any host keys. The host keys
+// of c cannot be copied since ssh.ServerConfig.AddHostKey replaces keys in
+// place, which would leak into connections still using c.
+func cloneServerConfig(c *ssh.ServerConfig) *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		Config:                      c.Config,
+		NoClientAuth:                c.NoClientAuth,
+		MaxAuthTries:                c.MaxAuthTries,
+		PasswordCallback:            c.PasswordCallback,
+		PublicKeyCallback:           c.PublicKeyCallback,
+		KeyboardInteractiveCallback: c.KeyboardInteractiveCallback,
+		AuthLogCallback:             c.AuthLogCallback,
+		ServerVersion:               c.ServerVersion,
+		BannerCallback:              c.BannerCallback,
+		GSSAPIWithMICConfig:         c.GSSAPIWithMICConfig,
+	}
+}
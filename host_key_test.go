@@ -0,0 +1,206 @@
+package gitkit
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_createServerKey(t *testing.T) {
+	examples := map[string]struct {
+		config   Config
+		keyFile  string
+		expected string
+	}{
+		"default":   {Config{}, "gitkit.rsa", ssh.KeyAlgoRSA},
+		"rsa":       {Config{KeyType: KeyTypeRSA, KeyBits: 3072}, "gitkit.rsa", ssh.KeyAlgoRSA},
+		"ed25519":   {Config{KeyType: KeyTypeEd25519}, "gitkit.ed25519", ssh.KeyAlgoED25519},
+		"ecdsa":     {Config{KeyType: KeyTypeECDSA}, "gitkit.ecdsa", ssh.KeyAlgoECDSA256},
+		"ecdsa-384": {Config{KeyType: KeyTypeECDSA, KeyBits: 384}, "gitkit.ecdsa", ssh.KeyAlgoECDSA384},
+		"ecdsa-521": {Config{KeyType: KeyTypeECDSA, KeyBits: 521}, "gitkit.ecdsa", ssh.KeyAlgoECDSA521},
+	}
+
+	for name, example := range examples {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "key-dir")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			example.config.KeyDir = dir
+			s := NewSSH(example.config)
+			assert.NoError(t, s.gitConfig.createServerKey())
+			assert.Equal(t, filepath.Join(dir, example.keyFile), s.gitConfig.KeyPath())
+
+			privateBytes, err := ioutil.ReadFile(s.gitConfig.KeyPath())
+			assert.NoError(t, err)
+			signer, err := ssh.ParsePrivateKey(privateBytes)
+			assert.NoError(t, err)
+			assert.Equal(t, example.expected, signer.PublicKey().Type())
+
+			pubBytes, err := ioutil.ReadFile(s.gitConfig.KeyPath() + ".pub")
+			assert.NoError(t, err)
+			pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+			assert.NoError(t, err)
+			assert.Equal(t, signer.PublicKey().Marshal(), pub.Marshal())
+		})
+	}
+
+	for name, config := range map[string]Config{
+		"unknown type":  {KeyType: "dsa"},
+		"weak rsa size": {KeyType: KeyTypeRSA, KeyBits: 1024},
+		"ecdsa curve":   {KeyType: KeyTypeECDSA, KeyBits: 2048},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "key-dir")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			config.KeyDir = dir
+			assert.Error(t, config.createServerKey())
+		})
+	}
+}
+
+func Test_loadHostKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "key-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = loadHostKeys(dir)
+	assert.Error(t, err)
+
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeEd25519, KeyTypeECDSA} {
+		config := Config{KeyDir: dir, KeyType: keyType}
+		assert.NoError(t, config.createServerKey())
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0644))
+
+	keys, err := loadHostKeys(dir)
+	assert.NoError(t, err)
+
+	var types []string
+	for _, key := range keys {
+		types = append(types, key.PublicKey().Type())
+	}
+	assert.ElementsMatch(t, []string{ssh.KeyAlgoRSA, ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256}, types)
+
+	// All of them are advertised to clients.
+	s := NewSSH(Config{KeyDir: dir, Dir: filepath.Join(dir, "repos")})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	defer s.Stop()
+	go s.Serve()
+
+	for _, algo := range []string{ssh.KeyAlgoRSA, ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256} {
+		var offered string
+		client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			HostKeyAlgorithms: []string{algo},
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				offered = key.Type()
+				return nil
+			},
+		})
+		assert.NoError(t, err)
+		client.Close()
+		assert.Equal(t, algo, offered)
+	}
+}
+
+func TestReloadHostKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "key-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewSSH(Config{KeyDir: dir, Dir: filepath.Join(dir, "repos")})
+	assert.Error(t, s.ReloadHostKeys())
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	defer s.Stop()
+	go s.Serve()
+
+	dial := func() (*ssh.Client, string) {
+		var fingerprint string
+		client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				fingerprint = KeyFingerprint(key)
+				return nil
+			},
+		})
+		assert.NoError(t, err)
+		return client, fingerprint
+	}
+
+	established, before := dial()
+	defer established.Close()
+
+	// Rotate the key on disk.
+	assert.NoError(t, os.Remove(s.gitConfig.KeyPath()))
+	assert.NoError(t, s.gitConfig.createServerKey())
+	assert.NoError(t, s.ReloadHostKeys())
+
+	client, after := dial()
+	client.Close()
+	assert.NotEqual(t, before, after)
+
+	// The established connection is still usable.
+	session, err := established.NewSession()
+	assert.NoError(t, err)
+	session.Close()
+}
+
+func TestHostCertificate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "key-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewSSH(Config{KeyDir: dir, KeyType: KeyTypeEd25519, Dir: filepath.Join(dir, "repos")})
+	assert.NoError(t, s.gitConfig.createServerKey())
+
+	caKey, _, err := generateHostKey(KeyTypeEd25519, 0)
+	assert.NoError(t, err)
+	ca, err := ssh.NewSignerFromSigner(caKey)
+	assert.NoError(t, err)
+
+	pubBytes, err := ioutil.ReadFile(s.gitConfig.KeyPath() + ".pub")
+	assert.NoError(t, err)
+	hostPub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+	assert.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:             hostPub,
+		CertType:        ssh.HostCert,
+		KeyId:           "gitkit",
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	certPath := s.gitConfig.KeyPath() + "-cert.pub"
+	assert.NoError(t, ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644))
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	defer s.Stop()
+	go s.Serve()
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		HostKeyAlgorithms: []string{ssh.CertAlgoED25519v01},
+		HostKeyCallback:   checker.CheckHostKey,
+	})
+	assert.NoError(t, err)
+	client.Close()
+
+	// User certificates are not accepted as host certificates.
+	cert.CertType = ssh.UserCert
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	assert.NoError(t, ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644))
+	_, err = loadHostKeys(dir)
+	assert.Error(t, err)
+}
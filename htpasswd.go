@@ -0,0 +1,219 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd checks passwords against an htpasswd file as written by Apache's
+// htpasswd tool. Its Authenticate method can be used as Server.BasicAuth.
+//
+// bcrypt ("htpasswd -B"), Apache MD5 ("$apr1$", the default of htpasswd)
+// and SHA-1 ("{SHA}") hashes are supported. Lines using other hashes, such
+// as crypt(3) or plain text, fail loading the file.
+type Htpasswd struct {
+	path string
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+}
+
+// NewHtpasswd loads the htpasswd file at path.
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the file again. On error the previously loaded users are
+// kept.
+func (h *Htpasswd) Reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(h.path, data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+// Watch polls the file for changes every interval and reloads it when it is
+// modified, until ctx is cancelled. Failed reloads are logged and leave the
+// previously loaded users in place.
+func (h *Htpasswd) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !h.changed() {
+				continue
+			}
+			if err := h.Reload(); err != nil {
+				log.Printf("htpasswd: reload failed: %v", err)
+			}
+		}
+	}
+}
+
+func (h *Htpasswd) changed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	info, err := os.Stat(h.path)
+	return err != nil || !info.ModTime().Equal(h.modTime)
+}
+
+// Check reports whether password is the password of username.
+func (h *Htpasswd) Check(username, password string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[username]
+	h.mu.RUnlock()
+
+	if !ok {
+		return false
+	}
+	return checkHtpasswdHash(hash, password)
+}
+
+// Authenticate checks the credentials of a request, see Server.BasicAuth.
+// The principal is identified by the username.
+func (h *Htpasswd) Authenticate(username, password string, _ *Request) (*Principal, error) {
+	if !h.Check(username, password) {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	return &Principal{ID: username, Name: username}, nil
+}
+
+func parseHtpasswd(path string, data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, i+1)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for user %s", path, i+1, user)
+		}
+		users[user] = hash
+	}
+	return users, nil
+}
+
+func checkHtpasswdHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	}
+	return false
+}
+
+// apr1 returns Apache's variant of the MD5 based crypt(3) hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	mixin := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		d.Write(mixin[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	// Stretching, as specified by the original implementation.
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return out.String()
+}
@@ -0,0 +1,63 @@
+package gitkit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_apr1(t *testing.T) {
+	// Generated with openssl passwd -apr1.
+	assert.Equal(t, "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", apr1("secret", "saltsalt"))
+	assert.Equal(t, "$apr1$ab$fGW6NJ7kMZj/0UCz7DMr/.", apr1("pässword", "ab"))
+	assert.Equal(t, "$apr1$12345678$sHuPAw7VA9xjRbJz7zKV7/", apr1("", "12345678"))
+}
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(content string, mtime time.Time) {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		assert.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	now := time.Now()
+	write("# users\n"+
+		"alice:"+string(bcryptHash)+"\n"+
+		"bob:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n"+
+		"carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", now.Add(-time.Hour))
+
+	h, err := NewHtpasswd(path)
+	assert.NoError(t, err)
+	assert.True(t, h.Check("alice", "bcrypt-secret"))
+	assert.False(t, h.Check("alice", "secret"))
+	assert.True(t, h.Check("bob", "secret"))
+	assert.False(t, h.Check("bob", "Secret"))
+	assert.True(t, h.Check("carol", "secret"))
+	assert.False(t, h.Check("dave", "secret"))
+
+	p, err := h.Authenticate("bob", "secret", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{ID: "bob", Name: "bob"}, p)
+	_, err = h.Authenticate("bob", "wrong", nil)
+	assert.Error(t, err)
+
+	// Unsupported hashes fail loading and keep the previous users.
+	write("bob:plaintext\n", now)
+	assert.EqualError(t, h.Reload(), path+":1: unsupported hash for user bob")
+	assert.True(t, h.Check("bob", "secret"))
+	_, err = NewHtpasswd(path)
+	assert.Error(t, err)
+
+	write("dave:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n", now.Add(time.Minute))
+	assert.True(t, h.changed())
+	assert.NoError(t, h.Reload())
+	assert.False(t, h.changed())
+	assert.True(t, h.Check("dave", "secret"))
+	assert.False(t, h.Check("bob", "secret"))
+}
@@ -1,14 +1,19 @@
 package gitkit
 
 import (
-	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 type service struct {
@@ -19,15 +24,209 @@ type service struct {
 }
 
 type Server struct {
-	config   Config
-	services []service
-	AuthFunc func(Credential, *Request) (bool, error)
+	config     Config
+	services   []service
+	procs      processRegistry
+	sessions   sessionRegistry
+	middleware []Middleware
+	bans       banList
+	mu         sync.Mutex
+	srv        *http.Server
+	lfsUploads map[string]bool
+	packFills  map[string]chan struct{}
+	AuthFunc   func(Credential, *Request) (bool, error)
+	// BasicAuth, if set instead of AuthFunc, checks the basic auth
+	// credentials of a request and returns the principal they belong to.
+	// Returning an error rejects the request.
+	BasicAuth func(username, password string, req *Request) (*Principal, error)
+	// MaxAuthFailures, if greater than zero, locks out client IPs failing
+	// authentication this many times within AuthFailureWindow, and
+	// MaxUserAuthFailures usernames, whichever is reached first. Locked
+	// out clients get 429 without their credentials being checked. Note
+	// that anyone can lock out a username by guessing its password.
+	MaxAuthFailures     int
+	MaxUserAuthFailures int
+	// AuthFailureWindow is the period over which failures are counted,
+	// 10 minutes if zero.
+	AuthFailureWindow time.Duration
+	// BanDuration is how long the lockout lasts, 15 minutes if zero.
+	BanDuration time.Duration
+	// DumbHTTP, if true, also serves the dumb HTTP protocol for fetching,
+	// for clients that can't use the smart protocol. info/refs and
+	// objects/info/packs are updated on every request for them.
+	DumbHTTP bool
+	// Archives, if true, serves downloads of the tree at a ref as
+	// /{repo}/archive/{ref}.tar.gz, .tgz, .tar or .zip. They are authorized
+	// as OperationRead of git-upload-archive.
+	Archives bool
+	// RawFiles, if true, serves single files as /{repo}/raw/{ref}/{path},
+	// with the blob ID as ETag. They are authorized like fetches.
+	RawFiles bool
+	// Bundles, if true, serves git bundles of a repository as
+	// /{repo}/bundle, of all refs or those given as refs query parameters.
+	Bundles bool
+	// BundleURIs, if set, returns the URIs of bundles of a repository,
+	// e.g. on a CDN, that upload-pack advertises to protocol v2 clients.
+	// Clients supporting bundle URIs download them before fetching the
+	// rest from the server, which takes most of the load of clones off it.
+	BundleURIs func(repo string) []string
+	// AllowFilter, if true, lets clients make partial clones, e.g. with
+	// --filter=blob:none, by enabling uploadpack.allowFilter.
+	AllowFilter bool
+	// FilterPolicy, if set, is asked whether a partial clone filter, such
+	// as "blob:none" or "tree:0", may be used on a repository. Fetches with
+	// filters it returns an error for are refused with the error, which is
+	// shown to the client if it wraps ErrAccessDenied.
+	FilterPolicy func(repo, filter string) error
+	// AllowSHA1InWant, if set, lets clients fetch commits by ID that no ref
+	// points to, e.g. CI systems checking out exact commits: WantReachable
+	// for commits reachable from a ref, WantAny for any object.
+	AllowSHA1InWant string
+	// AllowSHA1InWantFunc, if set, returns the setting for a repository
+	// instead. Returning "" falls back to AllowSHA1InWant.
+	AllowSHA1InWantFunc func(repo string) string
+	// DenyShallow, if true, refuses fetches limiting their history, such as
+	// shallow clones, which make the server walk the history to find where
+	// to cut it.
+	DenyShallow bool
+	// MaxDepth, if greater than zero, clamps the depth of shallow fetches,
+	// including --unshallow, to this many commits.
+	MaxDepth int
+	// ShallowPolicy, if set, is asked about each request of a fetch to limit
+	// its history. It returns the request to serve, e.g. with a smaller
+	// depth, or an error to refuse the fetch with.
+	ShallowPolicy func(repo string, req ShallowRequest) (ShallowRequest, error)
+	// MaxBundleSize, if set, refuses bundles growing larger with 413.
+	MaxBundleSize int64
+	// BundleCacheDir, if set, keeps generated bundles to serve them again
+	// until the refs they contain move. Nothing is removed from it.
+	BundleCacheDir string
+	// LFS, if true, serves the Git LFS batch API and basic transfers at
+	// /{repo}/info/lfs. Downloads are authorized as fetches, uploads as
+	// pushes.
+	LFS bool
+	// LFSStore keeps the LFS objects, a FilesystemLFSStore in Config.Dir
+	// if nil.
+	LFSStore LFSStore
+	// LFSStagingDir is where uploads are kept until they are complete and
+	// verified, gitkit-lfs in the temporary directory if empty.
+	LFSStagingDir string
+	// PackCacheDir, if set, caches the responses to clones in this
+	// directory, so identical clones, e.g. of CI jobs, are served from disk
+	// instead of packing the same objects again. Responses are keyed on the
+	// request and the refs of the repository. Those of old refs are
+	// dropped on push, or once the new refs are cached if the push didn't
+	// go through this server.
+	PackCacheDir string
+	// MaxPackCacheSize, if greater than zero, limits the size of
+	// PackCacheDir in bytes. The least recently used responses are removed
+	// when a new one takes it over the limit.
+	MaxPackCacheSize int64
+	// TLSConfig is the base TLS configuration of ListenAndServeTLS, e.g.
+	// from ClientCertAuthenticator.TLSConfig.
+	TLSConfig *tls.Config
+	// Autocert, if set, obtains certificates for ListenAndServeTLS when no
+	// certificate files are given.
+	Autocert *AutocertConfig
+	// DisableHTTP2 turns off HTTP/2, which ListenAndServeTLS negotiates
+	// with clients supporting it otherwise.
+	DisableHTTP2 bool
+	// ReadHeaderTimeout is how long the Serve methods wait for the headers
+	// of a request, 10 seconds if zero. Bodies aren't limited unless
+	// ReadTimeout is set, since pushes can take arbitrarily long.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// WriteTimeout, if set, limits how long writing a response may take.
+	// It applies to whole responses, so it cuts off large clones and is
+	// best left unset.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long idle keep-alive connections are kept, two
+	// minutes if zero.
+	IdleTimeout time.Duration
+	// MaxRequestDuration, if set, aborts requests taking longer, killing
+	// their git process. Git processes are killed when the client goes away
+	// in any case.
+	MaxRequestDuration time.Duration
+	// FlushInterval is how long the output of upload-pack and receive-pack,
+	// including the progress of hooks, may wait before it is flushed to the
+	// client. Zero flushes after every write, so pushes show progress as
+	// git reports it; a few milliseconds saves packets on large clones.
+	FlushInterval time.Duration
+	// HTTPBackend, if true, runs git http-backend as a CGI program to serve
+	// info/refs, upload-pack and receive-pack, for the protocol handling of
+	// git itself. Requests are still authenticated and authorized by the
+	// server. The pack cache isn't used then.
+	HTTPBackend bool
+	// MaxRequestBody, if set, limits the size of upload-pack and
+	// receive-pack request bodies after decompression, and of LFS uploads,
+	// so a single push can't fill the disk. Larger requests are refused
+	// with 413.
+	MaxRequestBody int64
+	// MaxRequestBodyFunc, if set, returns the limit for a repository
+	// instead, e.g. a quota. Returning 0 falls back to MaxRequestBody, a
+	// negative limit lifts it.
+	MaxRequestBodyFunc func(repo string) int64
+	// MaxHeaderBytes limits the size of request headers, 64 KiB if zero.
+	MaxHeaderBytes int
+	// CORS, if set, allows browsers to access repositories from the
+	// configured origins.
+	CORS *CORSConfig
+	// TrustedProxies are the reverse proxies whose Forwarded,
+	// X-Forwarded-For and X-Real-IP headers are believed to name the
+	// client, see SetTrustedProxies. Request.RemoteIP is the client found
+	// that way, as seen in logs, authorizers and hooks.
+	TrustedProxies []*net.IPNet
+	// RepoAPI, if true, serves a JSON API under /api/repos to create,
+	// delete and rename repositories. API requests are authenticated even
+	// if Config.Auth is off, changes are only allowed with an Authorizer.
+	RepoAPI bool
+	// OnRepoEvent, if set, is called after a repository was created,
+	// through the API or AutoCreate, deleted or renamed.
+	OnRepoEvent func(event RepoEvent)
+	// OnSession, if set, is called when a git request starts and ends, e.g.
+	// to audit clones and pushes.
+	OnSession func(event SessionEvent)
+	// Authorizer, if set, is asked whether the authenticated principal may
+	// perform req.Operation on the repository, the same way SSH.Authorizer
+	// is, so permissions can be defined once for both. Creating a
+	// repository through AutoCreate is authorized as OperationCreate.
+	Authorizer Authorizer
+	// ResolveRepo, if set, returns where on disk the repository a request
+	// names is kept, e.g. for sharded or ID-based storage layouts, with
+	// relative paths taken relative to Config.Dir. Returning "" keeps the
+	// repository in Config.Dir. The principal is nil for anonymous requests
+	// and for CreateRepo, RenameRepo and DeleteRepo. It applies to the
+	// repository API and LFS objects too. Errors wrapping ErrAccessDenied
+	// are shown to the client, anything else is answered as if the
+	// repository didn't exist. Repos lists Config.Dir as it is stored, since
+	// names can't be told from the paths ResolveRepo returns.
+	ResolveRepo func(ctx context.Context, principal *Principal, repo string) (string, error)
+	// Redirects, if set, serves repositories that moved, e.g. renamed
+	// through the repository API, which records them, from their new
+	// location or, with Redirects.Notify, refuses them with a notice. The
+	// notice is only shown to clients allowed to access the new location.
+	Redirects *Redirects
 }
 
 type Request struct {
 	*http.Request
 	RepoName string
 	RepoPath string
+	// Operation is OperationRead or OperationWrite, depending on Command,
+	// which is "git-upload-pack" or "git-receive-pack", or
+	// "git-upload-archive" for archive downloads.
+	Operation string
+	Command   string
+	// RemoteIP is the address of the client, behind trusted proxies if
+	// any, or nil if unknown.
+	RemoteIP net.IP
+	// Principal is the identity the client authenticated as, if the
+	// AuthFunc sets it, e.g. OIDCAuthenticator.Authenticate or
+	// ClientCertAuthenticator.Authenticate.
+	Principal *Principal
+	// GitNamespace is the git namespace the request is served from, as
+	// the Authorizer set it in AccessRequest.GitNamespace.
+	GitNamespace string
 }
 
 func New(cfg Config) *Server {
@@ -54,11 +253,43 @@ func (s *Server) findService(req *http.Request) (*service, string) {
 			return &svc, path
 		}
 	}
+	if s.LFS {
+		if svc, path := s.findLFSService(req); svc != nil {
+			return svc, path
+		}
+	}
+	if s.Archives && req.Method == "GET" {
+		if svc, path := s.findArchiveService(req.URL.Path); svc != nil {
+			return svc, path
+		}
+	}
+	if s.RawFiles && req.Method == "GET" {
+		if svc, path := s.findRawService(req.URL.Path); svc != nil {
+			return svc, path
+		}
+	}
+	if s.Bundles && req.Method == "GET" {
+		if svc, path := s.findBundleService(req.URL.Path); svc != nil {
+			return svc, path
+		}
+	}
+	if s.DumbHTTP && req.Method == "GET" {
+		return s.findDumbService(req.URL.Path)
+	}
 	return nil, ""
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logInfo("request", r.Method+" "+r.Host+r.URL.String())
+	remoteIP := s.clientIP(r)
+	logInfo("request", fmt.Sprintf("%s %s%s from %s", r.Method, r.Host, r.URL, remoteIP))
+
+	if s.CORS != nil && s.CORS.handle(w, r) {
+		return
+	}
+	if s.RepoAPI && (r.URL.Path == repoAPIPrefix || strings.HasPrefix(r.URL.Path, repoAPIPrefix+"/")) {
+		s.serveRepoAPI(w, r, remoteIP)
+		return
+	}
 
 	// Find the git subservice to handle the request
 	svc, repoUrlPath := s.findService(r)
@@ -75,41 +306,83 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rpc := svc.rpc
+	if rpc == "" {
+		rpc = r.URL.Query().Get("service")
+	}
+	if rpc == "" && s.DumbHTTP {
+		// A dumb fetch of info/refs.
+		rpc = "git-upload-pack"
+	}
 	req := &Request{
-		Request:  r,
-		RepoName: path.Join(repoNamespace, repoName),
-		RepoPath: path.Join(s.config.Dir, repoNamespace, repoName),
+		Request:   r,
+		RepoName:  path.Join(repoNamespace, repoName),
+		RepoPath:  path.Join(s.config.Dir, repoNamespace, repoName),
+		Operation: operationFor(rpc),
+		Command:   rpc,
+		RemoteIP:  remoteIP,
 	}
 
-	if s.config.Auth {
-		if s.AuthFunc == nil {
-			logError("auth", fmt.Errorf("no auth backend provided"))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	s.handler(svc)(w, req)
+}
 
-		cred := getCredential(r)
-		if cred.Authorization == "" {
-			logError("auth", fmt.Errorf("no Authorization header found"))
-			w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+// serveRequest authenticates and authorizes req before svc serves it.
+func (s *Server) serveRequest(w http.ResponseWriter, req *Request, svc *service) {
+	if s.MaxRequestDuration > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.MaxRequestDuration)
+		defer cancel()
+		req.Request = req.Request.WithContext(ctx)
+	}
 
-		allow, err := s.AuthFunc(cred, req)
-		if !allow || err != nil {
-			if err != nil {
-				logError("auth", err)
+	// Middleware may have moved the request to another repository, or
+	// authenticated it already.
+	name, moved := req.RepoName, false
+	if s.Redirects != nil {
+		req.RepoName, moved = s.Redirects.follow(req.RepoName)
+	}
+	req.RepoName = s.config.lookupRepo(req.RepoName)
+	repoPath, err := s.config.repoPath(req.RepoName)
+	if err != nil {
+		logError("auth", err)
+		http.Error(w, "Invalid repository path", http.StatusBadRequest)
+		return
+	}
+	req.RepoPath = repoPath
+	if s.config.Auth && req.Principal == nil && !s.authenticate(w, req) {
+		return
+	}
+	if !req.Principal.CanRun(req.Command) {
+		err := deniedBecause(fmt.Sprintf("this key may not run %s", req.Command))
+		logError("auth", fmt.Errorf("denied %s on %s for %s: %v", req.Command, req.RepoName, req.Principal, err))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !s.authorizeHTTP(w, req, req.Operation) {
+		return
+	}
+	if moved && s.Redirects.Notify {
+		s.serveMoved(w, req, name)
+		return
+	}
+	if s.ResolveRepo != nil {
+		repoPath, err := s.config.resolveRepo(req.Context(), s.ResolveRepo, req.Principal, req.RepoName)
+		if err != nil {
+			logError("resolve-repo", fmt.Errorf("resolving %s: %v", req.RepoName, err))
+			if errors.Is(err, ErrAccessDenied) {
+				http.Error(w, denialMessage(err, ""), http.StatusForbidden)
+			} else {
+				http.NotFound(w, req.Request)
 			}
-
-			logError("auth", fmt.Errorf("rejected user %s", cred.Username))
-			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		req.RepoPath = repoPath
 	}
 
 	if !repoExists(req.RepoPath) && s.config.AutoCreate == true {
-		err := initRepo(req.RepoName, &s.config)
+		if !s.authorizeHTTP(w, req, OperationCreate) {
+			return
+		}
+		err := s.createRepo(req.RepoName, req.RepoPath, req.Principal)
 		if err != nil {
 			logError("repo-init", err)
 		}
@@ -117,41 +390,87 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if !repoExists(req.RepoPath) {
 		logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
-		http.NotFound(w, r)
+		http.NotFound(w, req.Request)
 		return
 	}
 
+	// Like the SSH server, pretend the user only has read access. Pushes
+	// are refused before git-receive-pack advertises its refs.
+	if req.Operation == OperationWrite && s.config.ReadOnly {
+		http.Error(w, ErrAccessDenied.Error()+": "+permissionMessage(OperationWrite, req.RepoName), http.StatusForbidden)
+		return
+	}
+
+	session := Session{Protocol: "http", RemoteAddr: req.RemoteAddr, Repo: req.RepoName, Command: req.Command}
+	if req.RemoteIP != nil {
+		session.RemoteAddr = req.RemoteIP.String()
+	}
+	if req.Principal != nil {
+		session.Principal = req.Principal.ID
+	}
+	if user, _, ok := req.BasicAuth(); ok {
+		session.User = user
+	}
+	defer s.sessions.remove(s.sessions.add(session, s.OnSession), s.OnSession)
+
 	svc.handler(svc.rpc, w, req)
 }
 
 func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 	context := "get-info-refs"
 	rpc := r.URL.Query().Get("service")
+	if rpc == "" && s.DumbHTTP {
+		s.getDumbFile("info/refs", w, r)
+		return
+	}
 
 	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
 		http.Error(w, "Not Found", 404)
 		return
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
-	if err := cmd.Start(); err != nil {
+	// Clients polling for changes revalidate the advertisement, which is
+	// answered without running git while the refs are unchanged.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Git-Protocol")
+	config := s.uploadPack(r).config()
+	if etag, err := refsETag(r, rpc, config); err != nil {
+		logError(context, err)
+	} else {
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if s.HTTPBackend {
+		s.serveHTTPBackend(w, r, "info/refs")
+		return
+	}
+
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
+	cmd.Env = append(cmd.Env, r.environ()...)
+	cmd.Env = append(cmd.Env, configEnviron(config)...)
+	if err := s.procs.start(cmd); err != nil {
 		fail500(w, context, err)
 		return
 	}
-	defer cleanUpProcess(cmd)
+	defer s.procs.cleanUp(cmd)
 
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
-	w.Header().Add("Cache-Control", "no-cache")
 	w.WriteHeader(200)
 
-	if err := packLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
-		logError(context, err)
-		return
-	}
+	// Protocol v2 starts with the capability advertisement right away.
+	if !r.protocolV2() {
+		if err := packLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
+			logError(context, err)
+			return
+		}
 
-	if err := packFlush(w); err != nil {
-		logError(context, err)
-		return
+		if err := packFlush(w); err != nil {
+			logError(context, err)
+			return
+		}
 	}
 
 	if _, err := io.Copy(w, pipe); err != nil {
@@ -159,36 +478,60 @@ func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 		return
 	}
 
-	if err := cmd.Wait(); err != nil {
+	if err := s.procs.wait(cmd); err != nil {
 		logError(context, err)
 		return
 	}
 }
 
 func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
+	if s.HTTPBackend {
+		s.serveHTTPBackend(w, r, rpc)
+		return
+	}
 	context := "post-rpc"
-	body := r.Body
+	body, err := requestBody(r.Request)
+	if err != nil {
+		logError(context, err)
+		status := http.StatusBadRequest
+		if err == errUnsupportedEncoding {
+			status = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer body.Close()
 
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		var err error
-		body, err = gzip.NewReader(r.Body)
-		if err != nil {
-			fail500(w, context, err)
+	if limit := s.maxRequestBody(r); limit > 0 {
+		if r.Header.Get("Content-Encoding") == "" && r.ContentLength > limit {
+			s.rejectTooLarge(w, r, limit)
 			return
 		}
+		body = &maxBytesReader{ReadCloser: body, n: limit}
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
-
-	// Simulates servers that short-circuit the connection
-	// when the user does not have permissions to finish
-	// the operation at hand.
-	//
-	// During a git push, this leads to an 'early EOF' error.
-	if rpc == "git-receive-pack" && s.config.ReadOnly {
-		return
+	in := &readTracker{r: body}
+	var src io.Reader = in
+	var checker *pktLineChecker
+	if opts := s.uploadPack(r); opts.inspected() {
+		checker = newPktLineChecker(in, opts.check)
+		src = checker
+	}
+	var fill *packCacheFill
+	if rpc == "git-upload-pack" && s.PackCacheDir != "" {
+		var served bool
+		if src, fill, served = s.packCache(w, r, src); served {
+			return
+		}
+		if fill != nil {
+			defer fill.release()
+		}
 	}
 
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
+	cmd.Env = append(cmd.Env, r.environ()...)
+	cmd.Env = append(cmd.Env, configEnviron(s.uploadPack(r).config())...)
+
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		fail500(w, context, err)
@@ -196,38 +539,143 @@ func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 	}
 	defer stdin.Close()
 
-	if err := cmd.Start(); err != nil {
+	if err := s.procs.start(cmd); err != nil {
 		fail500(w, context, err)
 		return
 	}
-	defer cleanUpProcess(cmd)
+	defer s.procs.cleanUp(cmd)
 
-	if _, err := io.Copy(stdin, body); err != nil {
+	// Corrupt request bodies are the client's fault, failing to feed git
+	// is ours.
+	if _, err := io.Copy(stdin, src); err != nil {
+		if checker != nil && checker.denied != nil {
+			s.denyFetch(w, r, checker.denied)
+			return
+		}
+		if in.err == errRequestTooLarge {
+			s.rejectTooLarge(w, r, s.maxRequestBody(r))
+			return
+		}
+		if in.err != nil {
+			logError(context, in.err)
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
 		fail500(w, context, err)
 		return
 	}
+	stdin.Close()
 
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
 	w.Header().Add("Cache-Control", "no-cache")
+	// Keep proxies such as nginx from buffering progress messages.
+	w.Header().Set("X-Accel-Buffering", "no")
 	w.WriteHeader(200)
 
-	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
+	out, stop := newWriteFlusher(w, s.FlushInterval)
+	defer stop()
+	if fill != nil {
+		out = io.MultiWriter(out, fill)
+	}
+	if _, err := io.Copy(out, pipe); err != nil {
 		logError(context, err)
 		return
 	}
-	if err := cmd.Wait(); err != nil {
+	if err := s.procs.wait(cmd); err != nil {
 		logError(context, err)
 		return
 	}
+	switch {
+	case fill != nil:
+		fill.commit()
+	case rpc == "git-receive-pack":
+		s.invalidatePackCache(r.RepoName)
+	}
+}
+
+// denyFetch refuses an upload-pack request that was sent a line its
+// policies deny. The reason is sent as an ERR packet, which git shows.
+func (s *Server) denyFetch(w http.ResponseWriter, r *Request, err error) {
+	logError("post-rpc", fmt.Errorf("denied %s on %s for %s: %v", r.Command, r.RepoName, r.Principal, err))
+	WriteGitError(w, r.Request, http.StatusForbidden, denialMessage(err, "fetch not allowed"))
+}
+
+// maxRequestBody returns the limit for the body of r, 0 if there is none.
+func (s *Server) maxRequestBody(r *Request) int64 {
+	limit := s.MaxRequestBody
+	if s.MaxRequestBodyFunc != nil {
+		if l := s.MaxRequestBodyFunc(r.RepoName); l != 0 {
+			limit = l
+		}
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// rejectTooLarge refuses a request with a body exceeding limit. The
+// connection is closed, so the rest of the body isn't read.
+func (s *Server) rejectTooLarge(w http.ResponseWriter, r *Request, limit int64) {
+	logError("post-rpc", fmt.Errorf("%s to %s exceeds %d bytes", r.Command, r.RepoName, limit))
+	w.Header().Set("Connection", "close")
+	http.Error(w, fmt.Sprintf("request body exceeds the limit of %d bytes for %s", limit, r.RepoName), http.StatusRequestEntityTooLarge)
+}
+
+// environ returns the variables passed to the git process serving r: the
+// principal, as for SSH sessions, and the protocol version requested by the
+// client.
+func (r *Request) environ() []string {
+	var env []string
+	if r.Principal != nil {
+		env = append(env, r.Principal.environ()...)
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		env = append(env, "GITKIT_USER="+user)
+	}
+	if r.RemoteIP != nil {
+		env = append(env, "GITKIT_REMOTE_ADDR="+r.RemoteIP.String())
+	}
+	if proto := r.Header.Get("Git-Protocol"); proto != "" {
+		env = append(env, "GIT_PROTOCOL="+proto)
+	}
+	if r.GitNamespace != "" {
+		env = append(env, "GIT_NAMESPACE="+r.GitNamespace)
+	}
+	return env
+}
+
+// protocolV2 reports whether the client asked for git protocol version 2.
+func (r *Request) protocolV2() bool {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) Setup() error {
 	return s.config.Setup()
 }
 
-func initRepo(name string, config *Config) error {
-	fullPath := path.Join(config.Dir, name)
+// ActiveProcesses returns the number of git processes spawned by the server
+// that have not exited and been reaped yet.
+func (s *Server) ActiveProcesses() int {
+	return s.procs.count()
+}
+
+// Sessions returns the git requests being served.
+func (s *Server) Sessions() []Session {
+	return s.sessions.list()
+}
+
+// Config returns the configuration of the server.
+func (s *Server) Config() Config {
+	return s.config
+}
 
+func initRepo(fullPath string, config *Config) error {
 	if err := exec.Command(config.GitPath, "init", "--bare", fullPath).Run(); err != nil {
 		return err
 	}
@@ -244,8 +692,10 @@ func repoExists(p string) bool {
 	return err == nil
 }
 
-func gitCommand(name string, args ...string) (*exec.Cmd, io.Reader) {
-	cmd := exec.Command(name, args...)
+// gitCommand returns a git command, which is killed once ctx is done, e.g.
+// when the client of a request goes away.
+func gitCommand(ctx context.Context, name string, args ...string) (*exec.Cmd, io.Reader) {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Env = os.Environ()
 
 	r, _ := cmd.StdoutPipe()
@@ -0,0 +1,164 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// authenticate checks the credentials of a request with AuthFunc or
+// BasicAuth and sets its principal. Rejected requests are answered with 401.
+func (s *Server) authenticate(w http.ResponseWriter, req *Request) bool {
+	if s.AuthFunc == nil && s.BasicAuth == nil {
+		logError("auth", fmt.Errorf("no auth backend provided"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	// Clients with a TLS certificate may not send credentials at all.
+	cred := getCredential(req.Request)
+	if cred.Authorization == "" && !hasClientCert(req.Request) {
+		logError("auth", fmt.Errorf("no Authorization header found"))
+		basicAuthChallenge(w)
+		return false
+	}
+
+	if s.lockedOut(req, cred.Username) {
+		logError("auth", fmt.Errorf("rejected user %s from %s: too many failed attempts", cred.Username, req.RemoteIP))
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.banDuration()/time.Second)))
+		http.Error(w, errBanned.Error(), http.StatusTooManyRequests)
+		return false
+	}
+
+	var allow bool
+	var err error
+	if s.AuthFunc != nil {
+		allow, err = s.AuthFunc(cred, req)
+	} else if _, _, ok := req.BasicAuth(); !ok {
+		err = fmt.Errorf("no basic auth credentials found")
+	} else {
+		var principal *Principal
+		principal, err = s.BasicAuth(cred.Username, cred.Password, req)
+		if err == nil && principal == nil {
+			err = fmt.Errorf("no principal for user %s", cred.Username)
+		}
+		allow, req.Principal = err == nil, principal
+	}
+	if !allow || err != nil {
+		if err != nil {
+			logError("auth", err)
+		}
+
+		logError("auth", fmt.Errorf("rejected user %s", cred.Username))
+		s.authFailed(req, cred.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	s.authSucceeded(req, cred.Username)
+
+	if req.Principal == nil {
+		req.Principal = &Principal{ID: cred.Username}
+	}
+	return true
+}
+
+// lockedOut reports whether the client IP or username of req is locked out
+// for exceeding MaxAuthFailures or MaxUserAuthFailures.
+func (s *Server) lockedOut(req *Request, username string) bool {
+	now := time.Now()
+	if s.MaxAuthFailures > 0 && req.RemoteIP != nil && s.bans.banned("ip:"+req.RemoteIP.String(), now) {
+		return true
+	}
+	return s.MaxUserAuthFailures > 0 && username != "" && s.bans.banned("user:"+username, now)
+}
+
+// authFailed records failed credentials of username from the client of req.
+func (s *Server) authFailed(req *Request, username string) {
+	window := s.AuthFailureWindow
+	if window <= 0 {
+		window = defaultAuthFailureWindow
+	}
+	now, ban := time.Now(), s.banDuration()
+	if s.MaxAuthFailures > 0 && req.RemoteIP != nil && s.bans.fail("ip:"+req.RemoteIP.String(), now, s.MaxAuthFailures, window, ban) {
+		logError("auth", fmt.Errorf("locking out %s for %s after %d failed attempts", req.RemoteIP, ban, s.MaxAuthFailures))
+	}
+	if s.MaxUserAuthFailures > 0 && username != "" && s.bans.fail("user:"+username, now, s.MaxUserAuthFailures, window, ban) {
+		logError("auth", fmt.Errorf("locking out user %s for %s after %d failed attempts", username, ban, s.MaxUserAuthFailures))
+	}
+}
+
+// authSucceeded clears previous failures of the client and username.
+func (s *Server) authSucceeded(req *Request, username string) {
+	if s.MaxAuthFailures > 0 && req.RemoteIP != nil {
+		s.bans.reset("ip:" + req.RemoteIP.String())
+	}
+	if s.MaxUserAuthFailures > 0 && username != "" {
+		s.bans.reset("user:" + username)
+	}
+}
+
+func (s *Server) banDuration() time.Duration {
+	if s.BanDuration <= 0 {
+		return defaultBanDuration
+	}
+	return s.BanDuration
+}
+
+// basicAuthChallenge asks the client for basic auth credentials.
+func basicAuthChallenge(w http.ResponseWriter) {
+	w.Header()["WWW-Authenticate"] = []string{`Basic realm=""`}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// authorizeHTTP checks operation on the repository of req against the
+// Authorizer. Denied requests are answered with 403 and the reason.
+func (s *Server) authorizeHTTP(w http.ResponseWriter, req *Request, operation string) bool {
+	if err := s.authorizeRequest(req, operation); err != nil {
+		http.Error(w, denialMessage(err, permissionMessage(operation, req.RepoName)), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeRequest asks the Authorizer whether the principal of req may
+// perform operation on its repository.
+func (s *Server) authorizeRequest(req *Request, operation string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+
+	principal := req.Principal
+	if principal == nil {
+		principal = &Principal{}
+	}
+	user, _, _ := req.BasicAuth()
+	access := &AccessRequest{
+		KeyID:     principal.ID,
+		Principal: principal,
+		User:      user,
+		Repo:      req.RepoName,
+		Operation: operation,
+		Command:   req.Command,
+	}
+	if req.RemoteIP != nil {
+		access.RemoteAddr = &net.TCPAddr{IP: req.RemoteIP}
+		if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil && addr.IP.Equal(req.RemoteIP) {
+			access.RemoteAddr = addr
+		}
+	}
+
+	if err := s.Authorizer.Authorize(access); err != nil {
+		logError("auth", fmt.Errorf("denied %s %s on %s: %v", principal, operation, req.RepoName, err))
+		return err
+	}
+	if err := checkGitNamespace(access.GitNamespace); err != nil {
+		logError("auth", fmt.Errorf("denied %s %s on %s: %v", principal, operation, req.RepoName, err))
+		return err
+	}
+	if access.GitNamespace != "" {
+		req.GitNamespace = access.GitNamespace
+	}
+	return nil
+}
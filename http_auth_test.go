@@ -0,0 +1,153 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerBasicAuth(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	for _, repo := range []string{"repo.git", "private.git"} {
+		assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, repo)).Run())
+	}
+
+	acl := NewACL()
+	acl.Grant("alice", "*", AccessAdmin)
+	acl.Grant("bob", "*.git", AccessRead)
+
+	var requests []AccessRequest
+	server := New(Config{Dir: dir, Auth: true, AutoCreate: true})
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		if password != username+"-secret" {
+			return nil, fmt.Errorf("wrong password")
+		}
+		return &Principal{ID: username, Name: strings.ToUpper(username[:1]) + username[1:]}, nil
+	}
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		requests = append(requests, *req)
+		if req.Repo == "private.git" && req.KeyID != "alice" {
+			return deniedBecause("private.git is alice's")
+		}
+		return acl.Authorize(req)
+	})
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func(user, password, path string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	code, _ := get("bob", "bob-secret", "/repo.git/info/refs?service=git-upload-pack")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "bob", requests[0].KeyID)
+	assert.Equal(t, "Bob", requests[0].Principal.Name)
+	assert.Equal(t, "bob", requests[0].User)
+	assert.Equal(t, "git-upload-pack", requests[0].Command)
+	assert.Equal(t, OperationRead, requests[0].Operation)
+	assert.NotNil(t, requests[0].RemoteAddr)
+
+	code, body := get("bob", "bob-secret", "/repo.git/info/refs?service=git-receive-pack")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "access denied: you need write permission on repo.git\n", body)
+
+	code, body = get("bob", "bob-secret", "/private.git/info/refs?service=git-upload-pack")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "access denied: private.git is alice's\n", body)
+
+	code, _ = get("bob", "wrong", "/repo.git/info/refs?service=git-upload-pack")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = get("", "", "/repo.git/info/refs?service=git-upload-pack")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Creating repositories is authorized separately.
+	code, body = get("bob", "bob-secret", "/new.git/info/refs?service=git-upload-pack")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "access denied: you may not create new.git\n", body)
+	code, _ = get("alice", "alice-secret", "/new.git/info/refs?service=git-upload-pack")
+	assert.Equal(t, http.StatusOK, code)
+
+	// git clones with the credentials of the URL but may not push.
+	clone := filepath.Join(dir, "clone")
+	url := "http://bob:bob-secret@" + srv.Listener.Addr().String() + "/repo.git"
+	out, err := exec.Command("git", "clone", url, clone).CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-C", clone, "-c", "user.name=Bob", "-c", "user.email=bob@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	_, err = git("commit", "--allow-empty", "-m", "test")
+	assert.NoError(t, err)
+	out2, err := git("push", "origin", "HEAD:master")
+	assert.Error(t, err)
+	assert.Contains(t, out2, "403")
+}
+
+func TestServerAuthLockout(t *testing.T) {
+	server := New(Config{Dir: t.TempDir(), Auth: true})
+	server.MaxAuthFailures = 3
+	server.MaxUserAuthFailures = 2
+	server.BanDuration = time.Minute
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		if password != "secret" {
+			return nil, fmt.Errorf("wrong password")
+		}
+		return &Principal{ID: username}, nil
+	}
+
+	get := func(ip, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/repo.git/info/refs?service=git-upload-pack", nil)
+		r.RemoteAddr = ip + ":1234"
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// Missing credentials are how git starts, they don't count.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1", "", "").Code)
+	}
+
+	// A username is locked out from every address.
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1", "alice", "guess").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.2", "alice", "guess").Code)
+	rec := get("192.0.2.3", "alice", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	// An address is locked out for every username.
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1", "bob", "guess").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1", "eve", "guess").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("192.0.2.1", "carol", "secret").Code)
+
+	// Success resets the count.
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.4", "dave", "guess").Code)
+	assert.Equal(t, http.StatusNotFound, get("192.0.2.4", "dave", "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.4", "dave", "guess").Code)
+	assert.Equal(t, http.StatusNotFound, get("192.0.2.4", "dave", "secret").Code)
+}
@@ -0,0 +1,162 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// serveHTTPBackend serves the smart HTTP request r, for file in the
+// repository, by running git http-backend as a CGI program. r has been
+// authenticated and authorized already, so http-backend serves every
+// repository and accepts pushes.
+func (s *Server) serveHTTPBackend(w http.ResponseWriter, r *Request, file string) {
+	context := "http-backend"
+	body, err := requestBody(r.Request)
+	if err != nil {
+		logError(context, err)
+		status := http.StatusBadRequest
+		if err == errUnsupportedEncoding {
+			status = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer body.Close()
+
+	// Bodies are decompressed here, so the limit applies the same way as
+	// without http-backend, and their length is only known if they weren't
+	// compressed. http-backend reads up to EOF without CONTENT_LENGTH.
+	length := r.ContentLength
+	if r.Header.Get("Content-Encoding") != "" {
+		length = -1
+	}
+	if limit := s.maxRequestBody(r); limit > 0 && r.Method == http.MethodPost {
+		if length > limit {
+			s.rejectTooLarge(w, r, limit)
+			return
+		}
+		body = &maxBytesReader{ReadCloser: body, n: limit}
+	}
+	in := &readTracker{r: body}
+	var src io.Reader = in
+	var checker *pktLineChecker
+	if opts := s.uploadPack(r); opts.inspected() && r.Method == http.MethodPost {
+		checker = newPktLineChecker(in, opts.check)
+		src = checker
+	}
+
+	cmd, stdout := gitCommand(r.Context(), s.config.GitPath, "http-backend")
+	cmd.Env = append(cmd.Env, cgiEnviron(r, filepath.Dir(r.RepoPath), filepath.Base(r.RepoPath)+"/"+file, length)...)
+	cmd.Env = append(cmd.Env, r.environ()...)
+	// Pushes were authorized already, also when there is no user to set
+	// REMOTE_USER to.
+	config := append([]string{"http.receivepack", "true"}, s.uploadPack(r).config()...)
+	cmd.Env = append(cmd.Env, configEnviron(config)...)
+	cmd.Stdin = src
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := s.procs.start(cmd); err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer s.procs.cleanUp(cmd)
+
+	out := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(out).ReadMIMEHeader()
+	if err != nil {
+		s.procs.wait(cmd)
+		if in.err == errRequestTooLarge {
+			s.rejectTooLarge(w, r, s.maxRequestBody(r))
+			return
+		}
+		fail500(w, context, fmt.Errorf("reading headers: %v: %s", err, strings.TrimSpace(stderr.String())))
+		return
+	}
+	status := http.StatusOK
+	if line := header.Get("Status"); line != "" {
+		code, err := strconv.Atoi(strings.Fields(line + " ")[0])
+		if err != nil {
+			fail500(w, context, fmt.Errorf("invalid status %q", line))
+			return
+		}
+		status = code
+		header.Del("Status")
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(status)
+
+	dst, stop := newWriteFlusher(w, s.FlushInterval)
+	defer stop()
+	if _, err := io.Copy(dst, out); err != nil {
+		logError(context, err)
+		return
+	}
+	err = s.procs.wait(cmd)
+	// upload-pack stops before answering the request cut off at the
+	// denied line.
+	if checker != nil && checker.denied != nil {
+		logError(context, fmt.Errorf("denied %s on %s for %s: %v", r.Command, r.RepoName, r.Principal, checker.denied))
+		WriteErrorPacket(dst, denialMessage(checker.denied, "fetch not allowed"))
+		return
+	}
+	if err != nil {
+		logError(context, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String())))
+		return
+	}
+	if r.Command == "git-receive-pack" && r.Method == http.MethodPost {
+		s.invalidatePackCache(r.RepoName)
+	}
+}
+
+// cgiEnviron returns the CGI variables for running git http-backend on r.
+func cgiEnviron(r *Request, root, pathInfo string, length int64) []string {
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_PROTOCOL=" + r.Proto,
+		"REQUEST_METHOD=" + r.Method,
+		"QUERY_STRING=" + r.URL.RawQuery,
+		"PATH_INFO=/" + strings.TrimPrefix(pathInfo, "/"),
+		"GIT_PROJECT_ROOT=" + root,
+		"GIT_HTTP_EXPORT_ALL=1",
+	}
+	if r.Method == http.MethodPost {
+		env = append(env, "CONTENT_TYPE="+r.Header.Get("Content-Type"))
+		if length >= 0 {
+			env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(length, 10))
+		}
+	}
+	if user := remoteUser(r); user != "" {
+		env = append(env, "REMOTE_USER="+user)
+	}
+	if r.RemoteIP != nil {
+		env = append(env, "REMOTE_ADDR="+r.RemoteIP.String())
+	}
+	for _, h := range []string{"Git-Protocol", "Accept"} {
+		if v := r.Header.Get(h); v != "" {
+			env = append(env, "HTTP_"+strings.ToUpper(strings.Replace(h, "-", "_", -1))+"="+v)
+		}
+	}
+	return env
+}
+
+// remoteUser returns the name of the client for REMOTE_USER: the user it
+// authenticated as with basic auth, or the principal.
+func remoteUser(r *Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if r.Principal != nil {
+		return r.Principal.ID
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerHTTPBackend(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	hookOut := filepath.Join(dir, "hook.out")
+	cfg := Config{
+		Dir:        filepath.Join(dir, "repos"),
+		AutoCreate: true,
+		AutoHooks:  true,
+		Auth:       true,
+		Hooks: &HookScripts{
+			PreReceive: "#!/bin/sh\necho \"$REMOTE_USER $GITKIT_KEY\" > " + hookOut + "\n",
+		},
+	}
+	assert.NoError(t, os.MkdirAll(cfg.Dir, 0755))
+	server := New(cfg)
+	server.HTTPBackend = true
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		if password != "secret" {
+			return nil, ErrAccessDenied
+		}
+		return &Principal{ID: "key-" + username}, nil
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	url := func(password string) string {
+		return "http://alice:" + password + "@" + srv.Listener.Addr().String() + "/org/repo.git"
+	}
+
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+	out, err := git("-C", work, "push", url("secret"), "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+	data, err := os.ReadFile(hookOut)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice key-alice\n", string(data))
+
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone-v"+version)
+		out, err := git("-c", "protocol.version="+version, "clone", url("secret"), clone)
+		assert.NoError(t, err, out)
+		out, err = git("-C", clone, "log", "--format=%s")
+		assert.NoError(t, err)
+		assert.Equal(t, "initial\n", out)
+	}
+
+	// gitkit still authenticates the requests.
+	out, err = git("ls-remote", url("wrong"))
+	assert.Error(t, err, out)
+}
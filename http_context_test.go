@@ -0,0 +1,68 @@
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerKillsGitWithRequest(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "repo.git")).Run())
+	// A git that never answers.
+	fakeGit := filepath.Join(dir, "git")
+	assert.NoError(t, os.WriteFile(fakeGit, []byte("#!/bin/sh\nexec sleep 30\n"), 0755))
+
+	waitForProcesses := func(s *Server) int {
+		deadline := time.Now().Add(5 * time.Second)
+		for s.ActiveProcesses() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return s.ActiveProcesses()
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		server := New(Config{Dir: dir, GitPath: fakeGit})
+		server.MaxRequestDuration = 200 * time.Millisecond
+		start := time.Now()
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/repo.git/info/refs?service=git-upload-pack", nil))
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+		assert.Equal(t, 0, waitForProcesses(server))
+	})
+
+	t.Run("client disconnect", func(t *testing.T) {
+		server := New(Config{Dir: dir, GitPath: fakeGit})
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if res, err := http.DefaultClient.Do(req); err == nil {
+				res.Body.Close()
+			}
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for server.ActiveProcesses() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 1, server.ActiveProcesses())
+		cancel()
+		<-done
+		assert.Equal(t, 0, waitForProcesses(server))
+	})
+}
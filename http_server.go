@@ -0,0 +1,179 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultHTTPIdleTimeout   = 2 * time.Minute
+	defaultMaxHeaderBytes    = 64 << 10
+)
+
+// AutocertConfig configures certificates obtained from an ACME CA, Let's
+// Encrypt by default, for Server.ListenAndServeTLS.
+type AutocertConfig struct {
+	// Domains are the only host names certificates are requested for.
+	Domains []string
+	// CacheDir is where certificates and the account key are kept across
+	// restarts. Without one every restart requests new certificates, which
+	// quickly runs into the CA's rate limits.
+	CacheDir string
+	// Email is the contact address of the ACME account, optional.
+	Email string
+	// DirectoryURL is the ACME directory of the CA, Let's Encrypt's if
+	// empty.
+	DirectoryURL string
+}
+
+// manager returns the autocert manager. Challenges are answered with
+// TLS-ALPN-01 on the TLS port, so no plain HTTP listener is needed.
+func (c *AutocertConfig) manager() (*autocert.Manager, error) {
+	if len(c.Domains) == 0 {
+		return nil, fmt.Errorf("autocert: no domains configured")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Email:      c.Email,
+	}
+	if c.CacheDir != "" {
+		m.Cache = autocert.DirCache(c.CacheDir)
+	}
+	if c.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return m, nil
+}
+
+// ListenAndServe serves HTTP on addr until Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves HTTP on l until Shutdown is called.
+func (s *Server) Serve(l net.Listener) error {
+	srv, err := s.httpServer(nil)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return serveErr(srv.Serve(l))
+}
+
+// ListenAndServeTLS serves HTTPS on addr until Shutdown is called. The
+// certificate is read from certFile and keyFile, or obtained through
+// Autocert if both are empty.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS is like ListenAndServeTLS for an existing listener.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.TLSConfig != nil {
+		tlsConfig = s.TLSConfig.Clone()
+	}
+
+	if certFile == "" && keyFile == "" {
+		if s.Autocert == nil {
+			l.Close()
+			return fmt.Errorf("no certificate and no autocert configured")
+		}
+		m, err := s.Autocert.manager()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		tlsConfig.GetCertificate = m.GetCertificate
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+
+	srv, err := s.httpServer(tlsConfig)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return serveErr(srv.ServeTLS(l, certFile, keyFile))
+}
+
+// Shutdown stops the server started by one of the Serve methods, waiting
+// for requests in flight until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.srv
+	s.mu.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
+
+// httpServer sets up the repositories and returns the http.Server serving
+// them. A server can only be started once.
+func (s *Server) httpServer(tlsConfig *tls.Config) (*http.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.srv != nil {
+		return nil, ErrAlreadyStarted
+	}
+	if err := s.Setup(); err != nil {
+		return nil, err
+	}
+	s.srv = &http.Server{
+		Handler:           s,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: defaultDuration(s.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       defaultDuration(s.IdleTimeout, defaultHTTPIdleTimeout),
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+	}
+	if s.srv.MaxHeaderBytes == 0 {
+		s.srv.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if tlsConfig != nil {
+		if s.DisableHTTP2 {
+			// A non-nil map keeps net/http from setting up HTTP/2.
+			s.srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		} else if len(tlsConfig.NextProtos) == 0 || tlsConfig.NextProtos[0] != "h2" {
+			// net/http would append h2 after the ACME protocol, prefer
+			// it instead.
+			tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+		}
+	}
+	return s.srv, nil
+}
+
+func defaultDuration(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// serveErr returns ErrServerClosed after Shutdown, like SSH.Serve.
+func serveErr(err error) error {
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeServerCert writes a certificate for localhost and its key to dir.
+func writeServerCert(t *testing.T, dir string) (string, string) {
+	ca := newTestCert(t, pkix.Name{CommonName: "Test CA"}, nil)
+	cert := newTestCert(t, pkix.Name{CommonName: "localhost"}, &ca)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+	return certFile, keyFile
+}
+
+func TestServerServeTLS(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := writeServerCert(t, dir)
+
+	server := New(Config{Dir: filepath.Join(dir, "repos"), AutoCreate: true})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- server.ServeTLS(l, certFile, keyFile) }()
+
+	url := "https://" + l.Addr().String() + "/repo.git"
+	out, err := exec.Command("git", "-c", "http.sslVerify=false", "clone", url, filepath.Join(dir, "clone")).CombinedOutput()
+	assert.NoError(t, err, string(out))
+	assert.DirExists(t, filepath.Join(dir, "repos", "repo.git"))
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrAlreadyStarted, server.Serve(l2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, server.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-done)
+}
+
+func TestServerServeTLSAutocert(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.EqualError(t, New(Config{}).ServeTLS(l, "", ""), "no certificate and no autocert configured")
+
+	server := New(Config{})
+	server.Autocert = &AutocertConfig{}
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.EqualError(t, server.ServeTLS(l, "", ""), "autocert: no domains configured")
+
+	m, err := (&AutocertConfig{Domains: []string{"git.example.com"}, CacheDir: t.TempDir(), Email: "admin@example.com"}).manager()
+	assert.NoError(t, err)
+	assert.NoError(t, m.HostPolicy(context.Background(), "git.example.com"))
+	assert.Error(t, m.HostPolicy(context.Background(), "evil.example.com"))
+	assert.Equal(t, "admin@example.com", m.Email)
+	assert.NotNil(t, m.Cache)
+}
+
+func TestServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeServerCert(t, dir)
+
+	for _, disable := range []bool{false, true} {
+		server := New(Config{Dir: filepath.Join(dir, "repos")})
+		server.DisableHTTP2 = disable
+		server.IdleTimeout = time.Minute
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		done := make(chan error, 1)
+		go func() { done <- server.ServeTLS(l, certFile, keyFile) }()
+
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		assert.NoError(t, err)
+		if disable {
+			assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+		} else {
+			assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+		}
+		conn.Close()
+
+		server.mu.Lock()
+		assert.Equal(t, time.Duration(0), server.srv.WriteTimeout)
+		assert.Equal(t, time.Minute, server.srv.IdleTimeout)
+		assert.Equal(t, defaultReadHeaderTimeout, server.srv.ReadHeaderTimeout)
+		assert.Equal(t, defaultMaxHeaderBytes, server.srv.MaxHeaderBytes)
+		server.mu.Unlock()
+
+		assert.NoError(t, server.Shutdown(context.Background()))
+		assert.Equal(t, ErrServerClosed, <-done)
+	}
+}
@@ -0,0 +1,95 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	hookOut := filepath.Join(dir, "hook.out")
+	cfg := Config{
+		Dir:        filepath.Join(dir, "repos"),
+		AutoCreate: true,
+		AutoHooks:  true,
+		Auth:       true,
+		Hooks: &HookScripts{
+			PreReceive: "#!/bin/sh\necho \"$GITKIT_KEY $GITKIT_USER\" > " + hookOut + "\n",
+		},
+	}
+	assert.NoError(t, os.MkdirAll(cfg.Dir, 0755))
+
+	newServer := func(cfg Config) *httptest.Server {
+		server := New(cfg)
+		server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+			p := &Principal{ID: "key-" + username}
+			if username == "reader" {
+				p.Commands = []string{"git-upload-pack"}
+			}
+			return p, nil
+		}
+		srv := httptest.NewServer(server)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	srv := newServer(cfg)
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	url := func(srv *httptest.Server, user string) string {
+		return "http://" + user + ":secret@" + srv.Listener.Addr().String() + "/org/repo.git"
+	}
+
+	// Pushing creates the repository and runs hooks with the principal.
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+	out, err := git("-C", work, "push", url(srv, "alice"), "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+	data, err := os.ReadFile(hookOut)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-alice alice\n", string(data))
+
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone-v"+version)
+		out, err := git("-c", "protocol.version="+version, "clone", url(srv, "alice"), clone)
+		assert.NoError(t, err, out)
+		out, err = git("-C", clone, "log", "--format=%s")
+		assert.NoError(t, err)
+		assert.Equal(t, "initial\n", out)
+	}
+
+	// Principals limited to git-upload-pack may clone but not push.
+	out, err = git("clone", url(srv, "reader"), filepath.Join(dir, "clone-reader"))
+	assert.NoError(t, err, out)
+	out, err = git("-C", work, "push", url(srv, "reader"), "HEAD:refs/heads/other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "403")
+
+	// ReadOnly refuses pushes before anything is received.
+	cfg.ReadOnly = true
+	ro := newServer(cfg)
+	out, err = git("clone", url(ro, "alice"), filepath.Join(dir, "clone-ro"))
+	assert.NoError(t, err, out)
+	out, err = git("-C", work, "push", url(ro, "alice"), "HEAD:refs/heads/other")
+	assert.Error(t, err)
+	assert.Contains(t, out, "403")
+	out, err = git("-C", filepath.Join(cfg.Dir, "org/repo.git"), "branch", "--list", "other")
+	assert.NoError(t, err)
+	assert.Empty(t, strings.TrimSpace(out))
+}
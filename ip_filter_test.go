@@ -0,0 +1,40 @@
+package gitkit
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFilter(t *testing.T) {
+	filter, err := NewIPFilter(
+		[]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"},
+		[]string{"10.1.0.0/16"},
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, filter.Allowed(net.ParseIP(tt.ip)), tt.ip)
+	}
+
+	open, err := NewIPFilter(nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, open.Allowed(net.ParseIP("203.0.113.7")))
+
+	_, err = NewIPFilter([]string{"not-an-ip"}, nil)
+	assert.Error(t, err)
+	_, err = NewIPFilter(nil, []string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
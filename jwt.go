@@ -0,0 +1,284 @@
+package gitkit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var errTokenExpired = errors.New("token is expired")
+
+// jwtHeader is the JOSE header of a signed JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// jwt is a parsed, not yet verified, JSON web token.
+type jwt struct {
+	header       jwtHeader
+	claims       map[string]interface{}
+	signingInput []byte
+	signature    []byte
+}
+
+// parseJWT splits a compact serialized JWT into its parts.
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	t := &jwt{signingInput: []byte(parts[0] + "." + parts[1])}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if err := json.Unmarshal(header, &t.header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %v", err)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.UseNumber()
+	if err := dec.Decode(&t.claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %v", err)
+	}
+	if t.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	return t, nil
+}
+
+// verify checks the signature of the token with key. Only asymmetric
+// algorithms are supported, so a public key can never be mistaken for an
+// HMAC secret.
+func (t *jwt) verify(key crypto.PublicKey) error {
+	var hash crypto.Hash
+	switch t.header.Alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", t.header.Alg)
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(t.signingInput)
+		digest = h.Sum(nil)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch t.header.Alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, t.signature)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, t.signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if t.header.Alg[:2] != "ES" || len(t.signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if t.header.Alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, t.signingInput, t.signature) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key does not match signing algorithm %q", t.header.Alg)
+}
+
+// validate checks the registered claims of a verified token: issuer and
+// audience if given, and the validity window allowing for leeway.
+func (t *jwt) validate(issuer, audience string, now time.Time, leeway time.Duration) error {
+	if issuer != "" && t.stringClaim("iss") != issuer {
+		return fmt.Errorf("unexpected issuer %q", t.stringClaim("iss"))
+	}
+	if audience != "" && !t.hasAudience(audience) {
+		return fmt.Errorf("token is not intended for %q", audience)
+	}
+
+	exp, ok := t.timeClaim("exp")
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(exp.Add(leeway)) {
+		return errTokenExpired
+	}
+	if nbf, ok := t.timeClaim("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	return nil
+}
+
+func (t *jwt) stringClaim(name string) string {
+	s, _ := t.claims[name].(string)
+	return s
+}
+
+// stringsClaim returns a claim holding either a list of strings or a single,
+// space separated string, as used for scopes.
+func (t *jwt) stringsClaim(name string) []string {
+	switch v := t.claims[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (t *jwt) timeClaim(name string) (time.Time, bool) {
+	n, ok := t.claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func (t *jwt) hasAudience(audience string) bool {
+	for _, aud := range t.stringsClaim("aud") {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// jwkCurves are the elliptic curves of EC keys, by JWK name.
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// jwk is a JSON web key holding a public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwkSet is a JSON web key set, as served at an issuer's jwks_uri.
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// signingKeys returns the signature keys of the set by key ID. Keys that
+// can't be decoded are logged and skipped, so a single key of an unsupported
+// type doesn't break the others.
+func (set *jwkSet) signingKeys(component string) map[string]crypto.PublicKey {
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logError(component, fmt.Errorf("skipping key %q: %v", k.Kid, err))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys
+}
+
+// publicKey decodes the key. Unsupported key types return an error.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
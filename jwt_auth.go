@@ -0,0 +1,139 @@
+package gitkit
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// JWTAuthenticator authenticates HTTP clients with JWTs signed by one of a
+// fixed set of keys, e.g. tokens minted by a CI system for a single
+// pipeline. Unlike OIDCAuthenticator nothing is fetched, the keys are
+// configured up front. Its Authenticate method can be used as
+// Server.AuthFunc.
+//
+// Tokens are accepted as bearer tokens or as basic auth password. Their
+// scopes, from the scope or scp claim, become the scopes of the principal,
+// which ScopeAuthorizer turns into repository permissions.
+type JWTAuthenticator struct {
+	// Issuer, if set, is required in the iss claim.
+	Issuer string
+	// Audience, if set, is required in the aud claim.
+	Audience string
+	// Leeway is the clock skew allowed when checking exp and nbf, a minute
+	// if zero.
+	Leeway time.Duration
+	// ClaimsFunc maps the claims of a valid token to a principal, see
+	// OIDCAuthenticator.ClaimsFunc.
+	ClaimsFunc func(claims map[string]interface{}) (*Principal, error)
+
+	now func() time.Time
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+// NewJWTAuthenticator returns an authenticator for tokens signed by keys,
+// which are looked up by the kid header of the tokens. Tokens without kid
+// are accepted if there is a single key.
+func NewJWTAuthenticator(keys map[string]crypto.PublicKey) *JWTAuthenticator {
+	return &JWTAuthenticator{keys: keys}
+}
+
+// NewJWTAuthenticatorFromJWKS returns an authenticator for tokens signed by
+// the keys in the JSON web key set at path.
+func NewJWTAuthenticatorFromJWKS(path string) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{}
+	if err := a.LoadJWKS(path); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetKeys replaces the signing keys, e.g. after a key rotation.
+func (a *JWTAuthenticator) SetKeys(keys map[string]crypto.PublicKey) {
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+}
+
+// LoadJWKS replaces the signing keys with those of the JSON web key set at
+// path.
+func (a *JWTAuthenticator) LoadJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var set jwkSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	keys := set.signingKeys("jwt")
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no signing keys", path)
+	}
+	a.SetKeys(keys)
+	return nil
+}
+
+// Authenticate verifies the token of cred and sets the principal of req.
+func (a *JWTAuthenticator) Authenticate(cred Credential, req *Request) (bool, error) {
+	token := bearerToken(cred)
+	if token == "" {
+		return false, nil
+	}
+
+	principal, err := a.Verify(token)
+	if err != nil {
+		return false, err
+	}
+	req.Principal = principal
+	return true, nil
+}
+
+// Verify checks the signature and claims of token and returns the principal
+// it was issued to.
+func (a *JWTAuthenticator) Verify(token string) (*Principal, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.key(t.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.verify(key); err != nil {
+		return nil, err
+	}
+
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	leeway := a.Leeway
+	if leeway == 0 {
+		leeway = defaultTokenLeeway
+	}
+	if err := t.validate(a.Issuer, a.Audience, now(), leeway); err != nil {
+		return nil, err
+	}
+	return t.principal(a.ClaimsFunc)
+}
+
+func (a *JWTAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
@@ -0,0 +1,117 @@
+package gitkit
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	a := NewJWTAuthenticator(map[string]crypto.PublicKey{"ci": &key.PublicKey})
+	a.Issuer = "https://ci.example.com"
+
+	claims := map[string]interface{}{
+		"iss":   "https://ci.example.com",
+		"sub":   "pipeline-42",
+		"scope": "repo:team/app.git:write",
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	}
+	p, err := a.Verify(signToken(t, key, "ci", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{ID: "pipeline-42", Scopes: []string{"repo:team/app.git:write"}}, p)
+
+	// A single key is used for tokens without key ID.
+	_, err = a.Verify(signToken(t, key, "", claims))
+	assert.NoError(t, err)
+
+	_, err = a.Verify(signToken(t, key, "other", claims))
+	assert.EqualError(t, err, `unknown signing key "other"`)
+	claims["iss"] = "https://evil.example.com"
+	_, err = a.Verify(signToken(t, key, "ci", claims))
+	assert.Error(t, err)
+
+	// Keys can be loaded from a JWKS file.
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(jwkSet{Keys: []jwk{{
+		Kty: "RSA", Kid: "rotated",
+		N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	assert.NoError(t, os.WriteFile(jwks, data, 0600))
+	a, err = NewJWTAuthenticatorFromJWKS(jwks)
+	assert.NoError(t, err)
+	claims["iss"] = "https://ci.example.com"
+	_, err = a.Verify(signToken(t, key, "rotated", claims))
+	assert.NoError(t, err)
+	_, err = a.Verify(signToken(t, key, "ci", claims))
+	assert.Error(t, err)
+}
+
+func TestJWTAuthenticatorScopes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	token := func(scope string) string {
+		return signToken(t, key, "ci", map[string]interface{}{
+			"sub":   "pipeline-42",
+			"scope": scope,
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		})
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	for _, repo := range []string{"app.git", "web.git"} {
+		assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, repo)).Run())
+	}
+
+	server := New(Config{Dir: repos, Auth: true})
+	server.AuthFunc = NewJWTAuthenticator(map[string]crypto.PublicKey{"ci": &key.PublicKey}).Authenticate
+	server.Authorizer = ScopeAuthorizer{}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	url := func(token, repo string) string {
+		return "http://ci:" + token + "@" + srv.Listener.Addr().String() + "/" + repo
+	}
+
+	work := filepath.Join(dir, "work")
+	_, err = git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	writer := token("repo:app.git:write")
+	out, err := git("-C", work, "push", url(writer, "app.git"), "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+	out, err = git("-C", work, "push", url(writer, "web.git"), "HEAD:refs/heads/master")
+	assert.Error(t, err, out)
+
+	reader := token("repo:*:read")
+	out, err = git("clone", url(reader, "app.git"), filepath.Join(dir, "clone"))
+	assert.NoError(t, err, out)
+	out, err = git("-C", work, "push", url(reader, "app.git"), "HEAD:refs/heads/other")
+	assert.Error(t, err, out)
+	assert.Contains(t, out, "no write scope for app.git")
+}
@@ -0,0 +1,129 @@
+package gitkit
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errKeyLookupPanicked is returned to callers waiting on a lookup that
+// panicked.
+var errKeyLookupPanicked = errors.New("key lookup failed")
+
+// KeyCache caches the results of a PublicKeyLookupFunc. Concurrent lookups
+// of the same key share a single call to the underlying lookup. Failed
+// lookups are not cached.
+type KeyCache struct {
+	lookup     func(string) (*PublicKey, error)
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*keyLookupCall
+}
+
+type keyCacheEntry struct {
+	content string
+	key     *PublicKey
+	expires time.Time
+}
+
+type keyLookupCall struct {
+	done chan struct{}
+	key  *PublicKey
+	err  error
+}
+
+// NewKeyCache wraps lookup, caching keys for ttl. If maxEntries is greater
+// than zero, the least recently used keys are evicted beyond it.
+func NewKeyCache(lookup func(string) (*PublicKey, error), ttl time.Duration, maxEntries int) *KeyCache {
+	return &KeyCache{
+		lookup:     lookup,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		calls:      make(map[string]*keyLookupCall),
+	}
+}
+
+// Lookup implements PublicKeyLookupFunc. The returned key is shared between
+// callers and must not be modified.
+func (c *KeyCache) Lookup(content string) (*PublicKey, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[content]; ok {
+		entry := el.Value.(*keyCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.key, nil
+		}
+		c.remove(el)
+	}
+	if call, ok := c.calls[content]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.key, call.err
+	}
+	call := &keyLookupCall{done: make(chan struct{})}
+	c.calls[content] = call
+	c.mu.Unlock()
+
+	// Don't leave waiting callers hanging if the lookup panics.
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, content)
+		if call.err == nil && call.key != nil {
+			c.add(content, call.key)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.err = errKeyLookupPanicked
+	call.key, call.err = c.lookup(content)
+	return call.key, call.err
+}
+
+// Invalidate drops a key from the cache.
+func (c *KeyCache) Invalidate(content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[content]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge empties the cache.
+func (c *KeyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Len returns the number of cached keys.
+func (c *KeyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *KeyCache) add(content string, key *PublicKey) {
+	if el, ok := c.entries[content]; ok {
+		c.remove(el)
+	}
+	entry := &keyCacheEntry{content: content, key: key, expires: time.Now().Add(c.ttl)}
+	c.entries[content] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *KeyCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*keyCacheEntry).content)
+}
@@ -0,0 +1,87 @@
+package gitkit
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyCache(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	lookup := func(content string) (*PublicKey, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if content == "unknown" {
+			return nil, fmt.Errorf("key not found")
+		}
+		return &PublicKey{Id: content}, nil
+	}
+	cache := NewKeyCache(lookup, time.Hour, 2)
+
+	// Concurrent lookups of the same key share one call.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := cache.Lookup("a")
+			assert.NoError(t, err)
+			assert.Equal(t, "a", key.Id)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	_, err := cache.Lookup("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Failures are not cached.
+	_, err = cache.Lookup("unknown")
+	assert.Error(t, err)
+	_, err = cache.Lookup("unknown")
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// The least recently used key is evicted.
+	cache.Lookup("b")
+	cache.Lookup("a")
+	cache.Lookup("c")
+	assert.Equal(t, 2, cache.Len())
+	atomic.StoreInt32(&calls, 0)
+	cache.Lookup("a")
+	cache.Lookup("b")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	cache.Invalidate("a")
+	cache.Lookup("a")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+
+	// Entries expire.
+	short := NewKeyCache(lookup, time.Millisecond, 0)
+	short.Lookup("a")
+	time.Sleep(5 * time.Millisecond)
+	atomic.StoreInt32(&calls, 0)
+	short.Lookup("a")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestKeyCachePanic(t *testing.T) {
+	cache := NewKeyCache(func(string) (*PublicKey, error) {
+		panic("boom")
+	}, time.Hour, 0)
+
+	assert.Panics(t, func() { cache.Lookup("a") })
+	assert.Equal(t, 0, cache.Len())
+	assert.Panics(t, func() { cache.Lookup("a") })
+}
@@ -0,0 +1,151 @@
+// Package keystore provides persistent storage for the public keys used to
+// authenticate gitkit SSH clients.
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fluxcd/gitkit"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNotFound is returned when a key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// ErrInvalidKey is returned by NewKey and Register for keys that can't be
+// parsed.
+var ErrInvalidKey = errors.New("invalid public key")
+
+// ErrKeyExists is returned by Register for a key that is stored already.
+var ErrKeyExists = errors.New("key already exists")
+
+// Key is a stored public key.
+type Key struct {
+	// ID uniquely identifies the key and becomes the gitkit key ID.
+	ID string
+	// Owner is the user or account the key belongs to.
+	Owner string
+	// Name is a human readable label, e.g. "laptop".
+	Name string
+	// Fingerprint is the SHA256 fingerprint of the key.
+	Fingerprint string
+	// Content is the key in authorized_keys format, without comment.
+	Content   string
+	CreatedAt time.Time
+}
+
+// Store manages public keys.
+type Store interface {
+	// Add stores a key. ID, Fingerprint and CreatedAt are filled in if
+	// empty. Adding a key that is already stored fails.
+	Add(ctx context.Context, key *Key) error
+	// Get returns the key with the given ID.
+	Get(ctx context.Context, id string) (*Key, error)
+	// GetByFingerprint returns the key with the given fingerprint.
+	GetByFingerprint(ctx context.Context, fingerprint string) (*Key, error)
+	// List returns the keys of an owner.
+	List(ctx context.Context, owner string) ([]*Key, error)
+	// Update stores the owner and name of the key with key.ID, the fields
+	// of a key that can change. Its ID and fingerprint stay the same, so
+	// connections made with it aren't affected.
+	Update(ctx context.Context, key *Key) error
+	// Delete removes the key with the given ID.
+	Delete(ctx context.Context, id string) error
+}
+
+// NewKey parses an authorized_keys line into a Key for owner. The comment
+// of the line becomes the name unless name is given.
+func NewKey(owner, name, authorizedKey string) (*Key, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if name == "" {
+		name = comment
+	}
+	return &Key{
+		Owner:       owner,
+		Name:        name,
+		Fingerprint: gitkit.KeyFingerprint(pub),
+		Content:     gitkit.AuthorizedKeyString(pub),
+	}, nil
+}
+
+// Register adds authorizedKey to store as a key of owner, see NewKey. If
+// server is not nil, a revocation of the key there is lifted, so that a key
+// removed with Unregister can be added back.
+func Register(ctx context.Context, store Store, server *gitkit.SSH, owner, name, authorizedKey string) (*Key, error) {
+	key, err := NewKey(owner, name, authorizedKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.GetByFingerprint(ctx, key.Fingerprint); err == nil {
+		return nil, ErrKeyExists
+	}
+	if err := store.Add(ctx, key); err != nil {
+		return nil, err
+	}
+	if server != nil {
+		server.UnrevokeKey(key.Fingerprint)
+	}
+	return key, nil
+}
+
+// Update gives the key with the given ID in store a new owner or name. Empty
+// ones are left as they are.
+func Update(ctx context.Context, store Store, id, owner, name string) (*Key, error) {
+	key, err := store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		key.Owner = owner
+	}
+	if name != "" {
+		key.Name = name
+	}
+	if err := store.Update(ctx, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Unregister deletes the key with the given ID from store. If server is not
+// nil, the key is revoked there too, closing the connections using it.
+func Unregister(ctx context.Context, store Store, server *gitkit.SSH, id string) (*Key, error) {
+	key, err := store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+	if server != nil {
+		server.RevokeKey(key.Fingerprint)
+	}
+	return key, nil
+}
+
+// LookupKeyFunc returns a gitkit.SSH.PublicKeyLookupKeyFunc resolving keys
+// by fingerprint from store.
+func LookupKeyFunc(store Store) func(ssh.PublicKey, ssh.ConnMetadata) (*gitkit.PublicKey, error) {
+	return func(pub ssh.PublicKey, _ ssh.ConnMetadata) (*gitkit.PublicKey, error) {
+		key, err := store.GetByFingerprint(context.Background(), gitkit.KeyFingerprint(pub))
+		if err != nil {
+			return nil, err
+		}
+		// Guard against fingerprint collisions in the backing store.
+		if key.Content != gitkit.AuthorizedKeyString(pub) {
+			return nil, ErrNotFound
+		}
+		return &gitkit.PublicKey{
+			Id:          key.ID,
+			Name:        key.Name,
+			Fingerprint: key.Fingerprint,
+			Content:     key.Content,
+		}, nil
+	}
+}
@@ -0,0 +1,43 @@
+package keystore
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister(t *testing.T) {
+	db := sql.OpenDB(&memConnector{})
+	defer db.Close()
+
+	store, err := NewSQLStore(db, DialectSQLite)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, store.Migrate(ctx))
+
+	authorizedKey := gitkit.AuthorizedKeyString(newPublicKey(t))
+	_, err = Register(ctx, store, nil, "alice", "laptop", "not a key")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	key, err := Register(ctx, store, nil, "alice", "laptop", authorizedKey)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key.ID)
+	_, err = Register(ctx, store, nil, "bob", "", authorizedKey)
+	assert.ErrorIs(t, err, ErrKeyExists)
+
+	updated, err := Update(ctx, store, key.ID, "", "desktop")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", updated.Owner)
+	assert.Equal(t, "desktop", updated.Name)
+	_, err = Update(ctx, store, "missing", "bob", "")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	got, err := Unregister(ctx, store, nil, key.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, key.Fingerprint, got.Fingerprint)
+	_, err = Unregister(ctx, store, nil, key.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
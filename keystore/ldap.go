@@ -0,0 +1,250 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultLDAPFilter    = "(sshPublicKey=%s)"
+	defaultLDAPCacheTTL  = time.Minute
+	defaultLDAPPoolSize  = 4
+	defaultLDAPKeyAttr   = "sshPublicKey"
+	defaultLDAPIDAttr    = "uid"
+	defaultLDAPNameAttr  = "cn"
+	defaultLDAPTimeLimit = 10
+)
+
+// LDAPConfig configures an LDAPLookup.
+type LDAPConfig struct {
+	// URL of the directory, e.g. "ldaps://ldap.example.com".
+	URL string
+	// TLSConfig is used for ldaps:// URLs.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword authenticate the lookups. Anonymous if empty.
+	BindDN       string
+	BindPassword string
+	// BaseDN is where the search starts, e.g. "ou=people,dc=example,dc=com".
+	BaseDN string
+	// Filter selects the entries holding a key. Its %s is replaced by the
+	// escaped key in authorized_keys format, without comment. Defaults to
+	// "(sshPublicKey=%s)". Use "(sshPublicKey=%s*)" if your directory
+	// stores keys with comments and supports substring matches on them.
+	Filter string
+	// KeyAttribute, IDAttribute and NameAttribute name the attributes
+	// holding the keys, the key ID and the key name. They default to
+	// sshPublicKey, uid and cn.
+	KeyAttribute  string
+	IDAttribute   string
+	NameAttribute string
+	// CacheTTL is how long lookup results, including misses, are cached.
+	// Defaults to one minute, a negative value disables caching.
+	CacheTTL time.Duration
+	// PoolSize is the number of idle connections kept for reuse. Defaults
+	// to 4.
+	PoolSize int
+}
+
+// ldapConn is the part of *ldap.Conn used for lookups.
+type ldapConn interface {
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// LDAPLookup resolves SSH keys from sshPublicKey attributes in an LDAP
+// directory, the schema used by openssh-lpk. Its LookupKey method can be
+// used as gitkit.SSH.PublicKeyLookupKeyFunc.
+type LDAPLookup struct {
+	config LDAPConfig
+	dial   func() (ldapConn, error)
+	pool   chan ldapConn
+
+	mu    sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	key     *gitkit.PublicKey
+	expires time.Time
+}
+
+// NewLDAPLookup returns a lookup against the configured directory.
+// Connections are established lazily.
+func NewLDAPLookup(config LDAPConfig) (*LDAPLookup, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("LDAP URL is not provided")
+	}
+	if config.BaseDN == "" {
+		return nil, fmt.Errorf("LDAP base DN is not provided")
+	}
+
+	l := newLDAPLookup(config)
+	l.dial = func() (ldapConn, error) {
+		conn, err := ldap.DialURL(config.URL, ldap.DialWithTLSConfig(config.TLSConfig))
+		if err != nil {
+			return nil, err
+		}
+		if config.BindDN != "" {
+			if err := conn.Bind(config.BindDN, config.BindPassword); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	return l, nil
+}
+
+func newLDAPLookup(config LDAPConfig) *LDAPLookup {
+	if config.Filter == "" {
+		config.Filter = defaultLDAPFilter
+	}
+	if config.KeyAttribute == "" {
+		config.KeyAttribute = defaultLDAPKeyAttr
+	}
+	if config.IDAttribute == "" {
+		config.IDAttribute = defaultLDAPIDAttr
+	}
+	if config.NameAttribute == "" {
+		config.NameAttribute = defaultLDAPNameAttr
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultLDAPCacheTTL
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = defaultLDAPPoolSize
+	}
+	return &LDAPLookup{
+		config: config,
+		pool:   make(chan ldapConn, config.PoolSize),
+		cache:  make(map[string]ldapCacheEntry),
+	}
+}
+
+// LookupKey resolves key, see gitkit.SSH.PublicKeyLookupKeyFunc.
+func (l *LDAPLookup) LookupKey(key ssh.PublicKey, _ ssh.ConnMetadata) (*gitkit.PublicKey, error) {
+	fingerprint := gitkit.KeyFingerprint(key)
+	if pkey, ok := l.cached(fingerprint); ok {
+		if pkey == nil {
+			return nil, ErrNotFound
+		}
+		return pkey, nil
+	}
+
+	pkey, err := l.search(key)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	l.store(fingerprint, pkey)
+	return pkey, err
+}
+
+// Close closes the idle connections.
+func (l *LDAPLookup) Close() {
+	for {
+		select {
+		case conn := <-l.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (l *LDAPLookup) search(key ssh.PublicKey) (*gitkit.PublicKey, error) {
+	conn, err := l.get()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to LDAP: %v", err)
+	}
+
+	content := gitkit.AuthorizedKeyString(key)
+	req := ldap.NewSearchRequest(
+		l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, defaultLDAPTimeLimit, false,
+		fmt.Sprintf(l.config.Filter, ldap.EscapeFilter(content)),
+		[]string{l.config.KeyAttribute, l.config.IDAttribute, l.config.NameAttribute},
+		nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		// The connection may be broken, don't reuse it.
+		conn.Close()
+		return nil, fmt.Errorf("searching LDAP: %v", err)
+	}
+	l.put(conn)
+
+	for _, entry := range res.Entries {
+		for _, value := range entry.GetAttributeValues(l.config.KeyAttribute) {
+			stored, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+			if err != nil || !bytes.Equal(stored.Marshal(), key.Marshal()) {
+				continue
+			}
+			name := entry.GetAttributeValue(l.config.NameAttribute)
+			if name == "" {
+				name = comment
+			}
+			return &gitkit.PublicKey{
+				Id:          entry.GetAttributeValue(l.config.IDAttribute),
+				Name:        strings.TrimSpace(name),
+				Fingerprint: gitkit.KeyFingerprint(key),
+				Content:     content,
+			}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// get returns an idle connection from the pool or dials a new one.
+func (l *LDAPLookup) get() (ldapConn, error) {
+	select {
+	case conn := <-l.pool:
+		return conn, nil
+	default:
+		return l.dial()
+	}
+}
+
+// put returns a connection to the pool, closing it if the pool is full.
+func (l *LDAPLookup) put(conn ldapConn) {
+	select {
+	case l.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (l *LDAPLookup) cached(fingerprint string) (*gitkit.PublicKey, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.cache[fingerprint]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.key, true
+}
+
+func (l *LDAPLookup) store(fingerprint string, pkey *gitkit.PublicKey) {
+	if l.config.CacheTTL < 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for fp, entry := range l.cache {
+		if now.After(entry.expires) {
+			delete(l.cache, fp)
+		}
+	}
+	l.cache[fingerprint] = ldapCacheEntry{key: pkey, expires: now.Add(l.config.CacheTTL)}
+}
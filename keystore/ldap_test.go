@@ -0,0 +1,88 @@
+package keystore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLDAPConn struct {
+	mu       sync.Mutex
+	entries  []*ldap.Entry
+	filters  []string
+	closed   bool
+	failNext bool
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filters = append(c.filters, req.Filter)
+	if c.failNext {
+		c.failNext = false
+		return nil, fmt.Errorf("connection reset")
+	}
+	return &ldap.SearchResult{Entries: c.entries}, nil
+}
+
+func (c *fakeLDAPConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func TestLDAPLookup(t *testing.T) {
+	alice, bob := newPublicKey(t), newPublicKey(t)
+
+	conn := &fakeLDAPConn{entries: []*ldap.Entry{
+		ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":          {"alice"},
+			"cn":           {"Alice"},
+			"sshPublicKey": {"garbage", gitkit.AuthorizedKeyString(alice) + " alice@laptop"},
+		}),
+	}}
+	dials := 0
+	lookup := newLDAPLookup(LDAPConfig{BaseDN: "dc=example,dc=com"})
+	lookup.dial = func() (ldapConn, error) {
+		dials++
+		return conn, nil
+	}
+
+	pkey, err := lookup.LookupKey(alice, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &gitkit.PublicKey{
+		Id:          "alice",
+		Name:        "Alice",
+		Fingerprint: gitkit.KeyFingerprint(alice),
+		Content:     gitkit.AuthorizedKeyString(alice),
+	}, pkey)
+	assert.Equal(t, []string{"(sshPublicKey=" + gitkit.AuthorizedKeyString(alice) + ")"}, conn.filters)
+
+	// Hits and misses are cached and connections reused.
+	_, err = lookup.LookupKey(alice, nil)
+	assert.NoError(t, err)
+	_, err = lookup.LookupKey(bob, nil)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = lookup.LookupKey(bob, nil)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Len(t, conn.filters, 2)
+	assert.Equal(t, 1, dials)
+
+	// Broken connections are not returned to the pool.
+	uncached := newLDAPLookup(LDAPConfig{BaseDN: "dc=example,dc=com", CacheTTL: -1})
+	uncached.dial = lookup.dial
+	conn.failNext = true
+	_, err = uncached.LookupKey(alice, nil)
+	assert.Error(t, err)
+	assert.True(t, conn.closed)
+	_, err = uncached.LookupKey(alice, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, dials)
+
+	_, err = NewLDAPLookup(LDAPConfig{URL: "ldap://localhost"})
+	assert.Error(t, err)
+}
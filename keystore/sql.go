@@ -0,0 +1,213 @@
+package keystore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/gofrs/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dialects supported by SQLStore. They differ in their bind variables only.
+const (
+	DialectPostgres = "postgres"
+	DialectMySQL    = "mysql"
+	DialectSQLite   = "sqlite"
+)
+
+const defaultTable = "gitkit_keys"
+
+// SQLStore is a Store backed by a database/sql database. Bring your own
+// driver, e.g. github.com/lib/pq or modernc.org/sqlite.
+type SQLStore struct {
+	db      *sql.DB
+	table   string
+	dialect string
+}
+
+// NewSQLStore returns a store keeping keys in the gitkit_keys table of db.
+// Call Migrate to create the table.
+func NewSQLStore(db *sql.DB, dialect string) (*SQLStore, error) {
+	switch dialect {
+	case DialectPostgres, DialectMySQL, DialectSQLite:
+	default:
+		return nil, fmt.Errorf("unsupported dialect %q", dialect)
+	}
+	return &SQLStore{db: db, table: defaultTable, dialect: dialect}, nil
+}
+
+// Migrate creates the keys table and its index if they do not exist yet.
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.table+` (
+	id VARCHAR(64) PRIMARY KEY,
+	owner VARCHAR(255) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	fingerprint VARCHAR(128) NOT NULL UNIQUE,
+	content TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+)`); err != nil {
+		return fmt.Errorf("migrating %s: %v", s.table, err)
+	}
+
+	index := s.table + "_owner"
+	guard := "IF NOT EXISTS "
+	if s.dialect == DialectMySQL {
+		// MySQL can't create indexes IF NOT EXISTS, look for it instead.
+		var n int
+		err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?`, s.table, index).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %v", s.table, err)
+		}
+		if n > 0 {
+			return nil
+		}
+		guard = ""
+	}
+	if _, err := s.db.ExecContext(ctx, `CREATE INDEX `+guard+index+` ON `+s.table+` (owner)`); err != nil {
+		return fmt.Errorf("migrating %s: %v", s.table, err)
+	}
+	return nil
+}
+
+// Add implements Store.
+func (s *SQLStore) Add(ctx context.Context, key *Key) error {
+	if key.Content == "" {
+		return fmt.Errorf("key content is empty")
+	}
+	// Keys are stored without options and comment, as NewKey makes them,
+	// so that LookupKeyFunc finds them.
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Content))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	fingerprint := gitkit.KeyFingerprint(pub)
+	if key.Fingerprint != "" && key.Fingerprint != fingerprint {
+		return fmt.Errorf("fingerprint %s does not match the key", key.Fingerprint)
+	}
+	key.Content, key.Fingerprint = gitkit.AuthorizedKeyString(pub), fingerprint
+	if key.ID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return fmt.Errorf("error generating new uuid: %v", err)
+		}
+		key.ID = id.String()
+	}
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.query(`INSERT INTO `+s.table+
+		` (id, owner, name, fingerprint, content, created_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		key.ID, key.Owner, key.Name, key.Fingerprint, key.Content, key.CreatedAt)
+	return err
+}
+
+// Get implements Store.
+func (s *SQLStore) Get(ctx context.Context, id string) (*Key, error) {
+	return s.getBy(ctx, "id", id)
+}
+
+// GetByFingerprint implements Store.
+func (s *SQLStore) GetByFingerprint(ctx context.Context, fingerprint string) (*Key, error) {
+	return s.getBy(ctx, "fingerprint", fingerprint)
+}
+
+func (s *SQLStore) getBy(ctx context.Context, column, value string) (*Key, error) {
+	row := s.db.QueryRowContext(ctx, s.query(`SELECT `+keyColumns+` FROM `+s.table+` WHERE `+column+` = ?`), value)
+	key, err := scanKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+// List implements Store.
+func (s *SQLStore) List(ctx context.Context, owner string) ([]*Key, error) {
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT `+keyColumns+` FROM `+s.table+` WHERE owner = ? ORDER BY created_at, id`), owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*Key
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Update implements Store.
+func (s *SQLStore) Update(ctx context.Context, key *Key) error {
+	if key.Owner == "" {
+		return fmt.Errorf("key owner is empty")
+	}
+	res, err := s.db.ExecContext(ctx, s.query(`UPDATE `+s.table+` SET owner = ?, name = ? WHERE id = ?`), key.Owner, key.Name, key.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (s *SQLStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.query(`DELETE FROM `+s.table+` WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const keyColumns = "id, owner, name, fingerprint, content, created_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner) (*Key, error) {
+	var key Key
+	if err := row.Scan(&key.ID, &key.Owner, &key.Name, &key.Fingerprint, &key.Content, &key.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// query rewrites ? bind variables for the dialect.
+func (s *SQLStore) query(q string) string {
+	if s.dialect != DialectPostgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,246 @@
+package keystore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fluxcd/gitkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSQLStore(t *testing.T) {
+	db := sql.OpenDB(&memConnector{})
+	defer db.Close()
+
+	store, err := NewSQLStore(db, DialectSQLite)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, store.Migrate(ctx))
+
+	alicePub := newPublicKey(t)
+	alice, err := NewKey("alice", "", gitkit.AuthorizedKeyString(alicePub)+" alice@laptop")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@laptop", alice.Name)
+	assert.NoError(t, store.Add(ctx, alice))
+	assert.NotEmpty(t, alice.ID)
+	assert.Equal(t, gitkit.KeyFingerprint(alicePub), alice.Fingerprint)
+
+	second := &Key{Owner: "alice", Name: "desktop", Content: gitkit.AuthorizedKeyString(newPublicKey(t))}
+	assert.NoError(t, store.Add(ctx, second))
+	assert.Error(t, store.Add(ctx, &Key{Owner: "bob", Content: alice.Content}), "duplicate keys are rejected")
+	assert.Error(t, store.Add(ctx, &Key{Owner: "bob", Content: "not a key"}))
+	assert.Error(t, store.Add(ctx, &Key{Owner: "bob", Content: gitkit.AuthorizedKeyString(newPublicKey(t)), Fingerprint: alice.Fingerprint}))
+
+	// Keys are stored as NewKey makes them, so they can be looked up.
+	bobPub := newPublicKey(t)
+	bob := &Key{Owner: "bob", Content: `no-pty ` + gitkit.AuthorizedKeyString(bobPub) + " bob@laptop\n"}
+	assert.NoError(t, store.Add(ctx, bob))
+	assert.Equal(t, gitkit.AuthorizedKeyString(bobPub), bob.Content)
+	_, err = LookupKeyFunc(store)(bobPub, nil)
+	assert.NoError(t, err)
+
+	got, err := store.Get(ctx, alice.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, alice, got)
+
+	got, err = store.GetByFingerprint(ctx, alice.Fingerprint)
+	assert.NoError(t, err)
+	assert.Equal(t, alice.ID, got.ID)
+
+	keys, err := store.List(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	lookup := LookupKeyFunc(store)
+	pkey, err := lookup(alicePub, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &gitkit.PublicKey{Id: alice.ID, Name: alice.Name, Fingerprint: alice.Fingerprint, Content: alice.Content}, pkey)
+
+	// Keys can change hands and names, but stay the same key.
+	second.Owner, second.Name = "bob", "shared"
+	assert.NoError(t, store.Update(ctx, second))
+	got, err = store.Get(ctx, second.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, second, got)
+	keys, err = store.List(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Error(t, store.Update(ctx, &Key{ID: second.ID}), "owner is required")
+	assert.Equal(t, ErrNotFound, store.Update(ctx, &Key{ID: "missing", Owner: "bob"}))
+
+	assert.NoError(t, store.Delete(ctx, alice.ID))
+	assert.Equal(t, ErrNotFound, store.Delete(ctx, alice.ID))
+	_, err = store.Get(ctx, alice.ID)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = lookup(alicePub, nil)
+	assert.Error(t, err)
+}
+
+func TestSQLStoreMigrateMySQL(t *testing.T) {
+	db := sql.OpenDB(&memConnector{mysql: true})
+	defer db.Close()
+
+	store, err := NewSQLStore(db, DialectMySQL)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Migrate(context.Background()))
+	assert.NoError(t, store.Migrate(context.Background()), "migrating again")
+}
+
+func TestSQLStoreQuery(t *testing.T) {
+	store, err := NewSQLStore(nil, DialectPostgres)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT a FROM t WHERE b = $1 AND c = $2", store.query("SELECT a FROM t WHERE b = ? AND c = ?"))
+
+	_, err = NewSQLStore(nil, "oracle")
+	assert.Error(t, err)
+}
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	return key
+}
+
+// memConnector is a database/sql driver understanding just the statements
+// issued by SQLStore, keeping rows in memory. With mysql set, it refuses to
+// create indexes IF NOT EXISTS, as MySQL does.
+type memConnector struct {
+	mu      sync.Mutex
+	rows    [][]driver.Value
+	mysql   bool
+	indexes map[string]bool
+}
+
+func (c *memConnector) Connect(context.Context) (driver.Conn, error) { return &memConn{c}, nil }
+func (c *memConnector) Driver() driver.Driver                        { return nil }
+
+type memConn struct{ c *memConnector }
+
+func (m *memConn) Prepare(query string) (driver.Stmt, error) { return &memStmt{m.c, query}, nil }
+func (m *memConn) Close() error                              { return nil }
+func (m *memConn) Begin() (driver.Tx, error)                 { return nil, fmt.Errorf("not supported") }
+
+type memStmt struct {
+	c     *memConnector
+	query string
+}
+
+func (s *memStmt) Close() error  { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+
+// column returns the index of the column in the WHERE clause.
+func (s *memStmt) column() int {
+	where := s.query[strings.Index(s.query, "WHERE ")+len("WHERE "):]
+	name := strings.Fields(where)[0]
+	for i, col := range strings.Split(keyColumns, ", ") {
+		if col == name {
+			return i
+		}
+	}
+	panic("unknown column " + name)
+}
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE INDEX"):
+		fields := strings.Fields(s.query)
+		ifNotExists := fields[2] == "IF"
+		name := fields[len(fields)-4]
+		switch {
+		case ifNotExists && s.c.mysql:
+			return nil, fmt.Errorf("syntax error")
+		case s.c.indexes[name] && !ifNotExists:
+			return nil, fmt.Errorf("Duplicate key name '%s'", name)
+		}
+		if s.c.indexes == nil {
+			s.c.indexes = make(map[string]bool)
+		}
+		s.c.indexes[name] = true
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		for _, row := range s.c.rows {
+			if row[0] == args[0] || row[3] == args[3] {
+				return nil, fmt.Errorf("UNIQUE constraint failed")
+			}
+		}
+		s.c.rows = append(s.c.rows, args)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		n := 0
+		for _, row := range s.c.rows {
+			if row[s.column()] == args[2] {
+				row[1], row[2] = args[0], args[1]
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		col, n := s.column(), 0
+		kept := s.c.rows[:0]
+		for _, row := range s.c.rows {
+			if row[col] == args[0] {
+				n++
+				continue
+			}
+			kept = append(kept, row)
+		}
+		s.c.rows = kept
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %s", s.query)
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+
+	if strings.Contains(s.query, "information_schema") {
+		var n int64
+		if s.c.indexes[args[1].(string)] {
+			n = 1
+		}
+		return &memRows{cols: []string{"count"}, rows: [][]driver.Value{{n}}}, nil
+	}
+	col := s.column()
+	var rows [][]driver.Value
+	for _, row := range s.c.rows {
+		if row[col] == args[0] {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i][0].(string) < rows[j][0].(string) })
+	return &memRows{cols: strings.Split(keyColumns, ", "), rows: rows}, nil
+}
+
+type memRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *memRows) Columns() []string { return r.cols }
+func (r *memRows) Close() error      { return nil }
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,454 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// lfsContentType is the media type of LFS API requests and responses.
+const lfsContentType = "application/vnd.git-lfs+json"
+
+const (
+	lfsBatchSuffix   = "/info/lfs/objects/batch"
+	lfsObjectsSuffix = "/info/lfs/objects/"
+)
+
+var (
+	// lfsObjectPattern matches LFS object transfers,
+	// /{repo}/info/lfs/objects/{oid}.
+	lfsObjectPattern = regexp.MustCompile(`^(.*)/info/lfs/objects/([0-9a-f]{64})$`)
+	// lfsOidPattern matches the SHA-256 object IDs of LFS.
+	lfsOidPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// lfsBatchRequest is the body of a batch API request.
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers,omitempty"`
+	HashAlgo  string      `json:"hash_algo,omitempty"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+	HashAlgo string      `json:"hash_algo"`
+}
+
+type lfsObject struct {
+	Oid           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsError             `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// findLFSService returns the service serving LFS requests and the
+// repository path, or nil if req is not one. Batch requests are
+// authenticated as fetches, uploads are authorized once the batch request
+// is read.
+func (s *Server) findLFSService(req *http.Request) (*service, string) {
+	p := req.URL.Path
+	if req.Method == "POST" && strings.HasSuffix(p, lfsBatchSuffix) {
+		return &service{
+			method:  "POST",
+			suffix:  lfsBatchSuffix,
+			handler: func(_ string, w http.ResponseWriter, r *Request) { s.postLFSBatch(w, r) },
+			rpc:     "git-upload-pack",
+		}, strings.TrimSuffix(p, lfsBatchSuffix)
+	}
+
+	m := lfsObjectPattern.FindStringSubmatch(p)
+	if m == nil {
+		return nil, ""
+	}
+	oid := m[2]
+	switch req.Method {
+	case "GET":
+		return &service{
+			method:  "GET",
+			suffix:  lfsObjectsSuffix + oid,
+			handler: func(_ string, w http.ResponseWriter, r *Request) { s.getLFSObject(oid, w, r) },
+			rpc:     "git-upload-pack",
+		}, m[1]
+	case "PUT":
+		return &service{
+			method:  "PUT",
+			suffix:  lfsObjectsSuffix + oid,
+			handler: func(_ string, w http.ResponseWriter, r *Request) { s.putLFSObject(oid, w, r) },
+			rpc:     "git-receive-pack",
+		}, m[1]
+	}
+	return nil, ""
+}
+
+// postLFSBatch answers a batch API request with the URLs to transfer the
+// objects from or to, which are served by getLFSObject and putLFSObject.
+func (s *Server) postLFSBatch(w http.ResponseWriter, r *Request) {
+	var batch lfsBatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20)).Decode(&batch); err != nil {
+		writeLFSError(w, http.StatusBadRequest, "invalid batch request: "+err.Error())
+		return
+	}
+	if batch.HashAlgo != "" && batch.HashAlgo != "sha256" {
+		writeLFSError(w, http.StatusConflict, "unsupported hash algorithm "+batch.HashAlgo)
+		return
+	}
+
+	switch batch.Operation {
+	case "download":
+	case "upload":
+		// The request was authorized as a fetch.
+		r.Command, r.Operation = "git-receive-pack", OperationWrite
+		if !r.Principal.CanRun(r.Command) {
+			writeLFSError(w, http.StatusForbidden, deniedBecause(fmt.Sprintf("this key may not run %s", r.Command)).Error())
+			return
+		}
+		if s.config.ReadOnly {
+			writeLFSError(w, http.StatusForbidden, ErrAccessDenied.Error()+": "+permissionMessage(OperationWrite, r.RepoName))
+			return
+		}
+		if err := s.authorizeRequest(r, OperationWrite); err != nil {
+			writeLFSError(w, http.StatusForbidden, denialMessage(err, permissionMessage(OperationWrite, r.RepoName)))
+			return
+		}
+	default:
+		writeLFSError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unknown operation %q", batch.Operation))
+		return
+	}
+
+	// Transfers are sent to this server again, with the credentials of the
+	// batch request.
+	header := map[string]string{}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header["Authorization"] = auth
+	}
+	base := s.externalURL(r.Request) + "/" + r.RepoName + lfsObjectsSuffix
+
+	res := lfsBatchResponse{Transfer: "basic", HashAlgo: "sha256", Objects: []lfsObject{}}
+	for _, obj := range batch.Objects {
+		out := lfsObject{Oid: obj.Oid, Size: obj.Size}
+		if !lfsOidPattern.MatchString(obj.Oid) || obj.Size < 0 {
+			out.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: "invalid object"}
+			res.Objects = append(res.Objects, out)
+			continue
+		}
+		size, err := s.lfsStore(r).Size(r.Context(), r.RepoName, obj.Oid)
+		switch {
+		case err != nil && err != ErrLFSObjectNotFound:
+			logError("lfs-batch", err)
+			out.Error = &lfsError{Code: http.StatusInternalServerError, Message: "object storage failed"}
+		case batch.Operation == "download" && err != nil:
+			out.Error = &lfsError{Code: http.StatusNotFound, Message: "object does not exist"}
+		case batch.Operation == "download":
+			out.Size = size
+			out.Authenticated = true
+			out.Actions = map[string]*lfsAction{"download": {Href: base + obj.Oid, Header: header}}
+		case err == nil && size == obj.Size:
+			// Already uploaded, the client skips objects without
+			// actions.
+		default:
+			out.Authenticated = true
+			out.Actions = map[string]*lfsAction{"upload": {Href: base + obj.Oid, Header: header}}
+		}
+		res.Objects = append(res.Objects, out)
+	}
+
+	w.Header().Set("Content-Type", lfsContentType)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logError("lfs-batch", err)
+	}
+}
+
+// lfsStore returns LFSStore, or the store keeping objects in the
+// repositories, in the one r was resolved to for its own.
+func (s *Server) lfsStore(r *Request) LFSStore {
+	if s.LFSStore != nil {
+		return s.LFSStore
+	}
+	return &FilesystemLFSStore{Root: s.config.Dir, repoPath: func(repo string) (string, error) {
+		if repo == r.RepoName && r.RepoPath != "" {
+			return r.RepoPath, nil
+		}
+		return s.config.repoPath(repo)
+	}}
+}
+
+// getLFSObject serves an object. Interrupted downloads are resumed with a
+// "Range: bytes=<offset>-" header, as git-lfs sends it.
+func (s *Server) getLFSObject(oid string, w http.ResponseWriter, r *Request) {
+	context := "lfs-download"
+	store := s.lfsStore(r)
+
+	size, err := store.Size(r.Context(), r.RepoName, oid)
+	if err == ErrLFSObjectNotFound {
+		writeLFSError(w, http.StatusNotFound, "object does not exist")
+		return
+	}
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+	offset, ok := parseRangeOffset(r.Header.Get("Range"))
+	if ok && offset >= size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeLFSError(w, http.StatusRequestedRangeNotSatisfiable, "range starts after the object")
+		return
+	}
+	content, err := store.Get(r.Context(), r.RepoName, oid, offset)
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(size-offset, 10))
+	if offset > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		logError(context, err)
+	}
+}
+
+// parseRangeOffset parses a "bytes=<offset>-" range, the only kind used by
+// git-lfs. Other ranges are ignored and the whole object is sent.
+func parseRangeOffset(header string) (int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || !strings.HasSuffix(header, "-") {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(header, "bytes="), "-"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, false
+	}
+	return offset, true
+}
+
+// putLFSObject receives an upload. Uploads are staged on disk and only
+// handed to the store once their content matches their oid.
+//
+// Uploads may be split into chunks with "Content-Range: bytes
+// <first>-<last>/<size>" headers. Incomplete uploads are answered with 308
+// and a "Range: bytes=0-<last>" header of what was received so far, which
+// "Content-Range: bytes */<size>" without a body asks for, so interrupted
+// uploads can be resumed.
+func (s *Server) putLFSObject(oid string, w http.ResponseWriter, r *Request) {
+	context := "lfs-upload"
+
+	dir := s.LFSStagingDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gitkit-lfs")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fail500(w, context, err)
+		return
+	}
+
+	var staged string
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		var done bool
+		if staged, done = s.stageLFSChunk(dir, oid, contentRange, w, r); !done {
+			return
+		}
+	} else {
+		tmp, err := ioutil.TempFile(dir, oid+"-*")
+		if err != nil {
+			fail500(w, context, err)
+			return
+		}
+		staged = tmp.Name()
+		_, err = s.copyLFSBody(tmp, r.Body, w, r)
+		tmp.Close()
+		if err != nil {
+			os.Remove(staged)
+			return
+		}
+	}
+	defer os.Remove(staged)
+
+	f, err := os.Open(staged)
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != oid {
+		writeLFSError(w, http.StatusUnprocessableEntity, fmt.Sprintf("content has oid %s", got))
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fail500(w, context, err)
+		return
+	}
+	if err := s.lfsStore(r).Put(r.Context(), r.RepoName, oid, size, f); err != nil {
+		fail500(w, context, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// stageLFSChunk appends a chunk of an upload to its staging file. It
+// returns the file once the upload is complete, and answers the request
+// otherwise.
+func (s *Server) stageLFSChunk(dir, oid, contentRange string, w http.ResponseWriter, r *Request) (string, bool) {
+	context := "lfs-upload"
+
+	first, last, total, ok := parseContentRange(contentRange)
+	if !ok {
+		writeLFSError(w, http.StatusBadRequest, "invalid Content-Range")
+		return "", false
+	}
+	if limit := s.maxRequestBody(r); limit > 0 && total > limit {
+		s.rejectTooLarge(w, r, limit)
+		return "", false
+	}
+
+	// Chunks of the same upload are received one at a time.
+	key := sha256.Sum256([]byte(r.RepoName + "\x00" + oid))
+	name := filepath.Join(dir, hex.EncodeToString(key[:])+".part")
+	s.mu.Lock()
+	if s.lfsUploads == nil {
+		s.lfsUploads = make(map[string]bool)
+	}
+	busy := s.lfsUploads[name]
+	s.lfsUploads[name] = true
+	s.mu.Unlock()
+	if busy {
+		writeLFSError(w, http.StatusConflict, "another chunk of this upload is in progress")
+		return "", false
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.lfsUploads, name)
+		s.mu.Unlock()
+	}()
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fail500(w, context, err)
+		return "", false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fail500(w, context, err)
+		return "", false
+	}
+	received := info.Size()
+
+	switch {
+	case first < 0:
+		// A status query.
+	case first != received || last >= total:
+		lfsUploadIncomplete(w, http.StatusRequestedRangeNotSatisfiable, received)
+		return "", false
+	default:
+		n, err := s.copyLFSBody(f, io.LimitReader(r.Body, last-first+1), w, r)
+		if err != nil {
+			return "", false
+		}
+		received += n
+		if received > total {
+			f.Truncate(total)
+			received = total
+		}
+	}
+	if received < total {
+		lfsUploadIncomplete(w, http.StatusPermanentRedirect, received)
+		return "", false
+	}
+	return name, true
+}
+
+// copyLFSBody copies an upload to f, answering the request if it fails.
+func (s *Server) copyLFSBody(f *os.File, body io.Reader, w http.ResponseWriter, r *Request) (int64, error) {
+	if limit := s.maxRequestBody(r); limit > 0 {
+		body = &maxBytesReader{ReadCloser: ioutil.NopCloser(body), n: limit}
+	}
+	in := &readTracker{r: body}
+	n, err := io.Copy(f, in)
+	switch {
+	case err == nil:
+	case in.err == errRequestTooLarge:
+		s.rejectTooLarge(w, r, s.maxRequestBody(r))
+	case in.err != nil:
+		logError("lfs-upload", in.err)
+		writeLFSError(w, http.StatusBadRequest, "invalid request body")
+	default:
+		fail500(w, "lfs-upload", err)
+	}
+	return n, err
+}
+
+// lfsUploadIncomplete tells the client how much of an upload was received.
+func lfsUploadIncomplete(w http.ResponseWriter, status int, received int64) {
+	if received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	w.WriteHeader(status)
+}
+
+// parseContentRange parses "bytes <first>-<last>/<size>", or "bytes
+// */<size>", for which first and last are -1.
+func parseContentRange(header string) (first, last, size int64, ok bool) {
+	spec := strings.TrimPrefix(header, "bytes ")
+	rng, total, found := cut(spec, "/")
+	if !found || spec == header {
+		return 0, 0, 0, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, 0, 0, false
+	}
+	if rng == "*" {
+		return -1, -1, size, true
+	}
+	from, to, found := cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, err1 := strconv.ParseInt(from, 10, 64)
+	last, err2 := strconv.ParseInt(to, 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return 0, 0, 0, false
+	}
+	return first, last, size, true
+}
+
+func writeLFSError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", lfsContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,249 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// unsignedPayload skips signing request bodies, which S3 and GCS
+	// accept over TLS. Uploads are verified by the server beforehand.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+// S3LFSStore keeps LFS objects in an S3 bucket, or any storage speaking the
+// S3 API such as MinIO or, through NewGCSLFSStore, Google Cloud Storage.
+// Objects are stored as <Prefix><repo>/<oid>.
+type S3LFSStore struct {
+	// Endpoint is the URL of the S3 API, e.g.
+	// "https://s3.eu-west-1.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+	// AccessKeyID and SecretAccessKey sign the requests with AWS
+	// signature version 4. SessionToken is set for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// VirtualHosted addresses the bucket as <bucket>.<endpoint host>
+	// instead of <endpoint>/<bucket>.
+	VirtualHosted bool
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	now func() time.Time
+}
+
+// NewS3LFSStore returns a store for bucket in an AWS region.
+func NewS3LFSStore(region, bucket, accessKeyID, secretAccessKey string) *S3LFSStore {
+	return &S3LFSStore{
+		Endpoint:        "https://s3." + region + ".amazonaws.com",
+		Region:          region,
+		Bucket:          bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+	}
+}
+
+// NewGCSLFSStore returns a store for a Google Cloud Storage bucket, using
+// its S3 compatible XML API with HMAC keys.
+func NewGCSLFSStore(bucket, accessID, secret string) *S3LFSStore {
+	return &S3LFSStore{
+		Endpoint:        "https://storage.googleapis.com",
+		Region:          "auto",
+		Bucket:          bucket,
+		AccessKeyID:     accessID,
+		SecretAccessKey: secret,
+	}
+}
+
+// Size implements LFSStore.
+func (s *S3LFSStore) Size(ctx context.Context, repo, oid string) (int64, error) {
+	res, err := s.do(ctx, http.MethodHead, repo, oid, nil, -1, nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.ContentLength, nil
+}
+
+// Get implements LFSStore.
+func (s *S3LFSStore) Get(ctx context.Context, repo, oid string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(ctx, http.MethodGet, repo, oid, nil, -1, header)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Put implements LFSStore. S3 only makes objects visible once the upload
+// completed.
+func (s *S3LFSStore) Put(ctx context.Context, repo, oid string, size int64, r io.Reader) error {
+	res, err := s.do(ctx, http.MethodPut, repo, oid, r, size, http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// do sends a signed request for an object. Responses other than 2xx are
+// turned into errors, 404 into ErrLFSObjectNotFound.
+func (s *S3LFSStore) do(ctx context.Context, method, repo, oid string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	key := s.Prefix + repo + "/" + oid
+	if s.VirtualHosted {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path += "/" + key
+	} else {
+		u.Path += "/" + s.Bucket + "/" + key
+	}
+	// Send the path encoded exactly as it is signed.
+	u.RawPath = awsURIEncode(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if size >= 0 {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	s.sign(req, unsignedPayload, now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrLFSObjectNotFound
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, res.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds an AWS signature version 4 Authorization header to req,
+// covering the host, the range and all x-amz headers.
+func (s *S3LFSStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date[:8] + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{date[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// awsURIEncode encodes a path the way signature version 4 expects it:
+// everything but unreserved characters and slashes is percent-encoded.
+func awsURIEncode(p string) string {
+	return awsEncode(p, false)
+}
+
+func awsEncode(p string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := values[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEncode(k, true)+"="+awsEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,134 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrLFSObjectNotFound is returned by LFSStore implementations for objects
+// they don't have.
+var ErrLFSObjectNotFound = errors.New("lfs object not found")
+
+// LFSStore keeps the LFS objects of repositories. Objects are addressed by
+// repository and their SHA-256 oid. The server verifies uploads against
+// their oid before they are stored, so stores can trust the content they
+// are given.
+type LFSStore interface {
+	// Size returns the size of an object, or ErrLFSObjectNotFound.
+	Size(ctx context.Context, repo, oid string) (int64, error)
+	// Get returns the content of an object starting at offset, for
+	// resumed downloads, or ErrLFSObjectNotFound.
+	Get(ctx context.Context, repo, oid string, offset int64) (io.ReadCloser, error)
+	// Put stores an object of the given size. It must not become visible
+	// before it is complete.
+	Put(ctx context.Context, repo, oid string, size int64, r io.Reader) error
+}
+
+// FilesystemLFSStore keeps LFS objects in Root/<repo>/lfs/objects, in the
+// layout git-lfs uses locally. With Root set to Config.Dir, which is what
+// the server uses if Server.LFSStore is nil, objects live next to the
+// repositories.
+type FilesystemLFSStore struct {
+	Root string
+
+	// repoPath, if set, returns the directory of a repository in Root in
+	// place of joining them, see Config.repoPath.
+	repoPath func(repo string) (string, error)
+}
+
+// NewFilesystemLFSStore returns a store keeping objects below root.
+func NewFilesystemLFSStore(root string) *FilesystemLFSStore {
+	return &FilesystemLFSStore{Root: root}
+}
+
+func (s *FilesystemLFSStore) path(repo, oid string) (string, error) {
+	var dir string
+	if s.repoPath != nil {
+		p, err := s.repoPath(repo)
+		if err != nil {
+			return "", err
+		}
+		dir = p
+	} else {
+		if !validRepoName(repo) {
+			return "", fmt.Errorf("%w %q", errInvalidRepoPath, repo)
+		}
+		dir = filepath.Join(s.Root, filepath.FromSlash(repo))
+	}
+	return filepath.Join(dir, "lfs", "objects", oid[0:2], oid[2:4], oid), nil
+}
+
+// Size implements LFSStore.
+func (s *FilesystemLFSStore) Size(_ context.Context, repo, oid string) (int64, error) {
+	p, err := s.path(repo, oid)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return 0, ErrLFSObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Get implements LFSStore.
+func (s *FilesystemLFSStore) Get(_ context.Context, repo, oid string, offset int64) (io.ReadCloser, error) {
+	p, err := s.path(repo, oid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrLFSObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put implements LFSStore. The object is written to a temporary file that
+// is renamed into place once complete.
+func (s *FilesystemLFSStore) Put(_ context.Context, repo, oid string, size int64, r io.Reader) (err error) {
+	target, err := s.path(repo, oid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), oid+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
@@ -0,0 +1,178 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerLFS(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "org", "app.git")).Run())
+
+	acl := NewACL()
+	acl.Grant("alice", "org/*", AccessWrite)
+	acl.Grant("bob", "org/*", AccessRead)
+	server := New(Config{Dir: dir, Auth: true})
+	server.LFS = true
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		return &Principal{ID: username}, nil
+	}
+	server.Authorizer = acl
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	content := []byte("large binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	batch := func(user, operation string) (int, lfsBatchResponse) {
+		body, _ := json.Marshal(lfsBatchRequest{
+			Operation: operation,
+			Transfers: []string{"basic"},
+			Objects:   []lfsObject{{Oid: oid, Size: int64(len(content))}, {Oid: "not-an-oid", Size: 1}},
+		})
+		req, _ := http.NewRequest("POST", srv.URL+"/org/app.git/info/lfs/objects/batch", bytes.NewReader(body))
+		req.Header.Set("Accept", lfsContentType)
+		req.Header.Set("Content-Type", lfsContentType)
+		req.SetBasicAuth(user, "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var v lfsBatchResponse
+		json.NewDecoder(res.Body).Decode(&v)
+		return res.StatusCode, v
+	}
+	transfer := func(method string, action *lfsAction, body []byte) (int, []byte) {
+		req, _ := http.NewRequest(method, action.Href, bytes.NewReader(body))
+		for k, v := range action.Header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res.StatusCode, data
+	}
+
+	code, res := batch("bob", "download")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusNotFound, res.Objects[0].Error.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Objects[1].Error.Code)
+
+	code, _ = batch("bob", "upload")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, res = batch("alice", "upload")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "basic", res.Transfer)
+	upload := res.Objects[0].Actions["upload"]
+	if assert.NotNil(t, upload) {
+		assert.Equal(t, srv.URL+"/org/app.git/info/lfs/objects/"+oid, upload.Href)
+		assert.True(t, strings.HasPrefix(upload.Header["Authorization"], "Basic "))
+
+		// Content not matching the oid is refused.
+		code, _ = transfer("PUT", upload, []byte("something else"))
+		assert.Equal(t, http.StatusUnprocessableEntity, code)
+		code, _ = transfer("PUT", upload, content)
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	// Uploaded objects need no upload action anymore.
+	_, res = batch("alice", "upload")
+	assert.Nil(t, res.Objects[0].Actions)
+
+	code, res = batch("bob", "download")
+	assert.Equal(t, http.StatusOK, code)
+	download := res.Objects[0].Actions["download"]
+	if assert.NotNil(t, download) {
+		code, data := transfer("GET", download, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, content, data)
+	}
+
+	// Readers may not upload directly either.
+	bobUpload := &lfsAction{Href: srv.URL + "/org/app.git/info/lfs/objects/" + oid, Header: map[string]string{"Authorization": "Basic Ym9iOnNlY3JldA=="}}
+	code, _ = transfer("PUT", bobUpload, content)
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestServerLFSResumable(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "app.git")).Run())
+
+	store := NewFilesystemLFSStore(t.TempDir())
+	server := New(Config{Dir: dir})
+	server.LFS = true
+	server.LFSStore = store
+	server.LFSStagingDir = t.TempDir()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	href := srv.URL + "/app.git/info/lfs/objects/" + oid
+
+	send := func(method, header, value string, body []byte) *http.Response {
+		req, _ := http.NewRequest(method, href, bytes.NewReader(body))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res := send("PUT", "Content-Range", "bytes 0-3/10", content[:4])
+	assert.Equal(t, http.StatusPermanentRedirect, res.StatusCode)
+	assert.Equal(t, "bytes=0-3", res.Header.Get("Range"))
+
+	// Chunks must continue where the upload stopped.
+	res = send("PUT", "Content-Range", "bytes 6-9/10", content[6:])
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+	assert.Equal(t, "bytes=0-3", res.Header.Get("Range"))
+
+	res = send("PUT", "Content-Range", "bytes */10", nil)
+	assert.Equal(t, http.StatusPermanentRedirect, res.StatusCode)
+	assert.Equal(t, "bytes=0-3", res.Header.Get("Range"))
+
+	res = send("PUT", "Content-Range", "bytes 4-9/10", content[4:])
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	size, err := store.Size(context.Background(), "app.git", oid)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+
+	req, _ := http.NewRequest("GET", href, nil)
+	req.Header.Set("Range", "bytes=6-")
+	r, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		defer r.Body.Close()
+		data, _ := io.ReadAll(r.Body)
+		assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+		assert.Equal(t, "bytes 6-9/10", r.Header.Get("Content-Range"))
+		assert.Equal(t, "6789", string(data))
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "Content-Range", "bytes 4-2/10", nil).StatusCode)
+}
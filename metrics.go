@@ -0,0 +1,188 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram. Clones of large repositories take minutes.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// Metrics counts the requests served by the HTTP server per service, e.g.
+// git-upload-pack or git-receive-pack: their number by status code, their
+// duration and the bytes they transferred. Add it with Server.Use and serve
+// it in the Prometheus text format:
+//
+//	metrics := gitkit.NewMetrics()
+//	service.Use(metrics.Middleware())
+//	http.Handle("/metrics", metrics)
+type Metrics struct {
+	mu       sync.Mutex
+	services map[string]*serviceMetrics
+}
+
+type serviceMetrics struct {
+	codes    map[int]uint64
+	buckets  []uint64
+	count    uint64
+	seconds  float64
+	received uint64
+	sent     uint64
+}
+
+// NewMetrics returns metrics without any requests counted.
+func NewMetrics() *Metrics {
+	return &Metrics{services: make(map[string]*serviceMetrics)}
+}
+
+// Middleware returns middleware counting the requests it passes on.
+func (m *Metrics) Middleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, req *Request) {
+			start := time.Now()
+			rec := &metricsRecorder{ResponseWriter: w}
+			body := &countingReader{ReadCloser: req.Body}
+			req.Body = body
+			next(rec, req)
+			m.observe(req.Command, rec.status(), time.Since(start), body.n, rec.n)
+		}
+	}
+}
+
+func (m *Metrics) observe(service string, code int, d time.Duration, received, sent int64) {
+	if service == "" {
+		service = "unknown"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.services[service]
+	if sm == nil {
+		sm = &serviceMetrics{codes: make(map[int]uint64), buckets: make([]uint64, len(durationBuckets))}
+		m.services[service] = sm
+	}
+	sm.codes[code]++
+	sm.count++
+	sm.seconds += d.Seconds()
+	for i, le := range durationBuckets {
+		if d.Seconds() <= le {
+			sm.buckets[i]++
+		}
+	}
+	sm.received += uint64(received)
+	sm.sent += uint64(sent)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	services := make([]string, 0, len(m.services))
+	for service := range m.services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var n int64
+	printf := func(format string, args ...interface{}) {
+		written, _ := fmt.Fprintf(w, format, args...)
+		n += int64(written)
+	}
+	printf("# HELP gitkit_http_requests_total Git requests served over HTTP.\n")
+	printf("# TYPE gitkit_http_requests_total counter\n")
+	for _, service := range services {
+		codes := make([]int, 0, len(m.services[service].codes))
+		for code := range m.services[service].codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			printf("gitkit_http_requests_total{service=%q,code=\"%d\"} %d\n", service, code, m.services[service].codes[code])
+		}
+	}
+
+	printf("# HELP gitkit_http_request_duration_seconds Duration of git requests served over HTTP.\n")
+	printf("# TYPE gitkit_http_request_duration_seconds histogram\n")
+	for _, service := range services {
+		sm := m.services[service]
+		for i, le := range durationBuckets {
+			printf("gitkit_http_request_duration_seconds_bucket{service=%q,le=%q} %d\n", service, strconv.FormatFloat(le, 'g', -1, 64), sm.buckets[i])
+		}
+		printf("gitkit_http_request_duration_seconds_bucket{service=%q,le=\"+Inf\"} %d\n", service, sm.count)
+		printf("gitkit_http_request_duration_seconds_sum{service=%q} %g\n", service, sm.seconds)
+		printf("gitkit_http_request_duration_seconds_count{service=%q} %d\n", service, sm.count)
+	}
+
+	printf("# HELP gitkit_http_received_bytes_total Bytes of git request bodies received over HTTP.\n")
+	printf("# TYPE gitkit_http_received_bytes_total counter\n")
+	for _, service := range services {
+		printf("gitkit_http_received_bytes_total{service=%q} %d\n", service, m.services[service].received)
+	}
+	printf("# HELP gitkit_http_sent_bytes_total Bytes of git responses sent over HTTP.\n")
+	printf("# TYPE gitkit_http_sent_bytes_total counter\n")
+	for _, service := range services {
+		printf("gitkit_http_sent_bytes_total{service=%q} %d\n", service, m.services[service].sent)
+	}
+	return n, nil
+}
+
+// metricsRecorder records the status code and size of a response.
+type metricsRecorder struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (r *metricsRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *metricsRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Flush lets git responses be streamed through the recorder.
+func (r *metricsRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *metricsRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
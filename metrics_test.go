@@ -0,0 +1,53 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, "repo.git")).Run())
+
+	metrics := NewMetrics()
+	server := New(Config{Dir: repos})
+	server.Use(metrics.Middleware())
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	git := func(args ...string) {
+		out, err := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...).CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	git("-C", work, "-c", "protocol.version=0", "push", srv.URL+"/repo.git", "HEAD:refs/heads/master")
+	git("-c", "protocol.version=0", "clone", srv.URL+"/repo.git", filepath.Join(dir, "clone"))
+	assert.Error(t, exec.Command("git", "-c", "protocol.version=0", "clone", srv.URL+"/missing.git", filepath.Join(dir, "missing")).Run())
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+
+	assert.Contains(t, out, `gitkit_http_requests_total{service="git-receive-pack",code="200"} 2`)
+	assert.Contains(t, out, `gitkit_http_requests_total{service="git-upload-pack",code="200"} 2`)
+	assert.Contains(t, out, `gitkit_http_requests_total{service="git-upload-pack",code="404"} 1`)
+	assert.Contains(t, out, `gitkit_http_request_duration_seconds_count{service="git-upload-pack"} 3`)
+	assert.Contains(t, out, `gitkit_http_request_duration_seconds_bucket{service="git-upload-pack",le="+Inf"} 3`)
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "gitkit_http_received_bytes_total") || strings.HasPrefix(line, "gitkit_http_sent_bytes_total") {
+			assert.False(t, strings.HasSuffix(line, " 0"), line)
+		}
+	}
+}
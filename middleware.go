@@ -0,0 +1,35 @@
+package gitkit
+
+import "net/http"
+
+// HandlerFunc serves a git request to the HTTP server.
+type HandlerFunc func(w http.ResponseWriter, req *Request)
+
+// Middleware wraps the handling of git requests by the HTTP server, e.g.
+// for logging, authentication or resolving tenants. Middleware runs once the
+// service and repository of a request are known, before authentication.
+// It may answer the request itself instead of calling next, and change the
+// request before passing it on:
+//
+//   - RepoName, to serve another repository. RepoPath is derived from it
+//     afterwards.
+//   - Principal, to authenticate the request, which skips AuthFunc and
+//     BasicAuth. The Authorizer is still asked.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Use adds middleware, which runs in the order given, the first one
+// outermost. It must not be called while the server is serving requests.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// handler returns the middleware chain ending in svc.
+func (s *Server) handler(svc *service) HandlerFunc {
+	h := func(w http.ResponseWriter, req *Request) {
+		s.serveRequest(w, req, svc)
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
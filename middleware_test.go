@@ -0,0 +1,71 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMiddleware(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "acme", "repo.git")).Run())
+
+	var calls []string
+	var seen *Request
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		calls = append(calls, "auth")
+		return false, nil
+	}
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		calls = append(calls, "authorize "+req.Repo)
+		return nil
+	})
+	server.Use(
+		func(next HandlerFunc) HandlerFunc {
+			return func(w http.ResponseWriter, req *Request) {
+				calls = append(calls, "log "+req.Command)
+				next(w, req)
+			}
+		},
+		// Tenants are resolved from the host name, and authenticated by a
+		// header set by the proxy in front.
+		func(next HandlerFunc) HandlerFunc {
+			return func(w http.ResponseWriter, req *Request) {
+				if req.Header.Get("X-Tenant-Token") != "secret" {
+					http.Error(w, "no tenant", http.StatusUnauthorized)
+					return
+				}
+				req.RepoName = strings.Split(req.Host, ".")[0] + "/" + req.RepoName
+				req.Principal = &Principal{ID: "tenant-user"}
+				next(w, req)
+				seen = req
+			}
+		},
+	)
+
+	get := func(token string) int {
+		r := httptest.NewRequest("GET", "http://acme.git.example.com/repo.git/info/refs?service=git-upload-pack", nil)
+		r.Header.Set("X-Tenant-Token", token)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("secret"))
+	assert.Equal(t, []string{"log git-upload-pack", "authorize acme/repo.git"}, calls)
+	assert.Equal(t, filepath.Join(dir, "acme", "repo.git"), seen.RepoPath)
+
+	calls = nil
+	assert.Equal(t, http.StatusUnauthorized, get("wrong"))
+	assert.Equal(t, []string{"log git-upload-pack"}, calls)
+}
@@ -0,0 +1,308 @@
+package gitkit
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSCacheTTL = time.Hour
+	defaultTokenLeeway  = time.Minute
+	// jwksMinRefresh limits how often an unknown key ID refetches the JWKS,
+	// so tokens with made up key IDs can't hammer the identity provider.
+	jwksMinRefresh = 30 * time.Second
+	// jwksFetchTimeout bounds fetching the discovery document and keys.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// defaultOIDCClient fetches the keys of issuers if OIDCAuthenticator.Client
+// is nil.
+var defaultOIDCClient = &http.Client{Timeout: jwksFetchTimeout}
+
+// jwksFetch is a fetch of the keys of an issuer in progress, which requests
+// for unknown keys wait for.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// OIDCAuthenticator authenticates HTTP clients with OpenID Connect access
+// tokens, issued by Issuer for Audience. Its Authenticate method can be used
+// as Server.AuthFunc.
+//
+// Tokens are accepted as bearer tokens (git -c http.extraHeader="Authorization:
+// Bearer ...") or as basic auth password with any user name, which is what
+// credential helpers send. The signing keys are discovered through the
+// issuer's /.well-known/openid-configuration and cached.
+type OIDCAuthenticator struct {
+	// Issuer is the issuer URL the tokens must be issued by, e.g.
+	// "https://accounts.example.com".
+	Issuer string
+	// Audience is required in the aud claim of the tokens. Every token of the
+	// issuer is accepted if empty, which is rarely wanted.
+	Audience string
+	// Client is used to fetch the discovery document and keys, a client
+	// with a 10 second timeout if nil.
+	Client *http.Client
+	// CacheTTL is how long the keys are cached, an hour if zero. Keys are
+	// refetched earlier when a token is signed with an unknown key. If a
+	// refetch fails, the cached keys are used until the next one works.
+	CacheTTL time.Duration
+	// Leeway is the clock skew allowed when checking exp and nbf, a minute
+	// if zero.
+	Leeway time.Duration
+	// ClaimsFunc maps the claims of a valid token to a principal. If nil,
+	// sub becomes the ID, name or preferred_username the name, email the
+	// email and scope or scp the scopes.
+	ClaimsFunc func(claims map[string]interface{}) (*Principal, error)
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	jwksURI   string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	triedAt   time.Time
+	fetchErr  error
+	fetch     *jwksFetch
+}
+
+// NewOIDCAuthenticator returns an authenticator for tokens of issuer with
+// the given audience.
+func NewOIDCAuthenticator(issuer, audience string) *OIDCAuthenticator {
+	return &OIDCAuthenticator{Issuer: issuer, Audience: audience}
+}
+
+// Authenticate verifies the token of cred and sets the principal of req.
+func (a *OIDCAuthenticator) Authenticate(cred Credential, req *Request) (bool, error) {
+	token := bearerToken(cred)
+	if token == "" {
+		return false, nil
+	}
+
+	principal, err := a.Verify(req.Context(), token)
+	if err != nil {
+		return false, err
+	}
+	req.Principal = principal
+	return true, nil
+}
+
+// Verify checks the signature and claims of token and returns the principal
+// it was issued to.
+func (a *OIDCAuthenticator) Verify(ctx context.Context, token string) (*Principal, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.key(ctx, t.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.verify(key); err != nil {
+		return nil, err
+	}
+
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	leeway := a.Leeway
+	if leeway == 0 {
+		leeway = defaultTokenLeeway
+	}
+	if err := t.validate(strings.TrimSuffix(a.Issuer, "/"), a.Audience, now(), leeway); err != nil {
+		return nil, err
+	}
+	return t.principal(a.ClaimsFunc)
+}
+
+// bearerToken returns the token of cred, sent either as bearer token or as
+// basic auth password.
+func bearerToken(cred Credential) string {
+	if scheme, value, ok := cut(cred.Authorization, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(value)
+	}
+	return cred.Password
+}
+
+// principal returns the principal of a verified token, mapped by claimsFunc
+// if not nil.
+func (t *jwt) principal(claimsFunc func(map[string]interface{}) (*Principal, error)) (*Principal, error) {
+	if claimsFunc != nil {
+		principal, err := claimsFunc(t.claims)
+		if err == nil && principal == nil {
+			err = fmt.Errorf("no principal for token")
+		}
+		return principal, err
+	}
+	return principalFromClaims(t), nil
+}
+
+// principalFromClaims maps the standard claims of a token to a principal.
+func principalFromClaims(t *jwt) *Principal {
+	p := &Principal{
+		ID:    t.stringClaim("sub"),
+		Name:  t.stringClaim("name"),
+		Email: t.stringClaim("email"),
+	}
+	if p.Name == "" {
+		p.Name = t.stringClaim("preferred_username")
+	}
+	if p.Scopes = t.stringsClaim("scope"); p.Scopes == nil {
+		p.Scopes = t.stringsClaim("scp")
+	}
+	return p
+}
+
+// key returns the signing key with the given ID, fetching the keys of the
+// issuer if they aren't cached, are stale or don't include it. Stale keys
+// are served while they are refetched. The keys are fetched outside the
+// lock, once for all requests waiting for them.
+func (a *OIDCAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	ttl := a.CacheTTL
+	if ttl == 0 {
+		ttl = defaultJWKSCacheTTL
+	}
+	key, cached := a.cachedKey(kid)
+	switch {
+	case cached && time.Since(a.fetchedAt) < ttl:
+		a.mu.Unlock()
+		return key, nil
+	case time.Since(a.triedAt) < jwksMinRefresh:
+		err := a.fetchErr
+		a.mu.Unlock()
+		if cached {
+			return key, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetching signing keys: %v", err)
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	f := a.fetch
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		a.fetch = f
+		go a.fetchKeys(f)
+	}
+	a.mu.Unlock()
+	if cached {
+		return key, nil
+	}
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %v", f.err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.cachedKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// cachedKey looks up a key. Tokens without key ID are accepted if the issuer
+// has a single key.
+func (a *OIDCAuthenticator) cachedKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+// fetchKeys fetches the keys of the issuer for f. The keys cached before
+// are kept if it fails.
+func (a *OIDCAuthenticator) fetchKeys(f *jwksFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+
+	a.mu.Lock()
+	jwksURI := a.jwksURI
+	a.mu.Unlock()
+	keys, jwksURI, err := a.loadKeys(ctx, jwksURI)
+
+	a.mu.Lock()
+	now := time.Now()
+	a.triedAt, a.fetchErr, a.fetch = now, err, nil
+	if err == nil {
+		a.jwksURI, a.keys, a.fetchedAt = jwksURI, keys, now
+	}
+	a.mu.Unlock()
+	f.err = err
+	close(f.done)
+}
+
+// loadKeys fetches the keys of the issuer, discovering their location first
+// if jwksURI is empty.
+func (a *OIDCAuthenticator) loadKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, string, error) {
+	if jwksURI == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		issuer := strings.TrimSuffix(a.Issuer, "/")
+		if err := a.getJSON(ctx, issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", err
+		}
+		if discovery.Issuer != issuer {
+			return nil, "", fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", fmt.Errorf("discovery document has no jwks_uri")
+		}
+		jwksURI = discovery.JWKSURI
+	}
+
+	var set jwkSet
+	if err := a.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, "", err
+	}
+	return set.signingKeys("oidc"), jwksURI, nil
+}
+
+func (a *OIDCAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := a.Client
+	if client == nil {
+		client = defaultOIDCClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// cut is strings.Cut, which needs go 1.18.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,268 @@
+package gitkit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testIssuer is an OpenID Connect provider serving discovery and keys.
+type testIssuer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     []jwk
+	jwksHits int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/keys"})
+		case "/keys":
+			atomic.AddInt32(&iss.jwksHits, 1)
+			iss.mu.Lock()
+			defer iss.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string][]jwk{"keys": iss.keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) addRSAKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys = append(iss.keys, jwk{
+		Kty: "RSA", Kid: kid, Use: "sig",
+		N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	})
+	return key
+}
+
+func (iss *testIssuer) addECKey(t *testing.T, kid string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys = append(iss.keys, jwk{
+		Kty: "EC", Kid: kid, Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	return key
+}
+
+// signToken returns a token with the claims, signed by key with RS256 or
+// ES256.
+func signToken(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		assert.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	iss := newTestIssuer(t)
+	rsaKey := iss.addRSAKey(t, "rsa")
+	ecKey := iss.addECKey(t, "ec")
+
+	claims := func(override map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   iss.URL,
+			"aud":   []string{"gitkit", "other"},
+			"sub":   "alice",
+			"name":  "Alice",
+			"email": "alice@example.com",
+			"scope": "repo:read repo:write",
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		}
+		for k, v := range override {
+			c[k] = v
+		}
+		return c
+	}
+
+	a := NewOIDCAuthenticator(iss.URL, "gitkit")
+
+	p, err := a.Verify(context.Background(), signToken(t, rsaKey, "rsa", claims(nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{ID: "alice", Name: "Alice", Email: "alice@example.com", Scopes: []string{"repo:read", "repo:write"}}, p)
+
+	p, err = a.Verify(context.Background(), signToken(t, ecKey, "ec", claims(map[string]interface{}{"scp": []string{"repo:read"}, "scope": nil})))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"repo:read"}, p.Scopes)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&iss.jwksHits), "keys are cached")
+
+	for name, c := range map[string]map[string]interface{}{
+		"wrong audience": {"aud": "other"},
+		"wrong issuer":   {"iss": "https://evil.example.com"},
+		"expired":        {"exp": time.Now().Add(-2 * time.Minute).Unix()},
+		"not yet valid":  {"nbf": time.Now().Add(2 * time.Minute).Unix()},
+		"no expiry":      {"exp": nil},
+	} {
+		_, err := a.Verify(context.Background(), signToken(t, rsaKey, "rsa", claims(c)))
+		assert.Error(t, err, name)
+	}
+
+	// Within the leeway.
+	_, err = a.Verify(context.Background(), signToken(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()})))
+	assert.NoError(t, err)
+
+	// A key of the wrong type for the key ID, or a forged signature.
+	_, err = a.Verify(context.Background(), signToken(t, ecKey, "rsa", claims(nil)))
+	assert.Error(t, err)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = a.Verify(context.Background(), signToken(t, other, "rsa", claims(nil)))
+	assert.Error(t, err)
+
+	// Rotated keys are fetched, unknown ones aren't refetched every time.
+	a.fetchedAt = time.Now().Add(-time.Minute)
+	a.triedAt = a.fetchedAt
+	rotated := iss.addRSAKey(t, "rotated")
+	_, err = a.Verify(context.Background(), signToken(t, rotated, "rotated", claims(nil)))
+	assert.NoError(t, err)
+	hits := atomic.LoadInt32(&iss.jwksHits)
+	_, err = a.Verify(context.Background(), signToken(t, rotated, "unknown", claims(nil)))
+	assert.EqualError(t, err, `unknown signing key "unknown"`)
+	assert.Equal(t, hits, atomic.LoadInt32(&iss.jwksHits))
+
+	a.ClaimsFunc = func(claims map[string]interface{}) (*Principal, error) {
+		return &Principal{ID: "oidc:" + claims["sub"].(string)}, nil
+	}
+	p, err = a.Verify(context.Background(), signToken(t, rsaKey, "rsa", claims(nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, "oidc:alice", p.ID)
+}
+
+func TestOIDCAuthenticatorRefresh(t *testing.T) {
+	iss := newTestIssuer(t)
+	key := iss.addRSAKey(t, "rsa")
+	token := signToken(t, key, "rsa", map[string]interface{}{
+		"iss": iss.URL,
+		"aud": "gitkit",
+		"sub": "alice",
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	})
+	a := NewOIDCAuthenticator(iss.URL, "gitkit")
+
+	// Concurrent requests share one fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.Verify(context.Background(), token)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&iss.jwksHits))
+
+	// Stale keys are still served when the issuer is down.
+	iss.Close()
+	a.mu.Lock()
+	a.fetchedAt = time.Now().Add(-2 * defaultJWKSCacheTTL)
+	a.triedAt = a.fetchedAt
+	a.mu.Unlock()
+	_, err := a.Verify(context.Background(), token)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.fetch == nil && a.fetchErr != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = a.Verify(context.Background(), token)
+	assert.NoError(t, err)
+}
+
+func TestOIDCAuthenticatorHTTP(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	iss := newTestIssuer(t)
+	key := iss.addRSAKey(t, "rsa")
+	token := signToken(t, key, "rsa", map[string]interface{}{
+		"iss": iss.URL,
+		"aud": "gitkit",
+		"sub": "alice",
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	})
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "repo.git")).Run())
+
+	var principal *Principal
+	oidc := NewOIDCAuthenticator(iss.URL, "gitkit")
+	server := New(Config{Dir: dir, Auth: true})
+	server.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		ok, err := oidc.Authenticate(cred, req)
+		principal = req.Principal
+		return ok, err
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func(set func(*http.Request)) int {
+		req, _ := http.NewRequest("GET", srv.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+		set(req)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get(func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }))
+	assert.Equal(t, "alice", principal.ID)
+	assert.Equal(t, http.StatusOK, get(func(r *http.Request) { r.SetBasicAuth("oauth2", token) }))
+	assert.Equal(t, http.StatusUnauthorized, get(func(r *http.Request) { r.SetBasicAuth("oauth2", "not-a-token") }))
+	assert.Equal(t, http.StatusUnauthorized, get(func(r *http.Request) {}))
+
+	// git clone with the token as password.
+	out, err := exec.Command("git", "clone", "http://oauth2:"+token+"@"+srv.Listener.Addr().String()+"/repo.git", filepath.Join(dir, "clone")).CombinedOutput()
+	assert.NoError(t, err, string(out))
+	_, err = os.Stat(filepath.Join(dir, "clone", ".git"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,310 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCacheableRequest is the largest upload-pack request considered for the
+// pack cache. Clones are a few hundred bytes, large requests are
+// negotiations, which are never cached.
+const maxCacheableRequest = 64 << 10
+
+// packCacheFill writes an upload-pack response to the cache while it is
+// sent to the client.
+type packCacheFill struct {
+	file *os.File
+	name string
+	done chan struct{}
+	s    *Server
+	key  string
+}
+
+// Write writes p to the cache. Caching is best-effort: if writing fails,
+// the response is dropped from the cache but still sent to the client, so it
+// never fails.
+func (f *packCacheFill) Write(p []byte) (int, error) {
+	if f.file == nil {
+		return len(p), nil
+	}
+	if _, err := f.file.Write(p); err != nil {
+		logError("pack-cache", err)
+		f.drop()
+	}
+	return len(p), nil
+}
+
+// drop discards the response written so far.
+func (f *packCacheFill) drop() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+	f.file = nil
+}
+
+// commit makes the cached response visible to other requests and drops
+// those for other refs of the repository, which can't be served anymore.
+func (f *packCacheFill) commit() {
+	if f.file == nil {
+		return
+	}
+	if err := f.file.Close(); err != nil {
+		logError("pack-cache", err)
+		f.drop()
+		return
+	}
+	if err := os.Rename(f.file.Name(), f.name); err != nil {
+		logError("pack-cache", err)
+		f.drop()
+		return
+	}
+	f.file = nil
+	f.s.prunePackCache(filepath.Dir(f.name))
+	f.s.evictPackCache()
+}
+
+// release discards the response unless it was committed and wakes up the
+// requests waiting for it.
+func (f *packCacheFill) release() {
+	if f.file != nil {
+		f.drop()
+	}
+	f.s.mu.Lock()
+	delete(f.s.packFills, f.key)
+	f.s.mu.Unlock()
+	close(f.done)
+}
+
+// packCache serves the upload-pack request read from body from the cache,
+// if it is a clone that was served before. Otherwise it returns the request
+// body to pass on to git and, if the response can be cached, a fill to
+// write it to. body has been checked against the fetch policies already, a
+// request they deny fails to be read and is never cached.
+//
+// Identical clones arriving while the response is being generated wait for
+// it instead of running git themselves.
+func (s *Server) packCache(w http.ResponseWriter, r *Request, body io.Reader) (io.Reader, *packCacheFill, bool) {
+	request, err := ioutil.ReadAll(io.LimitReader(body, maxCacheableRequest+1))
+	rest := io.MultiReader(bytes.NewReader(request), body)
+	if err != nil || len(request) > maxCacheableRequest {
+		return rest, nil, false
+	}
+	key, ok := packCacheKey(request, r.protocolV2())
+	if !ok {
+		return rest, nil, false
+	}
+	state, err := refsState(r.RepoPath)
+	if err != nil {
+		logError("pack-cache", err)
+		return rest, nil, false
+	}
+	key = cacheKey(r.RepoName, r.Header.Get("Git-Protocol"), r.GitNamespace, state, key)
+
+	// Responses are kept by the refs they were made for, so those of old
+	// refs can be found and dropped however the repository was pushed to.
+	dir := filepath.Join(s.packCacheDir(r.RepoName), state)
+	name := filepath.Join(dir, key+".pack")
+	for {
+		if s.servePackFromCache(w, r, name) {
+			return nil, nil, true
+		}
+
+		s.mu.Lock()
+		if s.packFills == nil {
+			s.packFills = make(map[string]chan struct{})
+		}
+		wait, busy := s.packFills[key]
+		if !busy {
+			s.packFills[key] = make(chan struct{})
+		}
+		done := s.packFills[key]
+		s.mu.Unlock()
+		if busy {
+			select {
+			case <-wait:
+				continue
+			case <-r.Context().Done():
+				return rest, nil, false
+			}
+		}
+
+		fill := &packCacheFill{name: name, done: done, s: s, key: key}
+		err := os.MkdirAll(dir, 0755)
+		if err == nil {
+			fill.file, err = ioutil.TempFile(dir, key+"-*")
+		}
+		if err != nil {
+			logError("pack-cache", err)
+			fill.release()
+			return rest, nil, false
+		}
+		return rest, fill, false
+	}
+}
+
+// servePackFromCache answers r with the cached response in name, if there
+// is one.
+func (s *Server) servePackFromCache(w http.ResponseWriter, r *Request, name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	// The modification time orders responses for evictPackCache.
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		logError("pack-cache", err)
+	}
+	return true
+}
+
+// prunePackCache drops the cached responses of the repository of dir, but
+// those in dir. Responses being written are left alone.
+func (s *Server) prunePackCache(dir string) {
+	others, err := filepath.Glob(filepath.Join(filepath.Dir(dir), "*", "*.pack"))
+	if err != nil {
+		return
+	}
+	for _, name := range others {
+		if filepath.Dir(name) == dir {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logError("pack-cache", err)
+		}
+		// Only succeeds once the directory is empty.
+		os.Remove(filepath.Dir(name))
+	}
+}
+
+// evictPackCache removes the least recently used responses while the cache
+// is larger than MaxPackCacheSize.
+func (s *Server) evictPackCache() {
+	if s.MaxPackCacheSize <= 0 {
+		return
+	}
+	type pack struct {
+		name string
+		info os.FileInfo
+	}
+	var packs []pack
+	var size int64
+	filepath.Walk(s.PackCacheDir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && strings.HasSuffix(name, ".pack") {
+			packs = append(packs, pack{name, info})
+			size += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(packs, func(i, j int) bool {
+		return packs[i].info.ModTime().Before(packs[j].info.ModTime())
+	})
+	for _, p := range packs {
+		if size <= s.MaxPackCacheSize {
+			return
+		}
+		if err := os.Remove(p.name); err != nil && !os.IsNotExist(err) {
+			logError("pack-cache", err)
+			continue
+		}
+		size -= p.info.Size()
+	}
+}
+
+// packCacheDir returns the directory of the cached responses of repo.
+func (s *Server) packCacheDir(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	return filepath.Join(s.PackCacheDir, hex.EncodeToString(sum[:]))
+}
+
+// invalidatePackCache drops the cached responses of repo after a push.
+// Responses are keyed on the refs too, so this only frees the space.
+func (s *Server) invalidatePackCache(repo string) {
+	if s.PackCacheDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.packCacheDir(repo)); err != nil {
+		logError("pack-cache", err)
+	}
+}
+
+// packCacheKey returns the part of the cache key taken from an upload-pack
+// request: its lines, except those naming the client. Only requests
+// without haves, shallow commits or refs to resolve, which is what clones
+// send, can be cached.
+func packCacheKey(request []byte, v2 bool) (string, bool) {
+	var lines []string
+	var done, fetch bool
+	for len(request) > 0 {
+		if len(request) < 4 {
+			return "", false
+		}
+		n, err := strconv.ParseUint(string(request[:4]), 16, 16)
+		if err != nil {
+			return "", false
+		}
+		if n < 4 {
+			// Flush, delimiter and response end packets.
+			lines = append(lines, fmt.Sprintf("%04d", n))
+			request = request[4:]
+			continue
+		}
+		if int(n) > len(request) {
+			return "", false
+		}
+		line := strings.TrimSuffix(string(request[4:n]), "\n")
+		request = request[n:]
+
+		switch {
+		case strings.HasPrefix(line, "have "), strings.HasPrefix(line, "shallow "),
+			strings.HasPrefix(line, "deepen"), strings.HasPrefix(line, "want-ref "):
+			return "", false
+		case line == "done":
+			done = true
+		case line == "command=fetch":
+			fetch = true
+		}
+		var fields []string
+		for _, field := range strings.Fields(line) {
+			if !strings.HasPrefix(field, "agent=") && !strings.HasPrefix(field, "session-id=") {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	if !done || v2 && !fetch {
+		return "", false
+	}
+	// The order of wants doesn't change the pack.
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), true
+}
+
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%s\x00", part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,245 @@
+package gitkit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerPackCache(t *testing.T) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...).CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return string(out)
+	}
+	git("init", "--bare", filepath.Join(repos, "repo.git"))
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	git("-C", work, "push", filepath.Join(repos, "repo.git"), "HEAD:refs/heads/master")
+
+	// Count the packs made by git.
+	packs := filepath.Join(dir, "packs.log")
+	wrapper := filepath.Join(dir, "git")
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$*\" in *advertise-refs*) ;; upload-pack*) echo >> %s ;; esac\nexec %s \"$@\"\n", packs, gitPath)
+	assert.NoError(t, os.WriteFile(wrapper, []byte(script), 0755))
+	countPacks := func() int {
+		data, _ := os.ReadFile(packs)
+		return strings.Count(string(data), "\n")
+	}
+
+	server := New(Config{Dir: repos, GitPath: wrapper})
+	server.PackCacheDir = filepath.Join(dir, "cache")
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	url := srv.URL + "/repo.git"
+
+	clone := func(name, version string) {
+		clone := filepath.Join(dir, name)
+		git("-c", "protocol.version="+version, "clone", url, clone)
+		assert.Equal(t, "initial\n", git("-C", clone, "log", "--format=%s"))
+	}
+	cached := func() int {
+		packs, _ := filepath.Glob(filepath.Join(server.packCacheDir("repo.git"), "*", "*.pack"))
+		return len(packs)
+	}
+
+	clone("clone-v0", "0")
+	clone("clone-v0-again", "0")
+	assert.Equal(t, 1, countPacks())
+	clone("clone-v2", "2")
+	clone("clone-v2-again", "2")
+	assert.Equal(t, 2, cached())
+
+	git("-C", work, "commit", "--allow-empty", "-m", "second")
+	git("-C", work, "push", url, "HEAD:refs/heads/master")
+	_, err = os.Stat(server.packCacheDir("repo.git"))
+	assert.True(t, os.IsNotExist(err), "push drops the cache")
+
+	// Fetches negotiating with haves are not cached.
+	git("-C", filepath.Join(dir, "clone-v0"), "-c", "protocol.version=0", "fetch")
+	assert.Equal(t, 0, cached())
+
+	// Clones after the push get the new commits.
+	before := countPacks()
+	for _, name := range []string{"clone-new", "clone-new-again"} {
+		git("-c", "protocol.version=0", "clone", url, filepath.Join(dir, name))
+		assert.Equal(t, "second\ninitial\n", git("-C", filepath.Join(dir, name), "log", "--format=%s"))
+	}
+	assert.Equal(t, before+1, countPacks())
+	assert.Equal(t, 1, cached())
+
+	// Pushes that bypass the server, e.g. over SSH, leave the old responses
+	// until the new refs are cached.
+	git("-C", work, "commit", "--allow-empty", "-m", "third")
+	git("-C", work, "push", filepath.Join(repos, "repo.git"), "HEAD:refs/heads/master")
+	git("-c", "protocol.version=0", "clone", url, filepath.Join(dir, "clone-third"))
+	assert.Equal(t, "third\nsecond\ninitial\n", git("-C", filepath.Join(dir, "clone-third"), "log", "--format=%s"))
+	assert.Equal(t, 1, cached())
+}
+
+func TestServerPackCacheLimits(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...).CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return string(out)
+	}
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	for _, repo := range []string{"a.git", "b.git"} {
+		git("init", "--bare", filepath.Join(repos, repo))
+		git("-C", work, "push", filepath.Join(repos, repo), "HEAD:refs/heads/master")
+	}
+
+	server := New(Config{Dir: repos})
+	server.PackCacheDir = filepath.Join(dir, "cache")
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	cached := func(repo string) int {
+		packs, _ := filepath.Glob(filepath.Join(server.packCacheDir(repo), "*", "*.pack"))
+		return len(packs)
+	}
+
+	// Only the most recent response fits.
+	git("-c", "protocol.version=0", "clone", srv.URL+"/a.git", filepath.Join(dir, "a"))
+	packs, _ := filepath.Glob(filepath.Join(server.packCacheDir("a.git"), "*", "*.pack"))
+	if !assert.Len(t, packs, 1) {
+		return
+	}
+	info, err := os.Stat(packs[0])
+	assert.NoError(t, err)
+	limited := New(Config{Dir: repos})
+	limited.PackCacheDir = server.PackCacheDir
+	limited.MaxPackCacheSize = info.Size()
+	limitedSrv := httptest.NewServer(limited)
+	defer limitedSrv.Close()
+	git("-c", "protocol.version=0", "clone", limitedSrv.URL+"/b.git", filepath.Join(dir, "b"))
+	assert.Equal(t, 0, cached("a.git"))
+	assert.Equal(t, 1, cached("b.git"))
+
+	// Failing to write the cache doesn't fail the clone.
+	os.RemoveAll(server.PackCacheDir)
+	fill := &packCacheFill{name: filepath.Join(dir, "fill.pack"), done: make(chan struct{}), s: server}
+	fill.file, _ = os.Create(filepath.Join(dir, "fill.tmp"))
+	fill.file.Close()
+	n, err := fill.Write([]byte("0008NAK\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	fill.commit()
+	fill.release()
+	_, err = os.Stat(fill.name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPackCacheKey(t *testing.T) {
+	// request encodes lines as pkt-lines, with "0000" and "0001" as flush
+	// and delimiter packets.
+	request := func(lines ...string) []byte {
+		var b strings.Builder
+		for _, line := range lines {
+			if line == "0000" || line == "0001" {
+				b.WriteString(line)
+			} else {
+				packLine(&b, line+"\n")
+			}
+		}
+		return []byte(b.String())
+	}
+	want := "want 1111111111111111111111111111111111111111"
+	have := "have 2222222222222222222222222222222222222222"
+
+	key, ok := packCacheKey(request(want+" ofs-delta agent=git/2.1", "0000", "done"), false)
+	assert.True(t, ok)
+	other, _ := packCacheKey(request(want+" ofs-delta agent=git/2.9", "0000", "done"), false)
+	assert.Equal(t, key, other, "agents don't matter")
+
+	_, ok = packCacheKey(request(want, "0000", have, "done"), false)
+	assert.False(t, ok)
+	_, ok = packCacheKey(request(want, "0000"), false)
+	assert.False(t, ok, "negotiation without done")
+	_, ok = packCacheKey(request("command=ls-refs", "0001", "done", "0000"), true)
+	assert.False(t, ok)
+	_, ok = packCacheKey(request("command=fetch", "0001", "deepen 1", want, "done", "0000"), true)
+	assert.False(t, ok)
+	_, ok = packCacheKey(request("command=fetch", "agent=git/2.40", "0001", want, "done", "0000"), true)
+	assert.True(t, ok)
+}
+
+func TestServerPackCachePolicies(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...).CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+	_, err := git("init", "--bare", filepath.Join(repos, "repo.git"))
+	assert.NoError(t, err)
+	work := filepath.Join(dir, "work")
+	_, err = git("init", work)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = git("-C", work, "commit", "--allow-empty", "-m", fmt.Sprint("commit ", i))
+		assert.NoError(t, err)
+	}
+	_, err = git("-C", work, "push", filepath.Join(repos, "repo.git"), "HEAD:refs/heads/master")
+	assert.NoError(t, err)
+
+	server := New(Config{Dir: repos})
+	server.PackCacheDir = filepath.Join(dir, "cache")
+	server.MaxDepth = 2
+	server.AllowFilter = true
+	server.FilterPolicy = func(repo, filter string) error {
+		if filter != "blob:none" {
+			return fmt.Errorf("%w: only blob:none partial clones are allowed", ErrAccessDenied)
+		}
+		return nil
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	url := srv.URL + "/repo.git"
+
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "shallow-v"+version)
+		out, err := git("-c", "protocol.version="+version, "clone", "--depth=4", url, clone)
+		assert.NoError(t, err, out)
+		out, err = git("-C", clone, "rev-list", "--count", "HEAD")
+		assert.NoError(t, err)
+		assert.Equal(t, "2", out, version)
+
+		// The denied request is neither served nor cached, also after an
+		// allowed clone filled the cache.
+		for _, filter := range []string{"blob:none", "tree:0"} {
+			out, err = git("-c", "protocol.version="+version, "clone", "--no-checkout", "--filter="+filter, url, filepath.Join(dir, filter+"-v"+version))
+			if filter == "tree:0" {
+				assert.Error(t, err, version)
+				assert.Contains(t, out, "only blob:none partial clones are allowed", version)
+			} else {
+				assert.NoError(t, err, out)
+			}
+		}
+	}
+}
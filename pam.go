@@ -0,0 +1,84 @@
+//go:build pam
+// +build pam
+
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"strings"
+
+	"github.com/msteinert/pam"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultPAMService is the PAM service used if none is given, configured in
+// /etc/pam.d/gitkit.
+const defaultPAMService = "gitkit"
+
+// PAMAuthenticator checks passwords of system accounts through PAM. Its
+// Authenticate method can be used as SSH.PasswordFunc.
+//
+// It is only available when building with the pam tag, which requires cgo
+// and the PAM development headers.
+type PAMAuthenticator struct {
+	// Service is the PAM service to authenticate against, "gitkit" if
+	// empty.
+	Service string
+}
+
+// NewPAMAuthenticator returns an authenticator for the given PAM service.
+func NewPAMAuthenticator(service string) *PAMAuthenticator {
+	return &PAMAuthenticator{Service: service}
+}
+
+// Authenticate checks the password of the account named like the SSH user
+// and that the account may log in. The returned key is identified by the
+// account name, with the account's uid, gid and home directory as
+// attributes.
+func (a *PAMAuthenticator) Authenticate(meta ssh.ConnMetadata, password string) (*PublicKey, error) {
+	service := a.Service
+	if service == "" {
+		service = defaultPAMService
+	}
+	name := meta.User()
+
+	t, err := pam.StartFunc(service, name, func(style pam.Style, msg string) (string, error) {
+		switch style {
+		case pam.PromptEchoOff:
+			return password, nil
+		case pam.PromptEchoOn:
+			return name, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			return "", nil
+		}
+		return "", errors.New("unsupported PAM message style")
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting PAM transaction: %v", err)
+	}
+	if host, _, err := net.SplitHostPort(meta.RemoteAddr().String()); err == nil {
+		t.SetItem(pam.Rhost, host)
+	}
+	if err := t.Authenticate(pam.DisallowNullAuthtok); err != nil {
+		return nil, fmt.Errorf("PAM authentication: %v", err)
+	}
+	if err := t.AcctMgmt(pam.DisallowNullAuthtok); err != nil {
+		return nil, fmt.Errorf("PAM account check: %v", err)
+	}
+
+	pkey := &PublicKey{Id: name, Name: name}
+	if u, err := user.Lookup(name); err == nil {
+		if full := strings.SplitN(u.Name, ",", 2)[0]; full != "" {
+			pkey.Name = full
+		}
+		pkey.Attributes = map[string]string{
+			"uid":  u.Uid,
+			"gid":  u.Gid,
+			"home": u.HomeDir,
+		}
+	}
+	return pkey, nil
+}
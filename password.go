@@ -0,0 +1,64 @@
+package gitkit
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// passwordCallback authenticates a client with PasswordFunc.
+func (s *SSH) passwordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	perms, err := s.authenticatePassword(conn, string(password))
+	if err != nil {
+		s.authFailure(AuthEvent{
+			Type:       AuthEventAuthentication,
+			RemoteAddr: conn.RemoteAddr(),
+			User:       conn.User(),
+			Reason:     err.Error(),
+		})
+	}
+	return perms, err
+}
+
+// passwordPromptCallback asks for the password through keyboard-interactive
+// authentication, which clients such as OpenSSH prefer over plain password
+// authentication.
+func (s *SSH) passwordPromptCallback(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, fmt.Errorf("expected a single answer, got %d", len(answers))
+	}
+	return s.passwordCallback(conn, []byte(answers[0]))
+}
+
+func (s *SSH) authenticatePassword(conn ssh.ConnMetadata, password string) (perms *ssh.Permissions, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlePanic("ssh: password check", v)
+			perms, err = nil, fmt.Errorf("password check failed")
+		}
+	}()
+
+	if s.isBanned(conn.RemoteAddr()) {
+		return nil, errBanned
+	}
+	if err := s.checkClientVersion(conn); err != nil {
+		return nil, err
+	}
+
+	pkey, err := s.PasswordFunc(conn, password)
+	if err != nil {
+		return nil, err
+	}
+	if pkey == nil {
+		return nil, fmt.Errorf("password check did not return a key")
+	}
+	if err := checkKeyValidity(pkey, time.Now()); err != nil {
+		return nil, err
+	}
+	return principalPermissions(principalFromKey(pkey, nil)), nil
+}
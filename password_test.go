@@ -0,0 +1,90 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPasswordFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "password")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.PasswordFunc = func(meta ssh.ConnMetadata, password string) (*PublicKey, error) {
+		if meta.User() != "alice" || password != "secret" {
+			return nil, fmt.Errorf("invalid credentials")
+		}
+		return &PublicKey{Id: "alice", Attributes: map[string]string{"uid": "1000"}}, nil
+	}
+	events := make(chan AuthEvent, 4)
+	server.OnAuthFailure = func(event AuthEvent) {
+		events <- event
+	}
+	requests := make(chan *AccessRequest, 1)
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		requests <- req
+		return ErrAccessDenied
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func(user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+	prompt := func(password string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range questions {
+				answers[i] = password
+			}
+			return answers, nil
+		})
+	}
+
+	_, err = dial("alice", ssh.Password("wrong"))
+	g.Expect(err).To(HaveOccurred())
+	var event AuthEvent
+	g.Expect(events).To(Receive(&event))
+	g.Expect(event.User).To(Equal("alice"))
+	g.Expect(event.Reason).To(Equal("invalid credentials"))
+
+	_, err = dial("alice", prompt("wrong"))
+	g.Expect(err).To(HaveOccurred())
+
+	client, err := dial("alice", prompt("secret"))
+	g.Expect(err).ToNot(HaveOccurred())
+	client.Close()
+
+	client, err = dial("alice", ssh.Password("secret"))
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	session.Run("git-upload-pack 'repo.git'")
+
+	var req *AccessRequest
+	g.Eventually(requests, 5*time.Second).Should(Receive(&req))
+	g.Expect(req.KeyID).To(Equal("alice"))
+	g.Expect(req.Principal.Attributes).To(HaveKeyWithValue("uid", "1000"))
+	g.Expect(req.Principal.KeyType).To(BeEmpty())
+}
@@ -0,0 +1,146 @@
+package gitkit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PolicyInput is evaluated by SSH.PolicyFunc. Its JSON encoding is meant to
+// be used as input document of policy engines such as OPA.
+type PolicyInput struct {
+	// Principal is the key ID of the client, Scopes and Attributes are
+	// those of its Principal.
+	Principal  string            `json:"principal"`
+	Scopes     []string          `json:"scopes,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// SecurityKey is true if the client authenticated with a FIDO2
+	// security key.
+	SecurityKey bool   `json:"security_key,omitempty"`
+	Repo        string `json:"repo"`
+	// Operation is OperationRead or OperationWrite.
+	Operation string `json:"operation"`
+	// Ref, OldRev and NewRev describe a ref update of a push. They are
+	// empty when the command as a whole is evaluated.
+	Ref    string `json:"ref,omitempty"`
+	OldRev string `json:"old_rev,omitempty"`
+	NewRev string `json:"new_rev,omitempty"`
+}
+
+// PolicyDecision is the outcome of a policy evaluation.
+type PolicyDecision struct {
+	Allow bool
+	// Reason is shown to the client when the request is denied.
+	Reason string
+}
+
+// evaluatePolicy runs PolicyFunc, turning denials, errors and panics into an
+// error.
+func (s *SSH) evaluatePolicy(ctx context.Context, input PolicyInput) (err error) {
+	if s.PolicyFunc == nil {
+		return nil
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlePanic("ssh: policy", v)
+			err = fmt.Errorf("policy evaluation failed")
+		}
+	}()
+
+	decision, err := s.PolicyFunc(ctx, input)
+	if err != nil {
+		return fmt.Errorf("policy evaluation failed: %v", err)
+	}
+	if !decision.Allow {
+		return deniedBecause(decision.Reason)
+	}
+	return nil
+}
+
+// refUpdate is a command sent by the client to git-receive-pack.
+type refUpdate struct {
+	OldRev string
+	NewRev string
+	Ref    string
+}
+
+// readPushCommands reads the ref update commands a client sends to
+// git-receive-pack, up to and including the terminating flush packet. It
+// returns the raw bytes read so they can be passed on to git unchanged.
+func readPushCommands(r *bufio.Reader) ([]byte, []refUpdate, error) {
+	var raw []byte
+	var updates []refUpdate
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return raw, updates, err
+		}
+		raw = append(raw, header...)
+
+		size, err := strconv.ParseUint(string(header), 16, 16)
+		if err != nil {
+			return raw, updates, fmt.Errorf("invalid pkt-line length %q", header)
+		}
+		if size == 0 {
+			return raw, updates, nil
+		}
+		if size < 4 {
+			return raw, updates, fmt.Errorf("invalid pkt-line length %q", header)
+		}
+
+		payload := make([]byte, size-4)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return raw, updates, err
+		}
+		raw = append(raw, payload...)
+
+		line := string(payload)
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		// Skips shallow lines and push certificates.
+		if len(fields) == 3 && isObjectID(fields[0]) && isObjectID(fields[1]) {
+			updates = append(updates, refUpdate{OldRev: fields[0], NewRev: fields[1], Ref: fields[2]})
+		}
+	}
+}
+
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyPush passes a push from the client to git, checking each ref update
+// against PolicyFunc first. It only returns an error if an update was
+// denied, in which case nothing is passed on and the push must be aborted.
+func (s *SSH) copyPush(ctx context.Context, input PolicyInput, dst io.Writer, src io.Reader, stderr io.Writer) error {
+	r := bufio.NewReader(src)
+	raw, updates, err := readPushCommands(r)
+	if err == nil {
+		for _, u := range updates {
+			in := input
+			in.Ref, in.OldRev, in.NewRev = u.Ref, u.OldRev, u.NewRev
+			if err := s.evaluatePolicy(ctx, in); err != nil {
+				fmt.Fprintf(stderr, "%s\r\n", denialMessage(err, fmt.Sprintf("you may not update %s", u.Ref)))
+				return fmt.Errorf("%s: %w", u.Ref, err)
+			}
+		}
+	}
+
+	// Let git deal with whatever it was sent, including malformed input.
+	if _, err := dst.Write(raw); err == nil {
+		io.Copy(dst, r)
+	}
+	return nil
+}
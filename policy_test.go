@@ -0,0 +1,37 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readPushCommands(t *testing.T) {
+	old := strings.Repeat("a", 40)
+	newRev := strings.Repeat("b", 40)
+	var buf bytes.Buffer
+	packLine(&buf, "shallow "+old+"\n")
+	packLine(&buf, old+" "+newRev+" refs/heads/main\x00report-status side-band-64k\n")
+	packLine(&buf, ZeroSHA+" "+newRev+" refs/tags/v1\n")
+	packFlush(&buf)
+	input := buf.String() + "PACK..."
+
+	r := bufio.NewReader(strings.NewReader(input))
+	raw, updates, err := readPushCommands(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []refUpdate{
+		{OldRev: old, NewRev: newRev, Ref: "refs/heads/main"},
+		{OldRev: ZeroSHA, NewRev: newRev, Ref: "refs/tags/v1"},
+	}, updates)
+	assert.Equal(t, strings.TrimSuffix(input, "PACK..."), string(raw))
+
+	rest := new(bytes.Buffer)
+	rest.ReadFrom(r)
+	assert.Equal(t, "PACK...", rest.String())
+
+	_, _, err = readPushCommands(bufio.NewReader(strings.NewReader("zzzz")))
+	assert.Error(t, err)
+}
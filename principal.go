@@ -0,0 +1,163 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// principalExtension holds the JSON encoded Principal in the Permissions of
+// an authenticated connection.
+const principalExtension = "principal"
+
+// principalVariable is the environment variable git processes and their
+// hooks find the JSON encoded Principal in, see PrincipalFromEnv.
+const principalVariable = "GITKIT_PRINCIPAL"
+
+// Principal is the identity a client authenticated as. It is built from the
+// PublicKey returned by the key lookup and handed to authorizers, policies
+// and hooks, so they don't have to resolve the key ID again.
+type Principal struct {
+	// ID is the key ID, see PublicKey.Id.
+	ID         string            `json:"id"`
+	Name       string            `json:"name,omitempty"`
+	Email      string            `json:"email,omitempty"`
+	Scopes     []string          `json:"scopes,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Commands, if not empty, are the only git commands the principal may
+	// run, see PublicKey.Commands.
+	Commands []string `json:"commands,omitempty"`
+	// KeyType is the type of the key the client authenticated with, e.g.
+	// "sk-ssh-ed25519@openssh.com". SecurityKey is true if it is held by a
+	// FIDO2 security key, so policies can require hardware-backed keys.
+	KeyType     string `json:"key_type,omitempty"`
+	SecurityKey bool   `json:"security_key,omitempty"`
+	// Certificate is true if the client authenticated with a user
+	// certificate, which expires at ValidBefore unless that is zero.
+	Certificate bool      `json:"certificate,omitempty"`
+	ValidBefore time.Time `json:"valid_before,omitempty"`
+}
+
+// CanRun reports whether the principal may run the git command, e.g.
+// "git-upload-pack".
+func (p *Principal) CanRun(command string) bool {
+	if p == nil || len(p.Commands) == 0 {
+		return true
+	}
+	command = strings.Replace(command, " ", "-", 1)
+	for _, c := range p.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether scope was granted to the principal.
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the ID of the principal, followed by its name if known.
+func (p *Principal) String() string {
+	if p == nil {
+		return ""
+	}
+	if p.Name == "" || p.Name == p.ID {
+		return fmt.Sprintf("%q", p.ID)
+	}
+	return fmt.Sprintf("%q (%s)", p.ID, p.Name)
+}
+
+// PrincipalFromEnv returns the principal a git hook runs on behalf of, as
+// passed by the SSH server through the environment. It returns nil if the
+// hook wasn't started by an authenticated session.
+func PrincipalFromEnv() (*Principal, error) {
+	data := os.Getenv(principalVariable)
+	if data == "" {
+		return nil, nil
+	}
+	var p Principal
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", principalVariable, err)
+	}
+	return &p, nil
+}
+
+// principalFromKey returns the principal of a client that authenticated with
+// key, resolved to pkey. key is nil for password authentication.
+func principalFromKey(pkey *PublicKey, key ssh.PublicKey) *Principal {
+	p := &Principal{
+		ID:         pkey.Id,
+		Name:       pkey.Name,
+		Email:      pkey.Email,
+		Scopes:     pkey.Scopes,
+		Attributes: pkey.Attributes,
+		Commands:   pkey.Commands,
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if key != nil {
+		p.KeyType = key.Type()
+		p.SecurityKey = IsSecurityKey(key)
+	}
+	return p
+}
+
+// principalPermissions returns the Permissions of a connection
+// authenticated as principal.
+func principalPermissions(principal *Principal) *ssh.Permissions {
+	extensions := map[string]string{"key-id": principal.ID}
+	if data, err := json.Marshal(principal); err == nil {
+		extensions[principalExtension] = string(data)
+	}
+	return &ssh.Permissions{Extensions: extensions}
+}
+
+// keyPermissions returns the Permissions of a connection authenticated as
+// principal with key.
+func keyPermissions(principal *Principal, key ssh.PublicKey) *ssh.Permissions {
+	perms := principalPermissions(principal)
+	perms.Extensions[keyFingerprintExtension] = KeyFingerprint(key)
+	return perms
+}
+
+// principalFrom returns the principal of a connection. Connections without
+// authentication get an empty principal.
+func principalFrom(perms *ssh.Permissions) *Principal {
+	if perms == nil {
+		return &Principal{}
+	}
+	var p Principal
+	if data, ok := perms.Extensions[principalExtension]; ok && json.Unmarshal([]byte(data), &p) == nil {
+		return &p
+	}
+	return &Principal{ID: perms.Extensions["key-id"]}
+}
+
+// environ returns the variables describing the principal to git processes.
+func (p *Principal) environ() []string {
+	env := []string{
+		"GITKIT_KEY=" + p.ID,
+		"GITKIT_KEY_NAME=" + p.Name,
+		"GITKIT_EMAIL=" + p.Email,
+		"GITKIT_SCOPES=" + strings.Join(p.Scopes, " "),
+	}
+	if data, err := json.Marshal(p); err == nil {
+		env = append(env, principalVariable+"="+string(data))
+	}
+	return env
+}
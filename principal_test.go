@@ -0,0 +1,178 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPrincipal(t *testing.T) {
+	g := NewWithT(t)
+
+	p := &Principal{
+		ID:         "alice",
+		Name:       "Alice Liddell",
+		Email:      "alice@example.com",
+		Scopes:     []string{"repo:read", "repo:write"},
+		Attributes: map[string]string{"team": "platform"},
+	}
+	g.Expect(p.HasScope("repo:write")).To(BeTrue())
+	g.Expect(p.HasScope("admin")).To(BeFalse())
+	g.Expect((*Principal)(nil).HasScope("repo:read")).To(BeFalse())
+	g.Expect(p.CanRun("git-receive-pack")).To(BeTrue())
+	fetchOnly := &Principal{ID: "ci", Commands: []string{"git-upload-pack"}}
+	g.Expect(fetchOnly.CanRun("git-upload-pack")).To(BeTrue())
+	g.Expect(fetchOnly.CanRun("git upload-pack")).To(BeTrue())
+	g.Expect(fetchOnly.CanRun("git-receive-pack")).To(BeFalse())
+	g.Expect(fetchOnly.CanRun("git-upload-archive")).To(BeFalse())
+	g.Expect(p.String()).To(Equal(`"alice" (Alice Liddell)`))
+	g.Expect((&Principal{ID: "bob", Name: "bob"}).String()).To(Equal(`"bob"`))
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	key, err := ssh.NewPublicKey(pub)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(principalFrom(keyPermissions(p, key))).To(Equal(p))
+	g.Expect(principalFrom(nil)).To(Equal(&Principal{}))
+	g.Expect(principalFrom(&ssh.Permissions{Extensions: map[string]string{"key-id": "bob"}})).To(Equal(&Principal{ID: "bob"}))
+
+	env := p.environ()
+	g.Expect(env).To(ContainElements(
+		"GITKIT_KEY=alice",
+		"GITKIT_EMAIL=alice@example.com",
+		"GITKIT_SCOPES=repo:read repo:write",
+	))
+	for _, kv := range env {
+		if strings.HasPrefix(kv, principalVariable+"=") {
+			t.Setenv(principalVariable, strings.TrimPrefix(kv, principalVariable+"="))
+		}
+	}
+	fromEnv, err := PrincipalFromEnv()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(fromEnv).To(Equal(p))
+
+	t.Setenv(principalVariable, "")
+	fromEnv, err = PrincipalFromEnv()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(fromEnv).To(BeNil())
+}
+
+func TestPrincipalAuthorization(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "principal")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(priv)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.PublicKeyLookupKeyFunc = func(ssh.PublicKey, ssh.ConnMetadata) (*PublicKey, error) {
+		return &PublicKey{Id: "alice", Email: "alice@example.com", Scopes: []string{"repo:read"}}, nil
+	}
+	requests := make(chan *AccessRequest, 1)
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		requests <- req
+		return ErrAccessDenied
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	// The command is denied, so the session is closed without a reply.
+	session.Start("git-upload-pack 'repo.git'")
+
+	var req *AccessRequest
+	g.Eventually(requests, 5*time.Second).Should(Receive(&req))
+	g.Expect(req.KeyID).To(Equal("alice"))
+	g.Expect(req.Principal.Email).To(Equal("alice@example.com"))
+	g.Expect(req.Principal.HasScope("repo:read")).To(BeTrue())
+}
+
+func TestPrincipalCommands(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "principal")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(priv)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.PublicKeyLookupKeyFunc = func(ssh.PublicKey, ssh.ConnMetadata) (*PublicKey, error) {
+		return &PublicKey{Id: "ci", Commands: []string{"git-upload-pack"}}, nil
+	}
+	authorized := make(chan struct{}, 1)
+	server.Authorizer = AuthorizerFunc(func(*AccessRequest) error {
+		authorized <- struct{}{}
+		return nil
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	stderr := new(strings.Builder)
+	session.Stderr = stderr
+
+	g.Expect(session.Run("git-receive-pack 'repo.git'")).ToNot(Succeed())
+	g.Expect(stderr.String()).To(ContainSubstring("access denied: this key may not run git-receive-pack"))
+	g.Expect(authorized).ToNot(Receive())
+
+	// Fetching is what the key is for.
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	g.Expect(exec.Command("git", "init", "--bare", filepath.Join(dir, "repos", "repo.git")).Run()).To(Succeed())
+	session, err = client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	stderr.Reset()
+	session.Stderr = stderr
+	session.Stdin = strings.NewReader("0000")
+	g.Expect(session.Run("git-upload-pack 'repo.git'")).To(Succeed(), stderr.String())
+	g.Expect(authorized).To(Receive())
+}
@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// processRegistry keeps track of the git processes spawned by a server, so
+// that every one of them is reaped and the number of running processes can
+// be inspected.
+type processRegistry struct {
+	mu    sync.Mutex
+	procs map[*exec.Cmd]struct{}
+}
+
+// start starts cmd and registers it until it has been reaped by wait or
+// cleanUp.
+func (r *processRegistry) start(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.procs == nil {
+		r.procs = make(map[*exec.Cmd]struct{})
+	}
+	r.procs[cmd] = struct{}{}
+	return nil
+}
+
+// wait waits for cmd to exit and removes it from the registry. Calling wait
+// for a process that has already been reaped is a no-op.
+func (r *processRegistry) wait(cmd *exec.Cmd) error {
+	if !r.registered(cmd) {
+		return nil
+	}
+
+	err := cmd.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.procs, cmd)
+	return err
+}
+
+// cleanUp kills cmd if it has not been reaped yet and waits for it. It is
+// meant to be deferred right after start, so that early returns don't leave
+// zombie processes behind.
+func (r *processRegistry) cleanUp(cmd *exec.Cmd) {
+	if !r.registered(cmd) {
+		return
+	}
+
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	r.wait(cmd)
+}
+
+func (r *processRegistry) registered(cmd *exec.Cmd) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.procs[cmd]
+	return ok
+}
+
+func (r *processRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.procs)
+}
@@ -0,0 +1,34 @@
+package gitkit
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_processRegistry(t *testing.T) {
+	var r processRegistry
+
+	done := exec.Command("true")
+	assert.NoError(t, r.start(done))
+	assert.Equal(t, 1, r.count())
+	assert.NoError(t, r.wait(done))
+	assert.Equal(t, 0, r.count())
+	assert.NotNil(t, done.ProcessState)
+
+	// Waiting again or cleaning up a reaped process is a no-op.
+	assert.NoError(t, r.wait(done))
+	r.cleanUp(done)
+
+	running := exec.Command("sleep", "60")
+	assert.NoError(t, r.start(running))
+	assert.Equal(t, 1, r.count())
+	r.cleanUp(running)
+	assert.Equal(t, 0, r.count())
+	assert.NotNil(t, running.ProcessState)
+	assert.False(t, running.ProcessState.Success())
+
+	assert.Error(t, r.start(exec.Command("/does/not/exist")))
+	assert.Equal(t, 0, r.count())
+}
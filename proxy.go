@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SetTrustedProxies parses the addresses of the reverse proxies in front of
+// the server, as CIDR ranges or single addresses, see TrustedProxies.
+func (s *Server) SetTrustedProxies(entries ...string) error {
+	nets, err := parseCIDRs(entries)
+	if err != nil {
+		return err
+	}
+	s.TrustedProxies = nets
+	return nil
+}
+
+// clientIP returns the address of the client behind r. Headers naming the
+// client are only believed if the request comes from a trusted proxy, and
+// only as far as the chain of trusted proxies goes, so clients can't spoof
+// their address by sending the headers themselves.
+func (s *Server) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(s.TrustedProxies, ip) {
+		return ip
+	}
+
+	// Hops are listed from the client to the last proxy, so they are
+	// walked backwards until one isn't a trusted proxy.
+	hops := forwardedFor(r.Header)
+	if len(hops) == 0 {
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		hops = splitList(r.Header.Values("X-Real-IP"))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(s.TrustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the for parameters of RFC 7239 Forwarded headers.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, element := range splitList(h.Values("Forwarded")) {
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// splitList splits comma separated header values.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				list = append(list, e)
+			}
+		}
+	}
+	return list
+}
+
+// parseHop parses an address from a forwarding header, which may carry a
+// port and brackets around IPv6 addresses. Obfuscated identifiers such as
+// "unknown" return nil.
+func parseHop(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// externalURL returns the scheme and host clients reach the server at, as
+// seen by trusted proxies if r comes through one, e.g. "https://git.example.com".
+func (s *Server) externalURL(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if ip := parseHop(r.RemoteAddr); ip != nil && containsIP(s.TrustedProxies, ip) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+			host = h
+		}
+	}
+	return scheme + "://" + host
+}
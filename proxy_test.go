@@ -0,0 +1,77 @@
+package gitkit
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	s := New(Config{})
+	assert.NoError(t, s.SetTrustedProxies("10.0.0.0/8", "2001:db8::1"))
+	assert.Error(t, s.SetTrustedProxies("not-an-ip"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "192.0.2.1"},
+		{"x-forwarded-for", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"chain of proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"spoofed by client", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"x-real-ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8::1]:4711"`, "X-Forwarded-For": "203.0.113.9"}, "198.51.100.7"},
+		{"forwarded ipv6", "[2001:db8::1]:1234", map[string]string{"Forwarded": `for="[2001:db8::cafe]"`}, "2001:db8::cafe"},
+		{"obfuscated", "10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/repo.git/info/refs", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, s.clientIP(r).String())
+		})
+	}
+}
+
+func TestServerTrustedProxies(t *testing.T) {
+	var access *AccessRequest
+	s := New(Config{Dir: t.TempDir()})
+	assert.NoError(t, s.SetTrustedProxies("10.0.0.1"))
+	s.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		access = req
+		return ErrAccessDenied
+	})
+
+	r := httptest.NewRequest("GET", "/repo.git/info/refs?service=git-upload-pack", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "198.51.100.7:0", access.RemoteAddr.String())
+
+	r.Header.Del("X-Forwarded-For")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "10.0.0.1:1234", access.RemoteAddr.String())
+}
+
+func TestServerExternalURL(t *testing.T) {
+	s := New(Config{})
+	assert.NoError(t, s.SetTrustedProxies("10.0.0.0/8"))
+
+	r := httptest.NewRequest("GET", "/repo.git/info/lfs/objects/batch", nil)
+	r.Host = "git.internal:8080"
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "git.example.com")
+	assert.Equal(t, "http://git.internal:8080", s.externalURL(r))
+
+	r.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "https://git.example.com", s.externalURL(r))
+}
@@ -0,0 +1,172 @@
+package gitkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rawPattern matches raw file downloads, /{repo}/raw/{ref}/{path}. The
+// repository ends at the first /raw/, so files in raw directories work.
+var rawPattern = regexp.MustCompile(`^(.+?)/raw/(.+)$`)
+
+// objectIDPattern matches full SHA-1 and SHA-256 object IDs.
+var objectIDPattern = regexp.MustCompile(`^[0-9a-f]{40}(?:[0-9a-f]{24})?$`)
+
+// findRawService returns the service serving a raw file and the repository
+// path, or nil if p is not one.
+func (s *Server) findRawService(p string) (*service, string) {
+	m := rawPattern.FindStringSubmatch(p)
+	if m == nil {
+		return nil, ""
+	}
+	refAndPath := m[2]
+	return &service{
+		method: "GET",
+		suffix: "/raw/" + refAndPath,
+		handler: func(_ string, w http.ResponseWriter, r *Request) {
+			s.getRawFile(refAndPath, w, r)
+		},
+		rpc: "git-upload-pack",
+	}, m[1]
+}
+
+// rawObject is a blob found by resolveRawPath.
+type rawObject struct {
+	id   string
+	ref  string
+	size int64
+}
+
+// getRawFile streams the blob at ref:path. The blob ID is the ETag, so
+// clients can revalidate cheaply.
+func (s *Server) getRawFile(refAndPath string, w http.ResponseWriter, r *Request) {
+	context := "get-raw-file"
+
+	if rejectNamespaced(w, r) {
+		return
+	}
+
+	if strings.HasPrefix(refAndPath, "-") || strings.ContainsAny(refAndPath, "\n\x00") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	obj, err := s.resolveRawPath(r, refAndPath)
+	if err != nil {
+		fail500(w, context, err)
+		return
+	}
+	if obj == nil {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	etag := `"` + obj.id + `"`
+	w.Header().Set("ETag", etag)
+	if objectIDPattern.MatchString(obj.ref) {
+		w.Header().Set("Cache-Control", s.immutableCacheControl(r))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, "--git-dir", r.RepoPath, "cat-file", "blob", obj.id)
+	cmd.Stderr = nil
+	if err := s.procs.start(cmd); err != nil {
+		fail500(w, context, err)
+		return
+	}
+	defer s.procs.cleanUp(cmd)
+
+	content := bufio.NewReaderSize(pipe, 512)
+	contentType := mime.TypeByExtension(path.Ext(refAndPath))
+	if contentType == "" {
+		head, _ := content.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.size, 10))
+	// Don't let browsers render HTML or scripts from repositories.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, content); err != nil {
+		logError(context, err)
+		return
+	}
+	if err := s.procs.wait(cmd); err != nil {
+		logError(context, err)
+	}
+}
+
+// resolveRawPath splits refAndPath into a ref and the path of a blob in it.
+// Refs may contain slashes themselves, so every split is tried, shortest
+// ref first, in a single git cat-file process. It returns nil if no split
+// names a blob.
+func (s *Server) resolveRawPath(r *Request, refAndPath string) (*rawObject, error) {
+	parts := strings.Split(refAndPath, "/")
+	var refs, queries []string
+	for i := 1; i < len(parts); i++ {
+		ref, file := strings.Join(parts[:i], "/"), strings.Join(parts[i:], "/")
+		if file == "" {
+			continue
+		}
+		refs = append(refs, ref)
+		queries = append(queries, ref+":"+file)
+	}
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	cmd, pipe := gitCommand(r.Context(), s.config.GitPath, "--git-dir", r.RepoPath, "cat-file", "--batch-check")
+	cmd.Stderr = nil
+	cmd.Stdin = strings.NewReader(strings.Join(queries, "\n") + "\n")
+	if err := s.procs.start(cmd); err != nil {
+		return nil, err
+	}
+	defer s.procs.cleanUp(cmd)
+
+	var found *rawObject
+	scanner := bufio.NewScanner(pipe)
+	for i := 0; scanner.Scan() && i < len(refs); i++ {
+		// Found objects are "<id> <type> <size>", others "<query> missing"
+		// or "<query> ambiguous".
+		fields := strings.Fields(scanner.Text())
+		if found != nil || len(fields) != 3 || fields[1] != "blob" || !objectIDPattern.MatchString(fields[0]) {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		found = &rawObject{id: fields[0], ref: refs[i], size: size}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.procs.wait(cmd); err != nil {
+		return nil, fmt.Errorf("cat-file: %v", err)
+	}
+	return found, nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
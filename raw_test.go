@@ -0,0 +1,97 @@
+package gitkit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRawFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	assert.NoError(t, os.MkdirAll(filepath.Join(work, "config", "raw"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(work, "config", "raw", "app.json"), []byte(`{"debug":true}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(work, "notes"), []byte("plain text\n"), 0644))
+	git("-C", work, "add", ".")
+	git("-C", work, "commit", "-m", "initial")
+	git("-C", work, "push", repo, "HEAD:refs/heads/master", "HEAD:refs/heads/feature/x")
+	commit := git("-C", work, "rev-parse", "HEAD")
+	blob := git("-C", work, "rev-parse", "HEAD:config/raw/app.json")
+
+	server := New(Config{Dir: repos})
+	server.RawFiles = true
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func(path string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := get("/app.git/raw/master/config/raw/app.json")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `{"debug":true}`, body)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, `"`+blob+`"`, res.Header.Get("ETag"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+
+	res, _ = get("/app.git/raw/master/config/raw/app.json", "If-None-Match", `"`+blob+`"`)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+
+	// Refs with slashes, commit IDs and sniffed content types.
+	res, body = get("/app.git/raw/feature/x/notes")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "plain text\n", body)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	res, _ = get("/app.git/raw/" + commit + "/notes")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "public, max-age=31536000", res.Header.Get("Cache-Control"))
+
+	for _, path := range []string{"/app.git/raw/master/missing", "/app.git/raw/master/config", "/app.git/raw/master"} {
+		res, _ = get(path)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode, path)
+	}
+
+	// Files that needed authentication are kept out of shared caches.
+	private := New(Config{Dir: repos, Auth: true})
+	private.RawFiles = true
+	private.AuthFunc = func(Credential, *Request) (bool, error) { return true, nil }
+	privateSrv := httptest.NewServer(private)
+	defer privateSrv.Close()
+	req, _ := http.NewRequest("GET", privateSrv.URL+"/app.git/raw/"+commit+"/notes", nil)
+	req.SetBasicAuth("alice", "secret")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "private, max-age=31536000", res.Header.Get("Cache-Control"))
+}
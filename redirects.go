@@ -0,0 +1,83 @@
+package gitkit
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Redirects maps the old names of moved repositories to their new ones, so
+// clients still using an old name aren't served an empty repository created
+// by AutoCreate. It is safe for concurrent use and can be shared by the HTTP
+// and SSH servers.
+type Redirects struct {
+	// Notify, if true, refuses git commands on an old name, telling the
+	// client "repository moved to" the new one, instead of serving it.
+	Notify bool
+
+	mu    sync.RWMutex
+	moved map[string]string
+}
+
+// NewRedirects returns an empty redirect table. The zero value is one too.
+func NewRedirects() *Redirects {
+	return &Redirects{moved: make(map[string]string)}
+}
+
+// Add records that the repository from moved to to.
+func (r *Redirects) Add(from, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.moved == nil {
+		r.moved = make(map[string]string)
+	}
+	r.moved[from] = to
+}
+
+// Remove forgets the redirect of from, e.g. once a new repository is
+// created in its place.
+func (r *Redirects) Remove(from string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.moved, from)
+}
+
+// Lookup returns the name repo moved to, following repeated moves.
+func (r *Redirects) Lookup(repo string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	to, ok := r.moved[repo]
+	if !ok {
+		return "", false
+	}
+	// A cycle would leave to at some repository on it.
+	for i := 0; i < len(r.moved); i++ {
+		next, ok := r.moved[to]
+		if !ok {
+			break
+		}
+		to = next
+	}
+	return to, true
+}
+
+// follow returns the name repo moved to, or repo if it didn't move.
+func (r *Redirects) follow(repo string) (string, bool) {
+	if to, ok := r.Lookup(repo); ok {
+		return to, true
+	}
+	return repo, false
+}
+
+// movedMessage tells a client that the repository it asked for moved to repo.
+func movedMessage(repo string) string {
+	return "repository moved to " + repo
+}
+
+// serveMoved answers req, for the repository from that moved to
+// req.RepoName, with a notice. It is sent with WriteGitError, so git shows
+// it, and anything but the smart protocol is answered with 410.
+func (s *Server) serveMoved(w http.ResponseWriter, req *Request, from string) {
+	logInfo("redirect", from+" moved to "+req.RepoName)
+	WriteGitError(w, req.Request, http.StatusGone, movedMessage(req.RepoName))
+}
@@ -0,0 +1,100 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectsLookup(t *testing.T) {
+	r := NewRedirects()
+	_, ok := r.Lookup("app.git")
+	assert.False(t, ok)
+
+	r.Add("app.git", "team/app.git")
+	r.Add("team/app.git", "team/backend.git")
+	to, ok := r.Lookup("app.git")
+	assert.True(t, ok)
+	assert.Equal(t, "team/backend.git", to)
+
+	// Cycles don't hang lookups.
+	r.Add("team/backend.git", "app.git")
+	_, ok = r.Lookup("app.git")
+	assert.True(t, ok)
+
+	r.Remove("app.git")
+	_, ok = r.Lookup("app.git")
+	assert.False(t, ok)
+
+	var zero Redirects
+	zero.Add("app.git", "team/app.git")
+	to, ok = zero.Lookup("app.git")
+	assert.True(t, ok)
+	assert.Equal(t, "team/app.git", to)
+}
+
+func TestServerRedirects(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	server := New(Config{Dir: repos, AutoCreate: true})
+	server.Redirects = NewRedirects()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	out, err := git("-C", work, "push", srv.URL+"/app.git", "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+
+	// Renamed repositories keep being served under their old name, which
+	// AutoCreate doesn't create again.
+	assert.NoError(t, server.RenameRepo("app.git", "team/app.git"))
+	out, err = git("clone", srv.URL+"/app.git", filepath.Join(dir, "clone"))
+	assert.NoError(t, err, out)
+	out, err = git("-C", filepath.Join(dir, "clone"), "log", "--format=%s")
+	assert.NoError(t, err)
+	assert.Equal(t, "initial\n", out)
+	assert.False(t, repoExists(filepath.Join(repos, "app.git")))
+
+	notify := New(Config{Dir: repos, AutoCreate: true})
+	notify.Redirects = NewRedirects()
+	notify.Redirects.Notify = true
+	notify.Redirects.Add("app.git", "team/app.git")
+	notify.RawFiles = true
+	srv = httptest.NewServer(notify)
+	defer srv.Close()
+	for _, version := range []string{"0", "2"} {
+		out, err = git("-c", "protocol.version="+version, "clone", srv.URL+"/app.git", filepath.Join(dir, "notified"))
+		assert.Error(t, err)
+		assert.Contains(t, out, "repository moved to team/app.git")
+	}
+	out, err = git("-C", work, "push", srv.URL+"/app.git", "HEAD:refs/heads/master")
+	assert.Error(t, err)
+	assert.Contains(t, out, "repository moved to team/app.git")
+	res, err := http.Get(srv.URL + "/app.git/raw/master/README")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusGone, res.StatusCode)
+	assert.False(t, repoExists(filepath.Join(repos, "app.git")))
+
+	// A new repository can take the old name.
+	assert.NoError(t, notify.CreateRepo("app.git"))
+	_, ok := notify.Redirects.Lookup("app.git")
+	assert.False(t, ok)
+}
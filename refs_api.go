@@ -0,0 +1,258 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCommitLimit = 30
+	maxCommitLimit     = 100
+)
+
+// Ref is a branch, tag or other ref of a repository in the API.
+type Ref struct {
+	// Name is the full name, e.g. "refs/heads/main".
+	Name string `json:"name"`
+	// Type is "branch", "tag" or "other".
+	Type string `json:"type"`
+	// Commit is the commit the ref points to, after peeling annotated
+	// tags.
+	Commit string `json:"commit"`
+	// Tag is the ID of the tag object of annotated tags.
+	Tag string `json:"tag,omitempty"`
+}
+
+// Signature is the author or committer of a commit.
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Time  time.Time `json:"time"`
+}
+
+// Commit is the metadata of a commit in the API.
+type Commit struct {
+	ID        string    `json:"id"`
+	Tree      string    `json:"tree"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// splitAPIPath splits the path of an API request below /api/repos into the
+// repository and the resource requested from it, if any: "refs", or
+// "commits" with an optional revision.
+func splitAPIPath(p string) (repo, resource, arg string) {
+	if i := strings.Index(p, "/commits/"); i > 0 {
+		return p[:i], "commits", p[i+len("/commits/"):]
+	}
+	for _, resource := range []string{"refs", "commits"} {
+		if strings.HasSuffix(p, "/"+resource) {
+			return strings.TrimSuffix(p, "/"+resource), resource, ""
+		}
+	}
+	return p, "", ""
+}
+
+// serveRepoContents serves the read-only part of the repository API:
+//
+//	GET /api/repos/{name}/refs           lists branches and tags, or only
+//	                                     those of ?type=branch or tag
+//	GET /api/repos/{name}/commits        lists commits from ?ref, HEAD by
+//	                                     default, ?limit and ?skip page them
+//	GET /api/repos/{name}/commits/{rev}  returns a single commit
+//
+// Requests are authorized as OperationRead. Repositories the Authorizer
+// serves from a git namespace are not found.
+func (s *Server) serveRepoContents(w http.ResponseWriter, req *Request, name, resource, arg string) {
+	if req.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !validRepoName(name) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid repository name %q", name))
+		return
+	}
+	name = s.config.lookupRepo(name)
+	if !s.authenticate(w, req) {
+		return
+	}
+	req.RepoName = name
+	if err := s.authorizeRequest(req, OperationRead); err != nil {
+		writeAPIError(w, http.StatusForbidden, denialMessage(err, permissionMessage(OperationRead, name)))
+		return
+	}
+	dir, ok := s.apiRepoPath(w, req, name)
+	if !ok {
+		return
+	}
+	req.RepoPath = dir
+	// The refs and commits of a git namespace would be those of the whole
+	// repository, as with raw files.
+	if req.GitNamespace != "" || !repoExists(req.RepoPath) {
+		writeAPIError(w, http.StatusNotFound, name+" does not exist")
+		return
+	}
+
+	switch {
+	case resource == "refs":
+		s.listRefs(w, req)
+	case arg != "":
+		commits, ok := s.logCommits(w, req, arg, 1, 0)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, commits[0])
+	default:
+		query := req.URL.Query()
+		rev := query.Get("ref")
+		if rev == "" {
+			rev = "HEAD"
+		}
+		limit, err := queryInt(query.Get("limit"), defaultCommitLimit)
+		if err != nil || limit <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if limit > maxCommitLimit {
+			limit = maxCommitLimit
+		}
+		skip, err := queryInt(query.Get("skip"), 0)
+		if err != nil || skip < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid skip")
+			return
+		}
+		if commits, ok := s.logCommits(w, req, rev, limit, skip); ok {
+			writeJSON(w, http.StatusOK, commits)
+		}
+	}
+}
+
+// refTypes maps the type query parameter to ref prefixes.
+var refTypes = map[string]string{
+	"":       "refs/",
+	"branch": "refs/heads/",
+	"tag":    "refs/tags/",
+}
+
+func (s *Server) listRefs(w http.ResponseWriter, req *Request) {
+	prefix, ok := refTypes[req.URL.Query().Get("type")]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "type must be branch or tag")
+		return
+	}
+	out, err := s.gitOutput(req, "for-each-ref", "--format=%(refname)%00%(objectname)%00%(*objectname)", prefix)
+	if err != nil {
+		logError("refs-api", err)
+		writeAPIError(w, http.StatusInternalServerError, "listing refs failed")
+		return
+	}
+
+	refs := []Ref{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			continue
+		}
+		ref := Ref{Name: fields[0], Type: "other", Commit: fields[1]}
+		switch {
+		case strings.HasPrefix(ref.Name, "refs/heads/"):
+			ref.Type = "branch"
+		case strings.HasPrefix(ref.Name, "refs/tags/"):
+			ref.Type = "tag"
+		}
+		if fields[2] != "" {
+			ref.Tag, ref.Commit = fields[1], fields[2]
+		}
+		refs = append(refs, ref)
+	}
+	writeJSON(w, http.StatusOK, refs)
+}
+
+// commitFormat is the git log format parsed by parseCommit, with fields
+// separated by unit separators. The message comes last, so it may contain
+// anything.
+const commitFormat = "%H%x1f%T%x1f%P%x1f%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI%x1f%B"
+
+// logCommits returns up to limit commits reachable from rev after skipping
+// skip of them. Unknown revisions are answered with 404.
+func (s *Server) logCommits(w http.ResponseWriter, req *Request, rev string, limit, skip int) ([]Commit, bool) {
+	if strings.HasPrefix(rev, "-") || strings.ContainsAny(rev, " \n\x00") {
+		writeAPIError(w, http.StatusBadRequest, "invalid ref")
+		return nil, false
+	}
+	commit, err := s.resolveCommit(req, rev)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown ref %q", rev))
+		return nil, false
+	}
+
+	out, err := s.gitOutput(req, "log", "-z", "--format="+commitFormat, "-n", strconv.Itoa(limit), "--skip", strconv.Itoa(skip), commit, "--")
+	if err != nil {
+		logError("refs-api", err)
+		writeAPIError(w, http.StatusInternalServerError, "listing commits failed")
+		return nil, false
+	}
+	commits := []Commit{}
+	for _, record := range strings.Split(string(out), "\x00") {
+		if c, ok := parseCommit(record); ok {
+			commits = append(commits, c)
+		}
+	}
+	return commits, true
+}
+
+func parseCommit(record string) (Commit, bool) {
+	fields := strings.SplitN(record, "\x1f", 10)
+	if len(fields) != 10 {
+		return Commit{}, false
+	}
+	c := Commit{
+		ID:        fields[0],
+		Tree:      fields[1],
+		Parents:   strings.Fields(fields[2]),
+		Author:    Signature{Name: fields[3], Email: fields[4]},
+		Committer: Signature{Name: fields[6], Email: fields[7]},
+		Message:   fields[9],
+	}
+	c.Author.Time, _ = time.Parse(time.RFC3339, fields[5])
+	c.Committer.Time, _ = time.Parse(time.RFC3339, fields[8])
+	if c.Parents == nil {
+		c.Parents = []string{}
+	}
+	return c, true
+}
+
+// gitOutput runs a git command in the repository of req and returns its
+// output.
+func (s *Server) gitOutput(req *Request, args ...string) ([]byte, error) {
+	cmd, pipe := gitCommand(req.Context(), s.config.GitPath, append([]string{"--git-dir", req.RepoPath}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := s.procs.start(cmd); err != nil {
+		return nil, err
+	}
+	defer s.procs.cleanUp(cmd)
+
+	out, err := ioutil.ReadAll(pipe)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.procs.wait(cmd); err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, stderr.Bytes())
+	}
+	return out, nil
+}
+
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
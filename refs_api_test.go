@@ -0,0 +1,105 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRefsAPI(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "org", "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	first := git("-C", work, "rev-parse", "HEAD")
+	git("-C", work, "commit", "--allow-empty", "-m", "second\n\nWith a body.")
+	second := git("-C", work, "rev-parse", "HEAD")
+	git("-C", work, "tag", "-a", "-m", "release", "v1.0", first)
+	git("-C", work, "tag", "light")
+	git("-C", work, "push", repo, "HEAD:refs/heads/master", "HEAD:refs/heads/feature/x", "--tags")
+
+	acl := NewACL()
+	acl.Grant("alice", "org/*", AccessRead)
+	server := New(Config{Dir: repos})
+	server.RepoAPI = true
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		return &Principal{ID: username}, nil
+	}
+	server.Authorizer = acl
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func(user, path string, v interface{}) int {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.SetBasicAuth(user, "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		if v != nil {
+			assert.NoError(t, json.Unmarshal(data, v), string(data))
+		}
+		return res.StatusCode
+	}
+
+	var refs []Ref
+	assert.Equal(t, http.StatusOK, get("alice", "/api/repos/org/app.git/refs", &refs))
+	assert.Equal(t, []Ref{
+		{Name: "refs/heads/feature/x", Type: "branch", Commit: second},
+		{Name: "refs/heads/master", Type: "branch", Commit: second},
+		{Name: "refs/tags/light", Type: "tag", Commit: second},
+		{Name: "refs/tags/v1.0", Type: "tag", Commit: first, Tag: refs[3].Tag},
+	}, refs)
+	assert.NotEmpty(t, refs[3].Tag)
+	assert.Equal(t, http.StatusOK, get("alice", "/api/repos/org/app.git/refs?type=tag", &refs))
+	assert.Len(t, refs, 2)
+
+	var commits []Commit
+	assert.Equal(t, http.StatusOK, get("alice", "/api/repos/org/app.git/commits?ref=master", &commits))
+	if assert.Len(t, commits, 2) {
+		assert.Equal(t, second, commits[0].ID)
+		assert.Equal(t, []string{first}, commits[0].Parents)
+		assert.Equal(t, "second\n\nWith a body.\n", commits[0].Message)
+		assert.Equal(t, "Test", commits[0].Author.Name)
+		assert.Equal(t, "test@example.com", commits[0].Committer.Email)
+		assert.False(t, commits[0].Author.Time.IsZero())
+		assert.Equal(t, []string{}, commits[1].Parents)
+	}
+	assert.Equal(t, http.StatusOK, get("alice", "/api/repos/org/app.git/commits?limit=1&skip=1", &commits))
+	if assert.Len(t, commits, 1) {
+		assert.Equal(t, first, commits[0].ID)
+	}
+
+	var commit Commit
+	assert.Equal(t, http.StatusOK, get("alice", "/api/repos/org/app.git/commits/feature/x", &commit))
+	assert.Equal(t, second, commit.ID)
+	assert.Equal(t, http.StatusOK, get("alice", "/api/repos/org/app.git/commits/v1.0", &commit))
+	assert.Equal(t, first, commit.ID)
+
+	assert.Equal(t, http.StatusNotFound, get("alice", "/api/repos/org/app.git/commits/missing", nil))
+	assert.Equal(t, http.StatusBadRequest, get("alice", "/api/repos/org/app.git/commits?ref=--all", nil))
+	assert.Equal(t, http.StatusBadRequest, get("alice", "/api/repos/org/app.git/commits?limit=x", nil))
+	assert.Equal(t, http.StatusForbidden, get("bob", "/api/repos/org/app.git/refs", nil))
+	assert.Equal(t, http.StatusNotFound, get("alice", "/api/repos/org/missing.git/refs", nil))
+}
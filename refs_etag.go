@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// refsETag returns a validator for the ref advertisement of rpc, computed
+// from the files the advertisement is made of instead of running git: HEAD,
+// the loose refs, packed-refs and the config, which may hide refs. Files are
+// compared by size and modification time, which git changes on every update
+// since refs are written to a lock file that is renamed into place. The
+// capabilities depend on config too, the settings git runs with, as pairs
+// of keys and values.
+func refsETag(r *Request, rpc string, config []string) (string, error) {
+	state, err := refsState(r.RepoPath)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", rpc, r.Header.Get("Git-Protocol"))
+	if r.GitNamespace != "" {
+		fmt.Fprintf(h, "namespace %s\x00", r.GitNamespace)
+	}
+	for _, v := range configEnviron(config) {
+		fmt.Fprintf(h, "%s\x00", v)
+	}
+	h.Write([]byte(state))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// refsState returns a hash of the files making up the refs of the
+// repository at repoPath, see refsETag. It changes whenever a ref does.
+func refsState(repoPath string) (string, error) {
+	h := sha256.New()
+	head, err := ioutil.ReadFile(filepath.Join(repoPath, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	h.Write(head)
+
+	for _, name := range []string{"packed-refs", "config"} {
+		info, err := os.Stat(filepath.Join(repoPath, name))
+		switch {
+		case os.IsNotExist(err):
+			fmt.Fprintf(h, "%s -\n", name)
+		case err != nil:
+			return "", err
+		default:
+			fmt.Fprintf(h, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	refs := filepath.Join(repoPath, "refs")
+	err = filepath.Walk(refs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(refs, p)
+			fmt.Fprintf(h, "%s %d %d\n", rel, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
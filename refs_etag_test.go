@@ -0,0 +1,84 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerInfoRefsETag(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo.git")
+	git := func(args ...string) {
+		out, err := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...).CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	git("init", "--bare", repo)
+	work := filepath.Join(dir, "work")
+	git("init", work)
+	git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	git("-C", work, "push", repo, "HEAD:refs/heads/master")
+
+	var mu sync.Mutex
+	var bundles []string
+	server := New(Config{Dir: dir})
+	server.BundleURIs = func(string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return bundles
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func(etag, protocol string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if protocol != "" {
+			req.Header.Set("Git-Protocol", protocol)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res := get("", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	assert.Equal(t, http.StatusNotModified, get(etag, "").StatusCode)
+	assert.Equal(t, http.StatusOK, get(etag, "version=2").StatusCode)
+
+	// New refs and packing refs change the validator.
+	git("-C", work, "push", repo, "HEAD:refs/heads/other")
+	res = get(etag, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	etag = res.Header.Get("ETag")
+	git("--git-dir", repo, "pack-refs", "--all")
+	res = get(etag, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	etag = res.Header.Get("ETag")
+	assert.Equal(t, http.StatusNotModified, get(etag, "").StatusCode)
+
+	// So do the settings upload-pack advertises its capabilities with.
+	res = get("", "version=2")
+	v2 := res.Header.Get("ETag")
+	mu.Lock()
+	bundles = []string{"https://cdn.example.com/repo.bundle"}
+	mu.Unlock()
+	assert.Equal(t, http.StatusOK, get(etag, "").StatusCode)
+	assert.Equal(t, http.StatusOK, get(v2, "version=2").StatusCode)
+}
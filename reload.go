@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reload applies a new configuration to the server, including host keys
+// from its KeyDir and the authentication settings. Only connections
+// accepted after Reload returns use the new configuration, established
+// sessions are left untouched. Like ReloadHostKeys, host keys added
+// directly to a config passed to SetSSHConfig are not carried over.
+func (s *SSH) Reload(config Config) error {
+	current := s.serverConfig()
+	if current == nil {
+		return fmt.Errorf("cannot reload before Listen()")
+	}
+
+	// Use PATH if full path is not specified
+	if config.GitPath == "" {
+		config.GitPath = "git"
+	}
+
+	if err := config.Setup(); err != nil {
+		return err
+	}
+
+	sshConfig := cloneServerConfig(current)
+	if err := s.configureServer(sshConfig, &config); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.sshConfig = sshConfig
+	s.gitConfig = &config
+	s.mu.Unlock()
+	return nil
+}
+
+// ReloadOnSignal calls load and applies the returned configuration with
+// Reload every time one of the given signals is received, SIGHUP if none
+// are given. It blocks until ctx is cancelled. Failed reloads are logged and
+// leave the running configuration in place.
+func (s *SSH) ReloadOnSignal(ctx context.Context, load func() (Config, error), sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			logInfo("reload", fmt.Sprintf("received %s, reloading configuration", sig))
+
+			config, err := load()
+			if err != nil {
+				logError("reload", err)
+				continue
+			}
+			if err := s.Reload(config); err != nil {
+				logError("reload", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReload(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "reload")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	}
+
+	server := NewSSH(config)
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return nil, fmt.Errorf("no keys")
+	}
+	g.Expect(server.Reload(config)).ToNot(Succeed())
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+
+	established, err := dial()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer established.Close()
+
+	authConfig := config
+	authConfig.Auth = true
+	g.Expect(server.Reload(authConfig)).To(Succeed())
+	g.Expect(server.config().GitPath).To(Equal("git"))
+
+	_, err = dial()
+	g.Expect(err).To(HaveOccurred())
+
+	session, err := established.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	session.Close()
+
+	// Keep SIGHUP from terminating the test binary in case it arrives
+	// before ReloadOnSignal has registered its handler.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loaded := make(chan struct{}, 1)
+	go server.ReloadOnSignal(ctx, func() (Config, error) {
+		loaded <- struct{}{}
+		return config, nil
+	})
+
+	g.Eventually(func() error {
+		p, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			return err
+		}
+		if err := p.Signal(syscall.SIGHUP); err != nil {
+			return err
+		}
+		select {
+		case <-loaded:
+		case <-time.After(100 * time.Millisecond):
+			return fmt.Errorf("configuration not reloaded")
+		}
+		client, err := dial()
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}, 5*time.Second).Should(Succeed())
+}
@@ -0,0 +1,424 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// repoAPIPrefix is where the repository API is served, see Server.RepoAPI.
+const repoAPIPrefix = "/api/repos"
+
+// Types of a RepoEvent.
+const (
+	RepoCreated = "created"
+	RepoDeleted = "deleted"
+	RepoRenamed = "renamed"
+)
+
+// RepoEvent describes a change to the repositories of the HTTP server, see
+// Server.OnRepoEvent.
+type RepoEvent struct {
+	Type string
+	Time time.Time
+	// Repo is the repository, after the change for renames.
+	Repo string
+	// OldRepo is the previous name of a renamed repository.
+	OldRepo string
+	// Principal made the change. It is nil if authentication is disabled
+	// and the repository was created through AutoCreate, and for changes
+	// made with methods such as Server.CreateRepo.
+	Principal *Principal
+}
+
+// Repository is the JSON representation of a repository in the API.
+type Repository struct {
+	Name string `json:"name"`
+}
+
+// repoEvent reports a change to OnRepoEvent.
+func (s *Server) repoEvent(event RepoEvent) {
+	if s.OnRepoEvent == nil {
+		return
+	}
+	event.Time = time.Now()
+	s.OnRepoEvent(event)
+}
+
+// Errors of the repository management methods of Server.
+var (
+	ErrInvalidRepoName = errors.New("invalid repository name")
+	ErrRepoExists      = errors.New("repository already exists")
+	ErrRepoNotFound    = errors.New("repository does not exist")
+)
+
+// Repos returns the names of the repositories of the server, sorted.
+func (s *Server) Repos() ([]string, error) {
+	return listRepos(s.config.Dir)
+}
+
+// listRepos returns the names of the repositories in dir, sorted.
+func listRepos(dir string) ([]string, error) {
+	var repos []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if !repoExists(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			repos = append(repos, filepath.ToSlash(rel))
+		}
+		return filepath.SkipDir
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	sort.Strings(repos)
+	return repos, err
+}
+
+// CreateRepo creates a bare repository, with hooks if AutoHooks is set.
+// Like the changes made through the repository API, it is reported to
+// OnRepoEvent, without a principal.
+func (s *Server) CreateRepo(name string) error {
+	if !validRepoName(name) {
+		return ErrInvalidRepoName
+	}
+	name = s.config.lookupRepo(name)
+	dir, err := s.managedRepoPath(name)
+	if err != nil {
+		return err
+	}
+	if fileExists(dir) {
+		return ErrRepoExists
+	}
+	return s.createRepo(name, dir, nil)
+}
+
+// RenameRepo renames a repository, see CreateRepo.
+func (s *Server) RenameRepo(from, to string) error {
+	if !validRepoName(from) || !validRepoName(to) {
+		return ErrInvalidRepoName
+	}
+	from = s.config.lookupRepo(from)
+	source, err := s.managedRepoPath(from)
+	if err != nil {
+		return err
+	}
+	target, err := s.managedRepoPath(to)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !repoExists(source):
+		return ErrRepoNotFound
+	case s.renameConflicts(from, to, target):
+		return ErrRepoExists
+	}
+	if err := s.renameRepo(from, to, source, target); err != nil {
+		return err
+	}
+	s.repoEvent(RepoEvent{Type: RepoRenamed, Repo: to, OldRepo: from})
+	return nil
+}
+
+// DeleteRepo deletes a repository, see CreateRepo.
+func (s *Server) DeleteRepo(name string) error {
+	if !validRepoName(name) {
+		return ErrInvalidRepoName
+	}
+	name = s.config.lookupRepo(name)
+	dir, err := s.managedRepoPath(name)
+	if err != nil {
+		return err
+	}
+	if !repoExists(dir) {
+		return ErrRepoNotFound
+	}
+	if err := s.deleteRepo(name, dir); err != nil {
+		return err
+	}
+	s.repoEvent(RepoEvent{Type: RepoDeleted, Repo: name})
+	return nil
+}
+
+// resolveRepo returns where the repository name is kept for principal,
+// through ResolveRepo if it is set.
+func (s *Server) resolveRepo(ctx context.Context, principal *Principal, name string) (string, error) {
+	if s.ResolveRepo == nil {
+		return s.config.repoPath(name)
+	}
+	return s.config.resolveRepo(ctx, s.ResolveRepo, principal, name)
+}
+
+// managedRepoPath returns the location of the repository name for the
+// repository management methods, ErrInvalidRepoName for names repoPath
+// refuses. ResolveRepo is asked without a principal.
+func (s *Server) managedRepoPath(name string) (string, error) {
+	p, err := s.resolveRepo(context.Background(), nil, name)
+	if errors.Is(err, errInvalidRepoPath) {
+		return "", ErrInvalidRepoName
+	}
+	return p, err
+}
+
+// apiRepoPath returns the location of the repository name for the
+// repository API. If there is none, the request is answered with an error
+// the way serveRequest answers it.
+func (s *Server) apiRepoPath(w http.ResponseWriter, req *Request, name string) (string, bool) {
+	p, err := s.resolveRepo(req.Context(), req.Principal, name)
+	switch {
+	case err == nil:
+		return p, true
+	case errors.Is(err, errInvalidRepoPath):
+		logError("repo-api", err)
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid repository path %q", name))
+	case errors.Is(err, ErrAccessDenied):
+		writeAPIError(w, http.StatusForbidden, denialMessage(err, ""))
+	default:
+		logError("resolve-repo", fmt.Errorf("resolving %s: %v", name, err))
+		writeAPIError(w, http.StatusNotFound, name+" does not exist")
+	}
+	return "", false
+}
+
+// createRepo creates a bare repository, as AutoCreate does.
+func (s *Server) createRepo(name, dir string, principal *Principal) error {
+	if err := initRepo(dir, &s.config); err != nil {
+		return err
+	}
+	if s.Redirects != nil {
+		s.Redirects.Remove(name)
+	}
+	s.repoEvent(RepoEvent{Type: RepoCreated, Repo: name, Principal: principal})
+	return nil
+}
+
+// serveRepoAPI serves the repository API:
+//
+//	POST   /api/repos        {"name": "org/app.git"} creates a repository
+//	GET    /api/repos/{name} returns it
+//	PATCH  /api/repos/{name} {"name": "org/new.git"} renames it
+//	DELETE /api/repos/{name} deletes it
+//
+// and the refs and commits of repositories, see serveRepoContents. Requests
+// are always authenticated, even if Config.Auth is off, and authorized as
+// OperationCreate, OperationRead, OperationRename and OperationDelete.
+// Changes are refused if there is no Authorizer or Config.ReadOnly is set.
+func (s *Server) serveRepoAPI(w http.ResponseWriter, r *http.Request, remoteIP net.IP) {
+	name, resource, arg := splitAPIPath(strings.Trim(strings.TrimPrefix(r.URL.Path, repoAPIPrefix), "/"))
+	req := &Request{Request: r, RemoteIP: remoteIP}
+	if resource != "" {
+		s.serveRepoContents(w, req, name, resource, arg)
+		return
+	}
+
+	var body Repository
+	switch {
+	case name == "" && r.Method == http.MethodPost, name != "" && r.Method == http.MethodPatch:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if !validRepoName(body.Name) {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid repository name %q", body.Name))
+			return
+		}
+	case name != "" && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if name != "" && !validRepoName(name) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid repository name %q", name))
+		return
+	}
+	name = s.config.lookupRepo(name)
+
+	if !s.authenticate(w, req) {
+		return
+	}
+	authorize := func(repo, operation string) bool {
+		req.RepoName = repo
+		if operation != OperationRead {
+			// Without an Authorizer every authenticated client would be
+			// allowed to create and delete any repository.
+			switch {
+			case s.config.ReadOnly:
+				writeAPIError(w, http.StatusForbidden, "the server is read-only")
+				return false
+			case s.Authorizer == nil:
+				writeAPIError(w, http.StatusForbidden, "repository changes require an Authorizer")
+				return false
+			}
+		}
+		if err := s.authorizeRequest(req, operation); err != nil {
+			writeAPIError(w, http.StatusForbidden, denialMessage(err, permissionMessage(operation, repo)))
+			return false
+		}
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		body.Name = s.config.lookupRepo(body.Name)
+		if !authorize(body.Name, OperationCreate) {
+			return
+		}
+		dir, ok := s.apiRepoPath(w, req, body.Name)
+		if !ok {
+			return
+		}
+		if repoExists(dir) {
+			writeAPIError(w, http.StatusConflict, body.Name+" already exists")
+			return
+		}
+		if err := s.createRepo(body.Name, dir, req.Principal); err != nil {
+			logError("repo-api", err)
+			writeAPIError(w, http.StatusInternalServerError, "creating "+body.Name+" failed")
+			return
+		}
+		writeJSON(w, http.StatusCreated, Repository{Name: body.Name})
+
+	case http.MethodGet:
+		if !authorize(name, OperationRead) {
+			return
+		}
+		dir, ok := s.apiRepoPath(w, req, name)
+		if !ok {
+			return
+		}
+		if !repoExists(dir) {
+			writeAPIError(w, http.StatusNotFound, name+" does not exist")
+			return
+		}
+		writeJSON(w, http.StatusOK, Repository{Name: name})
+
+	case http.MethodPatch:
+		if !authorize(name, OperationRename) || !authorize(body.Name, OperationCreate) {
+			return
+		}
+		source, ok := s.apiRepoPath(w, req, name)
+		if !ok {
+			return
+		}
+		target, ok := s.apiRepoPath(w, req, body.Name)
+		if !ok {
+			return
+		}
+		switch {
+		case !repoExists(source):
+			writeAPIError(w, http.StatusNotFound, name+" does not exist")
+			return
+		case s.renameConflicts(name, body.Name, target):
+			writeAPIError(w, http.StatusConflict, body.Name+" already exists")
+			return
+		}
+		if err := s.renameRepo(name, body.Name, source, target); err != nil {
+			logError("repo-api", err)
+			writeAPIError(w, http.StatusInternalServerError, "renaming "+name+" failed")
+			return
+		}
+		s.repoEvent(RepoEvent{Type: RepoRenamed, Repo: body.Name, OldRepo: name, Principal: req.Principal})
+		writeJSON(w, http.StatusOK, Repository{Name: body.Name})
+
+	case http.MethodDelete:
+		if !authorize(name, OperationDelete) {
+			return
+		}
+		dir, ok := s.apiRepoPath(w, req, name)
+		if !ok {
+			return
+		}
+		if !repoExists(dir) {
+			writeAPIError(w, http.StatusNotFound, name+" does not exist")
+			return
+		}
+		if err := s.deleteRepo(name, dir); err != nil {
+			logError("repo-api", err)
+			writeAPIError(w, http.StatusInternalServerError, "deleting "+name+" failed")
+			return
+		}
+		s.repoEvent(RepoEvent{Type: RepoDeleted, Repo: name, Principal: req.Principal})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// renameConflicts reports whether renaming from to to, kept at target, would
+// replace another repository. With Config.CaseInsensitiveRepos, that is one
+// named to in any casing, other than from itself when only its casing
+// changes.
+func (s *Server) renameConflicts(from, to, target string) bool {
+	existing := s.config.lookupRepo(to)
+	if existing == from && from != to {
+		return false
+	}
+	if existing != to {
+		p, err := s.config.repoPath(existing)
+		return err != nil || fileExists(p)
+	}
+	return fileExists(target)
+}
+
+// renameRepo moves the repository from, kept at source, to target, where
+// the repository to is kept.
+func (s *Server) renameRepo(from, to, source, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(source, target); err != nil {
+		return err
+	}
+	if s.Redirects != nil {
+		s.Redirects.Remove(to)
+		s.Redirects.Add(from, to)
+	}
+	return nil
+}
+
+// deleteRepo deletes the repository name, kept at dir.
+func (s *Server) deleteRepo(name, dir string) error {
+	s.invalidatePackCache(name)
+	return os.RemoveAll(dir)
+}
+
+// validRepoName reports whether name is a relative path staying inside the
+// repository directory.
+func validRepoName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logError("repo-api", err)
+	}
+}
+
+// writeAPIError answers an API request with a JSON error.
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
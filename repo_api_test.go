@@ -0,0 +1,152 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRepoAPI(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	acl := NewACL()
+	acl.Grant("admin", "*", AccessAdmin)
+	acl.Grant("admin", "*/*", AccessAdmin)
+	acl.Grant("reader", "*", AccessRead)
+
+	var mu sync.Mutex
+	var events []RepoEvent
+	server := New(Config{Dir: dir})
+	server.RepoAPI = true
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		return &Principal{ID: username}, nil
+	}
+	server.Authorizer = acl
+	server.OnRepoEvent = func(event RepoEvent) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	call := func(user, method, path, body string) (int, map[string]string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		var v map[string]string
+		json.Unmarshal(data, &v)
+		return res.StatusCode, v
+	}
+
+	// Authentication is required even though Config.Auth is off.
+	code, _ := call("", "POST", "/api/repos", `{"name":"app.git"}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, v := call("reader", "POST", "/api/repos", `{"name":"app.git"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "access denied: you may not create app.git", v["error"])
+
+	code, v = call("admin", "POST", "/api/repos", `{"name":"app.git"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "app.git", v["name"])
+	assert.True(t, repoExists(filepath.Join(dir, "app.git")))
+	code, _ = call("admin", "POST", "/api/repos", `{"name":"app.git"}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, v = call("reader", "GET", "/api/repos/app.git", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "app.git", v["name"])
+	code, _ = call("reader", "GET", "/api/repos/missing.git", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	for _, name := range []string{"../escape.git", "/abs.git", "a//b.git", "-x.git", ""} {
+		code, _ = call("admin", "POST", "/api/repos", `{"name":"`+name+`"}`)
+		assert.Equal(t, http.StatusBadRequest, code, name)
+	}
+
+	code, _ = call("reader", "PATCH", "/api/repos/app.git", `{"name":"org/app.git"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, v = call("admin", "PATCH", "/api/repos/app.git", `{"name":"org/app.git"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "org/app.git", v["name"])
+	assert.False(t, repoExists(filepath.Join(dir, "app.git")))
+	assert.True(t, repoExists(filepath.Join(dir, "org", "app.git")))
+
+	code, _ = call("reader", "DELETE", "/api/repos/org/app.git", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = call("admin", "DELETE", "/api/repos/org/app.git", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.False(t, repoExists(filepath.Join(dir, "org", "app.git")))
+	code, _ = call("admin", "DELETE", "/api/repos/org/app.git", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = call("admin", "PUT", "/api/repos/app.git", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, RepoCreated, events[0].Type)
+		assert.Equal(t, "app.git", events[0].Repo)
+		assert.Equal(t, "admin", events[0].Principal.ID)
+		assert.Equal(t, RepoRenamed, events[1].Type)
+		assert.Equal(t, "org/app.git", events[1].Repo)
+		assert.Equal(t, "app.git", events[1].OldRepo)
+		assert.Equal(t, RepoDeleted, events[2].Type)
+		assert.False(t, events[2].Time.IsZero())
+	}
+}
+
+func TestServerRepoAPIRefusesChanges(t *testing.T) {
+	dir := t.TempDir()
+	post := func(server *Server) (int, string) {
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+		req, _ := http.NewRequest("POST", srv.URL+"/api/repos", strings.NewReader(`{"name":"app.git"}`))
+		req.SetBasicAuth("admin", "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var v map[string]string
+		json.NewDecoder(res.Body).Decode(&v)
+		return res.StatusCode, v["error"]
+	}
+	basicAuth := func(username, password string, req *Request) (*Principal, error) {
+		return &Principal{ID: username}, nil
+	}
+
+	// Without an Authorizer, authenticating isn't enough to change repositories.
+	server := New(Config{Dir: dir})
+	server.RepoAPI = true
+	server.BasicAuth = basicAuth
+	code, msg := post(server)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "repository changes require an Authorizer", msg)
+
+	acl := NewACL()
+	acl.Grant("admin", "*", AccessAdmin)
+	server = New(Config{Dir: dir, ReadOnly: true})
+	server.RepoAPI = true
+	server.BasicAuth = basicAuth
+	server.Authorizer = acl
+	code, msg = post(server)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "the server is read-only", msg)
+	assert.False(t, repoExists(filepath.Join(dir, "app.git")))
+}
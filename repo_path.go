@@ -0,0 +1,113 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errInvalidRepoPath is returned for repository names that would be found
+// outside of Config.Dir.
+var errInvalidRepoPath = errors.New("invalid repository path")
+
+// lookupRepo returns name in the casing the repository is stored with, if
+// CaseInsensitiveRepos is set. The directories of name that don't exist in
+// any casing, such as that of a repository yet to be created, are returned
+// as they are.
+func (c *Config) lookupRepo(name string) string {
+	if !c.CaseInsensitiveRepos || !validRepoName(name) {
+		return name
+	}
+	parts := strings.Split(name, "/")
+	dir := c.Dir
+	for i, part := range parts {
+		if _, err := os.Lstat(filepath.Join(dir, part)); err != nil {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				break
+			}
+			found := false
+			for _, entry := range entries {
+				if strings.EqualFold(entry.Name(), part) {
+					parts[i], found = entry.Name(), true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+		dir = filepath.Join(dir, parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// repoPath returns the location of the repository name in Dir. Names have
+// to be relative paths without "." or ".." elements and, with
+// ConfineSymlinks, may not lead out of Dir through symlinks either.
+func (c *Config) repoPath(name string) (string, error) {
+	if !validRepoName(name) {
+		return "", fmt.Errorf("%w %q", errInvalidRepoPath, name)
+	}
+	p := filepath.Join(c.Dir, filepath.FromSlash(name))
+	if c.ConfineSymlinks {
+		if err := confine(c.Dir, p); err != nil {
+			return "", err
+		}
+	}
+	return p, nil
+}
+
+// resolveRepo returns where resolve keeps the repository name, a path in
+// Dir for relative ones, or repoPath for "".
+func (c *Config) resolveRepo(ctx context.Context, resolve func(context.Context, *Principal, string) (string, error), principal *Principal, name string) (string, error) {
+	p, err := resolve(ctx, principal, name)
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return c.repoPath(name)
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(c.Dir, p)
+	}
+	return filepath.Clean(p), nil
+}
+
+// confine makes sure p, a path in dir, resolves to a path in dir. The part
+// of p that doesn't exist yet, as for a repository about to be created, is
+// taken as it is.
+func confine(dir, p string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	resolved, rest := p, ""
+	for {
+		r, err := filepath.EvalSymlinks(resolved)
+		if err == nil {
+			resolved = filepath.Join(r, rest)
+			break
+		}
+		// A link pointing nowhere could still be followed once created.
+		if _, lerr := os.Lstat(resolved); lerr == nil || !os.IsNotExist(err) {
+			return fmt.Errorf("%w: %v", errInvalidRepoPath, err)
+		}
+		parent := filepath.Dir(resolved)
+		if parent == resolved {
+			return fmt.Errorf("%w: %v", errInvalidRepoPath, err)
+		}
+		rest = filepath.Join(filepath.Base(resolved), rest)
+		resolved = parent
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s resolves outside of %s", errInvalidRepoPath, p, dir)
+	}
+	return nil
+}
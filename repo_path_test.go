@@ -0,0 +1,270 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoPath(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, os.MkdirAll(filepath.Join(repos, "team", "app.git"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "outside.git"), 0755))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "outside.git"), filepath.Join(repos, "escape.git")))
+	assert.NoError(t, os.Symlink(filepath.Join(repos, "team"), filepath.Join(repos, "alias")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "nowhere"), filepath.Join(repos, "dangling.git")))
+	assert.NoError(t, os.Symlink(dir, filepath.Join(repos, "parent")))
+
+	config := &Config{Dir: repos}
+	for _, name := range []string{"", "/etc", "../outside.git", "team/../../outside.git", "team/./app.git", "team//app.git", `team\app.git`, "-app.git"} {
+		_, err := config.repoPath(name)
+		assert.True(t, errors.Is(err, errInvalidRepoPath), name)
+	}
+	p, err := config.repoPath("team/app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(repos, "team", "app.git"), p)
+	_, err = config.repoPath("escape.git")
+	assert.NoError(t, err)
+
+	config.ConfineSymlinks = true
+	for _, name := range []string{"team/app.git", "alias/app.git", "new.git", "team/new/app.git"} {
+		_, err := config.repoPath(name)
+		assert.NoError(t, err, name)
+	}
+	for _, name := range []string{"escape.git", "dangling.git", "parent/outside.git", "parent/new.git"} {
+		_, err := config.repoPath(name)
+		assert.True(t, errors.Is(err, errInvalidRepoPath), name)
+	}
+}
+
+func TestServerConfineSymlinks(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, os.Mkdir(repos, 0755))
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "outside.git")).Run())
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "outside.git"), filepath.Join(repos, "app.git")))
+
+	status := func(confine bool) int {
+		srv := httptest.NewServer(New(Config{Dir: repos, ConfineSymlinks: confine}))
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/app.git/info/refs?service=git-upload-pack")
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, status(false))
+	assert.Equal(t, http.StatusBadRequest, status(true))
+}
+
+func TestServerRepoAPIConfineSymlinks(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	outside := filepath.Join(dir, "outside")
+	assert.NoError(t, os.Mkdir(repos, 0755))
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(outside, "secret.git")).Run())
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, "app.git")).Run())
+	assert.NoError(t, os.Symlink(outside, filepath.Join(repos, "link")))
+
+	server := New(Config{Dir: repos, ConfineSymlinks: true})
+	server.RepoAPI = true
+	server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+		return &Principal{ID: username}, nil
+	}
+	server.Authorizer = AuthorizerFunc(func(*AccessRequest) error { return nil })
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	call := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, call("GET", "/api/repos/link/secret.git", ""))
+	assert.Equal(t, http.StatusBadRequest, call("GET", "/api/repos/link/secret.git/refs", ""))
+	assert.Equal(t, http.StatusBadRequest, call("POST", "/api/repos", `{"name":"link/new.git"}`))
+	assert.Equal(t, http.StatusBadRequest, call("PATCH", "/api/repos/app.git", `{"name":"link/app.git"}`))
+	assert.Equal(t, http.StatusBadRequest, call("PATCH", "/api/repos/link/secret.git", `{"name":"secret.git"}`))
+	assert.Equal(t, http.StatusBadRequest, call("DELETE", "/api/repos/link/secret.git", ""))
+	assert.False(t, repoExists(filepath.Join(outside, "new.git")))
+	assert.True(t, repoExists(filepath.Join(outside, "secret.git")))
+	assert.True(t, repoExists(filepath.Join(repos, "app.git")))
+
+	assert.Equal(t, ErrInvalidRepoName, server.CreateRepo("link/new.git"))
+	assert.Equal(t, ErrInvalidRepoName, server.RenameRepo("app.git", "link/app.git"))
+	assert.Equal(t, ErrInvalidRepoName, server.DeleteRepo("link/secret.git"))
+	assert.True(t, repoExists(filepath.Join(outside, "secret.git")))
+
+	_, err := server.lfsStore(&Request{}).Size(context.Background(), "link/secret.git", strings.Repeat("a", 64))
+	assert.True(t, errors.Is(err, errInvalidRepoPath))
+}
+
+func TestServerResolveRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, os.Mkdir(repos, 0755))
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	var asked []string
+	resolve := func(ctx context.Context, principal *Principal, repo string) (string, error) {
+		asked = append(asked, repo)
+		switch repo {
+		case "app.git":
+			return filepath.Join("shards", "a1", "2f6c.git"), nil
+		case "archived.git":
+			return "", fmt.Errorf("%w: archived.git is archived", ErrAccessDenied)
+		case "broken.git":
+			return "", errors.New("lookup failed")
+		}
+		return "", nil
+	}
+
+	for _, backend := range []bool{false, true} {
+		server := New(Config{Dir: repos, AutoCreate: true})
+		server.HTTPBackend = backend
+		server.ResolveRepo = resolve
+		server.RepoAPI = true
+		server.BasicAuth = func(username, password string, req *Request) (*Principal, error) {
+			return &Principal{ID: username}, nil
+		}
+		server.Authorizer = AuthorizerFunc(func(*AccessRequest) error { return nil })
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+
+		out, err := git("-C", work, "push", srv.URL+"/app.git", "HEAD:refs/heads/master")
+		assert.NoError(t, err, out)
+		assert.True(t, repoExists(filepath.Join(repos, "shards", "a1", "2f6c.git")))
+		assert.False(t, repoExists(filepath.Join(repos, "app.git")))
+		out, err = git("clone", srv.URL+"/app.git", filepath.Join(dir, fmt.Sprint("clone-", backend)))
+		assert.NoError(t, err, out)
+
+		out, err = git("clone", srv.URL+"/archived.git", filepath.Join(dir, "archived"))
+		assert.Error(t, err)
+		assert.Contains(t, out, "archived.git is archived")
+		res, err := http.Get(srv.URL + "/broken.git/info/refs?service=git-upload-pack")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		// The repository API finds repositories where they are kept too.
+		call := func(method, path string) int {
+			req, _ := http.NewRequest(method, srv.URL+path, nil)
+			req.SetBasicAuth("admin", "secret")
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			return res.StatusCode
+		}
+		assert.Equal(t, http.StatusOK, call("GET", "/api/repos/app.git"))
+		assert.Equal(t, http.StatusOK, call("GET", "/api/repos/app.git/refs"))
+		assert.Equal(t, http.StatusForbidden, call("GET", "/api/repos/archived.git"))
+		assert.Equal(t, http.StatusNotFound, call("GET", "/api/repos/broken.git/refs"))
+		assert.Equal(t, http.StatusNoContent, call("DELETE", "/api/repos/app.git"))
+		assert.False(t, repoExists(filepath.Join(repos, "shards", "a1", "2f6c.git")))
+		assert.NoError(t, server.CreateRepo("app.git"))
+		assert.True(t, repoExists(filepath.Join(repos, "shards", "a1", "2f6c.git")))
+		assert.NoError(t, server.DeleteRepo("app.git"))
+	}
+	assert.Contains(t, asked, "broken.git")
+}
+
+func TestLookupRepo(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "Team", "MyApp.git"), 0755))
+
+	config := &Config{Dir: dir}
+	assert.Equal(t, "team/myapp.git", config.lookupRepo("team/myapp.git"))
+
+	config.CaseInsensitiveRepos = true
+	for name, want := range map[string]string{
+		"Team/MyApp.git": "Team/MyApp.git",
+		"team/myapp.git": "Team/MyApp.git",
+		"TEAM/MYAPP.GIT": "Team/MyApp.git",
+		"team/new.git":   "Team/new.git",
+		"other/app.git":  "other/app.git",
+		"../team":        "../team",
+	} {
+		assert.Equal(t, want, config.lookupRepo(name), name)
+	}
+}
+
+func TestServerCaseInsensitiveRepos(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, "MyApp.git")).Run())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	var authorized []string
+	server := New(Config{Dir: repos, AutoCreate: true, CaseInsensitiveRepos: true})
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		authorized = append(authorized, req.Repo)
+		return nil
+	})
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	out, err := git("-C", work, "push", srv.URL+"/myapp.git", "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+	entries, err := os.ReadDir(repos)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	out, err = git("--git-dir", filepath.Join(repos, "MyApp.git"), "rev-parse", "master")
+	assert.NoError(t, err, out)
+	assert.NotContains(t, authorized, "myapp.git")
+	assert.Contains(t, authorized, "MyApp.git")
+
+	// The repository API doesn't create duplicates either.
+	assert.Equal(t, ErrRepoExists, server.CreateRepo("MYAPP.git"))
+	assert.NoError(t, server.RenameRepo("myapp.git", "myApp.git"))
+	assert.True(t, repoExists(filepath.Join(repos, "myApp.git")))
+	assert.NoError(t, server.CreateRepo("other.git"))
+	assert.Equal(t, ErrRepoExists, server.RenameRepo("OTHER.git", "MyApp.git"))
+	assert.NoError(t, server.DeleteRepo("OTHER.GIT"))
+	assert.False(t, repoExists(filepath.Join(repos, "other.git")))
+}
@@ -0,0 +1,67 @@
+package gitkit
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+	errRequestTooLarge     = errors.New("request body too large")
+)
+
+// requestBody returns the body of an RPC request, decompressed if the client
+// compressed it. git gzips larger upload-pack and receive-pack requests.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return ioutil.NopCloser(r.Body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r.Body)
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// readTracker remembers the error reading from r, so it can be told apart
+// from errors writing what was read.
+type readTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+// maxBytesReader fails reads with errRequestTooLarge once more than n bytes
+// were read. Unlike http.MaxBytesReader the error can be told apart from
+// other read errors, and it limits decompressed bodies too.
+type maxBytesReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.n < 0 {
+		return 0, errRequestTooLarge
+	}
+	// Read one byte more than allowed, to tell bodies of exactly n bytes
+	// from larger ones.
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return n + int(r.n), errRequestTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,99 @@
+package gitkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(data))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestPostRPCContentEncoding(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "repo.git")).Run())
+	server := New(Config{Dir: dir})
+
+	post := func(encoding string, body []byte) int {
+		req := httptest.NewRequest("POST", "/repo.git/git-upload-pack", bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A flush packet alone asks for nothing.
+	assert.Equal(t, http.StatusOK, post("", []byte("0000")))
+	assert.Equal(t, http.StatusOK, post("gzip", gzipped(t, "0000")))
+	assert.Equal(t, http.StatusOK, post(" GZIP ", gzipped(t, "0000")))
+	assert.Equal(t, http.StatusOK, post("x-gzip", gzipped(t, "0000")))
+
+	assert.Equal(t, http.StatusBadRequest, post("gzip", []byte("0000")))
+	truncated := gzipped(t, "0000")
+	assert.Equal(t, http.StatusBadRequest, post("gzip", truncated[:len(truncated)-4]))
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("br", []byte("0000")))
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	for _, repo := range []string{"repo.git", "big.git"} {
+		assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, repo)).Run())
+	}
+	server := New(Config{Dir: dir})
+	server.MaxRequestBody = 1 << 10
+	server.MaxRequestBodyFunc = func(repo string) int64 {
+		if repo == "big.git" {
+			return -1
+		}
+		return 0
+	}
+
+	post := func(repo, encoding string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/"+repo+"/git-upload-pack", bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Flush packets are harmless filler for upload-pack.
+	small := bytes.Repeat([]byte("0000"), 1<<8)
+	large := bytes.Repeat([]byte("0000"), 1<<12)
+	assert.Equal(t, http.StatusOK, post("repo.git", "", small).Code)
+
+	rec := post("repo.git", "", large)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Equal(t, "request body exceeds the limit of 1024 bytes for repo.git\n", rec.Body.String())
+	assert.Equal(t, "close", rec.Header().Get("Connection"))
+
+	// Compressed bodies are limited after decompression.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("repo.git", "gzip", gzipped(t, string(large))).Code)
+	assert.Equal(t, http.StatusOK, post("repo.git", "gzip", gzipped(t, string(small))).Code)
+
+	assert.Equal(t, http.StatusOK, post("big.git", "", large).Code)
+	assert.Equal(t, 0, server.ActiveProcesses())
+}
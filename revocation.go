@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyFingerprintExtension is the Permissions extension holding the
+// fingerprint of the key a client authenticated with.
+const keyFingerprintExtension = "key-fingerprint"
+
+var errKeyRevoked = fmt.Errorf("key has been revoked")
+
+// RevokeKey rejects the key with the given SHA256 fingerprint from now on,
+// regardless of what the key lookup returns, and closes connections that
+// authenticated with it. The fingerprint may be that of a certificate or of
+// the key it certifies. Revocations are kept in memory only.
+func (s *SSH) RevokeKey(fingerprint string) {
+	s.mu.Lock()
+	if s.revoked == nil {
+		s.revoked = make(map[string]struct{})
+	}
+	s.revoked[fingerprint] = struct{}{}
+	var conns []net.Conn
+	for conn, fps := range s.connKeys {
+		for _, fp := range fps {
+			if fp == fingerprint {
+				conns = append(conns, conn)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// UnrevokeKey lifts the revocation of a key by RevokeKey.
+func (s *SSH) UnrevokeKey(fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.revoked, fingerprint)
+}
+
+// RevokedKeys returns the fingerprints of the keys revoked with RevokeKey.
+func (s *SSH) RevokedKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fingerprints := make([]string, 0, len(s.revoked))
+	for fp := range s.revoked {
+		fingerprints = append(fingerprints, fp)
+	}
+	return fingerprints
+}
+
+func (s *SSH) isRevoked(fingerprint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked[fingerprint]
+	return ok
+}
+
+// checkKeyRevocation rejects revoked keys before they are looked up. For
+// certificates, both the certificate and its key are checked.
+func (s *SSH) checkKeyRevocation(key ssh.PublicKey) error {
+	if s.isRevoked(KeyFingerprint(key)) {
+		return errKeyRevoked
+	}
+	if cert, ok := key.(*ssh.Certificate); ok && s.isRevoked(KeyFingerprint(cert.Key)) {
+		return errKeyRevoked
+	}
+	return nil
+}
+
+// checkKeyValidity enforces the expiry and revocation state of a key
+// returned by a lookup.
+func checkKeyValidity(pkey *PublicKey, now time.Time) error {
+	if pkey.Revoked {
+		return errKeyRevoked
+	}
+	if !pkey.ExpiresAt.IsZero() && !now.Before(pkey.ExpiresAt) {
+		return fmt.Errorf("key expired at %s", pkey.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// trackConnKey remembers which keys conn authenticated with, the key and,
+// for certificates, the certificate, so RevokeKey can close it with either.
+// It fails if one of them was revoked during the handshake.
+func (s *SSH) trackConnKey(conn net.Conn, fingerprints ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fp := range fingerprints {
+		if _, ok := s.revoked[fp]; ok {
+			return errKeyRevoked
+		}
+	}
+	if s.connKeys == nil {
+		s.connKeys = make(map[net.Conn][]string)
+	}
+	s.connKeys[conn] = fingerprints
+	return nil
+}
@@ -0,0 +1,46 @@
+package gitkit
+
+import "golang.org/x/crypto/ssh"
+
+// SecurityKeyApplication returns the FIDO application string of a security
+// key, "ssh:" unless chosen otherwise when the key was generated, and
+// whether the key is held by a FIDO2 security key (sk-ssh-ed25519 or
+// sk-ecdsa-sha2-nistp256). For certificates the certified key is inspected.
+func SecurityKeyApplication(key ssh.PublicKey) (string, bool) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	// The ssh package keeps the application to itself, so it is read from
+	// the wire format, which ends with it for both key types.
+	switch key.Type() {
+	case ssh.KeyAlgoSKED25519:
+		var w struct {
+			Type        string
+			Key         []byte
+			Application string
+		}
+		if err := ssh.Unmarshal(key.Marshal(), &w); err != nil {
+			return "", false
+		}
+		return w.Application, true
+	case ssh.KeyAlgoSKECDSA256:
+		var w struct {
+			Type        string
+			Curve       string
+			Key         []byte
+			Application string
+		}
+		if err := ssh.Unmarshal(key.Marshal(), &w); err != nil {
+			return "", false
+		}
+		return w.Application, true
+	}
+	return "", false
+}
+
+// IsSecurityKey reports whether key is held by a FIDO2 security key.
+func IsSecurityKey(key ssh.PublicKey) bool {
+	_, ok := SecurityKeyApplication(key)
+	return ok
+}
@@ -0,0 +1,146 @@
+package gitkit
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// skEd25519Signer stands in for a FIDO2 security key holding an
+// sk-ssh-ed25519 key.
+type skEd25519Signer struct {
+	priv        ed25519.PrivateKey
+	application string
+}
+
+func newSKEd25519Signer(t *testing.T, application string) *skEd25519Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &skEd25519Signer{priv: priv, application: application}
+}
+
+func (s *skEd25519Signer) PublicKey() ssh.PublicKey {
+	key, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Type        string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, s.priv.Public().(ed25519.PublicKey), s.application}))
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func (s *skEd25519Signer) Sign(_ io.Reader, data []byte) (*ssh.Signature, error) {
+	const flags, counter = 0x01, 1 // user present
+	appDigest := sha256.Sum256([]byte(s.application))
+	dataDigest := sha256.Sum256(data)
+	signed := append(appDigest[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(signed[len(signed)-4:], counter)
+	signed = append(signed, dataDigest[:]...)
+
+	return &ssh.Signature{
+		Format: ssh.KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(s.priv, signed),
+		Rest: ssh.Marshal(struct {
+			Flags   byte
+			Counter uint32
+		}{flags, counter}),
+	}, nil
+}
+
+func TestSecurityKeyApplication(t *testing.T) {
+	g := NewWithT(t)
+
+	skEd25519 := newSKEd25519Signer(t, "ssh:git").PublicKey()
+	application, ok := SecurityKeyApplication(skEd25519)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(application).To(Equal("ssh:git"))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	skECDSA, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Type        string
+		Curve       string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKECDSA256, "nistp256", elliptic.Marshal(elliptic.P256(), ecKey.X, ecKey.Y), "ssh:"}))
+	g.Expect(err).ToNot(HaveOccurred())
+	application, ok = SecurityKeyApplication(skECDSA)
+	g.Expect(ok).To(BeTrue())
+	g.Expect(application).To(Equal("ssh:"))
+
+	g.Expect(IsSecurityKey(&ssh.Certificate{Key: skEd25519})).To(BeTrue())
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	plain, err := ssh.NewPublicKey(pub)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(IsSecurityKey(plain)).To(BeFalse())
+}
+
+func TestSecurityKeyLogin(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "security-key")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	signer := newSKEd25519Signer(t, "ssh:")
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	lookups := make(chan *KeyLookupRequest, 1)
+	server.KeyLookupFunc = func(req *KeyLookupRequest) (*PublicKey, error) {
+		lookups <- req
+		return &PublicKey{Id: "alice"}, nil
+	}
+	requests := make(chan *AccessRequest, 1)
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		requests <- req
+		return ErrAccessDenied
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	var lookup *KeyLookupRequest
+	g.Expect(lookups).To(Receive(&lookup))
+	g.Expect(lookup.Algorithm).To(Equal(ssh.KeyAlgoSKED25519))
+	g.Expect(lookup.SecurityKey).To(BeTrue())
+	g.Expect(lookup.Application).To(Equal("ssh:"))
+
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	session.Run("git-receive-pack 'repo.git'")
+
+	var req *AccessRequest
+	g.Eventually(requests, 5*time.Second).Should(Receive(&req))
+	g.Expect(req.Principal.SecurityKey).To(BeTrue())
+	g.Expect(req.Principal.KeyType).To(Equal(ssh.KeyAlgoSKED25519))
+}
@@ -0,0 +1,95 @@
+package gitkit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a git command being served, e.g. a clone over SSH or a push
+// over HTTP.
+type Session struct {
+	ID string `json:"id"`
+	// Protocol is "ssh" or "http".
+	Protocol string `json:"protocol"`
+	// Principal is the ID of the principal running the command, empty for
+	// anonymous clients.
+	Principal  string    `json:"principal,omitempty"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Repo       string    `json:"repo"`
+	Command    string    `json:"command"`
+	Started    time.Time `json:"started"`
+}
+
+// Types of a SessionEvent.
+const (
+	SessionStarted = "started"
+	SessionEnded   = "ended"
+)
+
+// SessionEvent reports a session starting or ending, see Server.OnSession
+// and SSH.OnSession.
+type SessionEvent struct {
+	Type    string
+	Time    time.Time
+	Session Session
+}
+
+// sessionRegistry keeps track of the sessions of a server.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// add registers session and returns its ID. notify, if set, is told about
+// it.
+func (r *sessionRegistry) add(session Session, notify func(SessionEvent)) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	session.ID = hex.EncodeToString(b)
+	session.Started = time.Now()
+
+	r.mu.Lock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]Session)
+	}
+	r.sessions[session.ID] = session
+	r.mu.Unlock()
+
+	if notify != nil {
+		notify(SessionEvent{Type: SessionStarted, Time: session.Started, Session: session})
+	}
+	return session.ID
+}
+
+func (r *sessionRegistry) remove(id string, notify func(SessionEvent)) {
+	r.mu.Lock()
+	session, ok := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+
+	if ok && notify != nil {
+		notify(SessionEvent{Type: SessionEnded, Time: time.Now(), Session: session})
+	}
+}
+
+// list returns the sessions, the oldest first.
+func (r *sessionRegistry) list() []Session {
+	r.mu.Lock()
+	sessions := make([]Session, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Started.Equal(sessions[j].Started) {
+			return sessions[i].ID < sessions[j].ID
+		}
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+	return sessions
+}
@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Bands of the side-band-64k multiplexing git uses for the pack and status
+// it sends. Clients show what is sent on BandProgress prefixed with
+// "remote: ", and abort with what is sent on BandError.
+const (
+	BandData     byte = 1
+	BandProgress byte = 2
+	BandError    byte = 3
+)
+
+// maxPktData is the most data a pkt-line carries, LARGE_PACKET_MAX without
+// the length.
+const maxPktData = 65516
+
+// WriteSideband writes msg to w on band, as many pkt-lines as it needs. It
+// may only be used where the client expects sideband packets, i.e. after
+// it asked for side-band-64k and git began sending on it.
+func WriteSideband(w io.Writer, band byte, msg string) error {
+	for {
+		n := len(msg)
+		if n > maxPktData-1 {
+			n = maxPktData - 1
+		}
+		if err := packLine(w, string(band)+msg[:n]); err != nil {
+			return err
+		}
+		msg = msg[n:]
+		if msg == "" {
+			return nil
+		}
+	}
+}
+
+// WriteErrorPacket writes msg to w as an ERR packet. Clients show it as
+// "remote error: msg" and give up, wherever they expect a pkt-line, so it
+// can be sent in place of a ref advertisement or any response of git.
+func WriteErrorPacket(w io.Writer, msg string) error {
+	msg = "ERR " + strings.TrimSuffix(msg, "\n")
+	if len(msg) > maxPktData-1 {
+		msg = msg[:maxPktData-1]
+	}
+	return packLine(w, msg+"\n")
+}
+
+// WriteGitError answers r, a request to the smart HTTP protocol, with msg
+// the way git shows it: the ref advertisement or the result of the RPC is
+// an ERR packet, sent with status 200 since git prints nothing but the
+// status otherwise. Other requests, such as for dumb HTTP or archives, are
+// answered with status and msg as text. It can be used by Middleware, as
+// well as anywhere else the response wasn't started yet.
+func WriteGitError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	command := path.Base(r.URL.Path)
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs") && smartService(r.URL.Query().Get("service")):
+		w.Header().Set("Content-Type", "application/x-"+r.URL.Query().Get("service")+"-advertisement")
+	case r.Method == http.MethodPost && smartService(command):
+		w.Header().Set("Content-Type", "application/x-"+command+"-result")
+	default:
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	WriteErrorPacket(w, msg)
+}
+
+// smartService reports whether command is served over smart HTTP.
+func smartService(command string) bool {
+	return command == "git-upload-pack" || command == "git-receive-pack"
+}
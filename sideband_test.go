@@ -0,0 +1,82 @@
+package gitkit
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSideband(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteSideband(&buf, BandProgress, "checking quota\n"))
+	assert.Equal(t, "0014\x02checking quota\n", buf.String())
+
+	// Long messages are split to fit pkt-lines.
+	buf.Reset()
+	assert.NoError(t, WriteSideband(&buf, BandError, strings.Repeat("x", maxPktData)))
+	assert.Equal(t, "fff0\x03", buf.String()[:5])
+	assert.Equal(t, "0006\x03x", buf.String()[0xfff0:])
+
+	buf.Reset()
+	assert.NoError(t, WriteErrorPacket(&buf, "repository is archived\n"))
+	assert.Equal(t, "001fERR repository is archived\n", buf.String())
+}
+
+func TestWriteGitError(t *testing.T) {
+	for _, tt := range []struct {
+		method, target    string
+		status            int
+		contentType, body string
+	}{
+		{"GET", "/app.git/info/refs?service=git-upload-pack", 200, "application/x-git-upload-pack-advertisement", "0014ERR maintenance\n"},
+		{"POST", "/app.git/git-receive-pack", 200, "application/x-git-receive-pack-result", "0014ERR maintenance\n"},
+		{"GET", "/app.git/info/refs", 503, "text/plain; charset=utf-8", "maintenance\n"},
+		{"GET", "/app.git/archive/master.tar.gz", 503, "text/plain; charset=utf-8", "maintenance\n"},
+	} {
+		rec := httptest.NewRecorder()
+		WriteGitError(rec, httptest.NewRequest(tt.method, tt.target, nil), http.StatusServiceUnavailable, "maintenance")
+		assert.Equal(t, tt.status, rec.Code, tt.target)
+		assert.Equal(t, tt.contentType, rec.Header().Get("Content-Type"), tt.target)
+		assert.Equal(t, tt.body, rec.Body.String(), tt.target)
+	}
+}
+
+func TestServerMiddlewareGitError(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "app.git")).Run())
+
+	server := New(Config{Dir: dir})
+	server.Use(func(next HandlerFunc) HandlerFunc {
+		return func(w http.ResponseWriter, req *Request) {
+			if req.Operation == OperationWrite {
+				WriteGitError(w, req.Request, http.StatusServiceUnavailable, "pushes are paused for maintenance")
+				return
+			}
+			next(w, req)
+		}
+	})
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", work).Run())
+	commit := exec.Command("git", "-C", work, "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "-m", "initial")
+	assert.NoError(t, commit.Run())
+
+	out, err := exec.Command("git", "-C", work, "push", srv.URL+"/app.git", "HEAD:refs/heads/master").CombinedOutput()
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "remote error: pushes are paused for maintenance")
+
+	out, err = exec.Command("git", "ls-remote", srv.URL+"/app.git").CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
@@ -1,21 +1,17 @@
 package gitkit
 
 import (
-	"bytes"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -26,27 +22,325 @@ import (
 var (
 	ErrAlreadyStarted = errors.New("server has already been started")
 	ErrNoListener     = errors.New("cannot call Serve() before Listen()")
+	ErrServerClosed   = errors.New("server closed")
+
+	errServerBusy      = errors.New("server is busy")
+	errShuttingDown    = errors.New("server is shutting down")
+	errTooManySessions = errors.New("too many sessions on this connection")
+	errBanned          = errors.New("too many failed attempts, temporarily banned")
+	errTooManyKeyOps   = errors.New("too many concurrent operations for this key, try again later")
 )
 
+// shutdownPollInterval is how often Shutdown checks for idle connections.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// defaultKeepAliveCountMax is the default for SSH.KeepAliveCountMax, matching
+// OpenSSH's ClientAliveCountMax.
+const defaultKeepAliveCountMax = 3
+
 type PublicKey struct {
 	Id          string
 	Name        string
 	Fingerprint string
 	Content     string
+	// ExpiresAt, if set, is when the key stops being accepted.
+	ExpiresAt time.Time
+	// Revoked keys are rejected.
+	Revoked bool
+	// Email, Scopes and Attributes describe the owner of the key and are
+	// passed on as part of its Principal.
+	Email      string
+	Scopes     []string
+	Attributes map[string]string
+	// Commands, if not empty, restricts the git commands the key may run,
+	// e.g. []string{"git-upload-pack"} for a fetch-only key or
+	// []string{"git-upload-archive"} for one that may only download
+	// archives. It is enforced before the Authorizer is asked.
+	Commands []string
+}
+
+// KeyLookupRequest describes a public key presented by a client, passed to
+// KeyLookupFunc.
+type KeyLookupRequest struct {
+	// Key is the parsed public key.
+	Key ssh.PublicKey
+	// Algorithm is the key type, e.g. "ssh-ed25519".
+	Algorithm string
+	// SecurityKey is true for keys held by a FIDO2 security key, whose
+	// Application is then set, see SecurityKeyApplication.
+	SecurityKey bool
+	Application string
+	// Fingerprint is the SHA256 fingerprint of the key, see KeyFingerprint.
+	Fingerprint string
+	// AuthorizedKey is the key in authorized_keys format, see
+	// AuthorizedKeyString.
+	AuthorizedKey string
+	// User is the username the client is authenticating as.
+	User string
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+	// SessionID identifies the SSH connection.
+	SessionID []byte
+	// Meta gives access to the remaining connection metadata.
+	Meta ssh.ConnMetadata
 }
 
 type SSH struct {
-	listener net.Listener
+	listeners []net.Listener
+
+	// mu guards the connection tracking state below.
+	mu             sync.Mutex
+	conns          map[net.Conn]int      // active sessions per connection
+	hostConns      map[string]int        // open connections per remote host
+	keyOps         map[string]int        // running git commands per key ID
+	connKeys       map[net.Conn][]string // key fingerprints per connection
+	revoked        map[string]struct{}   // fingerprints revoked with RevokeKey
+	activeSessions int
+	inShutdown     bool
+	stopServe      context.CancelFunc
 
 	sshConfig *ssh.ServerConfig
 	gitConfig *Config
+	hostKeys  []ssh.Signer
+	procs     processRegistry
+	sessions  sessionRegistry
+	bans      banList
+	// execMiddleware wraps running git commands, see UseExec.
+	execMiddleware []ExecMiddleware
+	// commands are the handlers of other commands, see HandleCommand.
+	commands map[string]CommandHandler
+	// userBanner is the BannerCallback of a config passed to SetSSHConfig,
+	// which bannerCallback falls back to.
+	userBanner func(conn ssh.ConnMetadata) string
 	// Timeout, if set will close the connection after the given duration
+	//
+	// Deprecated: use MaxSessionDuration instead.
 	Timeout *time.Duration
+	// MaxSessionDuration, if set, closes connections after the given
+	// duration regardless of activity.
+	MaxSessionDuration time.Duration
+	// IdleTimeout, if set, closes connections that have not sent or
+	// received any data for the given duration. Unlike MaxSessionDuration,
+	// long running but active clones and pushes are not interrupted.
+	IdleTimeout time.Duration
+	// HandshakeTimeout, if set, is the read and write deadline for the SSH
+	// handshake, including authentication. Clients that connect and then
+	// stall are disconnected once it passes.
+	HandshakeTimeout time.Duration
+	// RequestTimeout, if set, closes authenticated connections that have no
+	// open session for the given duration, both right after the handshake
+	// and between sessions on a reused connection.
+	RequestTimeout time.Duration
+	// KeepAliveInterval, if set, sends a keepalive@openssh.com request to
+	// the client at the given interval. Connections that fail to answer
+	// KeepAliveCountMax requests in a row are closed.
+	KeepAliveInterval time.Duration
+	// KeepAliveCountMax is the number of unanswered keepalives after which
+	// a connection is considered dead. Defaults to 3.
+	KeepAliveCountMax int
 	// DisableConnReuse, if true will disable a reuse of ssh connection in a later session.
 	DisableConnReuse bool
 	// DisableSimultaneousConns, if true will disable simultaneous conns from the same host.
+	// Like MaxConnsPerHost, it doesn't apply to unix sockets.
+	//
+	// Deprecated: use MaxConnsPerHost set to 1 instead.
 	DisableSimultaneousConns bool
-	PublicKeyLookupFunc      func(string) (*PublicKey, error)
+	// MaxConnsPerHost, if greater than zero, limits the number of concurrent
+	// connections from the same client IP. Connections beyond the limit are
+	// rejected. Connections without an IP address, such as over unix
+	// sockets, are not limited.
+	MaxConnsPerHost int
+	// MaxConns, if greater than zero, limits the total number of concurrent
+	// connections. Clients beyond the limit are told the server is busy and
+	// disconnected.
+	MaxConns int
+	// MaxSessionsPerConn, if greater than zero, limits the number of
+	// concurrent session channels on a single connection. Additional
+	// channels are rejected.
+	MaxSessionsPerConn int
+	// MaxOpsPerKey, if greater than zero, limits the number of git and
+	// custom commands running concurrently for the same key ID, so a single runaway client
+	// can't saturate the server. Commands beyond the limit fail right away.
+	// Anonymous clients share a single limit.
+	MaxOpsPerKey int
+	// AcceptEnv are the variables clients may set for their git commands
+	// with env requests, GIT_PROTOCOL if nil. A trailing * matches any
+	// variable starting with the rest, as in the AcceptEnv option of sshd.
+	// Other requests are refused. Variables set by gitkit, such as
+	// GITKIT_KEY, can't be overridden. Beware of patterns such as GIT_*,
+	// GIT_CONFIG_COUNT lets clients configure git and run commands with it.
+	AcceptEnv []string
+	// BundleURIs, if set, returns the URIs of bundles of a repository that
+	// upload-pack advertises to protocol v2 clients, see
+	// Server.BundleURIs.
+	BundleURIs func(repo string) []string
+	// AllowFilter and FilterPolicy allow partial clones, see
+	// Server.AllowFilter and Server.FilterPolicy.
+	AllowFilter  bool
+	FilterPolicy func(repo, filter string) error
+	// AllowSHA1InWant and AllowSHA1InWantFunc let clients fetch commits no
+	// ref points to, see Server.AllowSHA1InWant.
+	AllowSHA1InWant     string
+	AllowSHA1InWantFunc func(repo string) string
+	// DenyShallow, MaxDepth and ShallowPolicy limit shallow fetches, see
+	// Server.DenyShallow, Server.MaxDepth and Server.ShallowPolicy.
+	DenyShallow   bool
+	MaxDepth      int
+	ShallowPolicy func(repo string, req ShallowRequest) (ShallowRequest, error)
+	// MaxPendingHandshakes, if greater than zero, bounds the number of
+	// connections in the middle of the SSH handshake. Once reached, the
+	// server stops accepting connections until a handshake completes, so
+	// floods queue up in the kernel instead of in memory.
+	MaxPendingHandshakes int
+	// CryptoProfile, if set, configures the key exchanges, ciphers and MACs
+	// offered to clients, overriding the ones of a config passed to
+	// SetSSHConfig. Either CryptoProfileModern or CryptoProfileCompat.
+	CryptoProfile string
+	// Banner is shown to clients before they authenticate, e.g. a legal
+	// notice. BannerFunc, if set, is preferred and returns the banner for
+	// a connection. Both take precedence over the BannerCallback of a
+	// config passed to SetSSHConfig.
+	Banner     string
+	BannerFunc func(conn ssh.ConnMetadata) string
+	// MOTD is written to the stderr of every session once it is accepted,
+	// before git runs, so git users see it along with the output of git,
+	// e.g. for maintenance warnings. MOTDFunc, if set, is preferred and
+	// returns the message for a principal, nothing is written if it is
+	// empty.
+	MOTD     string
+	MOTDFunc func(principal *Principal) string
+	// ClientVersionFunc, if set, is called with the SSH version string sent
+	// by the client, e.g. "SSH-2.0-OpenSSH_8.9p1". If it returns an error,
+	// the error is shown to the client as a banner and the connection is
+	// rejected before any key lookup. See MinClientVersion.
+	ClientVersionFunc func(version string) error
+	// AllowConnFunc, if set, is called with the client IP of every accepted
+	// connection and must return false to reject it before the handshake.
+	// Use IPFilter.Allowed for static allow and deny lists. Connections
+	// without an IP address, such as over unix sockets, are not checked.
+	AllowConnFunc func(ip net.IP) bool
+	// MaxAuthFailures, if greater than zero, temporarily bans client IPs
+	// that fail to authenticate this many times within AuthFailureWindow.
+	// Clients disconnecting before trying any credentials, such as health
+	// checks, aren't counted. Banned clients are disconnected on accept,
+	// before any key lookup.
+	MaxAuthFailures int
+	// AuthFailureWindow is the period over which authentication failures
+	// are counted. Defaults to 10 minutes.
+	AuthFailureWindow time.Duration
+	// BanDuration is how long a client exceeding MaxAuthFailures is
+	// banned. Defaults to 15 minutes.
+	BanDuration         time.Duration
+	PublicKeyLookupFunc func(string) (*PublicKey, error)
+	// UserCAKeys are the certificate authorities trusted to sign user
+	// certificates. Clients presenting a certificate from one of them are
+	// authenticated without a key lookup as long as the certificate is
+	// valid and lists the SSH username as a principal.
+	UserCAKeys []ssh.PublicKey
+	// CertLookupFunc, if set, resolves a validated user certificate to a
+	// key, e.g. to map its key ID to an account. By default the key ID of
+	// the certificate is used as the key ID.
+	CertLookupFunc func(cert *ssh.Certificate, meta ssh.ConnMetadata) (*PublicKey, error)
+	// PrincipalResolver, if set, is preferred over CertLookupFunc and maps a
+	// validated user certificate, typically its key ID and principals,
+	// directly to the Principal the client acts as.
+	PrincipalResolver func(cert *ssh.Certificate, meta ssh.ConnMetadata) (*Principal, error)
+	// MaxCertLifetime, if greater than zero, rejects user certificates whose
+	// validity window is longer, including ones that never expire, so only
+	// short-lived certificates are accepted.
+	MaxCertLifetime time.Duration
+	// Authorizer, if set, is asked before every git command whether the key
+	// may perform the operation on the repository. Creating a repository
+	// through AutoCreate is authorized separately as OperationCreate.
+	// Errors wrapping ErrAccessDenied are shown to the client, e.g.
+	// fmt.Errorf("%w: the repository is archived", ErrAccessDenied); other
+	// errors only in the logs.
+	Authorizer Authorizer
+	// ResolveRepo, if set, returns where on disk the repository of a git
+	// command is kept, as Server.ResolveRepo does. It is asked once the
+	// command has been authorized. The shell lists no repositories with it,
+	// since names can't be told from the paths it returns.
+	ResolveRepo func(ctx context.Context, principal *Principal, repo string) (string, error)
+	// Redirects, if set, serves repositories that moved from their new
+	// location, as Server.Redirects does.
+	Redirects *Redirects
+	// AllowAnonymous, if true and Config.Auth is enabled, lets clients
+	// without an accepted key connect as AnonymousKeyID. Anonymous clients
+	// can only clone and fetch repositories PublicRepoFunc reports as
+	// public, pushes still require a key. Anonymous access is offered
+	// through keyboard-interactive authentication with no prompts, which
+	// clients try after their keys.
+	AllowAnonymous bool
+	// PublicRepoFunc reports whether anonymous clients may read a
+	// repository. If nil, no repository is public.
+	PublicRepoFunc func(repo string) bool
+	// AuthorizeRead, if set, is called before git-upload-pack or
+	// git-upload-archive is spawned, after the Authorizer. Returning an
+	// error denies the clone or fetch, which unlike ReadOnly makes it
+	// possible to keep repositories private per key.
+	AuthorizeRead func(keyID, repo string) error
+	// PolicyFunc, if set, is evaluated before every git command with the
+	// key ID as principal and an empty ref, and for pushes again for every
+	// updated ref before git receives the push. A denial aborts the command
+	// and its reason is shown to the client.
+	PolicyFunc func(ctx context.Context, input PolicyInput) (PolicyDecision, error)
+	// UserResolver, if set, maps the SSH username to a namespace, a
+	// subdirectory of Config.Dir the connection is served from, e.g. so
+	// that "ssh acme@host git-upload-pack app.git" serves Dir/acme/app.git.
+	// It replaces the Config.GitUser check; returning an error rejects the
+	// connection. Repositories are reported as "namespace/repo" to
+	// authorizers, policies and hooks.
+	UserResolver func(user string) (namespace string, err error)
+	// ExpandUserPaths, if true, serves repositories asked for as
+	// ~user/repo.git from the namespace UserResolver returns for user, or
+	// from Dir/user without UserResolver, as traditional git hosting does.
+	// ~/repo.git is a repository of the connecting user. Authorizers see
+	// the expanded name.
+	ExpandUserPaths bool
+	// UserCheckFunc, if set, is called once the client authenticated with
+	// its SSH username and key ID and replaces the Config.GitUser check, so
+	// several login names such as "git", "gitea" or per-user names can be
+	// accepted. Returning an error rejects the connection. The username is
+	// passed on to authorizers and to git processes as GITKIT_USER.
+	UserCheckFunc func(user, keyID string) error
+	// KeyLookupFunc, if set, is preferred over both PublicKeyLookupFunc and
+	// PublicKeyLookupKeyFunc. It receives the key together with its
+	// algorithm, fingerprint and the user and address of the client, so
+	// backends can implement per-user keys and audit failed attempts.
+	KeyLookupFunc func(req *KeyLookupRequest) (*PublicKey, error)
+	// PasswordFunc, if set, enables password and keyboard-interactive
+	// authentication with Config.Auth. It checks the password of the SSH
+	// user and returns the key the client is identified as, see
+	// PAMAuthenticator. Keyboard-interactive authentication is left to
+	// AllowAnonymous if both are set.
+	PasswordFunc func(meta ssh.ConnMetadata, password string) (*PublicKey, error)
+	// PublicKeyLookupKeyFunc, if set, is preferred over PublicKeyLookupFunc and
+	// receives the parsed key directly instead of its marshalled form.
+	PublicKeyLookupKeyFunc func(key ssh.PublicKey, meta ssh.ConnMetadata) (*PublicKey, error)
+	// OnAuthFailure, if set, is called for every rejected key or username
+	// and every denied git command or ref update, e.g. to feed fail2ban or
+	// alerting. It is called synchronously and should not block.
+	OnAuthFailure func(event AuthEvent)
+	// OnPanic, if set, is called with the recovered value and stack trace
+	// when a connection, session or key lookup panics. The panic is logged and
+	// only the affected connection is closed either way.
+	OnPanic func(v interface{}, stack []byte)
+	// OnSession, if set, is called when a git command starts and ends. It
+	// is called synchronously and should not block.
+	OnSession func(event SessionEvent)
+}
+
+// AuthorizedKeyString returns the canonical authorized_keys representation of
+// the key, without comment or trailing newline. This is the string passed to
+// PublicKeyLookupFunc.
+func AuthorizedKeyString(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of the key in the format used
+// by OpenSSH, e.g. "SHA256:...".
+func KeyFingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
 }
 
 func NewSSH(config Config) *SSH {
@@ -64,51 +358,261 @@ func (s *SSH) SetSSHConfig(config *ssh.ServerConfig) {
 	s.sshConfig = config
 }
 
+// AddHostKey adds a host key in addition to the ones found in KeyDir. It
+// must be called before Listen. As with ssh.ServerConfig, a key replaces any
+// previous key of the same algorithm.
+func (s *SSH) AddHostKey(key ssh.Signer) {
+	s.hostKeys = append(s.hostKeys, key)
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil || os.IsExist(err)
 }
 
-func cleanCommand(cmd string) string {
-	i := strings.Index(cmd, "git")
-	if i == -1 {
-		return cmd
+// trackConn registers a newly accepted connection. It returns an error if
+// the server is shutting down or has reached MaxConns and the connection
+// must not be served.
+func (s *SSH) trackConn(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return ErrServerClosed
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		return errServerBusy
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]int)
+	}
+	s.conns[conn] = 0
+	return nil
+}
+
+func (s *SSH) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	delete(s.connKeys, conn)
+}
+
+// maxSessionDuration returns the absolute connection lifetime, 0 meaning no
+// limit.
+func (s *SSH) maxSessionDuration() time.Duration {
+	if s.MaxSessionDuration > 0 {
+		return s.MaxSessionDuration
+	}
+	if s.Timeout != nil {
+		return *s.Timeout
+	}
+	return 0
+}
+
+// maxConnsPerHost returns the per-host connection limit, 0 meaning no limit.
+func (s *SSH) maxConnsPerHost() int {
+	if s.MaxConnsPerHost > 0 {
+		return s.MaxConnsPerHost
+	}
+	if s.DisableSimultaneousConns {
+		return 1
 	}
-	return cmd[i:]
+	return 0
 }
 
-func execCommandBytes(cmdname string, args ...string) ([]byte, []byte, error) {
-	bufOut := new(bytes.Buffer)
-	bufErr := new(bytes.Buffer)
+// acquireHost registers a connection from host. It returns false if host
+// already has limit open connections.
+func (s *SSH) acquireHost(host string, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostConns[host] >= limit {
+		return false
+	}
+	if s.hostConns == nil {
+		s.hostConns = make(map[string]int)
+	}
+	s.hostConns[host]++
+	return true
+}
 
-	cmd := exec.Command(cmdname, args...)
-	cmd.Stdout = bufOut
-	cmd.Stderr = bufErr
+func (s *SSH) releaseHost(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostConns[host]--; s.hostConns[host] <= 0 {
+		delete(s.hostConns, host)
+	}
+}
 
-	err := cmd.Run()
-	return bufOut.Bytes(), bufErr.Bytes(), err
+// acquireKeyOp registers a git command run for keyID. It returns false if
+// keyID already runs MaxOpsPerKey commands.
+func (s *SSH) acquireKeyOp(keyID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyOps[keyID] >= s.MaxOpsPerKey {
+		return false
+	}
+	if s.keyOps == nil {
+		s.keyOps = make(map[string]int)
+	}
+	s.keyOps[keyID]++
+	return true
 }
 
-func execCommand(cmdname string, args ...string) (string, string, error) {
-	bufOut, bufErr, err := execCommandBytes(cmdname, args...)
-	return string(bufOut), string(bufErr), err
+func (s *SSH) releaseKeyOp(keyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyOps[keyID]--; s.keyOps[keyID] <= 0 {
+		delete(s.keyOps, keyID)
+	}
 }
 
-func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn *ssh.ServerConn) {
+// isBanned reports whether the client at addr is banned for exceeding
+// MaxAuthFailures.
+func (s *SSH) isBanned(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if s.MaxAuthFailures <= 0 || ip == nil {
+		return false
+	}
+	return s.bans.banned(ip.String(), time.Now())
+}
+
+// authFailed records a failed handshake from the client at addr.
+func (s *SSH) authFailed(addr net.Addr) {
+	ip := remoteIP(addr)
+	if s.MaxAuthFailures <= 0 || ip == nil {
+		return
+	}
+	window := s.AuthFailureWindow
+	if window <= 0 {
+		window = defaultAuthFailureWindow
+	}
+	ban := s.BanDuration
+	if ban <= 0 {
+		ban = defaultBanDuration
+	}
+	if s.bans.fail(ip.String(), time.Now(), s.MaxAuthFailures, window, ban) {
+		log.Printf("ssh: banning %s for %s after %d failed attempts", ip, ban, s.MaxAuthFailures)
+	}
+}
+
+// failedAuthentication reports whether a handshake failed with err because
+// the client's credentials were rejected, rather than because it went away
+// before trying any, as health checks and port scanners do.
+func failedAuthentication(err error) bool {
+	var authErr *ssh.ServerAuthError
+	if errors.As(err, &authErr) {
+		for _, err := range authErr.Errors {
+			if err != ssh.ErrNoAuth {
+				return true
+			}
+		}
+		return false
+	}
+	// Clients exceeding MaxAuthTries are disconnected with this message.
+	return strings.Contains(err.Error(), "too many authentication failures")
+}
+
+// authSucceeded clears previous failures from the client at addr.
+func (s *SSH) authSucceeded(addr net.Addr) {
+	if ip := remoteIP(addr); s.MaxAuthFailures > 0 && ip != nil {
+		s.bans.reset(ip.String())
+	}
+}
+
+// startSession marks a session as active on conn. It returns an error if the
+// server is shutting down or conn has reached MaxSessionsPerConn and no new
+// session should be started.
+func (s *SSH) startSession(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return errShuttingDown
+	}
+	if s.MaxSessionsPerConn > 0 && s.conns[conn] >= s.MaxSessionsPerConn {
+		return errTooManySessions
+	}
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn]++
+	}
+	s.activeSessions++
+	if s.RequestTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+func (s *SSH) endSession(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.conns[conn]; ok && n > 0 {
+		s.conns[conn]--
+		if n == 1 && s.RequestTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.RequestTimeout))
+		}
+	}
+	s.activeSessions--
+}
+
+// closeIdleConns closes all connections without an active session and
+// reports whether the server has fully drained.
+func (s *SSH) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, sessions := range s.conns {
+		if sessions == 0 {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0 && s.activeSessions == 0
+}
+
+func (s *SSH) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *SSH) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *SSH) handleConnection(ctx context.Context, cfg *Config, conn net.Conn, principal *Principal, namespace string, chans <-chan ssh.NewChannel, sConn *ssh.ServerConn) {
 	for newChan := range chans {
 		if newChan.ChannelType() != "session" {
 			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
 
+		if err := s.startSession(conn); err != nil {
+			newChan.Reject(ssh.ResourceShortage, err.Error())
+			continue
+		}
+
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
 			log.Printf("error accepting channel: %v", err)
+			s.endSession(conn)
 			continue
 		}
 
 		go func(in <-chan *ssh.Request) {
+			defer s.endSession(conn)
 			defer ch.Close()
+			defer s.recoverPanic("ssh: session")
+
+			// Closing the channel once the session context is done unblocks
+			// any copies still in flight.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				<-ctx.Done()
+				ch.Close()
+			}()
 
 			defer func() {
 				if s.DisableConnReuse {
@@ -117,52 +621,63 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn
 						log.Println("err while closing:", err)
 					}
 				}
-				if s.DisableSimultaneousConns {
-					host, _ := getHost(sConn.RemoteAddr().String())
-					mux.Lock()
-					defer mux.Unlock()
-					log.Println("disable simultaneous conns")
-					for i, connHost := range connHosts {
-						if host == connHost {
-							connHosts[i] = connHosts[len(connHosts)-1]
-							connHosts = connHosts[:len(connHosts)-1]
-						}
-					}
-				}
 			}()
 
+			// Variables set with env requests, passed on to the git command
+			// of the session.
+			env := map[string]string{}
 			for req := range in {
-				payload := cleanCommand(string(req.Payload))
-
 				switch req.Type {
 				case "env":
-					log.Printf("ssh: incoming env request: %s\n", payload)
-
-					args := strings.Split(strings.Replace(payload, "\x00", "", -1), "\v")
-					if len(args) != 2 {
-						log.Printf("env: invalid env arguments: '%#v'", args)
-						continue
+					var kv struct{ Name, Value string }
+					ok := ssh.Unmarshal(req.Payload, &kv) == nil && s.acceptsEnv(kv.Name)
+					if ok {
+						env[kv.Name] = kv.Value
+					} else {
+						log.Printf("ssh: ignoring env request for %q", kv.Name)
 					}
-
-					args[0] = strings.TrimLeft(args[0], "\x04")
-					if len(args[0]) == 0 {
-						log.Printf("env: invalid key from payload: %s", payload)
-						continue
+					if req.WantReply {
+						req.Reply(ok, nil)
 					}
-
-					_, _, err := execCommandBytes("env", args[0]+"="+args[1])
-					if err != nil {
-						log.Printf("env: %v", err)
+				case "pty-req":
+					// A plain ssh asks for a terminal before its shell.
+					req.Reply(true, nil)
+				case "shell":
+					req.Reply(true, nil)
+					s.serveShell(ctx, ch, sConn, cfg, principal, namespace)
+					return
+				case "exec":
+					var execReq struct{ Command string }
+					if err := ssh.Unmarshal(req.Payload, &execReq); err != nil {
+						log.Println("ssh: malformed exec request:", err)
+						ch.Write([]byte("Invalid command.\r\n"))
 						return
 					}
-				case "exec":
-					log.Printf("ssh: incoming exec request: %s\n", payload)
-
-					cmdName := strings.TrimLeft(payload, "'()")
-					log.Printf("ssh: payload '%v'", cmdName)
-
-					if strings.HasPrefix(cmdName, "\x00") {
-						cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
+					cmdName := execReq.Command
+					log.Printf("ssh: incoming exec request: %q", cmdName)
+
+					if handler, command := s.command(cmdName); handler != nil {
+						if err := s.authorizeCommand(sConn, principal, command.Name); err != nil {
+							log.Printf("ssh: denied %s for %s: %v", command.Name, principal, err)
+							s.connFailure(sConn, principal, AuthEventAuthorization, "", OperationRun, err)
+							denyExec(req, ch, command.Name, denialMessage(err, "you may not run "+command.Name))
+							return
+						}
+						if s.MaxOpsPerKey > 0 && principal.ID != "" {
+							if !s.acquireKeyOp(principal.ID) {
+								log.Printf("ssh: rejecting %s for %s: %v", command.Name, principal, errTooManyKeyOps)
+								denyExec(req, ch, command.Name, errTooManyKeyOps.Error())
+								return
+							}
+							defer s.releaseKeyOp(principal.ID)
+						}
+						command.Principal = principal
+						command.User = sConn.User()
+						command.RemoteAddr = sConn.RemoteAddr()
+						command.Env = env
+						command.Channel = ch
+						s.runCommand(ctx, req, ch, in, handler, command)
+						return
 					}
 
 					gitcmd, err := ParseGitCommand(cmdName)
@@ -171,9 +686,85 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn
 						ch.Write([]byte("Invalid command.\r\n"))
 						return
 					}
+					expanded := false
+					if s.ExpandUserPaths {
+						gitcmd.Repo, expanded, err = s.expandUserPath(gitcmd.Repo, sConn.User())
+					}
+					if err == nil && !expanded {
+						gitcmd.Repo, err = namespacedRepo(namespace, gitcmd.Repo)
+					}
+					if err != nil {
+						log.Printf("ssh: rejecting %s for user %q: %v", cmdName, sConn.User(), err)
+						ch.Write([]byte("Invalid command.\r\n"))
+						return
+					}
+					moved := false
+					if s.Redirects != nil {
+						gitcmd.Repo, moved = s.Redirects.follow(gitcmd.Repo)
+					}
+					gitcmd.Repo = cfg.lookupRepo(gitcmd.Repo)
+					repoPath, err := cfg.repoPath(gitcmd.Repo)
+					if err != nil {
+						log.Printf("ssh: rejecting %s for user %q: %v", cmdName, sConn.User(), err)
+						ch.Write([]byte("Invalid command.\r\n"))
+						return
+					}
+
+					if !principal.CanRun(gitcmd.Command) {
+						err := deniedBecause(fmt.Sprintf("this key may not run %s", gitcmd.Command))
+						log.Printf("ssh: denied %s on %s for %s: %v", gitcmd.Command, gitcmd.Repo, principal, err)
+						s.connFailure(sConn, principal, AuthEventAuthorization, gitcmd.Repo, operationFor(gitcmd.Command), err)
+						denyExec(req, ch, gitcmd.Command, err.Error())
+						return
+					}
 
-					if !repoExists(filepath.Join(s.gitConfig.Dir, gitcmd.Repo)) && s.gitConfig.AutoCreate == true {
-						err := initRepo(gitcmd.Repo, s.gitConfig)
+					gitNamespace, err := s.authorize(sConn, principal, gitcmd, operationFor(gitcmd.Command))
+					if err == nil && gitNamespace != "" && gitcmd.Command == "git-upload-archive" {
+						// git archive doesn't keep to the refs of a namespace.
+						err = deniedBecause("archives are not available in a git namespace")
+					}
+					if err != nil {
+						log.Printf("ssh: denied %s on %s for %s: %v", gitcmd.Command, gitcmd.Repo, principal, err)
+						s.connFailure(sConn, principal, AuthEventAuthorization, gitcmd.Repo, operationFor(gitcmd.Command), err)
+						denyExec(req, ch, gitcmd.Command, denialMessage(err, permissionMessage(operationFor(gitcmd.Command), gitcmd.Repo)))
+						return
+					}
+
+					policyInput := PolicyInput{
+						Principal:   principal.ID,
+						Scopes:      principal.Scopes,
+						Attributes:  principal.Attributes,
+						SecurityKey: principal.SecurityKey,
+						Repo:        gitcmd.Repo,
+						Operation:   operationFor(gitcmd.Command),
+					}
+					if err := s.evaluatePolicy(ctx, policyInput); err != nil {
+						log.Printf("ssh: policy denied %s on %s for %s: %v", gitcmd.Command, gitcmd.Repo, principal, err)
+						s.connFailure(sConn, principal, AuthEventAuthorization, gitcmd.Repo, policyInput.Operation, err)
+						denyExec(req, ch, gitcmd.Command, denialMessage(err, permissionMessage(policyInput.Operation, gitcmd.Repo)))
+						return
+					}
+					if moved && s.Redirects.Notify {
+						log.Printf("ssh: %s moved to %s", gitcmd.Original, gitcmd.Repo)
+						denyExec(req, ch, gitcmd.Command, movedMessage(strings.TrimPrefix(gitcmd.Repo, namespace+"/")))
+						return
+					}
+					if s.ResolveRepo != nil {
+						if repoPath, err = cfg.resolveRepo(ctx, s.ResolveRepo, principal, gitcmd.Repo); err != nil {
+							log.Printf("ssh: resolving %s for %s: %v", gitcmd.Repo, principal, err)
+							denyExec(req, ch, gitcmd.Command, denialMessage(err, fmt.Sprintf("repository %s not found", gitcmd.Repo)))
+							return
+						}
+					}
+
+					if !repoExists(repoPath) && cfg.AutoCreate == true {
+						if _, err := s.authorize(sConn, principal, gitcmd, OperationCreate); err != nil {
+							log.Printf("ssh: denied creating %s for %s: %v", gitcmd.Repo, principal, err)
+							s.connFailure(sConn, principal, AuthEventAuthorization, gitcmd.Repo, OperationCreate, err)
+							denyExec(req, ch, gitcmd.Command, denialMessage(err, permissionMessage(OperationCreate, gitcmd.Repo)))
+							return
+						}
+						err := initRepo(repoPath, cfg)
 						if err != nil {
 							logError("repo-init", err)
 							return
@@ -184,51 +775,173 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn
 					// when the user does not have permissions to finish
 					// the operation at hand.
 					//
-					// During a git push, this leads to an 'EOF' error.
-					if gitcmd.Command == "git-receive-pack" && s.gitConfig.ReadOnly {
+					// During a git push, this leads to an 'EOF' error,
+					// preceded by an explanation on stderr.
+					if gitcmd.Command == "git-receive-pack" && cfg.ReadOnly {
+						fmt.Fprintf(ch.Stderr(), "%s: %s\r\n", ErrAccessDenied, permissionMessage(OperationWrite, gitcmd.Repo))
 						sConn.Close()
 						break
 					}
 
-					cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
-					cmd.Dir = s.gitConfig.Dir
-					cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
-					// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
-
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stdout pipe: %v", err)
-						return
+					if s.MaxOpsPerKey > 0 && principal.ID != "" {
+						if !s.acquireKeyOp(principal.ID) {
+							log.Printf("ssh: rejecting %s on %s for %s: %v", gitcmd.Command, gitcmd.Repo, principal, errTooManyKeyOps)
+							denyExec(req, ch, gitcmd.Command, errTooManyKeyOps.Error())
+							return
+						}
+						defer s.releaseKeyOp(principal.ID)
 					}
 
-					stderr, err := cmd.StderrPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stderr pipe: %v", err)
+					// Check again what is about to run, the repository may
+					// have been moved into a namespace since it was parsed.
+					if err := gitcmd.validate(); err != nil {
+						log.Printf("ssh: rejecting %q for user %q: %v", gitcmd.Original, sConn.User(), err)
+						denyExec(req, ch, gitcmd.Command, "Invalid command.")
 						return
 					}
-
-					input, err := cmd.StdinPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stdin pipe: %v", err)
-						return
+					if abs, err := filepath.Abs(repoPath); err == nil {
+						repoPath = abs
 					}
-
-					if err = cmd.Start(); err != nil {
-						log.Printf("ssh: start error: %v", err)
-						return
+					environ := append(os.Environ(), sessionEnviron(env)...)
+					environ = append(environ, principal.environ()...)
+					environ = append(environ, "GITKIT_USER="+sConn.User())
+					if gitNamespace != "" {
+						environ = append(environ, "GIT_NAMESPACE="+gitNamespace)
+					}
+					var uploadPack uploadPackOptions
+					if gitcmd.Command == "git-upload-pack" {
+						uploadPack = s.uploadPack(gitcmd.Repo)
+						environ = append(environ, configEnviron(uploadPack.config())...)
 					}
+					if perms := sConn.Permissions; perms != nil {
+						if id, ok := perms.Extensions[certKeyIDExtension]; ok {
+							environ = append(environ,
+								"GITKIT_CERT_KEY_ID="+id,
+								"GITKIT_CERT_PRINCIPALS="+perms.Extensions[certPrincipalsExtension])
+						}
+					}
+					e := &Exec{
+						Principal:    principal,
+						User:         sConn.User(),
+						RemoteAddr:   sConn.RemoteAddr(),
+						Command:      gitcmd.Command,
+						Repo:         gitcmd.Repo,
+						RepoPath:     repoPath,
+						GitNamespace: gitNamespace,
+						Env:          environ,
+					}
+					ran, started := false, false
+					run := func(ctx context.Context, e *Exec) error {
+						ran = true
+						cmd := exec.CommandContext(ctx, gitcmd.Command, repoPath)
+						cmd.Dir = cfg.Dir
+						cmd.Env = e.Env
+
+						stdout, err := cmd.StdoutPipe()
+						if err != nil {
+							return fmt.Errorf("opening stdout pipe: %w", err)
+						}
 
-					req.Reply(true, nil)
-					go io.Copy(input, ch)
-					io.Copy(ch, stdout)
-					io.Copy(ch.Stderr(), stderr)
+						stderr, err := cmd.StderrPipe()
+						if err != nil {
+							return fmt.Errorf("opening stderr pipe: %w", err)
+						}
 
-					if err = cmd.Wait(); err != nil {
-						log.Printf("ssh: command failed: %v", err)
-						return
-					}
+						input, err := cmd.StdinPipe()
+						if err != nil {
+							return fmt.Errorf("opening stdin pipe: %w", err)
+						}
 
-					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+						if err = s.procs.start(cmd); err != nil {
+							return err
+						}
+						defer s.procs.cleanUp(cmd)
+						session := s.sessions.add(Session{
+							Protocol:   "ssh",
+							Principal:  principal.ID,
+							User:       sConn.User(),
+							RemoteAddr: sConn.RemoteAddr().String(),
+							Repo:       gitcmd.Repo,
+							Command:    gitcmd.Command,
+						}, s.OnSession)
+						defer s.sessions.remove(session, s.OnSession)
+
+						started = true
+						req.Reply(true, nil)
+						s.writeMOTD(ch.Stderr(), principal)
+
+						// The requests channel is closed once the client closes
+						// the session channel or disconnects. Kill the git process
+						// right away instead of waiting for its pipes to break.
+						go func() {
+							for req := range in {
+								if req.WantReply {
+									req.Reply(false, nil)
+								}
+							}
+							cancel()
+						}()
+
+						// With protocol v2, git reads commands until its input
+						// ends, so it is closed once the client is done sending.
+						if s.PolicyFunc != nil && policyInput.Operation == OperationWrite {
+							go func() {
+								defer input.Close()
+								if err := s.copyPush(ctx, policyInput, input, ch, ch.Stderr()); err != nil {
+									log.Printf("ssh: push to %s aborted: %v", gitcmd.Repo, err)
+									s.connFailure(sConn, principal, AuthEventAuthorization, gitcmd.Repo, OperationWrite, err)
+									cancel()
+								}
+							}()
+						} else if uploadPack.inspected() {
+							go func() {
+								defer input.Close()
+								checker := newPktLineChecker(ch, uploadPack.check)
+								io.Copy(input, checker)
+								if checker.denied != nil {
+									log.Printf("ssh: denied %s on %s for %s: %v", gitcmd.Command, gitcmd.Repo, principal, checker.denied)
+									fmt.Fprintf(ch.Stderr(), "%s\r\n", denialMessage(checker.denied, "fetch not allowed"))
+									cancel()
+								}
+							}()
+						} else {
+							go func() {
+								io.Copy(input, ch)
+								input.Close()
+							}()
+						}
+						// git writes progress and errors to stderr while it sends
+						// its output, and stops once the pipe it writes to is full.
+						// Both are read until git closes them, before it is reaped.
+						var copying sync.WaitGroup
+						copying.Add(1)
+						go func() {
+							defer copying.Done()
+							io.Copy(ch.Stderr(), stderr)
+						}()
+						if _, err := io.Copy(ch, stdout); err != nil {
+							log.Printf("ssh: client went away: %v", err)
+							cancel()
+						}
+						copying.Wait()
+						ch.CloseWrite()
+
+						return s.procs.wait(cmd)
+					}
+					err = s.execHandler(run)(ctx, e)
+					switch {
+					case !ran:
+						log.Printf("ssh: denied %s on %s for %s: %v", gitcmd.Command, gitcmd.Repo, principal, err)
+						s.connFailure(sConn, principal, AuthEventAuthorization, gitcmd.Repo, operationFor(gitcmd.Command), err)
+						denyExec(req, ch, gitcmd.Command, denialMessage(err, gitcmd.Command+" is not allowed"))
+					case !started:
+						log.Printf("ssh: running %s on %s: %v", gitcmd.Command, gitcmd.Repo, err)
+					default:
+						if err != nil {
+							log.Printf("ssh: %s on %s failed: %v", gitcmd.Command, gitcmd.Repo, err)
+						}
+						sendExitStatus(ch, err)
+					}
 					return
 				default:
 					ch.Write([]byte("Unsupported request type.\r\n"))
@@ -244,39 +957,155 @@ func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel, sConn
 	}
 }
 
-func (s *SSH) createServerKey() error {
-	if err := os.MkdirAll(s.gitConfig.KeyDir, os.ModePerm); err != nil {
-		return err
+// authorize checks an operation of a git or custom command against the
+// Authorizer and, for reads, AuthorizeRead. Anonymous clients may only read
+// public repositories. A panicking hook denies the operation. It returns the
+// git namespace the Authorizer set, if any.
+func (s *SSH) authorize(sConn *ssh.ServerConn, principal *Principal, gitcmd *GitCommand, operation string) (gitNamespace string, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlePanic("ssh: authorization", v)
+			gitNamespace, err = "", fmt.Errorf("authorization failed")
+		}
+	}()
+
+	if isAnonymous(sConn.Permissions) {
+		if operation != OperationRead || !s.isPublicRepo(gitcmd.Repo) {
+			return "", errAnonymousDenied
+		}
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
+	if s.Authorizer != nil {
+		access := &AccessRequest{
+			KeyID:      principal.ID,
+			Principal:  principal,
+			User:       sConn.User(),
+			Repo:       gitcmd.Repo,
+			Operation:  operation,
+			Command:    gitcmd.Command,
+			RemoteAddr: sConn.RemoteAddr(),
+		}
+		if err := s.Authorizer.Authorize(access); err != nil {
+			return "", err
+		}
+		if err := checkGitNamespace(access.GitNamespace); err != nil {
+			return "", err
+		}
+		gitNamespace = access.GitNamespace
+	}
+	if operation == OperationRead && s.AuthorizeRead != nil {
+		if err := s.AuthorizeRead(principal.ID, gitcmd.Repo); err != nil {
+			return "", err
+		}
+	}
+	return gitNamespace, nil
+}
+
+// handlePanic logs a recovered panic and passes it on to OnPanic.
+func (s *SSH) handlePanic(context string, v interface{}) {
+	stack := debug.Stack()
+	log.Printf("%s: panic: %v\n%s", context, v, stack)
+	if s.OnPanic != nil {
+		s.OnPanic(v, stack)
+	}
+}
+
+// recoverPanic recovers from a panic in a connection or session goroutine so
+// that it does not take down the whole server. It must be deferred directly.
+func (s *SSH) recoverPanic(context string) {
+	if v := recover(); v != nil {
+		s.handlePanic(context, v)
 	}
+}
 
-	privateKeyFile, err := os.Create(s.gitConfig.KeyPath())
+// authenticateKey decides whether a client may log in with key.
+func (s *SSH) authenticateKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if s.isBanned(conn.RemoteAddr()) {
+		return nil, errBanned
+	}
+	if err := s.checkClientVersion(conn); err != nil {
+		return nil, err
+	}
+	if err := s.checkKeyRevocation(key); err != nil {
+		return nil, err
+	}
+	if cert, ok := key.(*ssh.Certificate); ok && len(s.UserCAKeys) > 0 {
+		return s.authenticateCert(conn, cert)
+	}
+	if s.PublicKeyLookupFunc == nil && s.PublicKeyLookupKeyFunc == nil && s.KeyLookupFunc == nil {
+		if len(s.UserCAKeys) == 0 {
+			return nil, fmt.Errorf("public key authentication is disabled")
+		}
+		return nil, fmt.Errorf("only certificates are accepted")
+	}
+	pkey, err := s.lookupPublicKey(conn, key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := os.Chmod(s.gitConfig.KeyPath(), 0600); err != nil {
-		return err
+	return keyPermissions(principalFromKey(pkey, key), key), nil
+}
+
+// lookupPublicKey resolves the key using KeyLookupFunc or
+// PublicKeyLookupKeyFunc if set, falling back to PublicKeyLookupFunc with
+// the marshalled key. Expired and revoked keys are rejected, Fingerprint and
+// Content of the returned key are populated if the lookup left them empty.
+// A panicking lookup rejects the key.
+func (s *SSH) lookupPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (pkey *PublicKey, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlePanic("ssh: key lookup", v)
+			pkey, err = nil, fmt.Errorf("key lookup failed")
+		}
+	}()
+
+	switch {
+	case s.KeyLookupFunc != nil:
+		pkey, err = s.KeyLookupFunc(newKeyLookupRequest(conn, key))
+	case s.PublicKeyLookupKeyFunc != nil:
+		pkey, err = s.PublicKeyLookupKeyFunc(key, conn)
+	default:
+		pkey, err = s.PublicKeyLookupFunc(AuthorizedKeyString(key))
 	}
-	defer privateKeyFile.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
-		return err
+
+	if pkey == nil {
+		return nil, fmt.Errorf("auth handler did not return a key")
 	}
 
-	pubKeyPath := s.gitConfig.KeyPath() + ".pub"
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
-	if err != nil {
-		return err
+	if err := checkKeyValidity(pkey, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Fill in what the lookup left out on a copy, the returned key may be
+	// owned by the backend.
+	resolved := *pkey
+	if resolved.Fingerprint == "" {
+		resolved.Fingerprint = KeyFingerprint(key)
+	}
+	if resolved.Content == "" {
+		resolved.Content = AuthorizedKeyString(key)
 	}
-	return ioutil.WriteFile(pubKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
+	return &resolved, nil
+}
+
+func newKeyLookupRequest(conn ssh.ConnMetadata, key ssh.PublicKey) *KeyLookupRequest {
+	req := &KeyLookupRequest{
+		Key:           key,
+		Algorithm:     key.Type(),
+		Fingerprint:   KeyFingerprint(key),
+		AuthorizedKey: AuthorizedKeyString(key),
+		Meta:          conn,
+	}
+	req.Application, req.SecurityKey = SecurityKeyApplication(key)
+	if conn != nil {
+		req.User = conn.User()
+		req.RemoteAddr = conn.RemoteAddr()
+		req.SessionID = conn.SessionID()
+	}
+	return req
 }
 
 func (s *SSH) setup() error {
@@ -286,59 +1115,123 @@ func (s *SSH) setup() error {
 	} else {
 		config = &ssh.ServerConfig{}
 	}
+	s.userBanner = config.BannerCallback
+
+	if err := s.configureServer(config, s.gitConfig); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.sshConfig = config
+	s.mu.Unlock()
+	return nil
+}
+
+// configureServer applies the authentication settings and host keys of the
+// git config to the given ssh.ServerConfig, generating a host key if KeyDir
+// does not contain one yet.
+func (s *SSH) configureServer(config *ssh.ServerConfig, gitConfig *Config) error {
 	config.ServerVersion = fmt.Sprintf("SSH-2.0-gitkit %s", Version)
+	config.BannerCallback = s.bannerCallback
 
-	if s.gitConfig.KeyDir == "" {
+	if gitConfig.KeyDir == "" {
 		return fmt.Errorf("key directory is not provided")
 	}
 
-	if !s.gitConfig.Auth {
+	if err := applyCryptoProfile(&config.Config, s.CryptoProfile); err != nil {
+		return err
+	}
+
+	if !gitConfig.Auth {
 		config.NoClientAuth = true
 	} else {
-		if s.PublicKeyLookupFunc == nil {
+		if s.PasswordFunc != nil {
+			config.PasswordCallback = s.passwordCallback
+			config.KeyboardInteractiveCallback = s.passwordPromptCallback
+		}
+		if s.AllowAnonymous {
+			config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				perms, err := s.anonymousCallback(conn, challenge)
+				if err != nil {
+					s.authFailure(AuthEvent{
+						Type:       AuthEventAuthentication,
+						RemoteAddr: conn.RemoteAddr(),
+						User:       conn.User(),
+						Reason:     err.Error(),
+					})
+				}
+				return perms, err
+			}
+		}
+		if s.PublicKeyLookupFunc == nil && s.PublicKeyLookupKeyFunc == nil && s.KeyLookupFunc == nil && len(s.UserCAKeys) == 0 && s.PasswordFunc == nil {
 			return fmt.Errorf("public key lookup func is not provided")
 		}
 
+		config.NoClientAuth = false
 		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			pkey, err := s.PublicKeyLookupFunc(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+			perms, err := s.authenticateKey(conn, key)
 			if err != nil {
-				return nil, err
-			}
-
-			if pkey == nil {
-				return nil, fmt.Errorf("auth handler did not return a key")
+				s.authFailure(AuthEvent{
+					Type:        AuthEventAuthentication,
+					RemoteAddr:  conn.RemoteAddr(),
+					User:        conn.User(),
+					Fingerprint: KeyFingerprint(key),
+					Reason:      err.Error(),
+				})
 			}
-
-			return &ssh.Permissions{Extensions: map[string]string{"key-id": pkey.Id}}, nil
+			return perms, err
 		}
 	}
 
-	keypath := s.gitConfig.KeyPath()
+	keypath := gitConfig.KeyPath()
 	if !fileExists(keypath) {
-		if err := s.createServerKey(); err != nil {
+		if err := gitConfig.createServerKey(); err != nil {
 			return err
 		}
 	}
 
-	privateBytes, err := ioutil.ReadFile(keypath)
+	hostKeys, err := loadHostKeys(gitConfig.KeyDir)
 	if err != nil {
 		return err
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return err
+	for _, key := range append(hostKeys, s.hostKeys...) {
+		config.AddHostKey(key)
 	}
-
-	config.AddHostKey(private)
-	s.sshConfig = config
 	return nil
 }
 
+// serverConfig returns the ssh.ServerConfig to use for new connections.
+func (s *SSH) serverConfig() *ssh.ServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sshConfig
+}
+
+// config returns the git config to use for new connections.
+func (s *SSH) config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gitConfig
+}
+
+// Listen binds the server to the given address. The address is either a TCP
+// "host:port" or a unix domain socket written as "unix:///path/to/socket".
 func (s *SSH) Listen(bind string) error {
-	if s.listener != nil {
+	return s.ListenAddrs(bind)
+}
+
+// ListenAddrs binds the server to all of the given addresses at once, e.g.
+// an IPv4 and an IPv6 address. Serve then accepts connections on all of them
+// and Stop or Shutdown close them together. If any address fails to bind,
+// the listeners opened so far are closed again.
+func (s *SSH) ListenAddrs(binds ...string) error {
+	if len(s.listeners) > 0 {
 		return ErrAlreadyStarted
 	}
+	if len(binds) == 0 {
+		return fmt.Errorf("no bind address provided")
+	}
 
 	if err := s.setup(); err != nil {
 		return err
@@ -348,17 +1241,65 @@ func (s *SSH) Listen(bind string) error {
 		return err
 	}
 
-	var err error
-	s.listener, err = net.Listen("tcp", bind)
-	if err != nil {
-		return err
+	listeners := make([]net.Listener, 0, len(binds))
+	for _, bind := range binds {
+		l, err := listen(bind)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
 	}
 
+	s.listeners = listeners
 	return nil
 }
 
-var mux sync.Mutex
-var connHosts []string
+func listen(bind string) (net.Listener, error) {
+	network, address := parseBindAddr(bind)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// parseBindAddr returns the network and address to listen on. Addresses
+// prefixed with "unix://" or "unix:" are treated as unix domain sockets,
+// everything else as TCP.
+func parseBindAddr(bind string) (string, string) {
+	for _, prefix := range []string{"unix://", "unix:"} {
+		if strings.HasPrefix(bind, prefix) {
+			return "unix", strings.TrimPrefix(bind, prefix)
+		}
+	}
+	return "tcp", bind
+}
+
+// removeStaleSocket removes a leftover unix socket at path, e.g. from a
+// previous process that did not shut down cleanly. Sockets that still accept
+// connections and any other kind of file are left alone and reported as an
+// error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
 
 func getHost(addr string) (string, error) {
 	if !strings.HasPrefix(addr, "ssh://") {
@@ -376,75 +1317,285 @@ func getHost(addr string) (string, error) {
 }
 
 func (s *SSH) Serve() error {
-	if s.listener == nil {
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext accepts connections on all listeners until ctx is cancelled
+// or the server is stopped. Every connection and session is derived from
+// ctx, so cancelling it closes the listeners, terminates running git
+// processes and unblocks any copies in flight.
+func (s *SSH) ServeContext(ctx context.Context) error {
+	listeners := s.listeners
+	if len(listeners) == 0 {
 		return ErrNoListener
 	}
 
+	// Stopping the accept loops must not cancel connections that are still
+	// being served, so they are derived from ctx rather than acceptCtx.
+	acceptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	s.stopServe = cancel
+	s.mu.Unlock()
+	go func() {
+		<-acceptCtx.Done()
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	var handshakes chan struct{}
+	if s.MaxPendingHandshakes > 0 {
+		handshakes = make(chan struct{}, s.MaxPendingHandshakes)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.acceptLoop(ctx, acceptCtx, l, handshakes)
+		}(l)
+	}
+
+	// The first listener to fail takes the others down with it.
+	err := <-errs
+	cancel()
+	for i := 1; i < len(listeners); i++ {
+		<-errs
+	}
+	return err
+}
+
+// acceptLoop accepts connections on listener until acceptCtx is done.
+// Connections are served with ctx. If handshakes is not nil, it bounds the
+// number of pending handshakes: once it is full, no further connections are
+// accepted until a handshake completes.
+func (s *SSH) acceptLoop(ctx, acceptCtx context.Context, listener net.Listener, handshakes chan struct{}) error {
 	for {
 		// wait for connection or Stop()
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 
-		if s.DisableSimultaneousConns {
-			mux.Lock()
-			defer mux.Unlock()
-			host, _ := getHost(conn.RemoteAddr().String())
-			var matched bool
-			for _, connHost := range connHosts {
-				if host == connHost {
-					log.Println("can't have two multiple simultaneous connections from the same client")
-					err := conn.Close()
-					if err != nil {
-						log.Println("err while closing:", err)
-					}
-					matched = true
-					break
+		if ip := remoteIP(conn.RemoteAddr()); ip != nil && s.AllowConnFunc != nil && !s.AllowConnFunc(ip) {
+			log.Printf("ssh: rejecting connection from %s: address not allowed", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if s.isBanned(conn.RemoteAddr()) {
+			log.Printf("ssh: rejecting connection from %s: %v", conn.RemoteAddr(), errBanned)
+			conn.Close()
+			continue
+		}
+
+		if handshakes != nil {
+			select {
+			case handshakes <- struct{}{}:
+			case <-acceptCtx.Done():
+				conn.Close()
+				if ctx.Err() != nil {
+					return ctx.Err()
 				}
+				return ErrServerClosed
 			}
-			if !matched {
-				connHosts = append(connHosts, host)
-			} else {
-				continue
+		}
+		var once sync.Once
+		handshakeDone := func() {
+			once.Do(func() {
+				if handshakes != nil {
+					<-handshakes
+				}
+			})
+		}
+
+		if s.IdleTimeout > 0 {
+			conn = newIdleTimeoutConn(conn, s.IdleTimeout)
+		}
+
+		// Connections without an IP address, such as over unix sockets,
+		// would all share one host, e.g. that of a proxy in front.
+		host, _ := getHost(conn.RemoteAddr().String())
+		limitHost := s.maxConnsPerHost() > 0 && remoteIP(conn.RemoteAddr()) != nil
+		if limitHost && !s.acquireHost(host, s.maxConnsPerHost()) {
+			log.Printf("ssh: too many simultaneous connections from %s", host)
+			err := conn.Close()
+			if err != nil {
+				log.Println("err while closing:", err)
 			}
+			handshakeDone()
+			continue
 		}
 
-		if s.Timeout != nil {
-			go func(conn net.Conn) {
-				time.Sleep(*s.Timeout)
-				conn.Close()
-			}(conn)
+		if err := s.trackConn(conn); err != nil {
+			if err == errServerBusy {
+				log.Printf("ssh: rejecting connection from %s: %v", conn.RemoteAddr(), err)
+				// Lines before the version string are allowed by RFC 4253
+				// and shown by some clients.
+				fmt.Fprintf(conn, "%s, try again later\r\n", err)
+			}
+			conn.Close()
+			if limitHost {
+				s.releaseHost(host)
+			}
+			handshakeDone()
+			continue
 		}
 
 		go func() {
-			log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
-
-			sConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
-			if err != nil {
-				if err == io.EOF {
-					log.Printf("ssh: handshaking was terminated: %v", err)
-				} else {
-					log.Printf("ssh: error on handshaking: %v", err)
-				}
-				return
+			if limitHost {
+				defer s.releaseHost(host)
 			}
+			s.serveConn(ctx, conn, handshakeDone)
+		}()
+	}
+}
+
+// serveConn performs the SSH handshake on conn and handles its channels
+// until the connection is closed or ctx is cancelled. handshakeDone is
+// called once the handshake has finished, successfully or not.
+func (s *SSH) serveConn(ctx context.Context, conn net.Conn, handshakeDone func()) {
+	defer s.untrackConn(conn)
+	defer conn.Close()
+	defer handshakeDone()
+	defer s.recoverPanic("ssh: connection")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if d := s.maxSessionDuration(); d > 0 {
+		timer := time.AfterFunc(d, cancel)
+		defer timer.Stop()
+	}
+
+	log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+
+	// Configuration changes from Reload apply to new connections only.
+	cfg := s.config()
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	sConn, chans, reqs, err := ssh.NewServerConn(conn, s.serverConfig())
+	handshakeDone()
+	if err != nil {
+		if err == io.EOF {
+			log.Printf("ssh: handshaking was terminated: %v", err)
+		} else {
+			log.Printf("ssh: error on handshaking: %v", err)
+		}
+		if failedAuthentication(err) {
+			s.authFailed(conn.RemoteAddr())
+		}
+		return
+	}
+	s.authSucceeded(conn.RemoteAddr())
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	if s.RequestTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.RequestTimeout))
+	}
 
-			log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+	log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
 
-			if s.gitConfig.Auth && s.gitConfig.GitUser != "" && sConn.User() != s.gitConfig.GitUser {
+	if err := s.checkClientVersion(sConn); err != nil {
+		log.Printf("ssh: rejecting client %s: %v", sConn.RemoteAddr(), err)
+		sConn.Close()
+		return
+	}
+
+	principal := principalFrom(sConn.Permissions)
+	namespace, err := s.resolveNamespace(cfg, sConn.User())
+	if err != nil {
+		log.Printf("ssh: rejecting user %q from %s: %v", sConn.User(), sConn.RemoteAddr(), err)
+		s.connFailure(sConn, principal, AuthEventAuthentication, "", "", err)
+		rejectConn(sConn, chans, reqs, denialMessage(err, fmt.Sprintf("user %q is not accepted", sConn.User())))
+		return
+	}
+
+	if sConn.Permissions != nil {
+		if fp, ok := sConn.Permissions.Extensions[keyFingerprintExtension]; ok {
+			fingerprints := []string{fp}
+			if certFP, ok := sConn.Permissions.Extensions[certFingerprintExtension]; ok {
+				fingerprints = append(fingerprints, certFP)
+			}
+			if err := s.trackConnKey(conn, fingerprints...); err != nil {
+				log.Printf("ssh: closing connection from %s: %v", sConn.RemoteAddr(), err)
 				sConn.Close()
 				return
 			}
+		}
+	}
+
+	if s.UserCheckFunc != nil {
+		if err := s.UserCheckFunc(sConn.User(), principal.ID); err != nil {
+			log.Printf("ssh: rejecting user %q as %s from %s: %v", sConn.User(), principal, sConn.RemoteAddr(), err)
+			s.connFailure(sConn, principal, AuthEventAuthentication, "", "", err)
+			rejectConn(sConn, chans, reqs, denialMessage(err, fmt.Sprintf("user %q is not accepted for this key", sConn.User())))
+			return
+		}
+	}
+
+	go ssh.DiscardRequests(reqs)
+	if s.KeepAliveInterval > 0 {
+		go s.keepAlive(ctx, sConn)
+	}
+	s.handleConnection(ctx, cfg, conn, principal, namespace, chans, sConn)
+}
+
+// keepAlive periodically checks that the client behind sConn still responds
+// and closes the connection once it stops doing so.
+func (s *SSH) keepAlive(ctx context.Context, sConn *ssh.ServerConn) {
+	maxMissed := s.KeepAliveCountMax
+	if maxMissed <= 0 {
+		maxMissed = defaultKeepAliveCountMax
+	}
+
+	ticker := time.NewTicker(s.KeepAliveInterval)
+	defer ticker.Stop()
 
-			keyId := ""
-			if sConn.Permissions != nil {
-				keyId = sConn.Permissions.Extensions["key-id"]
+	// Only one request is in flight at a time. Every tick that passes
+	// while it is unanswered counts as a missed keepalive.
+	replies := make(chan error, 1)
+	inFlight := false
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			inFlight = false
+			missed = 0
+		case <-ticker.C:
+			if inFlight {
+				missed++
+				if missed >= maxMissed {
+					log.Printf("ssh: %s did not answer %d keepalives, closing connection", sConn.RemoteAddr(), missed)
+					sConn.Close()
+					return
+				}
+				continue
 			}
 
-			go ssh.DiscardRequests(reqs)
-			go s.handleConnection(keyId, chans, sConn)
-		}()
+			inFlight = true
+			go func() {
+				// Any reply counts, clients are expected to refuse the request.
+				_, _, err := sConn.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
 	}
 }
 
@@ -457,22 +1608,91 @@ func (s *SSH) ListenAndServe(bind string) error {
 
 // Stop stops the server if it has been started, otherwise it is a no-op.
 func (s *SSH) Stop() error {
-	if s.listener == nil {
+	if len(s.listeners) == 0 {
 		return nil
 	}
+
+	s.mu.Lock()
+	stopServe := s.stopServe
+	s.stopServe = nil
+	s.mu.Unlock()
+	if stopServe != nil {
+		stopServe()
+	}
+
 	defer func() {
-		s.listener = nil
+		s.listeners = nil
 	}()
 
-	return s.listener.Close()
+	var err error
+	for _, l := range s.listeners {
+		// The serve loop closes the remaining listeners once one fails.
+		if cerr := l.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, closes idle connections and waits for running git operations
+// to finish. If ctx expires first, all remaining connections are closed
+// and the context's error is returned.
+func (s *SSH) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	s.mu.Unlock()
+
+	err := s.Stop()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ActiveProcesses returns the number of git processes spawned by the server
+// that have not exited and been reaped yet.
+func (s *SSH) ActiveProcesses() int {
+	return s.procs.count()
+}
+
+// Sessions returns the git commands being served.
+func (s *SSH) Sessions() []Session {
+	return s.sessions.list()
+}
+
+// Config returns the configuration new connections are served with, the
+// last one passed to Reload.
+func (s *SSH) Config() Config {
+	return *s.config()
 }
 
 // Address returns the network address of the listener. This is in
 // particular useful when binding to :0 to get a free port assigned by
-// the OS.
+// the OS. When listening on several addresses, the first one is returned.
 func (s *SSH) Address() string {
-	if s.listener != nil {
-		return s.listener.Addr().String()
+	if len(s.listeners) > 0 {
+		return s.listeners[0].Addr().String()
 	}
 	return ""
 }
+
+// Addresses returns the network addresses of all listeners in the order
+// they were passed to ListenAddrs.
+func (s *SSH) Addresses() []string {
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
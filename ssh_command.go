@@ -0,0 +1,110 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Command is a command other than git's that a client runs over SSH, such
+// as "ssh git@host whoami".
+type Command struct {
+	// Name is the first word of the command line, Args the others.
+	Name string
+	Args []string
+	// Principal is the identity the client authenticated as, User its SSH
+	// username.
+	Principal  *Principal
+	User       string
+	RemoteAddr net.Addr
+	// Env holds the variables the client set with env requests that
+	// AcceptEnv lets through.
+	Env map[string]string
+	// Channel is the session of the client: reading from it reads its
+	// input, writing to it and to its Stderr writes to the terminal.
+	Channel ssh.Channel
+}
+
+// CommandHandler serves a Command. It returns once the command is done, the
+// client is told the command succeeded if it returns nil. Otherwise the
+// error is written to the client's stderr and the command exits with
+// status 1, so it should be meant for the client.
+type CommandHandler func(ctx context.Context, cmd *Command) error
+
+// HandleCommand registers the handler for the command name, e.g. "info" or
+// "whoami". Command lines starting with name and a space, or just name, are
+// served by it, keys restricted to Principal.Commands need name listed too.
+// Commands are authorized as OperationRun, anonymous clients can't run them
+// and they count towards MaxOpsPerKey. Git commands can't be overridden. It
+// must not be called while the server is serving.
+func (s *SSH) HandleCommand(name string, handler CommandHandler) {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") || name == "git" || gitCommands[name] {
+		panic(fmt.Sprintf("gitkit: invalid command name %q", name))
+	}
+	if s.commands == nil {
+		s.commands = make(map[string]CommandHandler)
+	}
+	s.commands[name] = handler
+}
+
+// command returns the handler registered for the command line, if any, and
+// the command it runs.
+func (s *SSH) command(line string) (CommandHandler, *Command) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	handler, ok := s.commands[fields[0]]
+	if !ok {
+		return nil, nil
+	}
+	return handler, &Command{Name: fields[0], Args: fields[1:]}
+}
+
+// authorizeCommand checks whether the client may run the command name.
+func (s *SSH) authorizeCommand(sConn *ssh.ServerConn, principal *Principal, name string) error {
+	if !principal.CanRun(name) {
+		return deniedBecause(fmt.Sprintf("this key may not run %s", name))
+	}
+	_, err := s.authorize(sConn, principal, &GitCommand{Command: name}, OperationRun)
+	return err
+}
+
+// runCommand serves an exec request for cmd with handler. Further requests
+// of the session are refused, and ctx is canceled once the client closes
+// the session.
+func (s *SSH) runCommand(ctx context.Context, req *ssh.Request, ch ssh.Channel, in <-chan *ssh.Request, handler CommandHandler, cmd *Command) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session := s.sessions.add(Session{
+		Protocol:   "ssh",
+		Principal:  cmd.Principal.ID,
+		User:       cmd.User,
+		RemoteAddr: cmd.RemoteAddr.String(),
+		Command:    cmd.Name,
+	}, s.OnSession)
+	defer s.sessions.remove(session, s.OnSession)
+
+	req.Reply(true, nil)
+	s.writeMOTD(ch.Stderr(), cmd.Principal)
+	go func() {
+		for req := range in {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+		cancel()
+	}()
+
+	err := handler(ctx, cmd)
+	if err != nil {
+		log.Printf("ssh: %s for %s failed: %v", cmd.Name, cmd.Principal, err)
+		fmt.Fprintf(ch.Stderr(), "%s\r\n", err)
+	}
+	ch.CloseWrite()
+	sendExitStatus(ch, err)
+}
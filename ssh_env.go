@@ -0,0 +1,38 @@
+package gitkit
+
+import (
+	"sort"
+	"strings"
+)
+
+// defaultAcceptEnv are the variables clients may set if SSH.AcceptEnv is
+// nil. Git sets GIT_PROTOCOL to ask for protocol version 2.
+var defaultAcceptEnv = []string{"GIT_PROTOCOL"}
+
+// acceptsEnv reports whether clients may set the variable name.
+func (s *SSH) acceptsEnv(name string) bool {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return false
+	}
+	patterns := s.AcceptEnv
+	if patterns == nil {
+		patterns = defaultAcceptEnv
+	}
+	for _, pattern := range patterns {
+		if pattern == name || strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionEnviron returns the variables set with env requests in the form
+// of os.Environ.
+func sessionEnviron(env map[string]string) []string {
+	environ := make([]string, 0, len(env))
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
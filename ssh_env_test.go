@@ -0,0 +1,22 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsEnv(t *testing.T) {
+	s := &SSH{}
+	assert.True(t, s.acceptsEnv("GIT_PROTOCOL"))
+	assert.False(t, s.acceptsEnv("LANG"))
+
+	s.AcceptEnv = []string{"LC_*", "GIT_PROTOCOL"}
+	assert.True(t, s.acceptsEnv("LC_ALL"))
+	assert.True(t, s.acceptsEnv("GIT_PROTOCOL"))
+	assert.False(t, s.acceptsEnv("LANG"))
+	assert.False(t, s.acceptsEnv("LC_ALL=C"))
+	assert.False(t, s.acceptsEnv(""))
+
+	assert.Equal(t, []string{"A=1", "B=2"}, sessionEnviron(map[string]string{"B": "2", "A": "1"}))
+}
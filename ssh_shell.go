@@ -0,0 +1,84 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveShell answers a shell request, as sent by a plain "ssh git@host",
+// with who the client is and the repositories of its namespace it may read,
+// marked W if it may push to them too, as gitolite does. The repositories
+// are checked with the Authorizer, AuthorizeRead and PolicyFunc like git
+// commands would be, denials aren't reported as failures. Without an
+// Authorizer every repository would look accessible, so none are listed,
+// nor are they to anonymous clients or with ResolveRepo, where the names
+// of repositories can't be told from Dir.
+func (s *SSH) serveShell(ctx context.Context, ch ssh.Channel, sConn *ssh.ServerConn, cfg *Config, principal *Principal, namespace string) {
+	s.writeMOTD(ch.Stderr(), principal)
+	if isAnonymous(sConn.Permissions) {
+		io.WriteString(ch, "Hi! You are connected anonymously, but shell access is not available.\r\n")
+		ch.CloseWrite()
+		sendExitStatus(ch, nil)
+		return
+	}
+	name := principal.Name
+	if name == "" {
+		name = principal.ID
+	}
+	if name == "" {
+		name = sConn.User()
+	}
+	fmt.Fprintf(ch, "Hi %s! You've successfully authenticated, but shell access is not available.\r\n", name)
+
+	var access []string
+	if s.Authorizer != nil && s.ResolveRepo == nil {
+		repos, err := listRepos(filepath.Join(cfg.Dir, filepath.FromSlash(namespace)))
+		if err != nil {
+			log.Printf("ssh: listing repositories for %s: %v", principal, err)
+		}
+		for _, repo := range repos {
+			full, err := namespacedRepo(namespace, repo)
+			if err != nil {
+				continue
+			}
+			if !s.mayRun(ctx, sConn, principal, "git-upload-pack", full) {
+				continue
+			}
+			perm := "R  "
+			if !cfg.ReadOnly && s.mayRun(ctx, sConn, principal, "git-receive-pack", full) {
+				perm = "R W"
+			}
+			access = append(access, " "+perm+"\t"+repo+"\r\n")
+		}
+	}
+	if len(access) > 0 {
+		io.WriteString(ch, "\r\n"+strings.Join(access, ""))
+	}
+	ch.CloseWrite()
+	sendExitStatus(ch, nil)
+}
+
+// mayRun reports whether the client may run command on repo.
+func (s *SSH) mayRun(ctx context.Context, sConn *ssh.ServerConn, principal *Principal, command, repo string) bool {
+	if !principal.CanRun(command) {
+		return false
+	}
+	operation := operationFor(command)
+	if _, err := s.authorize(sConn, principal, &GitCommand{Command: command, Repo: repo}, operation); err != nil {
+		return false
+	}
+	return s.evaluatePolicy(ctx, PolicyInput{
+		Principal:   principal.ID,
+		Scopes:      principal.Scopes,
+		Attributes:  principal.Attributes,
+		SecurityKey: principal.SecurityKey,
+		Repo:        repo,
+		Operation:   operation,
+	}) == nil
+}
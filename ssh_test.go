@@ -17,17 +17,27 @@ limitations under the License.
 package gitkit
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	mrand "math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestListenAndServe(t *testing.T) {
@@ -35,6 +45,7 @@ func TestListenAndServe(t *testing.T) {
 		name       string
 		serverFunc func(repo, keyDir string) *SSH
 		err        bool
+		stderr     string
 	}{
 		{
 			name: "default ssh server",
@@ -67,6 +78,82 @@ func TestListenAndServe(t *testing.T) {
 			},
 			err: true,
 		},
+		{
+			name: "ssh server exceeds max session duration",
+			serverFunc: func(repo, keyDir string) *SSH {
+				server := NewSSH(Config{
+					Dir:    filepath.Dir(repo),
+					KeyDir: keyDir,
+				})
+
+				server.PublicKeyLookupFunc = func(s string) (*PublicKey, error) {
+					return &PublicKey{Id: "12345"}, nil
+				}
+				server.MaxSessionDuration = time.Nanosecond * 1
+				return server
+			},
+			err: true,
+		},
+		{
+			name: "ssh server allows authorized reads",
+			serverFunc: func(repo, keyDir string) *SSH {
+				server := NewSSH(Config{
+					Dir:    filepath.Dir(repo),
+					KeyDir: keyDir,
+				})
+				acl := NewACL()
+				acl.Grant("", filepath.Base(repo), AccessRead)
+				server.Authorizer = acl
+				return server
+			},
+		},
+		{
+			name: "ssh server denies reads with AuthorizeRead",
+			serverFunc: func(repo, keyDir string) *SSH {
+				server := NewSSH(Config{
+					Dir:    filepath.Dir(repo),
+					KeyDir: keyDir,
+				})
+				server.AuthorizeRead = func(keyID, name string) error {
+					if name == filepath.Base(repo) {
+						return fmt.Errorf("%s is private", name)
+					}
+					return nil
+				}
+				return server
+			},
+			err: true,
+		},
+		{
+			name: "ssh server denies unauthorized commands",
+			serverFunc: func(repo, keyDir string) *SSH {
+				server := NewSSH(Config{
+					Dir:    filepath.Dir(repo),
+					KeyDir: keyDir,
+				})
+				server.Authorizer = AuthorizerFunc(func(*AccessRequest) error {
+					return ErrAccessDenied
+				})
+				return server
+			},
+			err:    true,
+			stderr: "access denied: you need read permission on ",
+		},
+		{
+			name: "ssh server shows denial reasons",
+			serverFunc: func(repo, keyDir string) *SSH {
+				server := NewSSH(Config{
+					Dir:    filepath.Dir(repo),
+					KeyDir: keyDir,
+				})
+				server.Authorizer = AuthorizerFunc(func(*AccessRequest) error {
+					return fmt.Errorf("%w: the repository is archived", ErrAccessDenied)
+				})
+				return server
+			},
+			err:    true,
+			stderr: "access denied: the repository is archived",
+		},
 	}
 
 	repo, err := createRepo()
@@ -116,6 +203,7 @@ func TestListenAndServe(t *testing.T) {
 			err = cmd.Wait()
 
 			g.Expect(err != nil).To(Equal(tt.err))
+			g.Expect(e.String()).To(ContainSubstring(tt.stderr))
 			_, err = os.Stat(filepath.Join(cloned, filepath.Base(repo)))
 			if !tt.err {
 				g.Expect(err).ToNot(HaveOccurred())
@@ -167,7 +255,7 @@ func retry(attempts int, sleep time.Duration, f func() error) error {
 	if err := f(); err != nil {
 		if attempts--; attempts > 0 {
 			// Add some randomness to prevent creating a Thundering Herd
-			jitter := time.Duration(rand.Int63n(int64(sleep)))
+			jitter := time.Duration(mrand.Int63n(int64(sleep)))
 			sleep = sleep + jitter/2
 
 			time.Sleep(sleep)
@@ -178,3 +266,2127 @@ func retry(attempts int, sleep time.Duration, f func() error) error {
 
 	return nil
 }
+
+func TestLookupPublicKey(t *testing.T) {
+	g := NewWithT(t)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	sshPub, err := ssh.NewPublicKey(pub)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	base := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	lines := []string{
+		base,
+		base + " user@host",
+		base + "   comment with  spaces\t",
+		base + " trailing-newline\n",
+		base + " \u00e9m\u00f8ji-\u2603",
+	}
+
+	for _, line := range lines {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		g.Expect(err).ToNot(HaveOccurred())
+
+		// Backend storage indexed by both the canonical string and fingerprint.
+		byContent := map[string]*PublicKey{
+			AuthorizedKeyString(sshPub): {Id: "by-content"},
+		}
+		byFingerprint := map[string]*PublicKey{
+			KeyFingerprint(sshPub): {Id: "by-fingerprint"},
+		}
+
+		stringSrv := NewSSH(Config{})
+		stringSrv.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+			if k, ok := byContent[content]; ok {
+				return k, nil
+			}
+			return nil, fmt.Errorf("key not found: %q", content)
+		}
+
+		keySrv := NewSSH(Config{})
+		keySrv.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+			return nil, fmt.Errorf("string lookup should not be used")
+		}
+		keySrv.PublicKeyLookupKeyFunc = func(k ssh.PublicKey, _ ssh.ConnMetadata) (*PublicKey, error) {
+			if entry, ok := byContent[AuthorizedKeyString(k)]; ok && byFingerprint[KeyFingerprint(k)] != nil {
+				return entry, nil
+			}
+			return nil, fmt.Errorf("key not found")
+		}
+
+		fromString, err := stringSrv.lookupPublicKey(nil, key)
+		g.Expect(err).ToNot(HaveOccurred(), line)
+		fromKey, err := keySrv.lookupPublicKey(nil, key)
+		g.Expect(err).ToNot(HaveOccurred(), line)
+		g.Expect(fromKey).To(Equal(fromString))
+	}
+
+	stored := &PublicKey{Id: "stored"}
+	srv := NewSSH(Config{})
+	srv.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return stored, nil
+	}
+	resolved, err := srv.lookupPublicKey(nil, sshPub)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(resolved.Id).To(Equal("stored"))
+	g.Expect(resolved.Fingerprint).To(Equal(KeyFingerprint(sshPub)))
+	g.Expect(resolved.Content).To(Equal(AuthorizedKeyString(sshPub)))
+	g.Expect(stored.Fingerprint).To(BeEmpty())
+
+	srv.PublicKeyLookupKeyFunc = func(ssh.PublicKey, ssh.ConnMetadata) (*PublicKey, error) {
+		return nil, nil
+	}
+	_, err = srv.lookupPublicKey(nil, sshPub)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestShutdown(t *testing.T) {
+	g := NewWithT(t)
+
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+	repoDir, err := os.MkdirTemp("", "repos")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repoDir)
+
+	server := NewSSH(Config{Dir: repoDir, KeyDir: keyDir})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve()
+	}()
+
+	// An idle connection that never completes the handshake must not
+	// block the shutdown.
+	addr := server.Address()
+	conn, err := net.Dial("tcp", addr)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	g.Expect(server.Shutdown(ctx)).To(Succeed())
+	g.Eventually(serveErr).Should(Receive(Equal(ErrServerClosed)))
+
+	_, err = net.Dial("tcp", addr)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestServeContext(t *testing.T) {
+	g := NewWithT(t)
+
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+	repoDir, err := os.MkdirTemp("", "repos")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repoDir)
+
+	server := NewSSH(Config{Dir: repoDir, KeyDir: keyDir})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ServeContext(ctx)
+	}()
+
+	addr := server.Address()
+	conn, err := net.Dial("tcp", addr)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	cancel()
+	g.Eventually(serveErr).Should(Receive(Equal(context.Canceled)))
+
+	// The in-flight connection is closed along with the listener.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = net.Dial("tcp", addr)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "unix-socket")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "gitkit.sock")
+	// A stale socket from a previous run must not prevent listening.
+	stale, err := net.Listen("unix", socket)
+	g.Expect(err).ToNot(HaveOccurred())
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	// Clients of a unix socket have no host to be limited by.
+	server.MaxConnsPerHost = 1
+	g.Expect(server.Listen("unix://" + socket)).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	g.Expect(server.Address()).To(Equal(socket))
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("unix", socket, &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+	client, err := dial()
+	g.Expect(err).ToNot(HaveOccurred())
+	second, err := dial()
+	g.Expect(err).ToNot(HaveOccurred())
+	second.Close()
+	client.Close()
+
+	// A second server cannot take over a socket that is in use.
+	other := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	g.Expect(other.Listen("unix:" + socket)).ToNot(Succeed())
+}
+
+func TestListenAddrs(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "listen-addrs")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	}
+
+	server := NewSSH(config)
+	g.Expect(server.ListenAddrs("127.0.0.1:0", "unix://"+filepath.Join(dir, "gitkit.sock"))).To(Succeed())
+	g.Expect(server.ListenAddrs("127.0.0.1:0")).To(Equal(ErrAlreadyStarted))
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve()
+	}()
+
+	addrs := server.Addresses()
+	g.Expect(addrs).To(HaveLen(2))
+	g.Expect(server.Address()).To(Equal(addrs[0]))
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	for i, network := range []string{"tcp", "unix"} {
+		client, err := ssh.Dial(network, addrs[i], clientConfig)
+		g.Expect(err).ToNot(HaveOccurred())
+		client.Close()
+	}
+
+	g.Expect(server.Stop()).To(Succeed())
+	g.Eventually(serveErr).Should(Receive())
+	g.Expect(server.Addresses()).To(BeEmpty())
+
+	// A failing address releases the listeners bound before it.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer taken.Close()
+
+	other := NewSSH(config)
+	g.Expect(other.ListenAddrs("127.0.0.1:0", taken.Addr().String())).ToNot(Succeed())
+	g.Expect(other.Addresses()).To(BeEmpty())
+}
+
+func TestPanicRecovery(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "panic")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		panic("lookup exploded")
+	}
+	panics := make(chan interface{}, 1)
+	server.OnPanic = func(v interface{}, stack []byte) {
+		g.Expect(stack).ToNot(BeEmpty())
+		panics <- v
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(priv)
+	g.Expect(err).ToNot(HaveOccurred())
+	clientConfig := &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = ssh.Dial("tcp", server.Address(), clientConfig)
+		g.Expect(err).To(HaveOccurred())
+		g.Eventually(panics).Should(Receive(Equal("lookup exploded")))
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "simultaneous")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	newServer := func(configure func(*SSH)) *SSH {
+		server := NewSSH(Config{
+			Dir:    filepath.Join(dir, "repos"),
+			KeyDir: filepath.Join(dir, "keys"),
+		})
+		configure(server)
+		g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+		go server.Serve()
+		return server
+	}
+
+	dial := func(server *SSH) (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	for name, tt := range map[string]struct {
+		configure func(*SSH)
+		limit     int
+	}{
+		"disable simultaneous conns": {func(s *SSH) { s.DisableSimultaneousConns = true }, 1},
+		"max conns per host":         {func(s *SSH) { s.MaxConnsPerHost = 3 }, 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+			first := newServer(tt.configure)
+			defer first.Stop()
+			second := newServer(tt.configure)
+			defer second.Stop()
+
+			var clients []*ssh.Client
+			for i := 0; i < tt.limit; i++ {
+				client, err := dial(first)
+				g.Expect(err).ToNot(HaveOccurred())
+				clients = append(clients, client)
+			}
+
+			// A connection to another server instance is unaffected.
+			other, err := dial(second)
+			g.Expect(err).ToNot(HaveOccurred())
+			other.Close()
+
+			_, err = dial(first)
+			g.Expect(err).To(HaveOccurred())
+
+			clients[0].Close()
+			g.Eventually(func() error {
+				client, err := dial(first)
+				if err != nil {
+					return err
+				}
+				return client.Close()
+			}, 5*time.Second).Should(Succeed())
+
+			for _, client := range clients[1:] {
+				client.Close()
+			}
+		})
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "max-conns")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.MaxConns = 1
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	client, err := dial()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	conn, err := net.Dial("tcp", server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, err := io.ReadAll(conn)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("server is busy"))
+	conn.Close()
+
+	client.Close()
+	g.Eventually(func() error {
+		client, err := dial()
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}, 5*time.Second).Should(Succeed())
+}
+
+func TestMaxSessionsPerConn(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "max-sessions")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.MaxSessionsPerConn = 2
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	var sessions []*ssh.Session
+	for i := 0; i < 2; i++ {
+		session, err := client.NewSession()
+		g.Expect(err).ToNot(HaveOccurred())
+		sessions = append(sessions, session)
+	}
+
+	_, err = client.NewSession()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("too many sessions"))
+
+	sessions[0].Close()
+	g.Eventually(func() error {
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		return session.Close()
+	}, 5*time.Second).Should(Succeed())
+}
+
+func TestMaxPendingHandshakes(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "handshakes")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.MaxPendingHandshakes = 1
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve()
+	}()
+
+	dial := func() error {
+		conn, err := net.Dial("tcp", server.Address())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		c, _, _, err := ssh.NewClientConn(conn, server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	// A client that connects and never sends anything occupies the only
+	// handshake slot.
+	stalled, err := net.Dial("tcp", server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Eventually(func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.conns)
+	}).Should(Equal(1))
+
+	g.Expect(dial()).ToNot(Succeed())
+
+	stalled.Close()
+	g.Eventually(dial, 5*time.Second).Should(Succeed())
+
+	// Stop must not hang on an accept loop waiting for a slot.
+	stalled, err = net.Dial("tcp", server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer stalled.Close()
+	pending, err := net.Dial("tcp", server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer pending.Close()
+	g.Expect(server.Stop()).To(Succeed())
+	g.Eventually(serveErr).Should(Receive())
+}
+
+func TestIdleTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "idle")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.IdleTimeout = 300 * time.Millisecond
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+
+	// Activity keeps the connection open well past the idle timeout.
+	for i := 0; i < 10; i++ {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		g.Expect(err).ToNot(HaveOccurred())
+		time.Sleep(100 * time.Millisecond)
+	}
+	g.Expect(closed).ToNot(Receive())
+
+	g.Eventually(closed, 2*time.Second).Should(Receive())
+}
+
+func TestKillCommandOnChannelClose(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "kill")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	// A stand-in for git-upload-pack that never finishes on its own.
+	binDir := filepath.Join(dir, "bin")
+	g.Expect(os.Mkdir(binDir, 0755)).To(Succeed())
+	pidFile := filepath.Join(dir, "pid")
+	script := fmt.Sprintf("#!/bin/sh\necho $$ > %s\nexec sleep 60\n", pidFile)
+	g.Expect(os.WriteFile(filepath.Join(binDir, "git-upload-pack"), []byte(script), 0755)).To(Succeed())
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(session.Start("git-upload-pack 'repo.git'")).To(Succeed())
+
+	var pid int
+	g.Eventually(func() error {
+		b, err := os.ReadFile(pidFile)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Sscanf(string(b), "%d", &pid)
+		return err
+	}, 5*time.Second).Should(Succeed())
+
+	g.Expect(server.ActiveProcesses()).To(Equal(1))
+	session.Close()
+
+	g.Eventually(func() error {
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			return nil
+		}
+		return p.Signal(syscall.Signal(0))
+	}, 5*time.Second).Should(HaveOccurred())
+	g.Eventually(server.ActiveProcesses).Should(Equal(0))
+}
+
+func TestKeepAlive(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "keepalive")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.KeepAliveInterval = 100 * time.Millisecond
+	server.KeepAliveCountMax = 2
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	// A responsive client answers the keepalives and stays connected.
+	healthy, err := ssh.Dial("tcp", server.Address(), clientConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer healthy.Close()
+	healthyClosed := make(chan error, 1)
+	go func() {
+		healthyClosed <- healthy.Wait()
+	}()
+
+	// A client that never processes global requests never answers them.
+	conn, err := net.Dial("tcp", server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+	dead, _, _, err := ssh.NewClientConn(conn, server.Address(), clientConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	deadClosed := make(chan error, 1)
+	go func() {
+		deadClosed <- dead.Wait()
+	}()
+
+	g.Eventually(deadClosed, 5*time.Second).Should(Receive())
+	g.Expect(healthyClosed).ToNot(Receive())
+}
+
+func TestAllowConnFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "allow-conn")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	filter, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.AllowConnFunc = filter.Allowed
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, err = ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestMaxAuthFailures(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "auth-failures")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(priv)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	var lookups int32
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		atomic.AddInt32(&lookups, 1)
+		return nil, fmt.Errorf("unknown key")
+	}
+	server.MaxAuthFailures = 2
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func() error {
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	banned := func() bool {
+		return server.isBanned(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+
+	// Health checks connecting without authenticating aren't failures.
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", server.Address())
+		g.Expect(err).ToNot(HaveOccurred())
+		conn.Close()
+	}
+	g.Consistently(banned, 300*time.Millisecond).Should(BeFalse())
+
+	g.Expect(dial()).To(HaveOccurred())
+	g.Expect(dial()).To(HaveOccurred())
+	g.Eventually(banned, 5*time.Second).Should(BeTrue())
+	before := atomic.LoadInt32(&lookups)
+	g.Expect(before).To(BeNumerically(">", 0))
+
+	g.Expect(dial()).To(HaveOccurred())
+	g.Expect(atomic.LoadInt32(&lookups)).To(Equal(before))
+}
+
+func TestHandshakeAndRequestTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "deadlines")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.HandshakeTimeout = 300 * time.Millisecond
+	server.RequestTimeout = 300 * time.Millisecond
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	// A client that never sends its version string.
+	conn, err := net.Dial("tcp", server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+
+	// An open session holds the connection open past the timeout.
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	time.Sleep(600 * time.Millisecond)
+	g.Expect(closed).ToNot(Receive())
+
+	session.Close()
+	g.Eventually(closed, 2*time.Second).Should(Receive())
+}
+
+func TestClientVersionFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "client-version")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.ClientVersionFunc = MinClientVersion("OpenSSH", "7.4")
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func(version string) (string, error) {
+		var banner string
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			ClientVersion:   version,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			BannerCallback: func(msg string) error {
+				banner = msg
+				return nil
+			},
+			Timeout: 5 * time.Second,
+		})
+		if err != nil {
+			return banner, err
+		}
+		defer client.Close()
+		_, err = client.NewSession()
+		return banner, err
+	}
+
+	banner, err := dial("SSH-2.0-OpenSSH_8.9p1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(banner).To(BeEmpty())
+
+	banner, err = dial("SSH-2.0-OpenSSH_6.6")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(banner).To(ContainSubstring("please upgrade"))
+}
+
+func TestCryptoProfile(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "crypto-profile")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.CryptoProfile = CryptoProfileModern
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func(server *SSH, config ssh.Config) error {
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			Config:          config,
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	g.Expect(dial(server, ssh.Config{})).To(Succeed())
+	g.Expect(dial(server, ssh.Config{MACs: []string{"hmac-sha1"}, Ciphers: []string{"aes128-ctr"}})).ToNot(Succeed())
+	g.Expect(dial(server, ssh.Config{MACs: []string{"hmac-sha2-256"}, Ciphers: []string{"aes128-ctr"}})).ToNot(Succeed())
+	g.Expect(dial(server, ssh.Config{KeyExchanges: []string{"diffie-hellman-group14-sha1"}})).ToNot(Succeed())
+
+	// The Compat profile accepts old clients as well as the modern ones.
+	compat := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	compat.CryptoProfile = CryptoProfileCompat
+	g.Expect(compat.Listen("127.0.0.1:0")).To(Succeed())
+	defer compat.Stop()
+	go compat.Serve()
+	g.Expect(dial(compat, ssh.Config{})).To(Succeed())
+	g.Expect(dial(compat, ssh.Config{MACs: []string{"hmac-sha1"}, Ciphers: []string{"aes128-cbc"}})).To(Succeed())
+	g.Expect(dial(compat, ssh.Config{MACs: []string{"hmac-sha2-256"}, Ciphers: []string{"aes128-ctr"}})).To(Succeed())
+	g.Expect(dial(compat, ssh.Config{KeyExchanges: []string{"diffie-hellman-group14-sha1"}})).To(Succeed())
+
+	invalid := NewSSH(Config{KeyDir: filepath.Join(dir, "keys")})
+	invalid.CryptoProfile = "legacy"
+	g.Expect(invalid.Listen("127.0.0.1:0")).ToNot(Succeed())
+}
+
+func TestKeyLookupFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "key-lookup")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(priv)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	requests := make(chan KeyLookupRequest, 10)
+	server.KeyLookupFunc = func(req *KeyLookupRequest) (*PublicKey, error) {
+		requests <- *req
+		return &PublicKey{Id: "key-1"}, nil
+	}
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return nil, fmt.Errorf("string lookup should not be used")
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	var req KeyLookupRequest
+	g.Expect(requests).To(Receive(&req))
+	g.Expect(req.Algorithm).To(Equal(ssh.KeyAlgoED25519))
+	g.Expect(req.Fingerprint).To(Equal(KeyFingerprint(signer.PublicKey())))
+	g.Expect(req.AuthorizedKey).To(Equal(AuthorizedKeyString(signer.PublicKey())))
+	g.Expect(req.User).To(Equal("alice"))
+	g.Expect(req.RemoteAddr.String()).To(Equal(client.LocalAddr().String()))
+	g.Expect(req.SessionID).To(Equal(client.SessionID()))
+}
+
+func TestPolicyFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	inputs := make(chan PolicyInput, 10)
+	server.PolicyFunc = func(_ context.Context, input PolicyInput) (PolicyDecision, error) {
+		inputs <- input
+		if input.Ref == "refs/heads/protected" {
+			return PolicyDecision{Reason: "protected branch"}, nil
+		}
+		return PolicyDecision{Allow: true}, nil
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	cloned, err := os.MkdirTemp("", "cloned")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(cloned)
+
+	git := func(dir string, args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	_, err = git(cloned, "clone", "ssh://git@127.0.0.1/"+filepath.Base(repo), "repo")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(inputs).To(Receive(Equal(PolicyInput{Repo: filepath.Base(repo), Operation: OperationRead})))
+
+	workdir := filepath.Join(cloned, "repo")
+	_, err = git(workdir, "push", "origin", "HEAD:refs/heads/feature")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(inputs).To(Receive(Equal(PolicyInput{Repo: filepath.Base(repo), Operation: OperationWrite})))
+	var update PolicyInput
+	g.Expect(inputs).To(Receive(&update))
+	g.Expect(update.Ref).To(Equal("refs/heads/feature"))
+	g.Expect(update.OldRev).To(Equal(ZeroSHA))
+
+	out, err := git(workdir, "push", "origin", "HEAD:refs/heads/protected")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(out).To(ContainSubstring("protected branch"))
+	_, err = git(repo, "rev-parse", "--verify", "refs/heads/protected")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestKeyRevocation(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "revocation")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		signer, err := ssh.NewSignerFromKey(priv)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	valid, expired, revoked := newSigner(), newSigner(), newSigner()
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.PublicKeyLookupKeyFunc = func(key ssh.PublicKey, _ ssh.ConnMetadata) (*PublicKey, error) {
+		switch KeyFingerprint(key) {
+		case KeyFingerprint(expired.PublicKey()):
+			return &PublicKey{Id: "expired", ExpiresAt: time.Now().Add(-time.Minute)}, nil
+		case KeyFingerprint(revoked.PublicKey()):
+			return &PublicKey{Id: "revoked", Revoked: true}, nil
+		}
+		return &PublicKey{Id: "valid", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	_, err = dial(expired)
+	g.Expect(err).To(HaveOccurred())
+	_, err = dial(revoked)
+	g.Expect(err).To(HaveOccurred())
+
+	client, err := dial(valid)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+
+	fingerprint := KeyFingerprint(valid.PublicKey())
+	server.RevokeKey(fingerprint)
+	g.Expect(server.RevokedKeys()).To(Equal([]string{fingerprint}))
+	g.Eventually(closed, 5*time.Second).Should(Receive())
+	_, err = dial(valid)
+	g.Expect(err).To(HaveOccurred())
+
+	server.UnrevokeKey(fingerprint)
+	client, err = dial(valid)
+	g.Expect(err).ToNot(HaveOccurred())
+	client.Close()
+}
+
+func TestAllowAnonymous(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+		Auth:   true,
+	})
+	server.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return nil, fmt.Errorf("unknown key")
+	}
+	server.AllowAnonymous = true
+	server.HandleCommand("whoami", func(ctx context.Context, cmd *Command) error {
+		return nil
+	})
+	var public int32 = 1
+	server.PublicRepoFunc = func(string) bool {
+		return atomic.LoadInt32(&public) == 1
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	cloned, err := os.MkdirTemp("", "cloned")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(cloned)
+
+	git := func(dir string, args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := git(cloned, "clone", "ssh://git@127.0.0.1/"+filepath.Base(repo), "repo")
+	g.Expect(err).ToNot(HaveOccurred(), out)
+
+	out, err = git(filepath.Join(cloned, "repo"), "push", "origin", "HEAD:refs/heads/feature")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(out).To(ContainSubstring("access denied: anonymous access is limited to reading public repositories"))
+
+	atomic.StoreInt32(&public, 0)
+	_, err = git(cloned, "clone", "ssh://git@127.0.0.1/"+filepath.Base(repo), "private")
+	g.Expect(err).To(HaveOccurred())
+
+	// Anonymous clients can't run custom commands.
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User: "git",
+		Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(string, string, []string, []bool) ([]string, error) {
+			return nil, nil
+		})},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	output, err := session.CombinedOutput("whoami")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(string(output)).To(ContainSubstring("anonymous access is limited"))
+
+	// Nor are they told they authenticated, or shown repositories.
+	shell, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer shell.Close()
+	var stdout bytes.Buffer
+	shell.Stdout = &stdout
+	g.Expect(shell.Shell()).To(Succeed())
+	g.Expect(shell.Wait()).To(Succeed())
+	g.Expect(stdout.String()).To(Equal("Hi! You are connected anonymously, but shell access is not available.\r\n"))
+
+	// Without a PublicRepoFunc nothing is public.
+	g.Expect((&SSH{}).isPublicRepo(filepath.Base(repo))).To(BeFalse())
+}
+
+func TestUserResolver(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	tenant, err := os.MkdirTemp("", "tenant")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(tenant)
+	g.Expect(os.Rename(repo, filepath.Join(tenant, "app"))).To(Succeed())
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(tenant),
+		KeyDir: keyDir,
+	})
+	server.UserResolver = func(user string) (string, error) {
+		if user != "acme" {
+			return "", fmt.Errorf("unknown tenant")
+		}
+		return filepath.Base(tenant), nil
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	cloned, err := os.MkdirTemp("", "cloned")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(cloned)
+
+	clone := func(user, dest string) (string, error) {
+		cmd := exec.Command("git", "clone", "ssh://"+user+"@127.0.0.1/app", dest)
+		cmd.Dir = cloned
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := clone("acme", "acme")
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	g.Expect(filepath.Join(cloned, "acme", "homework")).To(BeAnExistingFile())
+
+	_, err = clone("globex", "globex")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestUserCheckFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "user-check")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	g.Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(priv)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	server := NewSSH(Config{
+		Dir:     filepath.Join(dir, "repos"),
+		KeyDir:  filepath.Join(dir, "keys"),
+		Auth:    true,
+		GitUser: "git",
+	})
+	server.PublicKeyLookupKeyFunc = func(ssh.PublicKey, ssh.ConnMetadata) (*PublicKey, error) {
+		return &PublicKey{Id: "alice"}, nil
+	}
+	checked := make(chan string, 4)
+	server.UserCheckFunc = func(user, keyID string) error {
+		checked <- user + ":" + keyID
+		switch user {
+		case "git", "gitea", keyID:
+			return nil
+		}
+		return fmt.Errorf("user %q does not match key %q", user, keyID)
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	session := func(user string) error {
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		sess, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		return sess.Close()
+	}
+
+	for _, user := range []string{"git", "gitea", "alice"} {
+		g.Expect(session(user)).To(Succeed(), user)
+		g.Expect(<-checked).To(Equal(user + ":alice"))
+	}
+	err = session("bob")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring(`access denied: user "bob" is not accepted for this key`))
+	g.Expect(<-checked).To(Equal("bob:alice"))
+}
+
+func TestOnAuthFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "auth-failure")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		signer, err := ssh.NewSignerFromKey(priv)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	good, bad := newSigner(), newSigner()
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.PublicKeyLookupKeyFunc = func(key ssh.PublicKey, _ ssh.ConnMetadata) (*PublicKey, error) {
+		if KeyFingerprint(key) != KeyFingerprint(good.PublicKey()) {
+			return nil, fmt.Errorf("unknown key")
+		}
+		return &PublicKey{Id: "alice"}, nil
+	}
+	server.UserCheckFunc = func(user, _ string) error {
+		if user != "git" {
+			return fmt.Errorf("unknown user")
+		}
+		return nil
+	}
+	server.Authorizer = AuthorizerFunc(func(*AccessRequest) error {
+		return ErrAccessDenied
+	})
+	events := make(chan AuthEvent, 4)
+	server.OnAuthFailure = func(event AuthEvent) {
+		events <- event
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	dial := func(user string, signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	_, err = dial("git", bad)
+	g.Expect(err).To(HaveOccurred())
+	var event AuthEvent
+	g.Expect(events).To(Receive(&event))
+	g.Expect(event.Type).To(Equal(AuthEventAuthentication))
+	g.Expect(event.User).To(Equal("git"))
+	g.Expect(event.Fingerprint).To(Equal(KeyFingerprint(bad.PublicKey())))
+	g.Expect(event.Reason).To(ContainSubstring("unknown key"))
+	g.Expect(event.RemoteAddr).ToNot(BeNil())
+	g.Expect(event.Time).ToNot(BeZero())
+
+	client, err := dial("mallory", good)
+	g.Expect(err).ToNot(HaveOccurred())
+	client.Close()
+	g.Eventually(events, 5*time.Second).Should(Receive(&event))
+	g.Expect(event.Type).To(Equal(AuthEventAuthentication))
+	g.Expect(event.User).To(Equal("mallory"))
+	g.Expect(event.KeyID).To(Equal("alice"))
+	g.Expect(event.Reason).To(Equal("unknown user"))
+
+	client, err = dial("git", good)
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	g.Expect(session.Run("git-receive-pack 'repo.git'")).ToNot(Succeed())
+	g.Eventually(events, 5*time.Second).Should(Receive(&event))
+	g.Expect(event.Type).To(Equal(AuthEventAuthorization))
+	g.Expect(event.KeyID).To(Equal("alice"))
+	g.Expect(event.Fingerprint).To(Equal(KeyFingerprint(good.PublicKey())))
+	g.Expect(event.Repo).To(Equal("repo.git"))
+	g.Expect(event.Operation).To(Equal(OperationWrite))
+	g.Expect(event.Reason).To(Equal("access denied"))
+}
+
+func TestMaxOpsPerKey(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		signer, err := ssh.NewSignerFromKey(priv)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	alice, bob := newSigner(), newSigner()
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+		Auth:   true,
+	})
+	server.PublicKeyLookupKeyFunc = func(key ssh.PublicKey, _ ssh.ConnMetadata) (*PublicKey, error) {
+		if KeyFingerprint(key) == KeyFingerprint(alice.PublicKey()) {
+			return &PublicKey{Id: "alice"}, nil
+		}
+		return &PublicKey{Id: "bob"}, nil
+	}
+	server.MaxOpsPerKey = 1
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	uploadPack := func(signer ssh.Signer) (*ssh.Session, io.Reader, *strings.Builder) {
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(func() { client.Close() })
+		session, err := client.NewSession()
+		g.Expect(err).ToNot(HaveOccurred())
+		stdout, err := session.StdoutPipe()
+		g.Expect(err).ToNot(HaveOccurred())
+		// Keep stdin open, git exits once its input ends.
+		_, err = session.StdinPipe()
+		g.Expect(err).ToNot(HaveOccurred())
+		stderr := new(strings.Builder)
+		session.Stderr = stderr
+		g.Expect(session.Start("git-upload-pack '" + filepath.Base(repo) + "'")).To(Succeed())
+		return session, stdout, stderr
+	}
+	// git-upload-pack keeps running until the client sends its wants.
+	advertised := func(stdout io.Reader) {
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(stdout, buf)
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	first, stdout, _ := uploadPack(alice)
+	advertised(stdout)
+
+	second, _, stderr := uploadPack(alice)
+	var exitErr *ssh.ExitError
+	g.Expect(errors.As(second.Wait(), &exitErr)).To(BeTrue())
+	g.Expect(exitErr.ExitStatus()).To(Equal(1))
+	g.Expect(stderr.String()).To(ContainSubstring(errTooManyKeyOps.Error()))
+
+	_, stdout, _ = uploadPack(bob)
+	advertised(stdout)
+
+	first.Close()
+	g.Eventually(func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.keyOps["alice"]
+	}, 5*time.Second).Should(BeZero())
+	_, stdout, _ = uploadPack(alice)
+	advertised(stdout)
+}
+
+func TestFilterPolicy(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	server.AllowFilter = true
+	server.FilterPolicy = func(_, filter string) error {
+		if filter != "blob:none" {
+			return fmt.Errorf("%w: only blob:none partial clones are allowed", ErrAccessDenied)
+		}
+		return nil
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	cloned, err := os.MkdirTemp("", "cloned")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(cloned)
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = cloned
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	for _, version := range []string{"0", "2"} {
+		out, err := git("-c", "protocol.version="+version, "clone", "--no-checkout", "--filter=blob:none", "ssh://git@127.0.0.1/"+filepath.Base(repo), "blobless-v"+version)
+		g.Expect(err).ToNot(HaveOccurred(), out)
+
+		out, err = git("-c", "protocol.version="+version, "clone", "--filter=tree:0", "ssh://git@127.0.0.1/"+filepath.Base(repo), "treeless-v"+version)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(out).To(ContainSubstring("only blob:none partial clones are allowed"))
+	}
+}
+
+func TestEnvRequests(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+
+	g.Expect(session.Setenv("GIT_PROTOCOL", "version=2")).To(Succeed())
+	g.Expect(session.Setenv("LD_PRELOAD", "/tmp/evil.so")).ToNot(Succeed())
+	stdout, err := session.StdoutPipe()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(session.Start("git-upload-pack '" + filepath.Base(repo) + "'")).To(Succeed())
+
+	// Protocol v2 starts with the version line.
+	buf := make([]byte, len("000eversion 2\n"))
+	_, err = io.ReadFull(stdout, buf)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(buf)).To(Equal("000eversion 2\n"))
+}
+
+func TestUploadArchive(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		if req.Command == "git-upload-archive" && req.Repo == "private.git" {
+			return fmt.Errorf("%w: archives of private.git are disabled", ErrAccessDenied)
+		}
+		return nil
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	out, err := os.MkdirTemp("", "archive")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(out)
+
+	archive := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"archive", "--remote=ssh://git@127.0.0.1/" + filepath.Base(repo)}, args...)...)
+		cmd.Dir = out
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		stderr := new(strings.Builder)
+		cmd.Stderr = stderr
+		stdout, err := cmd.Output()
+		return string(stdout) + stderr.String(), err
+	}
+
+	_, err = archive("--format=tar", "-o", "repo.tar", "HEAD")
+	g.Expect(err).ToNot(HaveOccurred())
+	files, err := exec.Command("tar", "-tf", filepath.Join(out, "repo.tar")).Output()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(files)).To(Equal("homework\n"))
+
+	// Errors of git-upload-archive reach the client, which fails.
+	msg, err := archive("--format=tar", "no-such-ref")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(msg).To(ContainSubstring("no-such-ref"))
+
+	// So do denials.
+	_, err = exec.Command("git", "clone", "--bare", repo, filepath.Join(filepath.Dir(repo), "private.git")).CombinedOutput()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(filepath.Join(filepath.Dir(repo), "private.git"))
+	cmd := exec.Command("git", "archive", "--remote=ssh://git@127.0.0.1/private.git", "HEAD")
+	cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+	data, err := cmd.CombinedOutput()
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(string(data)).To(ContainSubstring("remote error: access denied: archives of private.git are disabled"))
+}
+
+func TestQuotedRepoNames(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	// git quotes these for the remote shell, the server has to undo it.
+	name := "it's a repo!.git"
+	g.Expect(os.Rename(repo, filepath.Join(filepath.Dir(repo), name))).To(Succeed())
+	defer os.RemoveAll(filepath.Join(filepath.Dir(repo), name))
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	clone, err := os.MkdirTemp("", "clone")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(clone)
+
+	cmd := exec.Command("git", "clone", "ssh://git@127.0.0.1/"+name, clone)
+	cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+	out, err := cmd.CombinedOutput()
+	g.Expect(err).ToNot(HaveOccurred(), string(out))
+	g.Expect(filepath.Join(clone, "homework")).To(BeAnExistingFile())
+}
+
+func TestResolveRepo(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	// The repository is kept elsewhere than its name says.
+	server.ResolveRepo = func(ctx context.Context, principal *Principal, name string) (string, error) {
+		if name == "vanity.git" {
+			return repo, nil
+		}
+		return "", fmt.Errorf("%w: %s is not served here", ErrAccessDenied, name)
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	clone, err := os.MkdirTemp("", "clone")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(clone)
+
+	gitClone := func(name, dest string) (string, error) {
+		cmd := exec.Command("git", "clone", "ssh://git@127.0.0.1/"+name, dest)
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	out, err := gitClone("vanity.git", filepath.Join(clone, "vanity"))
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	g.Expect(filepath.Join(clone, "vanity", "homework")).To(BeAnExistingFile())
+
+	out, err = gitClone(filepath.Base(repo), filepath.Join(clone, "direct"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(out).To(ContainSubstring("is not served here"))
+}
+
+func TestGitNamespace(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		req.GitNamespace = "fork"
+		return nil
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	work, err := os.MkdirTemp("", "work")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(work)
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = work
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	remote := "ssh://git@127.0.0.1/" + filepath.Base(repo)
+
+	// The namespace starts out empty, pushes end up in it.
+	out, err := git("ls-remote", remote)
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	g.Expect(out).ToNot(ContainSubstring("refs/"))
+	_, err = git("init", ".")
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = git("commit", "--allow-empty", "-m", "fork")
+	g.Expect(err).ToNot(HaveOccurred())
+	out, err = git("push", remote, "HEAD:refs/heads/main")
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	refs, err := exec.Command("git", "-C", repo, "for-each-ref", "--format=%(refname)").Output()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(string(refs)).To(Equal("refs/heads/master\nrefs/namespaces/fork/refs/heads/main\n"))
+
+	out, err = git("archive", "--remote="+remote, "master")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(out).To(ContainSubstring("archives are not available in a git namespace"))
+}
+
+func TestExpandUserPaths(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+	repos, err := os.MkdirTemp("", "repos")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repos)
+	g.Expect(os.Mkdir(filepath.Join(repos, "alice"), 0755)).To(Succeed())
+	g.Expect(os.Rename(repo, filepath.Join(repos, "alice", "app.git"))).To(Succeed())
+
+	server := NewSSH(Config{
+		Dir:    repos,
+		KeyDir: keyDir,
+	})
+	server.ExpandUserPaths = true
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	clone, err := os.MkdirTemp("", "clone")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(clone)
+
+	for i, url := range []string{"ssh://git@127.0.0.1/~alice/app.git", "git@127.0.0.1:~alice/app.git"} {
+		dest := filepath.Join(clone, fmt.Sprint(i))
+		cmd := exec.Command("git", "clone", url, dest)
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		g.Expect(err).ToNot(HaveOccurred(), string(out))
+		g.Expect(filepath.Join(dest, "homework")).To(BeAnExistingFile())
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	for _, notify := range []bool{false, true} {
+		server := NewSSH(Config{
+			Dir:        filepath.Dir(repo),
+			KeyDir:     keyDir,
+			AutoCreate: true,
+		})
+		server.Redirects = NewRedirects()
+		server.Redirects.Notify = notify
+		server.Redirects.Add("old.git", filepath.Base(repo))
+		g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+		defer server.Stop()
+		go server.Serve()
+
+		_, port, err := net.SplitHostPort(server.Address())
+		g.Expect(err).ToNot(HaveOccurred())
+		clone, err := os.MkdirTemp("", "clone")
+		g.Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(clone)
+
+		cmd := exec.Command("git", "clone", "ssh://git@127.0.0.1/old.git", clone)
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		if notify {
+			g.Expect(err).To(HaveOccurred())
+			g.Expect(string(out)).To(ContainSubstring("repository moved to " + filepath.Base(repo)))
+		} else {
+			g.Expect(err).ToNot(HaveOccurred(), string(out))
+			g.Expect(filepath.Join(clone, "homework")).To(BeAnExistingFile())
+		}
+		g.Expect(filepath.Join(filepath.Dir(repo), "old.git")).ToNot(BeAnExistingFile())
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	g.Expect(exec.Command("git", "init", "--bare", filepath.Join(dir, "repos", "repo.git")).Run()).To(Succeed())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+
+	run := func(input string) error {
+		session, err := client.NewSession()
+		g.Expect(err).ToNot(HaveOccurred())
+		defer session.Close()
+		session.Stdin = strings.NewReader(input)
+		return session.Run("git-upload-pack 'repo.git'")
+	}
+
+	g.Expect(run("0000")).To(Succeed())
+
+	// upload-pack dies on a request it cannot parse.
+	err = run("garbage")
+	var exitErr *ssh.ExitError
+	g.Expect(errors.As(err, &exitErr)).To(BeTrue(), fmt.Sprint(err))
+	g.Expect(exitErr.ExitStatus()).To(Equal(128))
+}
+
+func TestStderrStreaming(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repos", "repo.git")
+	g.Expect(exec.Command("git", "init", "--bare", repo).Run()).To(Succeed())
+	work := filepath.Join(dir, "work")
+	g.Expect(exec.Command("git", "init", work).Run()).To(Succeed())
+	g.Expect(exec.Command("git", "-C", work, "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "-m", "initial").Run()).To(Succeed())
+	g.Expect(exec.Command("git", "-C", work, "push", repo, "HEAD:refs/heads/feature").Run()).To(Succeed())
+	head, err := exec.Command("git", "-C", work, "rev-parse", "HEAD").Output()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// The hook writes more than a pipe holds before receive-pack answers.
+	hook := "#!/bin/sh\nhead -c 200000 /dev/zero | tr '\\0' x >&2\necho done >&2\n"
+	g.Expect(os.WriteFile(filepath.Join(repo, "hooks", "pre-receive"), []byte(hook), 0755)).To(Succeed())
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+
+	// Deleting a branch needs no pack, and without side-band the hook's
+	// output goes to the stderr of receive-pack.
+	var input, stdout, stderr bytes.Buffer
+	packLine(&input, strings.TrimSpace(string(head))+" 0000000000000000000000000000000000000000 refs/heads/feature\x00report-status\n")
+	packFlush(&input)
+	session.Stdin = &input
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run("git-receive-pack 'repo.git'")
+	}()
+	g.Eventually(done, 10*time.Second).Should(Receive(BeNil()))
+	g.Expect(stderr.Len()).To(BeNumerically(">", 200000))
+	g.Expect(stderr.String()).To(HaveSuffix("done\n"))
+	g.Expect(stdout.String()).To(ContainSubstring("ok refs/heads/feature"))
+}
+
+func TestExecMiddleware(t *testing.T) {
+	g := NewWithT(t)
+
+	repo, err := createRepo()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(repo)
+	g.Expect(exec.Command("git", "-C", repo, "branch", "secret").Run()).To(Succeed())
+	keyDir, err := os.MkdirTemp("", "key-dir")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(keyDir)
+
+	var mu sync.Mutex
+	var calls []string
+	server := NewSSH(Config{
+		Dir:    filepath.Dir(repo),
+		KeyDir: keyDir,
+	})
+	server.UseExec(
+		func(next ExecFunc) ExecFunc {
+			return func(ctx context.Context, e *Exec) error {
+				err := next(ctx, e)
+				mu.Lock()
+				defer mu.Unlock()
+				calls = append(calls, fmt.Sprintf("%s %s %s: %v", e.User, e.Command, e.Repo, err))
+				return err
+			}
+		},
+		func(next ExecFunc) ExecFunc {
+			return func(ctx context.Context, e *Exec) error {
+				if e.Command == "git-receive-pack" {
+					return fmt.Errorf("%w: push quota exceeded", ErrAccessDenied)
+				}
+				e.Env = append(e.Env, configEnviron([]string{"uploadpack.hideRefs", "refs/heads/secret"})...)
+				return next(ctx, e)
+			}
+		},
+	)
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	_, port, err := net.SplitHostPort(server.Address())
+	g.Expect(err).ToNot(HaveOccurred())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Env = []string{"GIT_SSH_COMMAND=ssh -p " + port + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	url := "ssh://git@127.0.0.1/" + filepath.Base(repo)
+
+	out, err := git("ls-remote", url)
+	g.Expect(err).ToNot(HaveOccurred(), out)
+	g.Expect(out).To(ContainSubstring("refs/heads/master"))
+	g.Expect(out).ToNot(ContainSubstring("refs/heads/secret"))
+
+	out, err = git("-C", repo, "push", url, "master:refs/heads/topic")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(out).To(ContainSubstring("push quota exceeded"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	g.Expect(calls).To(Equal([]string{
+		"git git-upload-pack " + filepath.Base(repo) + ": <nil>",
+		"git git-receive-pack " + filepath.Base(repo) + ": access denied: push quota exceeded",
+	}))
+}
+
+func TestHandleCommand(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.HandleCommand("whoami", func(ctx context.Context, cmd *Command) error {
+		fmt.Fprintf(cmd.Channel, "%s %s\n", cmd.User, strings.Join(cmd.Args, ","))
+		return nil
+	})
+	server.HandleCommand("2fa_recovery", func(ctx context.Context, cmd *Command) error {
+		return errors.New("no recovery codes left")
+	})
+	server.HandleCommand("admin", func(ctx context.Context, cmd *Command) error {
+		return nil
+	})
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		if req.Operation == OperationRun && req.Command == "admin" {
+			return deniedBecause("admins only")
+		}
+		return nil
+	})
+	g.Expect(func() { server.HandleCommand("git-upload-pack", nil) }).To(Panic())
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	run := func(command string) (string, string, error) {
+		session, err := client.NewSession()
+		g.Expect(err).ToNot(HaveOccurred())
+		defer session.Close()
+		var stdout, stderr bytes.Buffer
+		session.Stdout = &stdout
+		session.Stderr = &stderr
+		err = session.Run(command)
+		return stdout.String(), stderr.String(), err
+	}
+
+	stdout, _, err := run("whoami -v  --json")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stdout).To(Equal("git -v,--json\n"))
+
+	_, stderr, err := run("2fa_recovery")
+	var exitErr *ssh.ExitError
+	g.Expect(errors.As(err, &exitErr)).To(BeTrue(), fmt.Sprint(err))
+	g.Expect(exitErr.ExitStatus()).To(Equal(1))
+	g.Expect(stderr).To(Equal("no recovery codes left\r\n"))
+
+	_, stderr, err = run("admin")
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(stderr).To(ContainSubstring("access denied: admins only"))
+
+	_, _, err = run("whoamireally")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestShellListsRepos(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	for _, repo := range []string{"app.git", "docs.git", "team/secret.git", "web.git"} {
+		g.Expect(exec.Command("git", "init", "--bare", filepath.Join(dir, "repos", repo)).Run()).To(Succeed())
+	}
+	newServer := func() *SSH {
+		return NewSSH(Config{
+			Dir:    filepath.Join(dir, "repos"),
+			KeyDir: filepath.Join(dir, "keys"),
+		})
+	}
+	shell := func(server *SSH) string {
+		g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+		defer server.Stop()
+		go server.Serve()
+
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		defer client.Close()
+		session, err := client.NewSession()
+		g.Expect(err).ToNot(HaveOccurred())
+		defer session.Close()
+
+		var stdout bytes.Buffer
+		session.Stdout = &stdout
+		g.Expect(session.RequestPty("xterm", 24, 80, ssh.TerminalModes{})).To(Succeed())
+		g.Expect(session.Shell()).To(Succeed())
+		g.Expect(session.Wait()).To(Succeed())
+		return stdout.String()
+	}
+
+	server := newServer()
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		switch {
+		case req.Repo == "team/secret.git":
+			return ErrAccessDenied
+		case req.Repo == "docs.git" && req.Operation == OperationWrite:
+			return ErrAccessDenied
+		}
+		return nil
+	})
+	server.PolicyFunc = func(ctx context.Context, input PolicyInput) (PolicyDecision, error) {
+		return PolicyDecision{Allow: input.Repo != "web.git" || input.Operation == OperationRead}, nil
+	}
+	out := shell(server)
+	g.Expect(out).To(HavePrefix("Hi git! "))
+	g.Expect(out).To(HaveSuffix("\r\n\r\n R W\tapp.git\r\n R  \tdocs.git\r\n R  \tweb.git\r\n"))
+
+	// Without an Authorizer nothing is listed rather than everything.
+	g.Expect(shell(newServer())).To(Equal("Hi git! You've successfully authenticated, but shell access is not available.\r\n"))
+}
+
+func TestBannerAndMOTD(t *testing.T) {
+	g := NewWithT(t)
+
+	dir := t.TempDir()
+	g.Expect(exec.Command("git", "init", "--bare", filepath.Join(dir, "repos", "repo.git")).Run()).To(Succeed())
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+	})
+	server.Banner = "Authorized use only.\r\n"
+	server.MOTDFunc = func(principal *Principal) string {
+		return "Maintenance on Sunday.\nPushes will be paused.\n"
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	var banner string
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	g.Expect(banner).To(Equal("Authorized use only.\r\n"))
+
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader("0000")
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	g.Expect(session.Run("git-upload-pack 'repo.git'")).To(Succeed())
+	g.Expect(stderr.String()).To(Equal("Maintenance on Sunday.\r\nPushes will be paused.\r\n"))
+	g.Expect(stdout.String()).ToNot(ContainSubstring("Maintenance"))
+}
@@ -0,0 +1,246 @@
+package gitkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Which commits clients may fetch by ID besides those refs point to, see
+// Server.AllowSHA1InWant.
+const (
+	// WantReachable allows commits reachable from a ref, as with
+	// uploadpack.allowReachableSHA1InWant.
+	WantReachable = "reachable"
+	// WantAny allows any object, as with uploadpack.allowAnySHA1InWant.
+	WantAny = "any"
+)
+
+// ShallowRequest is a request of a fetch to limit the history it gets, as
+// in shallow clones. Each request sets one of its fields.
+type ShallowRequest struct {
+	// Depth is the number of commits asked for with --depth or --deepen.
+	Depth int
+	// Since is the date asked for with --shallow-since.
+	Since time.Time
+	// Not is a ref whose history is excluded with --shallow-exclude.
+	Not string
+}
+
+// uploadPackOptions are the settings of upload-pack shared by the HTTP and
+// SSH servers.
+type uploadPackOptions struct {
+	repo         string
+	bundleURIs   []string
+	sha1InWant   string
+	allowFilter  bool
+	filterPolicy func(repo, filter string) error
+
+	denyShallow   bool
+	maxDepth      int
+	shallowPolicy func(repo string, req ShallowRequest) (ShallowRequest, error)
+}
+
+// uploadPack returns the upload-pack settings for r, which are empty for
+// other commands.
+func (s *Server) uploadPack(r *Request) uploadPackOptions {
+	if r.Command != "git-upload-pack" {
+		return uploadPackOptions{}
+	}
+	o := uploadPackOptions{
+		repo:          r.RepoName,
+		allowFilter:   s.AllowFilter,
+		filterPolicy:  s.FilterPolicy,
+		denyShallow:   s.DenyShallow,
+		maxDepth:      s.MaxDepth,
+		shallowPolicy: s.ShallowPolicy,
+	}
+	if s.BundleURIs != nil {
+		o.bundleURIs = s.BundleURIs(r.RepoName)
+	}
+	o.sha1InWant = s.AllowSHA1InWant
+	if s.AllowSHA1InWantFunc != nil {
+		if want := s.AllowSHA1InWantFunc(r.RepoName); want != "" {
+			o.sha1InWant = want
+		}
+	}
+	return o
+}
+
+// uploadPack returns the upload-pack settings for repo.
+func (s *SSH) uploadPack(repo string) uploadPackOptions {
+	o := uploadPackOptions{
+		repo:          repo,
+		allowFilter:   s.AllowFilter,
+		filterPolicy:  s.FilterPolicy,
+		denyShallow:   s.DenyShallow,
+		maxDepth:      s.MaxDepth,
+		shallowPolicy: s.ShallowPolicy,
+	}
+	if s.BundleURIs != nil {
+		o.bundleURIs = s.BundleURIs(repo)
+	}
+	o.sha1InWant = s.AllowSHA1InWant
+	if s.AllowSHA1InWantFunc != nil {
+		if want := s.AllowSHA1InWantFunc(repo); want != "" {
+			o.sha1InWant = want
+		}
+	}
+	return o
+}
+
+// config returns the git configuration upload-pack runs with, as pairs of
+// keys and values.
+func (o uploadPackOptions) config() []string {
+	config := bundleURIConfig(o.bundleURIs)
+	if o.allowFilter {
+		config = append(config, "uploadpack.allowFilter", "true")
+	}
+	switch o.sha1InWant {
+	case WantReachable:
+		config = append(config, "uploadpack.allowReachableSHA1InWant", "true")
+	case WantAny:
+		config = append(config, "uploadpack.allowAnySHA1InWant", "true")
+	}
+	return config
+}
+
+// check returns the line to pass on to git for line, a pkt-line of an
+// upload-pack request, or an error if the client may not send it.
+func (o uploadPackOptions) check(line string) (string, error) {
+	if strings.HasPrefix(line, "filter ") && o.filterPolicy != nil {
+		filter := strings.TrimPrefix(line, "filter ")
+		if err := o.filterPolicy(o.repo, filter); err != nil {
+			return "", fmt.Errorf("filter %s is not allowed: %w", filter, err)
+		}
+	}
+	if strings.HasPrefix(line, "deepen") {
+		return o.checkShallow(line)
+	}
+	return line, nil
+}
+
+// checkShallow checks a deepen line, clamping its depth to the limits.
+func (o uploadPackOptions) checkShallow(line string) (string, error) {
+	var req ShallowRequest
+	switch {
+	case strings.HasPrefix(line, "deepen "):
+		depth, err := strconv.Atoi(strings.TrimPrefix(line, "deepen "))
+		if err != nil {
+			return line, nil
+		}
+		req.Depth = depth
+	case strings.HasPrefix(line, "deepen-since "):
+		since, err := strconv.ParseInt(strings.TrimPrefix(line, "deepen-since "), 10, 64)
+		if err != nil {
+			return line, nil
+		}
+		req.Since = time.Unix(since, 0)
+	case strings.HasPrefix(line, "deepen-not "):
+		req.Not = strings.TrimPrefix(line, "deepen-not ")
+	default:
+		// deepen-relative only changes what the depth counts from.
+		return line, nil
+	}
+
+	if o.denyShallow {
+		return "", fmt.Errorf("%w: shallow fetches are not allowed", ErrAccessDenied)
+	}
+	if o.shallowPolicy != nil {
+		var err error
+		if req, err = o.shallowPolicy(o.repo, req); err != nil {
+			return "", fmt.Errorf("shallow fetch is not allowed: %w", err)
+		}
+	}
+	switch {
+	case strings.HasPrefix(line, "deepen "):
+		if o.maxDepth > 0 && (req.Depth <= 0 || req.Depth > o.maxDepth) {
+			req.Depth = o.maxDepth
+		}
+		if req.Depth <= 0 {
+			return "", fmt.Errorf("%w: invalid depth %d", ErrAccessDenied, req.Depth)
+		}
+		return fmt.Sprintf("deepen %d", req.Depth), nil
+	case strings.HasPrefix(line, "deepen-since "):
+		return fmt.Sprintf("deepen-since %d", req.Since.Unix()), nil
+	}
+	return "deepen-not " + req.Not, nil
+}
+
+// inspected reports whether requests have to be checked line by line.
+func (o uploadPackOptions) inspected() bool {
+	return o.allowFilter && o.filterPolicy != nil ||
+		o.denyShallow || o.maxDepth > 0 || o.shallowPolicy != nil
+}
+
+// pktLineChecker passes the pkt-lines read from r on, as check rewrites
+// them. Once check fails, reading fails with its error, so the line never
+// reaches git. Input that isn't made of pkt-lines is passed on as it is,
+// git rejects it anyway.
+type pktLineChecker struct {
+	r      *bufio.Reader
+	check  func(line string) (string, error)
+	buf    []byte
+	err    error
+	denied error
+}
+
+func newPktLineChecker(r io.Reader, check func(line string) (string, error)) *pktLineChecker {
+	return &pktLineChecker{r: bufio.NewReader(r), check: check}
+}
+
+func (c *pktLineChecker) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.check == nil {
+			return c.r.Read(p)
+		}
+		c.buf, c.err = c.next()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next reads the next pkt-line.
+func (c *pktLineChecker) next() ([]byte, error) {
+	head := make([]byte, 4)
+	n, err := io.ReadFull(c.r, head)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return head[:n], err
+	}
+	size, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		c.check = nil
+		return head, nil
+	}
+	if size < 4 {
+		return head, nil
+	}
+	pkt := make([]byte, size)
+	copy(pkt, head)
+	if n, err := io.ReadFull(c.r, pkt[4:]); err != nil {
+		return pkt[:4+n], io.EOF
+	}
+	line := string(pkt[4:])
+	checked, err := c.check(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		c.denied = err
+		return nil, err
+	}
+	if strings.HasSuffix(line, "\n") {
+		checked += "\n"
+	}
+	if checked == line {
+		return pkt, nil
+	}
+	return []byte(fmt.Sprintf("%04x%s", len(checked)+4, checked)), nil
+}
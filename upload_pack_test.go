@@ -0,0 +1,256 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPktLineChecker(t *testing.T) {
+	var request bytes.Buffer
+	packLine(&request, "want 1111111111111111111111111111111111111111\n")
+	packLine(&request, "filter blob:none\n")
+	packFlush(&request)
+	packLine(&request, "done\n")
+
+	var seen []string
+	check := func(line string) (string, error) {
+		seen = append(seen, line)
+		return line, nil
+	}
+	out, err := ioutil.ReadAll(newPktLineChecker(bytes.NewReader(request.Bytes()), check))
+	assert.NoError(t, err)
+	assert.Equal(t, request.Bytes(), out)
+	assert.Equal(t, []string{"want 1111111111111111111111111111111111111111", "filter blob:none", "done"}, seen)
+
+	// Nothing from the denied line on is passed on.
+	denied := errors.New("denied")
+	checker := newPktLineChecker(bytes.NewReader(request.Bytes()), func(line string) (string, error) {
+		if strings.HasPrefix(line, "filter ") {
+			return "", denied
+		}
+		return line, nil
+	})
+	out, err = ioutil.ReadAll(checker)
+	assert.Equal(t, denied, err)
+	assert.Equal(t, denied, checker.denied)
+	assert.Equal(t, "0032want 1111111111111111111111111111111111111111\n", string(out))
+
+	// Lines are rewritten.
+	out, err = ioutil.ReadAll(newPktLineChecker(strings.NewReader("000fdeepen 1000\n0000"), func(string) (string, error) { return "deepen 50", nil }))
+	assert.NoError(t, err)
+	assert.Equal(t, "000ddeepen 50\n0000", string(out))
+
+	// Anything else is passed on as is.
+	out, err = ioutil.ReadAll(newPktLineChecker(strings.NewReader("PACK garbage"), func(string) (string, error) { return "", denied }))
+	assert.NoError(t, err)
+	assert.Equal(t, "PACK garbage", string(out))
+}
+
+func TestUploadPackCheckShallow(t *testing.T) {
+	var asked []ShallowRequest
+	o := uploadPackOptions{
+		repo:     "app.git",
+		maxDepth: 100,
+		shallowPolicy: func(repo string, req ShallowRequest) (ShallowRequest, error) {
+			asked = append(asked, req)
+			if req.Not != "" {
+				return req, fmt.Errorf("%w: --shallow-exclude is not allowed", ErrAccessDenied)
+			}
+			return req, nil
+		},
+	}
+	for _, tt := range []struct {
+		line, want, err string
+	}{
+		{line: "deepen 1", want: "deepen 1"},
+		{line: "deepen 2147483647", want: "deepen 100"},
+		{line: "deepen-since 1700000000", want: "deepen-since 1700000000"},
+		{line: "deepen-relative", want: "deepen-relative"},
+		{line: "deepen-not refs/heads/main", err: "--shallow-exclude is not allowed"},
+		{line: "want 1111111111111111111111111111111111111111", want: "want 1111111111111111111111111111111111111111"},
+	} {
+		got, err := o.check(tt.line)
+		if tt.err != "" {
+			assert.Error(t, err, tt.line)
+			assert.True(t, errors.Is(err, ErrAccessDenied), tt.line)
+			assert.Contains(t, denialMessage(err, ""), tt.err, tt.line)
+			continue
+		}
+		assert.NoError(t, err, tt.line)
+		assert.Equal(t, tt.want, got)
+	}
+	assert.Equal(t, []ShallowRequest{
+		{Depth: 1},
+		{Depth: 2147483647},
+		{Since: time.Unix(1700000000, 0)},
+		{Not: "refs/heads/main"},
+	}, asked)
+
+	_, err := uploadPackOptions{denyShallow: true}.check("deepen 1")
+	assert.True(t, errors.Is(err, ErrAccessDenied))
+}
+
+func TestServerShallowPolicy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = git("-C", work, "commit", "--allow-empty", "-m", fmt.Sprint("commit ", i))
+		assert.NoError(t, err)
+	}
+	_, err = git("-C", work, "push", repo, "HEAD:refs/heads/master")
+	assert.NoError(t, err)
+
+	server := New(Config{Dir: repos})
+	server.MaxDepth = 2
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	for _, version := range []string{"0", "2"} {
+		clone := filepath.Join(dir, "clone-v"+version)
+		out, err := git("-c", "protocol.version="+version, "clone", "--depth=4", srv.URL+"/app.git", clone)
+		assert.NoError(t, err, out)
+		out, err = git("-C", clone, "rev-list", "--count", "HEAD")
+		assert.NoError(t, err)
+		assert.Equal(t, "2", out)
+	}
+
+	server = New(Config{Dir: repos})
+	server.DenyShallow = true
+	denied := httptest.NewServer(server)
+	defer denied.Close()
+	out, err := git("clone", "--depth=1", denied.URL+"/app.git", filepath.Join(dir, "denied"))
+	assert.Error(t, err)
+	assert.Contains(t, out, "shallow fetches are not allowed")
+}
+
+func TestServerFilterPolicy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	repo := filepath.Join(repos, "app.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repo).Run())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(work, "README"), []byte("hello\n"), 0644))
+	_, err = git("-C", work, "add", "README")
+	assert.NoError(t, err)
+	_, err = git("-C", work, "commit", "-m", "initial")
+	assert.NoError(t, err)
+	_, err = git("-C", work, "push", repo, "HEAD:refs/heads/master")
+	assert.NoError(t, err)
+
+	for _, backend := range []bool{false, true} {
+		server := New(Config{Dir: repos})
+		server.HTTPBackend = backend
+		server.AllowFilter = true
+		server.FilterPolicy = func(repo, filter string) error {
+			if filter != "blob:none" {
+				return fmt.Errorf("%w: only blob:none partial clones are allowed", ErrAccessDenied)
+			}
+			return nil
+		}
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+
+		for _, version := range []string{"0", "2"} {
+			name := fmt.Sprintf("backend-%v-v%s", backend, version)
+			clone := filepath.Join(dir, name)
+			out, err := git("-c", "protocol.version="+version, "clone", "--no-checkout", "--filter=blob:none", srv.URL+"/app.git", clone)
+			assert.NoError(t, err, name+": "+out)
+			out, err = git("-C", clone, "config", "remote.origin.partialclonefilter")
+			assert.NoError(t, err, name)
+			assert.Equal(t, "blob:none\n", out, name)
+
+			out, err = git("-c", "protocol.version="+version, "clone", "--filter=tree:0", srv.URL+"/app.git", clone+"-tree")
+			assert.Error(t, err, name)
+			assert.Contains(t, out, "only blob:none partial clones are allowed", name)
+		}
+	}
+}
+
+func TestServerSHA1InWant(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, "app.git")).Run())
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(repos, "ci.git")).Run())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+	work := filepath.Join(dir, "work")
+	_, err := git("init", work)
+	assert.NoError(t, err)
+	for _, msg := range []string{"first", "second"} {
+		_, err = git("-C", work, "commit", "--allow-empty", "-m", msg)
+		assert.NoError(t, err)
+	}
+	first, err := git("-C", work, "rev-parse", "HEAD~1")
+	assert.NoError(t, err)
+	for _, repo := range []string{"app.git", "ci.git"} {
+		_, err = git("-C", work, "push", filepath.Join(repos, repo), "HEAD:refs/heads/master")
+		assert.NoError(t, err)
+	}
+
+	server := New(Config{Dir: repos})
+	server.AllowSHA1InWantFunc = func(repo string) string {
+		if repo == "ci.git" {
+			return WantReachable
+		}
+		return ""
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	fetch := func(repo string) error {
+		clone := filepath.Join(dir, "fetch-"+repo)
+		_, err := git("init", clone)
+		assert.NoError(t, err)
+		out, err := git("-C", clone, "-c", "protocol.version=0", "fetch", srv.URL+"/"+repo, first)
+		if err == nil {
+			_, err = git("-C", clone, "cat-file", "-e", first)
+			assert.NoError(t, err, out)
+		}
+		return err
+	}
+	assert.Error(t, fetch("app.git"))
+	assert.NoError(t, fetch("ci.git"))
+}
@@ -0,0 +1,136 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Permissions extensions set for clients authenticated with a certificate.
+const (
+	certKeyIDExtension       = "cert-key-id"
+	certPrincipalsExtension  = "cert-principals"
+	certFingerprintExtension = "cert-fingerprint"
+)
+
+// isUserAuthority reports whether auth is one of UserCAKeys.
+func (s *SSH) isUserAuthority(auth ssh.PublicKey) bool {
+	for _, ca := range s.UserCAKeys {
+		if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateCert validates a user certificate against UserCAKeys and
+// resolves it to a Principal. Like OpenSSH, the certificate must list the
+// SSH username as one of its principals, be within its validity window and
+// carry no critical options other than source-address.
+func (s *SSH) authenticateCert(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: s.isUserAuthority,
+		// Enforced by the ssh package once authentication succeeds.
+		SupportedCriticalOptions: []string{"source-address"},
+	}
+	if _, err := checker.Authenticate(conn, cert); err != nil {
+		return nil, err
+	}
+	if err := s.checkCertLifetime(cert); err != nil {
+		return nil, err
+	}
+
+	principal, err := s.certPrincipal(conn, cert)
+	if err != nil {
+		return nil, err
+	}
+	principal.Certificate = true
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		principal.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+
+	perms := keyPermissions(principal, cert.Key)
+	perms.CriticalOptions = cert.CriticalOptions
+	perms.Extensions[certKeyIDExtension] = cert.KeyId
+	perms.Extensions[certPrincipalsExtension] = strings.Join(cert.ValidPrincipals, ",")
+	perms.Extensions[certFingerprintExtension] = KeyFingerprint(cert)
+	return perms, nil
+}
+
+// checkCertLifetime rejects certificates valid for longer than
+// MaxCertLifetime.
+func (s *SSH) checkCertLifetime(cert *ssh.Certificate) error {
+	if s.MaxCertLifetime <= 0 {
+		return nil
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity ||
+		time.Duration(cert.ValidBefore-cert.ValidAfter)*time.Second > s.MaxCertLifetime {
+		return fmt.Errorf("certificate %q is valid for longer than %s", cert.KeyId, s.MaxCertLifetime)
+	}
+	return nil
+}
+
+// certPrincipal resolves a validated certificate with PrincipalResolver, or
+// through lookupCert if unset.
+func (s *SSH) certPrincipal(conn ssh.ConnMetadata, cert *ssh.Certificate) (principal *Principal, err error) {
+	if s.PrincipalResolver == nil {
+		pkey, err := s.lookupCert(conn, cert)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKeyValidity(pkey, time.Now()); err != nil {
+			return nil, err
+		}
+		return principalFromKey(pkey, cert), nil
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlePanic("ssh: principal resolver", v)
+			principal, err = nil, fmt.Errorf("principal resolver failed")
+		}
+	}()
+	principal, err = s.PrincipalResolver(cert, conn)
+	if err != nil {
+		return nil, err
+	}
+	if principal == nil || principal.ID == "" {
+		return nil, fmt.Errorf("principal resolver did not return a principal")
+	}
+	p := *principal
+	p.KeyType = cert.Key.Type()
+	p.SecurityKey = IsSecurityKey(cert.Key)
+	return &p, nil
+}
+
+// lookupCert resolves a validated certificate using CertLookupFunc, or to a
+// key identified by the certificate's key ID if unset.
+func (s *SSH) lookupCert(conn ssh.ConnMetadata, cert *ssh.Certificate) (pkey *PublicKey, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.handlePanic("ssh: certificate lookup", v)
+			pkey, err = nil, fmt.Errorf("certificate lookup failed")
+		}
+	}()
+
+	if s.CertLookupFunc == nil {
+		return &PublicKey{
+			Id:          cert.KeyId,
+			Name:        cert.KeyId,
+			Fingerprint: KeyFingerprint(cert.Key),
+			Content:     AuthorizedKeyString(cert),
+		}, nil
+	}
+
+	pkey, err = s.CertLookupFunc(cert, conn)
+	if err != nil {
+		return nil, err
+	}
+	if pkey == nil {
+		return nil, fmt.Errorf("certificate lookup did not return a key")
+	}
+	return pkey, nil
+}
@@ -0,0 +1,250 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUserCertificate(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "user-cert")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		signer, err := ssh.NewSignerFromKey(priv)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	ca, otherCA, user := newSigner(), newSigner(), newSigner()
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.UserCAKeys = []ssh.PublicKey{ca.PublicKey()}
+	lookups := make(chan string, 10)
+	server.CertLookupFunc = func(cert *ssh.Certificate, _ ssh.ConnMetadata) (*PublicKey, error) {
+		lookups <- cert.KeyId
+		if cert.KeyId == "revoked" {
+			return nil, fmt.Errorf("certificate revoked")
+		}
+		return &PublicKey{Id: "user-" + cert.KeyId}, nil
+	}
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	sign := func(authority ssh.Signer, keyID string, principals []string, validFor time.Duration) ssh.Signer {
+		now := time.Now()
+		cert := &ssh.Certificate{
+			Key:             user.PublicKey(),
+			CertType:        ssh.UserCert,
+			KeyId:           keyID,
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(now.Add(validFor).Unix()),
+		}
+		g.Expect(cert.SignCert(rand.Reader, authority)).To(Succeed())
+		signer, err := ssh.NewCertSigner(cert, user)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	dial := func(signer ssh.Signer) error {
+		client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	tests := []struct {
+		name   string
+		signer ssh.Signer
+		ok     bool
+	}{
+		{"valid", sign(ca, "alice", []string{"git"}, time.Hour), true},
+		{"expired", sign(ca, "alice", []string{"git"}, -time.Minute), false},
+		{"wrong principal", sign(ca, "alice", []string{"alice"}, time.Hour), false},
+		{"untrusted CA", sign(otherCA, "alice", []string{"git"}, time.Hour), false},
+		{"rejected by lookup", sign(ca, "revoked", []string{"git"}, time.Hour), false},
+		{"plain key", user, false},
+	}
+	for _, tt := range tests {
+		err := dial(tt.signer)
+		if tt.ok {
+			g.Expect(err).ToNot(HaveOccurred(), tt.name)
+		} else {
+			g.Expect(err).To(HaveOccurred(), tt.name)
+		}
+	}
+	g.Expect(lookups).To(Receive(Equal("alice")))
+	g.Expect(lookups).To(Receive(Equal("revoked")))
+	g.Expect(lookups).ToNot(Receive())
+
+	perms, err := server.authenticateCert(fakeConnMetadata{user: "git"}, sign(ca, "alice", []string{"git", "deploy"}, time.Hour).PublicKey().(*ssh.Certificate))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(perms.Extensions).To(HaveKeyWithValue("key-id", "user-alice"))
+	g.Expect(perms.Extensions).To(HaveKeyWithValue("key-fingerprint", KeyFingerprint(user.PublicKey())))
+	g.Expect(perms.Extensions).To(HaveKeyWithValue("cert-key-id", "alice"))
+	g.Expect(perms.Extensions).To(HaveKeyWithValue("cert-principals", "git,deploy"))
+	g.Expect(perms.Extensions).To(HaveKey("cert-fingerprint"))
+	g.Expect(principalFrom(perms).ID).To(Equal("user-alice"))
+
+	// Revoking the certificate itself closes connections that use it.
+	signer := sign(ca, "alice", []string{"git"}, time.Hour)
+	client, err := ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+	server.RevokeKey(KeyFingerprint(signer.PublicKey()))
+	g.Eventually(closed, 5*time.Second).Should(Receive())
+	g.Expect(dial(signer)).ToNot(Succeed())
+	g.Expect(dial(sign(ca, "alice", []string{"git"}, time.Hour))).To(Succeed())
+}
+
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+	addr net.Addr
+}
+
+func (m fakeConnMetadata) User() string         { return m.user }
+func (m fakeConnMetadata) RemoteAddr() net.Addr { return m.addr }
+
+func TestCertPrincipalResolver(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := os.MkdirTemp("", "user-cert")
+	g.Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		g.Expect(err).ToNot(HaveOccurred())
+		signer, err := ssh.NewSignerFromKey(priv)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	ca, user := newSigner(), newSigner()
+
+	server := NewSSH(Config{
+		Dir:    filepath.Join(dir, "repos"),
+		KeyDir: filepath.Join(dir, "keys"),
+		Auth:   true,
+	})
+	server.UserCAKeys = []ssh.PublicKey{ca.PublicKey()}
+	server.MaxCertLifetime = time.Hour
+	server.PrincipalResolver = func(cert *ssh.Certificate, _ ssh.ConnMetadata) (*Principal, error) {
+		if cert.KeyId == "mallory" {
+			return nil, fmt.Errorf("unknown user")
+		}
+		return &Principal{ID: cert.KeyId, Scopes: cert.ValidPrincipals}, nil
+	}
+	requests := make(chan *AccessRequest, 1)
+	server.Authorizer = AuthorizerFunc(func(req *AccessRequest) error {
+		requests <- req
+		return ErrAccessDenied
+	})
+	g.Expect(server.Listen("127.0.0.1:0")).To(Succeed())
+	defer server.Stop()
+	go server.Serve()
+
+	type certOpts struct {
+		keyID    string
+		lifetime time.Duration
+		options  map[string]string
+	}
+	sign := func(opts certOpts) ssh.Signer {
+		now := time.Now()
+		cert := &ssh.Certificate{
+			Key:             user.PublicKey(),
+			CertType:        ssh.UserCert,
+			KeyId:           opts.keyID,
+			ValidPrincipals: []string{"git", "production"},
+			ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(opts.lifetime - time.Minute).Unix()),
+			Permissions:     ssh.Permissions{CriticalOptions: opts.options},
+		}
+		if opts.lifetime == 0 {
+			cert.ValidBefore = ssh.CertTimeInfinity
+		}
+		g.Expect(cert.SignCert(rand.Reader, ca)).To(Succeed())
+		signer, err := ssh.NewCertSigner(cert, user)
+		g.Expect(err).ToNot(HaveOccurred())
+		return signer
+	}
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", server.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	tests := []struct {
+		name string
+		opts certOpts
+		ok   bool
+	}{
+		{"short-lived", certOpts{keyID: "alice", lifetime: 30 * time.Minute}, true},
+		{"matching source address", certOpts{keyID: "alice", lifetime: 30 * time.Minute, options: map[string]string{"source-address": "127.0.0.1/32"}}, true},
+		{"too long-lived", certOpts{keyID: "alice", lifetime: 2 * time.Hour}, false},
+		{"never expires", certOpts{keyID: "alice"}, false},
+		{"other source address", certOpts{keyID: "alice", lifetime: 30 * time.Minute, options: map[string]string{"source-address": "10.0.0.0/8"}}, false},
+		{"unsupported critical option", certOpts{keyID: "alice", lifetime: 30 * time.Minute, options: map[string]string{"force-command": "true"}}, false},
+		{"rejected by resolver", certOpts{keyID: "mallory", lifetime: 30 * time.Minute}, false},
+	}
+	for _, tt := range tests {
+		client, err := dial(sign(tt.opts))
+		if tt.ok {
+			g.Expect(err).ToNot(HaveOccurred(), tt.name)
+			client.Close()
+		} else {
+			g.Expect(err).To(HaveOccurred(), tt.name)
+		}
+	}
+
+	client, err := dial(sign(certOpts{keyID: "alice", lifetime: 30 * time.Minute}))
+	g.Expect(err).ToNot(HaveOccurred())
+	defer client.Close()
+	session, err := client.NewSession()
+	g.Expect(err).ToNot(HaveOccurred())
+	defer session.Close()
+	session.Run("git-upload-pack 'prod.git'")
+
+	var req *AccessRequest
+	g.Eventually(requests, 5*time.Second).Should(Receive(&req))
+	g.Expect(req.KeyID).To(Equal("alice"))
+	g.Expect(req.Principal.HasScope("production")).To(BeTrue())
+	g.Expect(req.Principal.Certificate).To(BeTrue())
+	g.Expect(req.Principal.ValidBefore).To(BeTemporally("~", time.Now().Add(29*time.Minute), time.Minute))
+	g.Expect(req.Principal.KeyType).To(Equal(ssh.KeyAlgoED25519))
+}
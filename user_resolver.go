@@ -0,0 +1,83 @@
+package gitkit
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// resolveNamespace returns the namespace the connection of user is served
+// from, using UserResolver if set. Without UserResolver and UserCheckFunc the
+// user must match Config.GitUser.
+func (s *SSH) resolveNamespace(cfg *Config, user string) (string, error) {
+	if s.UserResolver == nil {
+		if s.UserCheckFunc == nil && cfg.Auth && cfg.GitUser != "" && user != cfg.GitUser {
+			return "", fmt.Errorf("unexpected user")
+		}
+		return "", nil
+	}
+
+	namespace, err := s.UserResolver(user)
+	if err != nil {
+		return "", err
+	}
+	return cleanNamespace(namespace)
+}
+
+// cleanNamespace returns namespace as a clean relative path, refusing ones
+// outside of Config.Dir.
+func cleanNamespace(namespace string) (string, error) {
+	if namespace == "" {
+		return "", nil
+	}
+	clean := path.Clean(namespace)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return clean, nil
+}
+
+// expandUserPath expands a repository of the form ~user/repo.git to repo.git
+// in the namespace UserResolver returns for user, or in a directory named
+// after user without UserResolver. ~/repo.git is a repository of self, the
+// user of the connection. Other repositories are returned unchanged, with
+// ok false.
+func (s *SSH) expandUserPath(repo, self string) (expanded string, ok bool, err error) {
+	if !strings.HasPrefix(repo, "~") {
+		return repo, false, nil
+	}
+	user, rest, _ := cut(repo[1:], "/")
+	if user == "" {
+		user = self
+	}
+	if rest == "" {
+		return "", true, fmt.Errorf("invalid repository %q", repo)
+	}
+
+	namespace := user
+	if s.UserResolver != nil {
+		if namespace, err = s.UserResolver(user); err != nil {
+			return "", true, err
+		}
+	} else if strings.Contains(user, "/") {
+		return "", true, fmt.Errorf("invalid user %q", user)
+	}
+	if namespace, err = cleanNamespace(namespace); err != nil {
+		return "", true, err
+	}
+	expanded, err = namespacedRepo(namespace, rest)
+	return expanded, true, err
+}
+
+// namespacedRepo prefixes repo with namespace, refusing paths that would
+// leave it.
+func namespacedRepo(namespace, repo string) (string, error) {
+	if namespace == "" {
+		return repo, nil
+	}
+	joined := path.Join(namespace, repo)
+	if !strings.HasPrefix(joined, namespace+"/") {
+		return "", fmt.Errorf("repository %q is outside of namespace %q", repo, namespace)
+	}
+	return joined, nil
+}
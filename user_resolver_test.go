@@ -0,0 +1,100 @@
+package gitkit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveNamespace(t *testing.T) {
+	s := &SSH{}
+	cfg := &Config{Auth: true, GitUser: "git"}
+
+	ns, err := s.resolveNamespace(cfg, "git")
+	assert.NoError(t, err)
+	assert.Equal(t, "", ns)
+	_, err = s.resolveNamespace(cfg, "alice")
+	assert.Error(t, err)
+
+	s.UserResolver = func(user string) (string, error) {
+		if user == "nobody" {
+			return "", fmt.Errorf("unknown user")
+		}
+		return user, nil
+	}
+	ns, err = s.resolveNamespace(cfg, "acme/")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", ns)
+	_, err = s.resolveNamespace(cfg, "nobody")
+	assert.Error(t, err)
+	for _, user := range []string{"..", "../acme", "/acme", "."} {
+		_, err = s.resolveNamespace(cfg, user)
+		assert.Error(t, err, user)
+	}
+}
+
+func TestNamespacedRepo(t *testing.T) {
+	repo, err := namespacedRepo("", "app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "app.git", repo)
+
+	repo, err = namespacedRepo("acme", "team/app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "acme/team/app.git", repo)
+
+	_, err = namespacedRepo("acme", "../globex/app.git")
+	assert.Error(t, err)
+	_, err = namespacedRepo("acme", "..")
+	assert.Error(t, err)
+}
+
+func TestResolveNamespaceWithUserCheckFunc(t *testing.T) {
+	s := &SSH{UserCheckFunc: func(user, keyID string) error { return nil }}
+	cfg := &Config{Auth: true, GitUser: "git"}
+
+	ns, err := s.resolveNamespace(cfg, "gitea")
+	assert.NoError(t, err)
+	assert.Equal(t, "", ns)
+}
+
+func TestExpandUserPath(t *testing.T) {
+	s := &SSH{}
+	for repo, want := range map[string]string{
+		"~alice/app.git":      "alice/app.git",
+		"~alice/team/app.git": "alice/team/app.git",
+		"~/app.git":           "git/app.git",
+	} {
+		expanded, ok, err := s.expandUserPath(repo, "git")
+		assert.NoError(t, err, repo)
+		assert.True(t, ok, repo)
+		assert.Equal(t, want, expanded, repo)
+	}
+	expanded, ok, err := s.expandUserPath("app.git", "git")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "app.git", expanded)
+	for _, repo := range []string{"~alice", "~alice/", "~../app.git", "~alice/../bob/app.git", "~./app.git"} {
+		_, ok, err := s.expandUserPath(repo, "git")
+		assert.True(t, ok, repo)
+		assert.Error(t, err, repo)
+	}
+
+	s.UserResolver = func(user string) (string, error) {
+		switch user {
+		case "alice":
+			return "users/alice", nil
+		case "admin":
+			return "", nil
+		}
+		return "", fmt.Errorf("unknown user")
+	}
+	expanded, _, err = s.expandUserPath("~alice/app.git", "git")
+	assert.NoError(t, err)
+	assert.Equal(t, "users/alice/app.git", expanded)
+	expanded, _, err = s.expandUserPath("~admin/app.git", "git")
+	assert.NoError(t, err)
+	assert.Equal(t, "app.git", expanded)
+	_, _, err = s.expandUserPath("~mallory/app.git", "git")
+	assert.Error(t, err)
+}
@@ -5,7 +5,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os/exec"
 	"regexp"
 	"strings"
 )
@@ -25,19 +24,6 @@ func logInfo(context string, message string) {
 	log.Printf("%s: %s\n", context, message)
 }
 
-func cleanUpProcess(cmd *exec.Cmd) {
-	if cmd == nil {
-		return
-	}
-
-	process := cmd.Process
-	if process != nil && process.Pid > 0 {
-		process.Kill()
-	}
-
-	go cmd.Wait()
-}
-
 func packLine(w io.Writer, s string) error {
 	_, err := fmt.Fprintf(w, "%04x%s", len(s)+4, s)
 	return err
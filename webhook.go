@@ -0,0 +1,210 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	defaultWebhookBackoff = 200 * time.Millisecond
+	// maxWebhookResponse bounds the decoded response body.
+	maxWebhookResponse = 1 << 20
+)
+
+// Webhook request types.
+const (
+	WebhookAuthenticate = "authenticate"
+	WebhookAuthorize    = "authorize"
+)
+
+// AuthWebhook delegates authentication and authorization decisions to an
+// HTTP endpoint. Set its LookupKey method as SSH.KeyLookupFunc and the
+// webhook itself as SSH.Authorizer.
+//
+// Every decision is a POST of a JSON encoded WebhookRequest to URL, which
+// must answer with a JSON encoded WebhookResponse. A 401 or 403 status is
+// taken as a denial. Transport errors and 5xx responses are retried.
+type AuthWebhook struct {
+	URL string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// Header is added to every request, e.g. for an Authorization header.
+	Header http.Header
+	// Timeout bounds each attempt. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Retries is the number of additional attempts after a failed one.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubled after
+	// each attempt. Defaults to 200ms.
+	RetryBackoff time.Duration
+	// FailOpen allows operations if the endpoint can't be reached. Only
+	// authorization fails open, authentication always fails closed.
+	FailOpen bool
+}
+
+// WebhookRequest is the body posted to an AuthWebhook endpoint.
+type WebhookRequest struct {
+	// Type is WebhookAuthenticate or WebhookAuthorize.
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Key         string `json:"key,omitempty"`
+	KeyID       string `json:"key_id,omitempty"`
+	User        string `json:"user,omitempty"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	Repo        string `json:"repo,omitempty"`
+	Operation   string `json:"operation,omitempty"`
+}
+
+// WebhookResponse is the answer expected from an AuthWebhook endpoint.
+type WebhookResponse struct {
+	Allow bool `json:"allow"`
+	// KeyID and Name identify the key of an allowed authentication.
+	// KeyID defaults to the key fingerprint.
+	KeyID string `json:"key_id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	// Reason explains a denial.
+	Reason string `json:"reason,omitempty"`
+}
+
+// LookupKey authenticates a key, see SSH.KeyLookupFunc.
+func (w *AuthWebhook) LookupKey(req *KeyLookupRequest) (*PublicKey, error) {
+	body := WebhookRequest{
+		Type:        WebhookAuthenticate,
+		Fingerprint: req.Fingerprint,
+		Key:         req.AuthorizedKey,
+		User:        req.User,
+	}
+	if req.RemoteAddr != nil {
+		body.RemoteAddr = req.RemoteAddr.String()
+	}
+
+	res, err := w.call(body)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Allow {
+		return nil, webhookDenial(res)
+	}
+
+	id := res.KeyID
+	if id == "" {
+		id = req.Fingerprint
+	}
+	return &PublicKey{
+		Id:          id,
+		Name:        res.Name,
+		Fingerprint: req.Fingerprint,
+		Content:     req.AuthorizedKey,
+	}, nil
+}
+
+// Authorize implements Authorizer.
+func (w *AuthWebhook) Authorize(req *AccessRequest) error {
+	body := WebhookRequest{
+		Type:      WebhookAuthorize,
+		KeyID:     req.KeyID,
+		User:      req.User,
+		Repo:      req.Repo,
+		Operation: req.Operation,
+	}
+	if req.RemoteAddr != nil {
+		body.RemoteAddr = req.RemoteAddr.String()
+	}
+
+	res, err := w.call(body)
+	if err != nil {
+		if w.FailOpen {
+			logError("webhook", fmt.Errorf("allowing %s on %s: %v", req.Operation, req.Repo, err))
+			return nil
+		}
+		return err
+	}
+	if !res.Allow {
+		return deniedBecause(res.Reason)
+	}
+	return nil
+}
+
+func webhookDenial(res *WebhookResponse) error {
+	if res.Reason != "" {
+		return fmt.Errorf("%s", res.Reason)
+	}
+	return ErrAccessDenied
+}
+
+// call posts body to the endpoint, retrying failed attempts.
+func (w *AuthWebhook) call(body WebhookRequest) (*WebhookResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := w.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, retry, err := w.post(payload)
+		if err == nil {
+			return res, nil
+		}
+		if !retry || attempt >= w.Retries {
+			return nil, fmt.Errorf("auth webhook: %v", err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single attempt and reports whether a failure may be retried.
+func (w *AuthWebhook) post(payload []byte) (*WebhookResponse, bool, error) {
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, false, err
+	}
+	for name, values := range w.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+		return nil, true, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return &WebhookResponse{Allow: false}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var res WebhookResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponse)).Decode(&res); err != nil {
+		return nil, false, fmt.Errorf("invalid response: %v", err)
+	}
+	return &res, false, nil
+}
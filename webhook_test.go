@@ -0,0 +1,78 @@
+package gitkit
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthWebhook(t *testing.T) {
+	var calls int32
+	var failures int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		var req WebhookRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch {
+		case req.Type == WebhookAuthenticate && req.Fingerprint == "SHA256:known":
+			json.NewEncoder(w).Encode(WebhookResponse{Allow: true, KeyID: "alice", Name: "laptop"})
+		case req.Type == WebhookAuthenticate:
+			json.NewEncoder(w).Encode(WebhookResponse{Reason: "unknown key"})
+		case req.Type == WebhookAuthorize && req.Repo == "forbidden.git":
+			w.WriteHeader(http.StatusForbidden)
+		case req.Type == WebhookAuthorize:
+			json.NewEncoder(w).Encode(WebhookResponse{Allow: req.KeyID == "alice" && req.Operation == OperationRead})
+		}
+	}))
+	defer srv.Close()
+
+	hook := &AuthWebhook{
+		URL:          srv.URL,
+		Header:       http.Header{"Authorization": {"Bearer secret"}},
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+	pkey, err := hook.LookupKey(&KeyLookupRequest{Fingerprint: "SHA256:known", RemoteAddr: addr})
+	assert.NoError(t, err)
+	assert.Equal(t, &PublicKey{Id: "alice", Name: "laptop", Fingerprint: "SHA256:known"}, pkey)
+
+	_, err = hook.LookupKey(&KeyLookupRequest{Fingerprint: "SHA256:other"})
+	assert.EqualError(t, err, "unknown key")
+
+	assert.NoError(t, hook.Authorize(&AccessRequest{KeyID: "alice", Repo: "repo.git", Operation: OperationRead}))
+	assert.Equal(t, ErrAccessDenied, hook.Authorize(&AccessRequest{KeyID: "alice", Repo: "repo.git", Operation: OperationWrite}))
+	assert.Equal(t, ErrAccessDenied, hook.Authorize(&AccessRequest{KeyID: "alice", Repo: "forbidden.git", Operation: OperationRead}))
+
+	// Server errors are retried.
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&failures, 2)
+	assert.NoError(t, hook.Authorize(&AccessRequest{KeyID: "alice", Repo: "repo.git", Operation: OperationRead}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&failures, 3)
+	assert.Error(t, hook.Authorize(&AccessRequest{KeyID: "alice", Repo: "repo.git", Operation: OperationRead}))
+
+	// An unreachable endpoint fails closed unless configured otherwise.
+	down := &AuthWebhook{URL: "http://127.0.0.1:1", Timeout: time.Second}
+	assert.Error(t, down.Authorize(&AccessRequest{Repo: "repo.git"}))
+	_, err = down.LookupKey(&KeyLookupRequest{})
+	assert.Error(t, err)
+	down.FailOpen = true
+	assert.NoError(t, down.Authorize(&AccessRequest{Repo: "repo.git"}))
+	_, err = down.LookupKey(&KeyLookupRequest{})
+	assert.Error(t, err)
+}
@@ -3,23 +3,83 @@ package gitkit
 import (
 	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
-func newWriteFlusher(w http.ResponseWriter) io.Writer {
-	return writeFlusher{w.(interface {
-		io.Writer
-		http.Flusher
-	})}
+// newWriteFlusher returns a writer flushing what is written to w, after
+// every write if interval is zero and at most interval later otherwise.
+// Writers that can't flush are returned as they are. Call the stop function
+// once done writing; it flushes what is left.
+func newWriteFlusher(w http.ResponseWriter, interval time.Duration) (io.Writer, func()) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return w, func() {}
+	}
+	if interval <= 0 {
+		return writeFlusher{w, f}, func() {}
+	}
+	l := &latencyWriter{w: w, f: f, interval: interval}
+	return l, l.stop
 }
 
 type writeFlusher struct {
-	wf interface {
-		io.Writer
-		http.Flusher
-	}
+	w io.Writer
+	f http.Flusher
 }
 
 func (w writeFlusher) Write(p []byte) (int, error) {
-	defer w.wf.Flush()
-	return w.wf.Write(p)
+	defer w.f.Flush()
+	return w.w.Write(p)
+}
+
+// latencyWriter flushes writes on a timer, so a burst of writes is sent
+// together but none waits longer than interval.
+type latencyWriter struct {
+	w        io.Writer
+	f        http.Flusher
+	interval time.Duration
+
+	mu      sync.Mutex
+	t       *time.Timer
+	pending bool
+	stopped bool
+}
+
+func (l *latencyWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.w.Write(p)
+	if !l.pending {
+		l.pending = true
+		if l.t == nil {
+			l.t = time.AfterFunc(l.interval, l.flush)
+		} else {
+			l.t.Reset(l.interval)
+		}
+	}
+	return n, err
+}
+
+func (l *latencyWriter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.pending || l.stopped {
+		return
+	}
+	l.f.Flush()
+	l.pending = false
+}
+
+func (l *latencyWriter) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending {
+		l.f.Flush()
+		l.pending = false
+	}
+	l.stopped = true
+	if l.t != nil {
+		l.t.Stop()
+	}
 }
@@ -0,0 +1,66 @@
+package gitkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flushRecorder counts the flushes of a response.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	flushes int
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	r.flushes++
+	r.mu.Unlock()
+}
+
+func (r *flushRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flushes
+}
+
+func TestWriteFlusher(t *testing.T) {
+	t.Run("every write", func(t *testing.T) {
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		w, stop := newWriteFlusher(rec, 0)
+		w.Write([]byte("a"))
+		w.Write([]byte("b"))
+		stop()
+		assert.Equal(t, 2, rec.count())
+		assert.Equal(t, "ab", rec.Body.String())
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		w, stop := newWriteFlusher(rec, 20*time.Millisecond)
+		w.Write([]byte("a"))
+		w.Write([]byte("b"))
+		assert.Equal(t, 0, rec.count())
+		assert.Eventually(t, func() bool { return rec.count() == 1 }, time.Second, time.Millisecond)
+
+		w.Write([]byte("c"))
+		stop()
+		assert.Equal(t, 2, rec.count())
+		time.Sleep(40 * time.Millisecond)
+		assert.Equal(t, 2, rec.count())
+		assert.Equal(t, "abc", rec.Body.String())
+	})
+
+	t.Run("no flusher", func(t *testing.T) {
+		var w http.ResponseWriter = struct{ http.ResponseWriter }{httptest.NewRecorder()}
+		out, stop := newWriteFlusher(w, 0)
+		_, err := out.Write([]byte("a"))
+		assert.NoError(t, err)
+		stop()
+	})
+}